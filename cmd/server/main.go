@@ -2,6 +2,9 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
 	"os"
 
 	"github.com/jpfaria/image-updater/internal/config"
@@ -18,6 +21,14 @@ func init() {
 }
 
 func main() {
+	configFile := flag.String("config", "", "path of the YAML or JSON configuration file, overrides CONFIG_FILE")
+	printConfig := flag.Bool("print-config", false, "print the effective configuration, secrets redacted, and exit")
+	flag.Parse()
+
+	if *printConfig {
+		os.Exit(dumpConfig(*configFile))
+	}
+
 	// Initialize Boost
 	boost.Start()
 
@@ -30,6 +41,9 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
+	if *configFile != "" {
+		cfg.File = *configFile
+	}
 
 	// Create and start server
 	ctx := context.Background()
@@ -43,3 +57,25 @@ func main() {
 		log.Fatalf("Failed to start server: %v", err)
 	}
 }
+
+// dumpConfig prints the effective configuration as JSON with its secrets
+// redacted, and returns the exit code
+func dumpConfig(configFile string) int {
+	cfg, err := config.Load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if configFile != "" {
+		cfg.File = configFile
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(cfg.Redacted()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	return 0
+}
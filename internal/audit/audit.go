@@ -0,0 +1,339 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/jpfaria/image-updater/internal/clock"
+	"github.com/jpfaria/image-updater/internal/store"
+	"github.com/xgodev/boost/wrapper/log"
+)
+
+// Outcomes of audited actions
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+	OutcomeDenied  = "denied"
+)
+
+// Event is an audited action. Events are only ever appended, and each one
+// carries the hash of the event before it, so editing or removing an event
+// breaks the chain.
+type Event struct {
+	ID         string          `json:"id"`
+	Timestamp  string          `json:"timestamp"`
+	Actor      string          `json:"actor"`
+	TokenID    string          `json:"token_id,omitempty"` // API token the actor used
+	SourceIP   string          `json:"source_ip,omitempty"`
+	Action     string          `json:"action"`
+	TargetType string          `json:"target_type,omitempty"`
+	TargetID   string          `json:"target_id,omitempty"`
+	Before     json.RawMessage `json:"before,omitempty"`
+	After      json.RawMessage `json:"after,omitempty"`
+	Outcome    string          `json:"outcome"`
+	Status     int             `json:"status,omitempty"` // HTTP status of API requests
+	Error      string          `json:"error,omitempty"`
+	PrevHash   string          `json:"prev_hash,omitempty"` // empty for the first event
+	Hash       string          `json:"hash,omitempty"`
+}
+
+// Filter selects audit events; empty fields match everything
+type Filter struct {
+	Actor      string
+	Action     string
+	TargetType string
+	TargetID   string
+	Outcome    string
+	Since      time.Time
+	Until      time.Time
+	Limit      int // newest events first when set
+}
+
+// LogOptions holds the settings of the audit log
+type LogOptions struct {
+	DataDir string      // empty keeps events in memory
+	Signer  Signer      // signs checkpoints; nil disables them
+	Clock   clock.Clock // defaults to the system clock
+}
+
+// Log is an append-only audit log. With a directory, events are appended
+// to a JSON Lines file and survive restarts.
+type Log struct {
+	options LogOptions
+
+	mu          sync.RWMutex
+	file        *os.File
+	events      []Event
+	head        string // hash of the last event
+	genesis     *Genesis
+	checkpoints *checkpointFile
+}
+
+// NewLog opens the audit log stored under the data directory
+func NewLog(options LogOptions) (*Log, error) {
+	if options.Clock == nil {
+		options.Clock = clock.Real()
+	}
+
+	l := &Log{options: options, events: make([]Event, 0)}
+	if options.DataDir == "" {
+		l.checkpoints = &checkpointFile{}
+		return l, nil
+	}
+
+	if err := os.MkdirAll(options.DataDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create storage directory: %w", err)
+	}
+
+	path := l.path()
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+
+	events, err := readEvents(file, path)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	l.events = events
+	if len(events) > 0 {
+		l.head = events[len(events)-1].Hash
+	}
+
+	if l.genesis, err = openGenesis(l.genesisPath(), events); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	checkpoints, err := openCheckpoints(filepath.Join(options.DataDir, "audit_checkpoints.jsonl"))
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	l.file = file
+	l.checkpoints = checkpoints
+	return l, nil
+}
+
+// Record appends an event. The actor and source IP default to those of the
+// context, the ID and timestamp are always set. A nil Log records nothing.
+func (l *Log) Record(ctx context.Context, event Event) error {
+	if l == nil {
+		return nil
+	}
+
+	if event.Actor == "" {
+		event.Actor, event.TokenID, event.SourceIP = actorFrom(ctx)
+	}
+	if event.Outcome == "" {
+		event.Outcome = OutcomeSuccess
+	}
+
+	now := l.options.Clock.Now()
+	// Prefix with the time so IDs sort in recording order
+	event.ID = now.UTC().Format("20060102150405") + "-" + store.NewID()
+	event.Timestamp = now.Format(time.RFC3339)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	event.PrevHash = l.head
+	hash, err := hashEvent(event)
+	if err != nil {
+		return err
+	}
+	event.Hash = hash
+
+	if l.file != nil {
+		line, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		if _, err := l.file.Write(append(line, '\n')); err != nil {
+			log.Errorf("Failed to write audit event %s: %v", event.Action, err)
+			return fmt.Errorf("failed to write audit event: %w", err)
+		}
+		if err := l.file.Sync(); err != nil {
+			return fmt.Errorf("failed to sync audit log: %w", err)
+		}
+	}
+
+	l.events = append(l.events, event)
+	l.head = event.Hash
+
+	// The first chained event is recorded as the genesis, so events after
+	// it cannot pass for events written before hashing existed. Should this
+	// fail, the genesis is found again when the log is opened.
+	if l.genesis == nil {
+		l.genesis = &Genesis{Index: len(l.events) - 1, EventID: event.ID}
+		return writeGenesis(l.genesisPath(), l.genesis)
+	}
+	return nil
+}
+
+// Query returns the events matching a filter, newest first
+func (l *Log) Query(filter Filter) []Event {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	events := make([]Event, 0)
+	for i := len(l.events) - 1; i >= 0; i-- {
+		if filter.Limit > 0 && len(events) >= filter.Limit {
+			break
+		}
+		if filter.matches(l.events[i]) {
+			events = append(events, l.events[i])
+		}
+	}
+
+	return events
+}
+
+// WriteJSONLines writes events as JSON Lines
+func WriteJSONLines(w io.Writer, events []Event) error {
+	encoder := json.NewEncoder(w)
+	for _, event := range events {
+		if err := encoder.Encode(event); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// WriteCSV writes events as CSV with a header row; before and after values
+// are written as JSON
+func WriteCSV(w io.Writer, events []Event) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"id", "timestamp", "actor", "token_id", "source_ip", "action", "target_type", "target_id", "outcome", "status", "error", "before", "after", "prev_hash", "hash"})
+
+	for _, event := range events {
+		status := ""
+		if event.Status != 0 {
+			status = fmt.Sprint(event.Status)
+		}
+		writer.Write([]string{
+			event.ID, event.Timestamp, event.Actor, event.TokenID, event.SourceIP, event.Action,
+			event.TargetType, event.TargetID, event.Outcome, status, event.Error,
+			string(event.Before), string(event.After), event.PrevHash, event.Hash,
+		})
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+// path returns the file the events are stored in
+func (l *Log) path() string {
+	return filepath.Join(l.options.DataDir, "audit.jsonl")
+}
+
+// genesisPath returns the file the chain genesis is stored in, empty for
+// logs kept in memory
+func (l *Log) genesisPath() string {
+	if l.options.DataDir == "" {
+		return ""
+	}
+	return filepath.Join(l.options.DataDir, "audit_genesis.json")
+}
+
+// readEvents decodes the events of a JSON Lines file
+func readEvents(r io.Reader, path string) ([]Event, error) {
+	events := make([]Event, 0)
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return nil, fmt.Errorf("failed to decode %s line %d: %w", path, line, err)
+		}
+		events = append(events, event)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	return events, nil
+}
+
+// Snapshot captures a value as JSON for the before or after field of an
+// event; nil values are left out
+func Snapshot(v interface{}) json.RawMessage {
+	if v == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil || string(data) == "null" {
+		return nil
+	}
+
+	return data
+}
+
+// Outcome returns the outcome of an action that ended with err
+func Outcome(err error) string {
+	if err != nil {
+		return OutcomeFailure
+	}
+	return OutcomeSuccess
+}
+
+// matches reports whether an event passes the filter
+func (f Filter) matches(event Event) bool {
+	if (f.Actor != "" && event.Actor != f.Actor) ||
+		(f.Action != "" && event.Action != f.Action) ||
+		(f.TargetType != "" && event.TargetType != f.TargetType) ||
+		(f.TargetID != "" && event.TargetID != f.TargetID) ||
+		(f.Outcome != "" && event.Outcome != f.Outcome) {
+		return false
+	}
+
+	if !f.Since.IsZero() || !f.Until.IsZero() {
+		ts, err := time.Parse(time.RFC3339, event.Timestamp)
+		if err != nil {
+			return false
+		}
+		if (!f.Since.IsZero() && ts.Before(f.Since)) || (!f.Until.IsZero() && ts.After(f.Until)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// actorKey is the context key of the acting user
+type actorKey struct{}
+
+// actor is who acts in a context
+type actor struct {
+	name     string
+	tokenID  string
+	sourceIP string
+}
+
+// WithActor returns a context whose recorded events are attributed to an
+// actor, such as a user or a background job like "system:scheduler"
+func WithActor(ctx context.Context, name, tokenID, sourceIP string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor{name: name, tokenID: tokenID, sourceIP: sourceIP})
+}
+
+// actorFrom returns the actor of a context, "system" when there is none
+func actorFrom(ctx context.Context) (string, string, string) {
+	if a, ok := ctx.Value(actorKey{}).(actor); ok && a.name != "" {
+		return a.name, a.tokenID, a.sourceIP
+	}
+
+	return "system", "", ""
+}
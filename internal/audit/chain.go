@@ -0,0 +1,414 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jpfaria/image-updater/internal/store"
+	"github.com/xgodev/boost/wrapper/log"
+)
+
+// ErrNoSigner is returned when checkpoints are requested from a log without
+// a signer
+var ErrNoSigner = errors.New("audit checkpoints are not configured")
+
+// Signer signs checkpoints and verifies their signatures; auth.KeySet is one,
+// so checkpoints can be checked against the published JWKS
+type Signer interface {
+	Sign(claims jwt.Claims) (string, error)
+	Verify(token string, claims jwt.Claims) error
+}
+
+// Genesis is the first chained event of the log. Events before it were
+// written before hashing existed; every event from it on must be chained.
+type Genesis struct {
+	Index   int    `json:"index"` // position of the event in the log, from 0
+	EventID string `json:"event_id"`
+}
+
+// Checkpoint is a signed statement of the head of the chain after a number
+// of events. Exported checkpoints prove the log was not rewritten or
+// truncated since: the signature cannot be forged without the signing key.
+type Checkpoint struct {
+	ID        string `json:"id"`
+	Timestamp string `json:"timestamp"`
+	Sequence  int    `json:"sequence"` // number of events covered
+	EventID   string `json:"event_id"` // last event covered
+	Hash      string `json:"hash"`     // hash of that event
+	Genesis   int    `json:"genesis"`  // index of the first chained event
+	Signature string `json:"signature"`
+}
+
+// checkpointClaims are the signed claims of a checkpoint
+type checkpointClaims struct {
+	jwt.RegisteredClaims
+	Sequence int    `json:"seq"`
+	EventID  string `json:"event_id"`
+	Hash     string `json:"hash"`
+	Genesis  *int   `json:"genesis,omitempty"`
+}
+
+// Break describes the first broken link of the chain
+type Break struct {
+	Index   int    `json:"index"` // position of the event in the log, from 0
+	EventID string `json:"event_id,omitempty"`
+	Reason  string `json:"reason"`
+}
+
+// Verification is the result of walking the chain
+type Verification struct {
+	Valid       bool   `json:"valid"`
+	Events      int    `json:"events"`
+	Unchained   int    `json:"unchained,omitempty"` // events recorded before hashing existed
+	Checkpoints int    `json:"checkpoints"`
+	Head        string `json:"head,omitempty"`
+	Broken      *Break `json:"broken,omitempty"`
+}
+
+// Verify walks the chain as stored, so edits made to the file behind the
+// service's back are found, and checks every checkpoint against it
+func (l *Log) Verify(ctx context.Context) (*Verification, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	lines, err := l.lines()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Verification{Events: len(lines), Checkpoints: len(l.checkpoints.list)}
+	hashes := make([]string, len(lines))
+
+	// Events written before the chain existed carry no hash; from the
+	// genesis on every event must. A log without a genesis has no chain.
+	start := len(lines)
+	if l.genesis != nil {
+		start = l.genesis.Index
+	}
+	if start > len(lines) {
+		result.Broken = &Break{Index: len(lines), EventID: l.genesis.EventID, Reason: "the chain genesis is missing, events were removed"}
+		return result, nil
+	}
+
+	prev := ""
+	for i, line := range lines {
+		var event Event
+		if err := json.Unmarshal(line, &event); err != nil {
+			result.Broken = &Break{Index: i, Reason: "event cannot be decoded"}
+			return result, nil
+		}
+
+		if i < start {
+			if event.Hash != "" {
+				result.Broken = &Break{Index: i, EventID: event.ID, Reason: "event is chained before the chain genesis"}
+				return result, nil
+			}
+			result.Unchained++
+			continue
+		}
+		if i == start && event.ID != l.genesis.EventID {
+			result.Broken = &Break{Index: i, EventID: event.ID, Reason: fmt.Sprintf("event is not the chain genesis %s", l.genesis.EventID)}
+			return result, nil
+		}
+		if event.Hash == "" {
+			result.Broken = &Break{Index: i, EventID: event.ID, Reason: "event after the chain genesis has no hash"}
+			return result, nil
+		}
+
+		if event.PrevHash != prev {
+			result.Broken = &Break{Index: i, EventID: event.ID, Reason: "previous hash does not match, an event before it was changed or removed"}
+			return result, nil
+		}
+
+		hash, err := hashEvent(event)
+		if err != nil {
+			return nil, err
+		}
+		if hash != event.Hash {
+			result.Broken = &Break{Index: i, EventID: event.ID, Reason: "hash does not match, the event was changed"}
+			return result, nil
+		}
+
+		hashes[i] = hash
+		prev = hash
+	}
+	result.Head = prev
+
+	for _, checkpoint := range l.checkpoints.list {
+		if broken := l.checkCheckpoint(checkpoint, hashes); broken != nil {
+			result.Broken = broken
+			return result, nil
+		}
+	}
+
+	result.Valid = true
+	return result, nil
+}
+
+// Checkpoint signs the current head of the chain. Nothing is signed when no
+// event was chained yet, or none since the last checkpoint, which is
+// returned instead.
+func (l *Log) Checkpoint(ctx context.Context) (*Checkpoint, error) {
+	if l.options.Signer == nil {
+		return nil, ErrNoSigner
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	last := l.checkpoints.last()
+	if l.genesis == nil || (last != nil && last.Sequence == len(l.events)) {
+		return last, nil
+	}
+
+	now := l.options.Clock.Now()
+	head := l.events[len(l.events)-1]
+	checkpoint := Checkpoint{
+		ID:        store.NewID(),
+		Timestamp: now.Format(time.RFC3339),
+		Sequence:  len(l.events),
+		EventID:   head.ID,
+		Hash:      head.Hash,
+		Genesis:   l.genesis.Index,
+	}
+
+	signature, err := l.options.Signer.Sign(checkpointClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:       checkpoint.ID,
+			Subject:  "audit-checkpoint",
+			IssuedAt: jwt.NewNumericDate(now),
+		},
+		Sequence: checkpoint.Sequence,
+		EventID:  checkpoint.EventID,
+		Hash:     checkpoint.Hash,
+		Genesis:  &checkpoint.Genesis,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign audit checkpoint: %w", err)
+	}
+	checkpoint.Signature = signature
+
+	if err := l.checkpoints.append(checkpoint); err != nil {
+		return nil, err
+	}
+
+	return &checkpoint, nil
+}
+
+// Checkpoints returns the checkpoints, oldest first
+func (l *Log) Checkpoints() []Checkpoint {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return append([]Checkpoint{}, l.checkpoints.list...)
+}
+
+// StartCheckpoints signs a checkpoint at every interval until ctx is cancelled
+func (l *Log) StartCheckpoints(ctx context.Context, interval time.Duration) {
+	log.Infof("Starting audit checkpoints (interval: %s)", interval)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			if _, err := l.Checkpoint(ctx); err != nil {
+				log.Errorf("Failed to sign audit checkpoint: %v", err)
+			}
+		}
+	}()
+}
+
+// checkCheckpoint verifies the signature of a checkpoint and that the chain
+// still holds the event it signed
+func (l *Log) checkCheckpoint(checkpoint Checkpoint, hashes []string) *Break {
+	index := checkpoint.Sequence - 1
+
+	// The signed claims are authoritative, not the fields next to them
+	claims := checkpointClaims{}
+	if l.options.Signer == nil {
+		claims.Sequence, claims.EventID, claims.Hash = checkpoint.Sequence, checkpoint.EventID, checkpoint.Hash
+		claims.Genesis = &checkpoint.Genesis
+	} else if err := l.options.Signer.Verify(checkpoint.Signature, &claims); err != nil {
+		return &Break{Index: index, EventID: checkpoint.EventID, Reason: fmt.Sprintf("checkpoint %s has an invalid signature: %v", checkpoint.ID, err)}
+	}
+
+	if claims.Sequence > len(hashes) {
+		return &Break{Index: len(hashes), Reason: fmt.Sprintf("checkpoint %s covers %d events but the log has %d, events were removed", checkpoint.ID, claims.Sequence, len(hashes))}
+	}
+	if claims.Sequence < 1 || hashes[claims.Sequence-1] != claims.Hash {
+		return &Break{Index: claims.Sequence - 1, EventID: claims.EventID, Reason: fmt.Sprintf("event does not match checkpoint %s", checkpoint.ID)}
+	}
+	if claims.Genesis != nil && (l.genesis == nil || l.genesis.Index != *claims.Genesis) {
+		return &Break{Index: *claims.Genesis, Reason: fmt.Sprintf("the chain genesis does not match checkpoint %s", checkpoint.ID)}
+	}
+
+	return nil
+}
+
+// lines returns the raw events as stored; callers must hold l.mu
+func (l *Log) lines() ([][]byte, error) {
+	if l.file == nil {
+		lines := make([][]byte, 0, len(l.events))
+		for _, event := range l.events {
+			line, err := json.Marshal(event)
+			if err != nil {
+				return nil, err
+			}
+			lines = append(lines, line)
+		}
+		return lines, nil
+	}
+
+	data, err := os.ReadFile(l.path())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read audit log: %w", err)
+	}
+
+	lines := make([][]byte, 0, len(l.events))
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		lines = append(lines, append([]byte{}, scanner.Bytes()...))
+	}
+
+	return lines, scanner.Err()
+}
+
+// hashEvent returns the SHA-256 of an event encoded without its own hash
+func hashEvent(event Event) (string, error) {
+	event.Hash = ""
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// openGenesis loads the chain genesis stored at path. Logs chained before
+// the genesis was recorded get the first event starting the chain, one
+// with a hash and no previous hash.
+func openGenesis(path string, events []Event) (*Genesis, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		var genesis Genesis
+		if err := json.Unmarshal(data, &genesis); err != nil {
+			return nil, fmt.Errorf("failed to decode %s: %w", path, err)
+		}
+		return &genesis, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read the audit chain genesis: %w", err)
+	}
+
+	for i, event := range events {
+		if event.Hash != "" && event.PrevHash == "" {
+			genesis := &Genesis{Index: i, EventID: event.ID}
+			log.Warnf("Recording event %d (%s) as the genesis of the audit chain", i, event.ID)
+			return genesis, writeGenesis(path, genesis)
+		}
+	}
+
+	return nil, nil
+}
+
+// writeGenesis stores the chain genesis; logs in memory keep it only there
+func writeGenesis(path string, genesis *Genesis) error {
+	if path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(genesis)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write the audit chain genesis: %w", err)
+	}
+
+	return nil
+}
+
+// checkpointFile is the append-only list of checkpoints, kept in a JSON
+// Lines file when it has a path
+type checkpointFile struct {
+	path string
+	list []Checkpoint
+}
+
+// openCheckpoints loads the checkpoints stored at path
+func openCheckpoints(path string) (*checkpointFile, error) {
+	f := &checkpointFile{path: path, list: make([]Checkpoint, 0)}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read audit checkpoints: %w", err)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	for decoder.More() {
+		var checkpoint Checkpoint
+		if err := decoder.Decode(&checkpoint); err != nil {
+			return nil, fmt.Errorf("failed to decode %s: %w", path, err)
+		}
+		f.list = append(f.list, checkpoint)
+	}
+
+	return f, nil
+}
+
+// append adds a checkpoint
+func (f *checkpointFile) append(checkpoint Checkpoint) error {
+	if f.path != "" {
+		file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return fmt.Errorf("failed to open audit checkpoints: %w", err)
+		}
+		defer file.Close()
+
+		line, err := json.Marshal(checkpoint)
+		if err != nil {
+			return err
+		}
+		if _, err := file.Write(append(line, '\n')); err != nil {
+			return fmt.Errorf("failed to write audit checkpoint: %w", err)
+		}
+		if err := file.Sync(); err != nil {
+			return fmt.Errorf("failed to sync audit checkpoints: %w", err)
+		}
+	}
+
+	f.list = append(f.list, checkpoint)
+	return nil
+}
+
+// last returns the latest checkpoint, or nil
+func (f *checkpointFile) last() *Checkpoint {
+	if len(f.list) == 0 {
+		return nil
+	}
+
+	checkpoint := f.list[len(f.list)-1]
+	return &checkpoint
+}
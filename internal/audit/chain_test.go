@@ -0,0 +1,244 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jpfaria/image-updater/internal/auth"
+)
+
+// jsonSigner "signs" claims by encoding them, enough to carry them
+type jsonSigner struct{}
+
+func (jsonSigner) Sign(claims jwt.Claims) (string, error) {
+	data, err := json.Marshal(claims)
+	return string(data), err
+}
+
+func (jsonSigner) Verify(token string, claims jwt.Claims) error {
+	return json.Unmarshal([]byte(token), claims)
+}
+
+// writeEvents replaces the events stored in dir
+func writeEvents(t *testing.T, dir string, events []Event) {
+	t.Helper()
+
+	lines := make([]string, 0, len(events))
+	for _, event := range events {
+		line, err := json.Marshal(event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, string(line)+"\n")
+	}
+	if err := os.WriteFile(filepath.Join(dir, "audit.jsonl"), []byte(strings.Join(lines, "")), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	tests := []struct {
+		name   string
+		legacy int // unhashed events written before the log is opened
+		tamper func(t *testing.T, dir string, events []Event)
+		valid  bool
+	}{
+		{
+			name:  "intact",
+			valid: true,
+		},
+		{
+			name:   "events before hashing",
+			legacy: 2,
+			valid:  true,
+		},
+		{
+			name: "event changed",
+			tamper: func(t *testing.T, dir string, events []Event) {
+				events[1].Actor = "mallory"
+				writeEvents(t, dir, events)
+			},
+		},
+		{
+			name: "event removed",
+			tamper: func(t *testing.T, dir string, events []Event) {
+				writeEvents(t, dir, append(events[:1:1], events[2:]...))
+			},
+		},
+		{
+			name: "log truncated",
+			tamper: func(t *testing.T, dir string, events []Event) {
+				writeEvents(t, dir, events[:2])
+			},
+		},
+		{
+			name: "every hash stripped",
+			tamper: func(t *testing.T, dir string, events []Event) {
+				for i := range events {
+					events[i].Hash, events[i].PrevHash = "", ""
+				}
+				writeEvents(t, dir, events)
+			},
+		},
+		{
+			name:   "leading hashes stripped",
+			legacy: 1,
+			tamper: func(t *testing.T, dir string, events []Event) {
+				events[1].Hash = ""
+				writeEvents(t, dir, events)
+			},
+		},
+		{
+			name:   "genesis moved",
+			legacy: 1,
+			tamper: func(t *testing.T, dir string, events []Event) {
+				for i := 0; i < 3; i++ {
+					events[i].Hash, events[i].PrevHash = "", ""
+				}
+				events[3].PrevHash = ""
+				events[3].Hash, _ = hashEvent(events[3])
+				for i := 4; i < len(events); i++ {
+					events[i].PrevHash = events[i-1].Hash
+					events[i].Hash, _ = hashEvent(events[i])
+				}
+				writeEvents(t, dir, events)
+				genesis, _ := json.Marshal(Genesis{Index: 3, EventID: events[3].ID})
+				if err := os.WriteFile(filepath.Join(dir, "audit_genesis.json"), genesis, 0600); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			dir := t.TempDir()
+
+			legacy := make([]Event, tt.legacy)
+			for i := range legacy {
+				legacy[i] = Event{ID: "legacy-" + string(rune('a'+i)), Action: "legacy", Outcome: OutcomeSuccess}
+			}
+			writeEvents(t, dir, legacy)
+
+			l, err := NewLog(LogOptions{DataDir: dir, Signer: jsonSigner{}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 5; i++ {
+				if err := l.Record(ctx, Event{Actor: "alice", Action: "test"}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := l.Checkpoint(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.tamper != nil {
+				events := append([]Event{}, l.events...)
+				l.file.Close()
+				tt.tamper(t, dir, events)
+
+				// Reopened, as the log would be after a restart
+				if l, err = NewLog(LogOptions{DataDir: dir, Signer: jsonSigner{}}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			defer l.file.Close()
+
+			result, err := l.Verify(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Valid != tt.valid {
+				t.Fatalf("Valid = %v, want %v (broken: %+v)", result.Valid, tt.valid, result.Broken)
+			}
+			if tt.valid && result.Unchained != tt.legacy {
+				t.Fatalf("Unchained = %d, want %d", result.Unchained, tt.legacy)
+			}
+		})
+	}
+}
+
+func TestCheckpointsAcrossKeySets(t *testing.T) {
+	tests := []struct {
+		name string
+		// reopen returns the key set the log is reopened with, given the
+		// file of the key the checkpoint was signed with
+		reopen func(t *testing.T, dir, first string) *auth.KeySet
+		valid  bool
+	}{
+		{
+			name: "same key after a restart",
+			reopen: func(t *testing.T, dir, first string) *auth.KeySet {
+				return loadKeys(t, first)
+			},
+			valid: true,
+		},
+		{
+			name: "rotated key keeping the previous one",
+			reopen: func(t *testing.T, dir, first string) *auth.KeySet {
+				return loadKeys(t, filepath.Join(dir, "second.pem"), first)
+			},
+			valid: true,
+		},
+		{
+			name: "rotated key dropping the previous one",
+			reopen: func(t *testing.T, dir, first string) *auth.KeySet {
+				return loadKeys(t, filepath.Join(dir, "second.pem"))
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			dir := t.TempDir()
+			first := filepath.Join(t.TempDir(), "first.pem")
+
+			l, err := NewLog(LogOptions{DataDir: dir, Signer: loadKeys(t, first)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 3; i++ {
+				if err := l.Record(ctx, Event{Actor: "alice", Action: "test"}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := l.Checkpoint(ctx); err != nil {
+				t.Fatal(err)
+			}
+			l.file.Close()
+
+			// Reopened with a new key set, as after a restart
+			l, err = NewLog(LogOptions{DataDir: dir, Signer: tt.reopen(t, t.TempDir(), first)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.file.Close()
+
+			result, err := l.Verify(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Valid != tt.valid {
+				t.Fatalf("Valid = %v, want %v (broken: %+v)", result.Valid, tt.valid, result.Broken)
+			}
+		})
+	}
+}
+
+// loadKeys loads a key set signing with the key in file, generated when
+// missing, and verifying with the previous key files
+func loadKeys(t *testing.T, file string, previous ...string) *auth.KeySet {
+	t.Helper()
+
+	keys, err := auth.LoadOrCreateKeySet(file, previous)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
@@ -3,10 +3,37 @@ package auth
 import (
 	"context"
 	"errors"
+	"fmt"
+	"sync"
 	"time"
 
-	"github.com/golang-jwt/jwt/v5"
+	"github.com/jpfaria/image-updater/internal/clock"
+	"github.com/jpfaria/image-updater/internal/store"
 	"github.com/xgodev/boost/wrapper/log"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Roles a user can have
+const (
+	RoleViewer   = "viewer"
+	RoleDeployer = "deployer"
+	RoleApprover = "approver"
+	RoleScanner  = "scanner"
+	RoleAdmin    = "admin"
+	// RoleNone gives no global permissions, only those of role bindings
+	RoleNone = ""
+)
+
+// MinPasswordLength is the minimum length of a user password
+const MinPasswordLength = 8
+
+// Errors returned by the authentication service
+var (
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	ErrInvalidToken       = errors.New("invalid token")
+	ErrUserNotFound       = errors.New("user not found")
+	ErrUserExists         = errors.New("user already exists")
+	ErrInvalidUser        = errors.New("invalid user")
 )
 
 // User represents an authenticated user
@@ -15,78 +42,323 @@ type User struct {
 	Username string `json:"username"`
 	Email    string `json:"email"`
 	Role     string `json:"role"`
+	// Provider names the identity provider of users that sign in through
+	// single sign-on; such users have no password
+	Provider string `json:"provider,omitempty"`
+	// ServiceAccount users only authenticate with API tokens
+	ServiceAccount bool `json:"service_account,omitempty"`
+	// TokenID and Scopes are set when the user authenticated with an API
+	// token, whose scopes limit what the user may do
+	TokenID string   `json:"token_id,omitempty"`
+	Scopes  []string `json:"scopes,omitempty"`
+}
+
+// userRecord is a user as kept in the user store
+type userRecord struct {
+	User
+	PasswordHash string `json:"password_hash"`
+	Subject      string `json:"subject,omitempty"` // identifies the user at its identity provider
+	Generation   int    `json:"generation"`        // bumped to end every session of the user
+	CreatedAt    string `json:"created_at"`
+	UpdatedAt    string `json:"updated_at"`
+}
+
+// AuthOptions holds the settings of the authentication service
+type AuthOptions struct {
+	DataDir string // empty keeps users in memory
+	// Keys sign access tokens and verify them
+	Keys            *KeySet
+	Issuer          string
+	Audience        string
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+	Clock           clock.Clock // defaults to the system clock
 }
 
 // AuthService handles authentication operations
 type AuthService struct {
-	// Add dependencies here
-	jwtSecret []byte
+	options       AuthOptions
+	users         *store.Collection[userRecord]
+	bindings      *store.Collection[RoleBinding]
+	tokens        *store.Collection[apiTokenRecord]
+	refreshTokens *store.Collection[refreshTokenRecord]
+	revoked       *store.Collection[revocation]
+
+	// mu guards username uniqueness
+	mu sync.Mutex
 }
 
 // NewAuthService creates a new authentication service
-func NewAuthService(jwtSecret string) *AuthService {
+func NewAuthService(options AuthOptions) (*AuthService, error) {
+	if options.Keys == nil {
+		return nil, errors.New("auth: signing keys are required")
+	}
+	if options.Clock == nil {
+		options.Clock = clock.Real()
+	}
+
+	users, err := store.NewCollection[userRecord](options.DataDir, "users")
+	if err != nil {
+		return nil, err
+	}
+
+	bindings, err := store.NewCollection[RoleBinding](options.DataDir, "role_bindings")
+	if err != nil {
+		return nil, err
+	}
+
+	tokens, err := store.NewCollection[apiTokenRecord](options.DataDir, "api_tokens")
+	if err != nil {
+		return nil, err
+	}
+
+	refreshTokens, err := store.NewCollection[refreshTokenRecord](options.DataDir, "refresh_tokens")
+	if err != nil {
+		return nil, err
+	}
+
+	revoked, err := store.NewCollection[revocation](options.DataDir, "revoked_tokens")
+	if err != nil {
+		return nil, err
+	}
+
 	return &AuthService{
-		jwtSecret: []byte(jwtSecret),
+		options:       options,
+		users:         users,
+		bindings:      bindings,
+		tokens:        tokens,
+		refreshTokens: refreshTokens,
+		revoked:       revoked,
+	}, nil
+}
+
+// Bootstrap creates the first admin user when the user store is empty.
+// Without a password one is generated and logged once.
+func (s *AuthService) Bootstrap(ctx context.Context, username, password string) error {
+	if s.users.Len() > 0 {
+		return nil
+	}
+
+	generated := password == ""
+	if generated {
+		password = store.NewID() + store.NewID()
 	}
+
+	if _, err := s.CreateUser(ctx, User{Username: username, Role: RoleAdmin}, password); err != nil {
+		return fmt.Errorf("failed to create bootstrap admin: %w", err)
+	}
+
+	if generated {
+		log.Warnf("Created bootstrap admin user %s with password %s, change it after the first login", username, password)
+	} else {
+		log.Infof("Created bootstrap admin user %s", username)
+	}
+
+	return nil
 }
 
-// Login authenticates a user and returns a JWT token
-func (s *AuthService) Login(ctx context.Context, username, password string) (string, error) {
+// Login authenticates a user and returns a new session's tokens
+func (s *AuthService) Login(ctx context.Context, username, password string) (*TokenPair, error) {
 	log.Infof("Authenticating user: %s", username)
-	
-	// Mock implementation for now
-	// In a real implementation, this would validate credentials against a database
-	if username == "admin" && password == "admin" {
-		// Create a new token
-		token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-			"id":       "1",
-			"username": username,
-			"email":    "admin@example.com",
-			"role":     "admin",
-			"exp":      time.Now().Add(time.Hour * 24).Unix(),
-		})
-		
-		// Sign and get the complete encoded token as a string
-		tokenString, err := token.SignedString(s.jwtSecret)
-		if err != nil {
-			return "", err
+
+	record, ok := s.findByUsername(username)
+	if !ok {
+		// Compare against a dummy hash so unknown users take as long as known ones
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return nil, ErrInvalidCredentials
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(record.PasswordHash), []byte(password)); err != nil {
+		return nil, ErrInvalidCredentials
+	}
+
+	return s.issueTokens(record, "")
+}
+
+// ListUsers lists all users
+func (s *AuthService) ListUsers(ctx context.Context) ([]User, error) {
+	records := s.users.List()
+
+	users := make([]User, 0, len(records))
+	for _, record := range records {
+		users = append(users, record.User)
+	}
+
+	return users, nil
+}
+
+// GetUser gets a user by ID
+func (s *AuthService) GetUser(ctx context.Context, id string) (*User, error) {
+	record, ok := s.users.Get(id)
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+
+	user := record.User
+	return &user, nil
+}
+
+// CreateUser creates a user with the given password
+func (s *AuthService) CreateUser(ctx context.Context, user User, password string) (*User, error) {
+	log.Infof("Creating user: %s", user.Username)
+
+	if err := validateUser(user); err != nil {
+		return nil, err
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.findByUsername(user.Username); exists {
+		return nil, ErrUserExists
+	}
+
+	now := s.options.Clock.Now().Format(time.RFC3339)
+	user.ID = store.NewID()
+	record := userRecord{
+		User:         user,
+		PasswordHash: hash,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+
+	if err := s.users.Put(user.ID, record); err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// UpdateUser updates the email and role of a user, and its password when one is given
+func (s *AuthService) UpdateUser(ctx context.Context, id string, update User, password string) (*User, error) {
+	log.Infof("Updating user with ID: %s", id)
+
+	hash := ""
+	if password != "" {
+		var err error
+		if hash, err = hashPassword(password); err != nil {
+			return nil, err
+		}
+	}
+
+	record, err := s.users.Update(id, func(r *userRecord) error {
+		r.Email = update.Email
+		r.Role = update.Role
+		if err := validateUser(r.User); err != nil {
+			return err
+		}
+		if r.ServiceAccount && hash != "" {
+			return fmt.Errorf("%w: service accounts have no password", ErrInvalidUser)
 		}
-		
-		return tokenString, nil
-	}
-	
-	return "", errors.New("invalid credentials")
-}
-
-// ValidateToken validates a JWT token and returns the user
-func (s *AuthService) ValidateToken(ctx context.Context, tokenString string) (*User, error) {
-	log.Info("Validating token")
-	
-	// Parse the token
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		// Validate the signing method
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, errors.New("unexpected signing method")
+		// A password reset ends every session, like a password change
+		if hash != "" {
+			r.PasswordHash = hash
+			r.Generation++
 		}
-		
-		return s.jwtSecret, nil
+		r.UpdatedAt = s.options.Clock.Now().Format(time.RFC3339)
+		return nil
 	})
-	
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, ErrUserNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
-	
-	// Validate the token
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		user := &User{
-			ID:       claims["id"].(string),
-			Username: claims["username"].(string),
-			Email:    claims["email"].(string),
-			Role:     claims["role"].(string),
+
+	user := record.User
+	return &user, nil
+}
+
+// DeleteUser deletes a user
+func (s *AuthService) DeleteUser(ctx context.Context, id string) error {
+	log.Infof("Deleting user with ID: %s", id)
+
+	if err := s.users.Delete(id); err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return ErrUserNotFound
+		}
+		return err
+	}
+
+	if err := s.deleteUserTokens(id); err != nil {
+		return err
+	}
+
+	return s.deleteUserBindings(id)
+}
+
+// ChangePassword changes the password of a user after checking the current one
+func (s *AuthService) ChangePassword(ctx context.Context, id, currentPassword, newPassword string) error {
+	log.Infof("Changing password of user with ID: %s", id)
+
+	record, ok := s.users.Get(id)
+	if !ok {
+		return ErrUserNotFound
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(record.PasswordHash), []byte(currentPassword)); err != nil {
+		return ErrInvalidCredentials
+	}
+
+	hash, err := hashPassword(newPassword)
+	if err != nil {
+		return err
+	}
+
+	// A new password ends every session, including stolen ones
+	_, err = s.users.Update(id, func(r *userRecord) error {
+		r.PasswordHash = hash
+		r.Generation++
+		r.UpdatedAt = s.options.Clock.Now().Format(time.RFC3339)
+		return nil
+	})
+
+	return err
+}
+
+// findByUsername returns the stored user with the given username
+func (s *AuthService) findByUsername(username string) (userRecord, bool) {
+	for _, record := range s.users.List() {
+		if record.Username == username {
+			return record, true
 		}
-		
-		return user, nil
 	}
-	
-	return nil, errors.New("invalid token")
+
+	return userRecord{}, false
+}
+
+// dummyHash is compared against when a login names an unknown user
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("image-updater"), bcrypt.DefaultCost)
+
+// hashPassword checks the password policy and hashes the password
+func hashPassword(password string) (string, error) {
+	if len(password) < MinPasswordLength {
+		return "", fmt.Errorf("%w: password must have at least %d characters", ErrInvalidUser, MinPasswordLength)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash password: %w", err)
+	}
+
+	return string(hash), nil
+}
+
+// validateUser checks the fields of a user
+func validateUser(user User) error {
+	if user.Username == "" {
+		return fmt.Errorf("%w: username is required", ErrInvalidUser)
+	}
+
+	// Users without a global role only get what their role bindings grant
+	if _, ok := rolePermissions[user.Role]; !ok && user.Role != RoleNone {
+		return fmt.Errorf("%w: unknown role %q", ErrInvalidUser, user.Role)
+	}
+
+	return nil
 }
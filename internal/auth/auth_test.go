@@ -0,0 +1,257 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestUpdateUser(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name     string
+		update   User
+		password string
+		// loginWith is the password that logs in after the update
+		loginWith    string
+		wantErr      error
+		endsSessions bool
+	}{
+		{name: "role and email", update: User{Email: "alice@example.com", Role: RoleDeployer}, loginWith: "password"},
+		{name: "password reset", update: User{Role: RoleViewer}, password: "new-password", loginWith: "new-password", endsSessions: true},
+		{name: "short password", update: User{Role: RoleViewer}, password: "short", loginWith: "password", wantErr: ErrInvalidUser},
+		{name: "unknown role", update: User{Role: "owner"}, password: "new-password", loginWith: "password", wantErr: ErrInvalidUser},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := &fakeClock{now: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}
+			service, alice := newTestAuthService(t, clock)
+			session, err := service.Login(ctx, "alice", "password")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			updated, err := service.UpdateUser(ctx, alice.ID, tt.update, tt.password)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+			if err == nil && (updated.Email != tt.update.Email || updated.Role != tt.update.Role || updated.Username != "alice") {
+				t.Fatalf("unexpected user %+v", updated)
+			}
+
+			if _, err := service.Login(ctx, "alice", tt.loginWith); err != nil {
+				t.Fatalf("login with %q failed: %v", tt.loginWith, err)
+			}
+			if tt.loginWith != "password" {
+				if _, err := service.Login(ctx, "alice", "password"); !errors.Is(err, ErrInvalidCredentials) {
+					t.Fatalf("old password still accepted: %v", err)
+				}
+			}
+
+			_, accessErr := service.ValidateToken(ctx, session.AccessToken)
+			_, refreshErr := service.Refresh(ctx, session.RefreshToken)
+			for name, err := range map[string]error{"access": accessErr, "refresh": refreshErr} {
+				if tt.endsSessions && !errors.Is(err, ErrInvalidToken) {
+					t.Fatalf("%s token of the old session still accepted: %v", name, err)
+				}
+				if !tt.endsSessions && err != nil {
+					t.Fatalf("%s token of the old session rejected: %v", name, err)
+				}
+			}
+		})
+	}
+}
+
+func TestUpdateUserErrors(t *testing.T) {
+	ctx := context.Background()
+	service, _ := newTestAuthService(t, &fakeClock{now: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)})
+
+	if _, err := service.UpdateUser(ctx, "missing", User{Role: RoleViewer}, ""); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("expected ErrUserNotFound, got %v", err)
+	}
+
+	account, err := service.CreateServiceAccount(ctx, "ci", RoleDeployer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.UpdateUser(ctx, account.ID, User{Role: RoleDeployer}, "new-password"); !errors.Is(err, ErrInvalidUser) {
+		t.Fatalf("service account given a password: %v", err)
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	ctx := context.Background()
+	service, alice := newTestAuthService(t, &fakeClock{now: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)})
+	session, err := service.Login(ctx, "alice", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := service.ChangePassword(ctx, alice.ID, "wrong-password", "new-password"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("expected ErrInvalidCredentials, got %v", err)
+	}
+	if err := service.ChangePassword(ctx, alice.ID, "password", "short"); !errors.Is(err, ErrInvalidUser) {
+		t.Fatalf("expected ErrInvalidUser, got %v", err)
+	}
+	if _, err := service.ValidateToken(ctx, session.AccessToken); err != nil {
+		t.Fatalf("failed change ended the session: %v", err)
+	}
+
+	if err := service.ChangePassword(ctx, alice.ID, "password", "new-password"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.ValidateToken(ctx, session.AccessToken); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("session survived the password change: %v", err)
+	}
+	if _, err := service.Login(ctx, "alice", "new-password"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUserStore(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	open := func() *AuthService {
+		t.Helper()
+		service, err := NewAuthService(AuthOptions{
+			DataDir:         dir,
+			Keys:            NewHMACKeySet("test-secret-test-secret-test-secret"),
+			AccessTokenTTL:  15 * time.Minute,
+			RefreshTokenTTL: 24 * time.Hour,
+			Clock:           &fakeClock{now: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return service
+	}
+
+	service := open()
+	alice, err := service.CreateUser(ctx, User{Username: "alice", Email: "alice@example.com", Role: RoleDeployer}, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		user     User
+		password string
+		wantErr  error
+	}{
+		{name: "taken username", user: User{Username: "alice", Role: RoleViewer}, password: "password", wantErr: ErrUserExists},
+		{name: "no username", user: User{Role: RoleViewer}, password: "password", wantErr: ErrInvalidUser},
+		{name: "unknown role", user: User{Username: "bob", Role: "owner"}, password: "password", wantErr: ErrInvalidUser},
+		{name: "short password", user: User{Username: "bob", Role: RoleViewer}, password: "short", wantErr: ErrInvalidUser},
+		{name: "no global role", user: User{Username: "carol", Role: RoleNone}, password: "password"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := service.CreateUser(ctx, tt.user, tt.password); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+
+	// Users, passwords and role bindings survive a restart
+	if _, err := service.CreateRoleBinding(ctx, RoleBinding{UserID: alice.ID, Role: RoleApprover, Scope: ScopeTeam, Target: "payments"}); err != nil {
+		t.Fatal(err)
+	}
+	service = open()
+	restored, err := service.GetUser(ctx, alice.ID)
+	if err != nil || !reflect.DeepEqual(restored, alice) {
+		t.Fatalf("GetUser() = %+v, %v, want %+v", restored, err, alice)
+	}
+	if _, err := service.Login(ctx, "alice", "password"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.Login(ctx, "alice", "wrong-password"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("expected ErrInvalidCredentials, got %v", err)
+	}
+	if _, err := service.Login(ctx, "nobody", "password"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("expected ErrInvalidCredentials, got %v", err)
+	}
+
+	// Deleting a user deletes its role bindings
+	if err := service.DeleteUser(ctx, alice.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.GetUser(ctx, alice.ID); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("expected ErrUserNotFound, got %v", err)
+	}
+	if bindings, err := service.ListRoleBindings(ctx, alice.ID); err != nil || len(bindings) != 0 {
+		t.Fatalf("bindings of the deleted user left: %v, %v", bindings, err)
+	}
+	if err := service.DeleteUser(ctx, alice.ID); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("expected ErrUserNotFound, got %v", err)
+	}
+}
+
+func TestBootstrap(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name     string
+		existing bool // a user exists before the bootstrap
+		password string
+		wantErr  bool
+	}{
+		{name: "given password", password: "bootstrap-password"},
+		{name: "generated password"},
+		{name: "short password", password: "short", wantErr: true},
+		{name: "users exist", existing: true, password: "bootstrap-password"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service, err := NewAuthService(AuthOptions{
+				Keys:            NewHMACKeySet("test-secret-test-secret-test-secret"),
+				AccessTokenTTL:  15 * time.Minute,
+				RefreshTokenTTL: 24 * time.Hour,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.existing {
+				if _, err := service.CreateUser(ctx, User{Username: "alice", Role: RoleViewer}, "password"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err = service.Bootstrap(ctx, "admin", tt.password)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Bootstrap() error = %v, want error %v", err, tt.wantErr)
+			}
+
+			users, err := service.ListUsers(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr || tt.existing {
+				for _, user := range users {
+					if user.Username == "admin" {
+						t.Fatal("bootstrap admin created")
+					}
+				}
+				return
+			}
+			if len(users) != 1 || users[0].Username != "admin" || users[0].Role != RoleAdmin {
+				t.Fatalf("unexpected users %+v", users)
+			}
+			if tt.password != "" {
+				if _, err := service.Login(ctx, "admin", tt.password); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// A second bootstrap never replaces the admin
+			if err := service.Bootstrap(ctx, "admin", "other-password"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := service.Login(ctx, "admin", "other-password"); !errors.Is(err, ErrInvalidCredentials) {
+				t.Fatalf("second bootstrap changed the admin: %v", err)
+			}
+		})
+	}
+}
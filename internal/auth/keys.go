@@ -0,0 +1,254 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// signingKey is a key tokens are signed or verified with
+type signingKey struct {
+	kid     string
+	method  jwt.SigningMethod
+	private crypto.PrivateKey // nil for verification-only keys
+	public  crypto.PublicKey
+}
+
+// KeySet holds the key new tokens are signed with and the keys tokens are
+// still accepted from. Rotating keys means signing with a new key while
+// keeping the previous ones for verification until their tokens expire.
+type KeySet struct {
+	current signingKey
+	keys    map[string]signingKey // by kid, including the current key
+}
+
+// NewHMACKeySet creates a key set signing HS256 tokens with a shared secret
+func NewHMACKeySet(secret string) *KeySet {
+	key := signingKey{
+		kid:     "hs256",
+		method:  jwt.SigningMethodHS256,
+		private: []byte(secret),
+		public:  []byte(secret),
+	}
+
+	return &KeySet{
+		current: key,
+		keys:    map[string]signingKey{key.kid: key},
+	}
+}
+
+// LoadKeySet creates a key set from PEM files: an RSA or Ed25519 private
+// key to sign with, and previous private or public keys still accepted
+func LoadKeySet(signingKeyFile string, previousKeyFiles []string) (*KeySet, error) {
+	current, err := loadKey(signingKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	if current.private == nil {
+		return nil, fmt.Errorf("%s: signing key must be a private key", signingKeyFile)
+	}
+
+	set := &KeySet{
+		current: current,
+		keys:    map[string]signingKey{current.kid: current},
+	}
+
+	for _, path := range previousKeyFiles {
+		key, err := loadKey(path)
+		if err != nil {
+			return nil, err
+		}
+		// Previous keys only verify
+		key.private = nil
+		set.keys[key.kid] = key
+	}
+
+	return set, nil
+}
+
+// LoadOrCreateKeySet is LoadKeySet, generating an Ed25519 signing key in
+// signingKeyFile first when it does not exist
+func LoadOrCreateKeySet(signingKeyFile string, previousKeyFiles []string) (*KeySet, error) {
+	if _, err := os.Stat(signingKeyFile); errors.Is(err, os.ErrNotExist) {
+		if err := generateKeyFile(signingKeyFile); err != nil {
+			return nil, err
+		}
+	}
+
+	return LoadKeySet(signingKeyFile, previousKeyFiles)
+}
+
+// generateKeyFile writes a new Ed25519 private key as PKCS #8 PEM
+func generateKeyFile(path string) error {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("failed to create key directory: %w", err)
+	}
+	// O_EXCL so concurrent starts cannot overwrite each other's key
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to create key: %w", err)
+	}
+	defer file.Close()
+
+	if err := pem.Encode(file, &pem.Block{Type: "PRIVATE KEY", Bytes: der}); err != nil {
+		return fmt.Errorf("failed to write key: %w", err)
+	}
+	return file.Close()
+}
+
+// Methods returns the names of the signing methods of the keys
+func (s *KeySet) Methods() []string {
+	seen := make(map[string]bool)
+	methods := make([]string, 0, len(s.keys))
+	for _, key := range s.keys {
+		if name := key.method.Alg(); !seen[name] {
+			seen[name] = true
+			methods = append(methods, name)
+		}
+	}
+
+	return methods
+}
+
+// Sign signs claims with the current key
+func (s *KeySet) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(s.current.method, claims)
+	token.Header["kid"] = s.current.kid
+
+	return token.SignedString(s.current.private)
+}
+
+// Verify checks the signature of a token signed by Sign and decodes its
+// claims; tokens signed with a previous key are accepted
+func (s *KeySet) Verify(tokenString string, claims jwt.Claims) error {
+	parser := jwt.NewParser(jwt.WithValidMethods(s.Methods()))
+	_, err := parser.ParseWithClaims(tokenString, claims, s.verificationKey)
+	return err
+}
+
+// verificationKey returns the key a token was signed with
+func (s *KeySet) verificationKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	key, ok := s.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	if key.method.Alg() != token.Method.Alg() {
+		return nil, errors.New("unexpected signing method")
+	}
+
+	return key.public, nil
+}
+
+// JWKS returns the public keys as a JSON Web Key Set. Shared HMAC secrets
+// are never published.
+func (s *KeySet) JWKS() map[string]interface{} {
+	keys := make([]map[string]string, 0, len(s.keys))
+	for _, key := range s.keys {
+		switch public := key.public.(type) {
+		case *rsa.PublicKey:
+			keys = append(keys, map[string]string{
+				"kty": "RSA",
+				"kid": key.kid,
+				"use": "sig",
+				"alg": key.method.Alg(),
+				"n":   base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+			})
+		case ed25519.PublicKey:
+			keys = append(keys, map[string]string{
+				"kty": "OKP",
+				"crv": "Ed25519",
+				"kid": key.kid,
+				"use": "sig",
+				"alg": key.method.Alg(),
+				"x":   base64.RawURLEncoding.EncodeToString(public),
+			})
+		}
+	}
+
+	return map[string]interface{}{"keys": keys}
+}
+
+// loadKey reads an RSA or Ed25519 key from a PEM file
+func loadKey(path string) (signingKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return signingKey{}, fmt.Errorf("failed to read key: %w", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return signingKey{}, fmt.Errorf("%s: no PEM data found", path)
+	}
+
+	var parsed interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		parsed, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return signingKey{}, fmt.Errorf("%s: unsupported PEM block %q", path, block.Type)
+	}
+	if err != nil {
+		return signingKey{}, fmt.Errorf("%s: %w", path, err)
+	}
+
+	var key signingKey
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		key = signingKey{method: jwt.SigningMethodRS256, private: k, public: &k.PublicKey}
+	case *rsa.PublicKey:
+		key = signingKey{method: jwt.SigningMethodRS256, public: k}
+	case ed25519.PrivateKey:
+		key = signingKey{method: jwt.SigningMethodEdDSA, private: k, public: k.Public()}
+	case ed25519.PublicKey:
+		key = signingKey{method: jwt.SigningMethodEdDSA, public: k}
+	default:
+		return signingKey{}, fmt.Errorf("%s: only RSA and Ed25519 keys are supported", path)
+	}
+
+	if key.kid, err = keyID(key.public); err != nil {
+		return signingKey{}, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return key, nil
+}
+
+// keyID derives a stable key ID from a public key
+func keyID(public crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(der)
+	return base64.RawURLEncoding.EncodeToString(sum[:12]), nil
+}
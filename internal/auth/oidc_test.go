@@ -0,0 +1,420 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	testClientID    = "image-updater"
+	testRedirectURL = "https://image-updater.example.com/auth/oidc/callback"
+)
+
+// oidcStandIn is an identity provider serving discovery, a JWKS and a
+// token endpoint checking PKCE
+type oidcStandIn struct {
+	t      *testing.T
+	server *httptest.Server
+	clock  *fakeClock
+
+	mu          sync.Mutex
+	issuer      string // issuer of the discovery document, server URL when empty
+	keys        map[string]*rsa.PrivateKey
+	signingKey  string
+	claims      jwt.MapClaims // claims of the next ID tokens
+	codes       map[string]url.Values
+	jwksFetches int
+}
+
+// newOIDCStandIn starts a provider signing ID tokens with key-1
+func newOIDCStandIn(t *testing.T, clock *fakeClock) *oidcStandIn {
+	t.Helper()
+
+	p := &oidcStandIn{
+		t:     t,
+		clock: clock,
+		keys:  make(map[string]*rsa.PrivateKey),
+		codes: make(map[string]url.Values),
+	}
+	p.rotate("key-1")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("/jwks", p.jwks)
+	mux.HandleFunc("/token", p.token)
+	p.server = httptest.NewServer(mux)
+	t.Cleanup(p.server.Close)
+
+	return p
+}
+
+// rotate publishes a new key, drops the others and signs with it
+func (p *oidcStandIn) rotate(kid string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.keys = map[string]*rsa.PrivateKey{kid: key}
+	p.signingKey = kid
+}
+
+// provider returns an OIDC provider for the stand-in
+func (p *oidcStandIn) provider(mappings string) *OIDCProvider {
+	p.t.Helper()
+
+	groupMappings, err := ParseGroupMappings(mappings)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	provider, err := NewOIDCProvider(OIDCOptions{
+		Issuer:        p.server.URL,
+		ClientID:      testClientID,
+		RedirectURL:   testRedirectURL,
+		GroupMappings: groupMappings,
+		DefaultRole:   RoleViewer,
+		HTTPClient:    p.server.Client(),
+		Clock:         p.clock,
+	})
+	if err != nil {
+		p.t.Fatal(err)
+	}
+
+	return provider
+}
+
+// authorize plays the user signing in at the authorization endpoint and
+// returns the code and state the callback receives
+func (p *oidcStandIn) authorize(ctx context.Context, provider *OIDCProvider, tamper func(query url.Values)) (code, state string) {
+	p.t.Helper()
+
+	redirect, state, err := provider.AuthCodeURL(ctx)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	location, err := url.Parse(redirect)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	query := location.Query()
+	if query.Get("state") != state || query.Get("code_challenge_method") != "S256" {
+		p.t.Fatalf("unexpected authorization request %s", redirect)
+	}
+	if tamper != nil {
+		tamper(query)
+	}
+
+	code, err = randomToken()
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	p.mu.Lock()
+	p.codes[code] = query
+	p.mu.Unlock()
+
+	return code, state
+}
+
+func (p *oidcStandIn) discovery(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	issuer := p.issuer
+	p.mu.Unlock()
+	if issuer == "" {
+		issuer = p.server.URL
+	}
+
+	json.NewEncoder(w).Encode(oidcDiscovery{
+		Issuer:                issuer,
+		AuthorizationEndpoint: p.server.URL + "/authorize",
+		TokenEndpoint:         p.server.URL + "/token",
+		JWKSURI:               p.server.URL + "/jwks",
+	})
+}
+
+func (p *oidcStandIn) jwks(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.jwksFetches++
+
+	keys := make([]jsonWebKey, 0, len(p.keys))
+	for kid, key := range p.keys {
+		keys = append(keys, jsonWebKey{
+			Kty: "RSA",
+			Kid: kid,
+			Use: "sig",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		})
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+}
+
+func (p *oidcStandIn) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		p.t.Error(err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	request, ok := p.codes[r.PostForm.Get("code")]
+	delete(p.codes, r.PostForm.Get("code"))
+	challenge := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || r.PostForm.Get("client_id") != request.Get("client_id") || r.PostForm.Get("redirect_uri") != request.Get("redirect_uri") ||
+		base64.RawURLEncoding.EncodeToString(challenge[:]) != request.Get("code_challenge") {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	now := p.clock.Now()
+	claims := jwt.MapClaims{
+		"iss":   p.server.URL,
+		"aud":   testClientID,
+		"sub":   "subject-1",
+		"nonce": request.Get("nonce"),
+		"iat":   now.Unix(),
+		"exp":   now.Add(5 * time.Minute).Unix(),
+	}
+	for name, value := range p.claims {
+		claims[name] = value
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = p.signingKey
+	idToken, err := token.SignedString(p.keys[p.signingKey])
+	if err != nil {
+		p.t.Error(err)
+	}
+	json.NewEncoder(w).Encode(map[string]string{"access_token": "opaque", "token_type": "Bearer", "id_token": idToken})
+}
+
+func TestLoginOIDC(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		tamper func(query url.Values)
+		state  string // state presented at the callback, the login's when empty
+		// wantErr is the error of the login, which succeeds when nil
+		wantErr error
+	}{
+		{name: "valid ID token", claims: jwt.MapClaims{"preferred_username": "bob"}},
+		{name: "username from email", claims: jwt.MapClaims{"email": "bob@example.com"}},
+		{name: "wrong nonce", claims: jwt.MapClaims{"nonce": "replayed"}, wantErr: ErrInvalidCredentials},
+		{name: "wrong audience", claims: jwt.MapClaims{"aud": "other-client"}, wantErr: ErrInvalidCredentials},
+		{name: "wrong issuer", claims: jwt.MapClaims{"iss": "https://attacker.example.com"}, wantErr: ErrInvalidCredentials},
+		{name: "expired ID token", claims: jwt.MapClaims{"exp": time.Date(2024, 1, 2, 3, 0, 0, 0, time.UTC).Unix()}, wantErr: ErrInvalidCredentials},
+		{name: "no subject", claims: jwt.MapClaims{"sub": ""}, wantErr: ErrInvalidCredentials},
+		{
+			name:    "code issued for another PKCE challenge",
+			tamper:  func(query url.Values) { query.Set("code_challenge", "intercepted") },
+			wantErr: ErrInvalidCredentials,
+		},
+		{name: "unknown state", state: "forged", wantErr: ErrInvalidCredentials},
+		{name: "local user with the same username", claims: jwt.MapClaims{"preferred_username": "alice"}, wantErr: ErrUserExists},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := &fakeClock{now: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}
+			service, alice := newTestAuthService(t, clock)
+			standIn := newOIDCStandIn(t, clock)
+			standIn.claims = tt.claims
+			provider := standIn.provider("")
+
+			code, state := standIn.authorize(ctx, provider, tt.tamper)
+			if tt.state != "" {
+				state = tt.state
+			}
+
+			tokens, err := service.LoginOIDC(ctx, provider, code, state)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("expected %v, got %v", tt.wantErr, err)
+				}
+				// A failed login never changes the local user
+				local, err := service.GetUser(ctx, alice.ID)
+				if err != nil || local.Provider != "" {
+					t.Fatalf("local user changed: %+v, %v", local, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			user, err := service.ValidateToken(ctx, tokens.AccessToken)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user.ID == alice.ID || user.Provider != ProviderOIDC || user.Role != RoleViewer {
+				t.Fatalf("unexpected user %+v", user)
+			}
+			if want, _ := tt.claims["preferred_username"].(string); want != "" && user.Username != want {
+				t.Fatalf("username = %q, want %q", user.Username, want)
+			}
+			if want, _ := tt.claims["email"].(string); want != "" && user.Username != want {
+				t.Fatalf("username = %q, want %q", user.Username, want)
+			}
+
+			// The state is used up by the login
+			code, _ = standIn.authorize(ctx, provider, nil)
+			if _, err := service.LoginOIDC(ctx, provider, code, state); !errors.Is(err, ErrInvalidCredentials) {
+				t.Fatalf("replayed state accepted: %v", err)
+			}
+		})
+	}
+}
+
+func TestOIDCDiscovery(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}
+	standIn := newOIDCStandIn(t, clock)
+
+	standIn.issuer = "https://attacker.example.com"
+	if _, _, err := standIn.provider("").AuthCodeURL(context.Background()); err == nil {
+		t.Fatal("discovery accepted another issuer")
+	}
+
+	standIn.issuer = standIn.server.URL + "/"
+	redirect, _, err := standIn.provider("").AuthCodeURL(context.Background())
+	if err != nil {
+		t.Fatalf("discovery rejected a trailing slash: %v", err)
+	}
+	location, err := url.Parse(redirect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := location.Query()
+	if location.Path != "/authorize" || query.Get("client_id") != testClientID || query.Get("redirect_uri") != testRedirectURL ||
+		query.Get("scope") != "openid profile email" || query.Get("nonce") == "" {
+		t.Fatalf("unexpected authorization request %s", redirect)
+	}
+}
+
+func TestOIDCKeyRotation(t *testing.T) {
+	ctx := context.Background()
+	clock := &fakeClock{now: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}
+	service, _ := newTestAuthService(t, clock)
+	standIn := newOIDCStandIn(t, clock)
+	provider := standIn.provider("")
+
+	login := func() error {
+		code, state := standIn.authorize(ctx, provider, nil)
+		_, err := service.LoginOIDC(ctx, provider, code, state)
+		return err
+	}
+
+	if err := login(); err != nil {
+		t.Fatal(err)
+	}
+	if err := login(); err != nil {
+		t.Fatal(err)
+	}
+	if standIn.jwksFetches != 1 {
+		t.Fatalf("JWKS fetched %d times, want once", standIn.jwksFetches)
+	}
+
+	// Unknown key IDs refetch the JWKS at most once a minute
+	standIn.rotate("key-2")
+	if err := login(); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("expected ErrInvalidCredentials within the refresh interval, got %v", err)
+	}
+	if standIn.jwksFetches != 1 {
+		t.Fatalf("JWKS fetched %d times within the refresh interval", standIn.jwksFetches)
+	}
+
+	clock.now = clock.now.Add(jwksRefreshInterval)
+	if err := login(); err != nil {
+		t.Fatalf("rotated key rejected: %v", err)
+	}
+	if standIn.jwksFetches != 2 {
+		t.Fatalf("JWKS fetched %d times, want twice", standIn.jwksFetches)
+	}
+}
+
+func TestOIDCGroupBindings(t *testing.T) {
+	ctx := context.Background()
+	clock := &fakeClock{now: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}
+	service, _ := newTestAuthService(t, clock)
+	standIn := newOIDCStandIn(t, clock)
+	provider := standIn.provider("admins=admin,payments=deployer@team:payments,release=approver@environment:2")
+
+	login := func(groups ...interface{}) *User {
+		t.Helper()
+		standIn.claims = jwt.MapClaims{"preferred_username": "bob", "groups": groups}
+		code, state := standIn.authorize(ctx, provider, nil)
+		tokens, err := service.LoginOIDC(ctx, provider, code, state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		user, err := service.ValidateToken(ctx, tokens.AccessToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return user
+	}
+	bindings := func(userID string) []string {
+		t.Helper()
+		list, err := service.ListRoleBindings(ctx, userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		grants := make([]string, 0, len(list))
+		for _, binding := range list {
+			grants = append(grants, binding.Role+"@"+binding.Scope+":"+binding.Target+"/"+binding.Source)
+		}
+		sort.Strings(grants)
+		return grants
+	}
+	assertBindings := func(userID string, want ...string) {
+		if want == nil {
+			want = []string{}
+		}
+		t.Helper()
+		if got := bindings(userID); !reflect.DeepEqual(got, want) {
+			t.Fatalf("bindings = %v, want %v", got, want)
+		}
+	}
+
+	user := login("payments", "release", "unmapped")
+	assertBindings(user.ID, "approver@environment:2/oidc", "deployer@team:payments/oidc")
+	if user.Role != RoleViewer {
+		t.Fatalf("role = %q, want %q", user.Role, RoleViewer)
+	}
+	if !service.Can(user, PermissionDeploy, Resource{Team: "payments"}) || service.Can(user, PermissionDeploy, Resource{Team: "billing"}) {
+		t.Fatal("team binding not applied to the team alone")
+	}
+
+	// Bindings made through the API survive logins, group bindings follow
+	// the groups of the latest login
+	if _, err := service.CreateRoleBinding(ctx, RoleBinding{UserID: user.ID, Role: RoleScanner, Scope: ScopeGlobal}); err != nil {
+		t.Fatal(err)
+	}
+	again := login("release")
+	if again.ID != user.ID {
+		t.Fatalf("second login created user %s, want %s", again.ID, user.ID)
+	}
+	assertBindings(user.ID, "approver@environment:2/oidc", "scanner@global:/")
+
+	login()
+	assertBindings(user.ID, "scanner@global:/")
+}
@@ -0,0 +1,226 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jpfaria/image-updater/internal/store"
+	"github.com/xgodev/boost/wrapper/log"
+)
+
+// Permissions granted by roles
+const (
+	PermissionView    = "view"
+	PermissionDeploy  = "deploy"
+	PermissionApprove = "approve"
+	// PermissionScan uploads vulnerability reports, which gate deployments,
+	// so CI pipelines hold it without being able to deploy
+	PermissionScan  = "scan"
+	PermissionAdmin = "admin"
+)
+
+// rolePermissions lists the permissions each role grants
+var rolePermissions = map[string][]string{
+	RoleViewer:   {PermissionView},
+	RoleDeployer: {PermissionView, PermissionDeploy},
+	RoleApprover: {PermissionView, PermissionApprove},
+	RoleScanner:  {PermissionView, PermissionScan},
+	RoleAdmin:    {PermissionView, PermissionDeploy, PermissionApprove, PermissionScan, PermissionAdmin},
+}
+
+// Scopes a role binding can apply to
+const (
+	ScopeGlobal      = "global"
+	ScopeTeam        = "team"
+	ScopeApplication = "application"
+	ScopeEnvironment = "environment"
+)
+
+// ErrBindingNotFound is returned when a role binding does not exist
+var ErrBindingNotFound = errors.New("role binding not found")
+
+// RoleBinding grants a role to a user within a scope. The role a user holds
+// in its own Role field applies globally.
+type RoleBinding struct {
+	ID     string `json:"id"`
+	UserID string `json:"user_id"`
+	Role   string `json:"role"`
+	Scope  string `json:"scope"`
+	// Target is the team name, application name or environment ID the
+	// binding applies to; empty for global bindings
+	Target string `json:"target,omitempty"`
+	// Source names the identity provider managing the binding; bindings
+	// created through the API have none
+	Source string `json:"source,omitempty"`
+}
+
+// Resource describes what a permission is checked against
+type Resource struct {
+	Kind            string // used in error messages, e.g. "environment"
+	Name            string // used in error messages
+	Team            string
+	Application     string
+	Environment     string // environment ID
+	EnvironmentName string
+}
+
+// PermissionError reports a permission the user is missing
+type PermissionError struct {
+	Permission string
+	Resource   Resource
+}
+
+// Error describes the missing permission
+func (e *PermissionError) Error() string {
+	if e.Resource.Kind == "" {
+		return fmt.Sprintf("missing permission %q", e.Permission)
+	}
+	return fmt.Sprintf("missing permission %q on %s %q", e.Permission, e.Resource.Kind, e.Resource.Name)
+}
+
+// Authorize checks that a user holds a permission on a resource and returns
+// a *PermissionError when it does not
+func (s *AuthService) Authorize(ctx context.Context, user *User, permission string, resource Resource) error {
+	if !s.Can(user, permission, resource) {
+		username := ""
+		if user != nil {
+			username = user.Username
+		}
+		log.Warnf("User %s denied %s on %s %s", username, permission, resource.Kind, resource.Name)
+		return &PermissionError{Permission: permission, Resource: resource}
+	}
+
+	return nil
+}
+
+// Can reports whether a user holds a permission on a resource
+func (s *AuthService) Can(user *User, permission string, resource Resource) bool {
+	if user == nil {
+		return false
+	}
+
+	// API tokens never exceed their scopes
+	if user.TokenID != "" && !scopesAllow(user.Scopes, permission, resource) {
+		return false
+	}
+
+	if grants(user.Role, permission) {
+		return true
+	}
+
+	for _, binding := range s.bindings.List() {
+		if binding.UserID == user.ID && binding.applies(resource) && grants(binding.Role, permission) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ListRoleBindings lists the role bindings, optionally only those of a user
+func (s *AuthService) ListRoleBindings(ctx context.Context, userID string) ([]RoleBinding, error) {
+	bindings := make([]RoleBinding, 0)
+	for _, binding := range s.bindings.List() {
+		if userID == "" || binding.UserID == userID {
+			bindings = append(bindings, binding)
+		}
+	}
+
+	return bindings, nil
+}
+
+// CreateRoleBinding grants a role to a user within a scope
+func (s *AuthService) CreateRoleBinding(ctx context.Context, binding RoleBinding) (*RoleBinding, error) {
+	log.Infof("Binding role %s to user %s on %s %s", binding.Role, binding.UserID, binding.Scope, binding.Target)
+
+	if _, ok := s.users.Get(binding.UserID); !ok {
+		return nil, ErrUserNotFound
+	}
+
+	if err := validateBinding(binding); err != nil {
+		return nil, err
+	}
+	if binding.Scope == ScopeGlobal {
+		binding.Target = ""
+	}
+
+	binding.ID = store.NewID()
+	if err := s.bindings.Put(binding.ID, binding); err != nil {
+		return nil, err
+	}
+
+	return &binding, nil
+}
+
+// DeleteRoleBinding removes a role binding
+func (s *AuthService) DeleteRoleBinding(ctx context.Context, id string) error {
+	log.Infof("Deleting role binding with ID: %s", id)
+
+	if err := s.bindings.Delete(id); err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return ErrBindingNotFound
+		}
+		return err
+	}
+
+	return nil
+}
+
+// deleteUserBindings removes the role bindings of a deleted user
+func (s *AuthService) deleteUserBindings(userID string) error {
+	for _, binding := range s.bindings.List() {
+		if binding.UserID == userID {
+			if err := s.bindings.Delete(binding.ID); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateBinding checks the role and scope of a binding
+func validateBinding(binding RoleBinding) error {
+	if _, ok := rolePermissions[binding.Role]; !ok {
+		return fmt.Errorf("%w: unknown role %q", ErrInvalidUser, binding.Role)
+	}
+
+	switch binding.Scope {
+	case ScopeGlobal:
+		return nil
+	case ScopeTeam, ScopeApplication, ScopeEnvironment:
+		if binding.Target == "" {
+			return fmt.Errorf("%w: %s bindings need a target", ErrInvalidUser, binding.Scope)
+		}
+		return nil
+	default:
+		return fmt.Errorf("%w: unknown scope %q", ErrInvalidUser, binding.Scope)
+	}
+}
+
+// applies reports whether the binding covers a resource
+func (b RoleBinding) applies(resource Resource) bool {
+	switch b.Scope {
+	case ScopeGlobal:
+		return true
+	case ScopeTeam:
+		return resource.Team != "" && b.Target == resource.Team
+	case ScopeApplication:
+		return resource.Application != "" && b.Target == resource.Application
+	case ScopeEnvironment:
+		return resource.Environment != "" && b.Target == resource.Environment
+	default:
+		return false
+	}
+}
+
+// grants reports whether a role includes a permission
+func grants(role, permission string) bool {
+	for _, p := range rolePermissions[role] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
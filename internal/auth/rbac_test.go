@@ -0,0 +1,159 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestValidateBinding(t *testing.T) {
+	tests := []struct {
+		name    string
+		binding RoleBinding
+		wantErr bool
+	}{
+		{name: "global", binding: RoleBinding{Role: RoleAdmin, Scope: ScopeGlobal}},
+		{name: "team", binding: RoleBinding{Role: RoleDeployer, Scope: ScopeTeam, Target: "payments"}},
+		{name: "application", binding: RoleBinding{Role: RoleScanner, Scope: ScopeApplication, Target: "checkout"}},
+		{name: "environment", binding: RoleBinding{Role: RoleApprover, Scope: ScopeEnvironment, Target: "2"}},
+		{name: "unknown role", binding: RoleBinding{Role: "owner", Scope: ScopeGlobal}, wantErr: true},
+		{name: "no role", binding: RoleBinding{Role: RoleNone, Scope: ScopeGlobal}, wantErr: true},
+		{name: "unknown scope", binding: RoleBinding{Role: RoleViewer, Scope: "cluster", Target: "prod"}, wantErr: true},
+		{name: "no scope", binding: RoleBinding{Role: RoleViewer}, wantErr: true},
+		{name: "team without target", binding: RoleBinding{Role: RoleDeployer, Scope: ScopeTeam}, wantErr: true},
+		{name: "environment without target", binding: RoleBinding{Role: RoleDeployer, Scope: ScopeEnvironment}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateBinding(tt.binding)
+			if tt.wantErr && !errors.Is(err, ErrInvalidUser) {
+				t.Fatalf("expected ErrInvalidUser, got %v", err)
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestCan(t *testing.T) {
+	ctx := context.Background()
+	service, _ := newTestAuthService(t, &fakeClock{now: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)})
+
+	// bob holds no global role, only bindings
+	bob, err := service.CreateUser(ctx, User{Username: "bob", Role: RoleNone}, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, binding := range []RoleBinding{
+		{UserID: bob.ID, Role: RoleDeployer, Scope: ScopeTeam, Target: "payments"},
+		{UserID: bob.ID, Role: RoleApprover, Scope: ScopeEnvironment, Target: "2"},
+		{UserID: bob.ID, Role: RoleScanner, Scope: ScopeApplication, Target: "checkout"},
+	} {
+		if _, err := service.CreateRoleBinding(ctx, binding); err != nil {
+			t.Fatal(err)
+		}
+	}
+	viewer := &User{ID: "viewer", Username: "viewer", Role: RoleViewer}
+	admin := &User{ID: "admin", Username: "admin", Role: RoleAdmin}
+
+	payments := Resource{Kind: "environment", Name: "production", Team: "payments", Application: "api", Environment: "1", EnvironmentName: "production"}
+	checkout := Resource{Kind: "environment", Name: "staging", Team: "shop", Application: "checkout", Environment: "2", EnvironmentName: "staging"}
+	other := Resource{Kind: "environment", Name: "dev", Team: "shop", Application: "web", Environment: "3", EnvironmentName: "dev"}
+	unowned := Resource{Kind: "environment", Name: "sandbox", Environment: "4"}
+
+	tests := []struct {
+		name       string
+		user       *User
+		permission string
+		resource   Resource
+		want       bool
+	}{
+		{name: "global role", user: viewer, permission: PermissionView, resource: other, want: true},
+		{name: "global role lacks permission", user: viewer, permission: PermissionDeploy, resource: other},
+		{name: "admin", user: admin, permission: PermissionAdmin, resource: Resource{}, want: true},
+		{name: "team binding", user: bob, permission: PermissionDeploy, resource: payments, want: true},
+		{name: "team binding grants viewing", user: bob, permission: PermissionView, resource: payments, want: true},
+		{name: "team binding on another team", user: bob, permission: PermissionDeploy, resource: other},
+		{name: "team binding lacks permission", user: bob, permission: PermissionApprove, resource: payments},
+		{name: "environment binding", user: bob, permission: PermissionApprove, resource: checkout, want: true},
+		{name: "environment binding on another environment", user: bob, permission: PermissionApprove, resource: other},
+		{name: "application binding", user: bob, permission: PermissionScan, resource: checkout, want: true},
+		{name: "application binding on another application", user: bob, permission: PermissionScan, resource: payments},
+		{name: "bindings on a resource without owner", user: bob, permission: PermissionView, resource: unowned},
+		{name: "no global role", user: bob, permission: PermissionView, resource: other},
+		{name: "no user", permission: PermissionView, resource: other},
+		{
+			name:       "token scope within the role",
+			user:       &User{ID: "admin", Role: RoleAdmin, TokenID: "t1", Scopes: []string{"deploy:payments"}},
+			permission: PermissionDeploy, resource: payments, want: true,
+		},
+		{
+			name:       "token scope on another team",
+			user:       &User{ID: "admin", Role: RoleAdmin, TokenID: "t1", Scopes: []string{"deploy:payments"}},
+			permission: PermissionDeploy, resource: other,
+		},
+		{
+			name:       "token scope beyond the role",
+			user:       &User{ID: "viewer", Role: RoleViewer, TokenID: "t1", Scopes: []string{"deploy"}},
+			permission: PermissionDeploy, resource: other,
+		},
+		{
+			name:       "token scope and binding",
+			user:       &User{ID: bob.ID, Role: RoleNone, TokenID: "t1", Scopes: []string{"approve:staging"}},
+			permission: PermissionApprove, resource: checkout, want: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := service.Can(tt.user, tt.permission, tt.resource); got != tt.want {
+				t.Fatalf("Can() = %v, want %v", got, tt.want)
+			}
+
+			err := service.Authorize(ctx, tt.user, tt.permission, tt.resource)
+			var permissionErr *PermissionError
+			if tt.want != (err == nil) || (err != nil && !errors.As(err, &permissionErr)) {
+				t.Fatalf("Authorize() = %v, want allowed %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRoleBindings(t *testing.T) {
+	ctx := context.Background()
+	service, alice := newTestAuthService(t, &fakeClock{now: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)})
+
+	if _, err := service.CreateRoleBinding(ctx, RoleBinding{UserID: "missing", Role: RoleViewer, Scope: ScopeGlobal}); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("expected ErrUserNotFound, got %v", err)
+	}
+	if _, err := service.CreateRoleBinding(ctx, RoleBinding{UserID: alice.ID, Role: RoleViewer, Scope: ScopeTeam}); !errors.Is(err, ErrInvalidUser) {
+		t.Fatalf("expected ErrInvalidUser, got %v", err)
+	}
+
+	// Global bindings have no target
+	binding, err := service.CreateRoleBinding(ctx, RoleBinding{UserID: alice.ID, Role: RoleDeployer, Scope: ScopeGlobal, Target: "payments"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if binding.ID == "" || binding.Target != "" {
+		t.Fatalf("unexpected binding %+v", binding)
+	}
+	user, err := service.GetUser(ctx, alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !service.Can(user, PermissionDeploy, Resource{Team: "billing"}) {
+		t.Fatal("global binding not applied")
+	}
+
+	if err := service.DeleteRoleBinding(ctx, binding.ID); err != nil {
+		t.Fatal(err)
+	}
+	if service.Can(user, PermissionDeploy, Resource{Team: "billing"}) {
+		t.Fatal("deleted binding still applied")
+	}
+	if err := service.DeleteRoleBinding(ctx, binding.ID); !errors.Is(err, ErrBindingNotFound) {
+		t.Fatalf("expected ErrBindingNotFound, got %v", err)
+	}
+}
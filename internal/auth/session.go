@@ -0,0 +1,274 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jpfaria/image-updater/internal/store"
+	"github.com/xgodev/boost/wrapper/log"
+)
+
+// Claims are the claims of the access tokens issued by AuthService. The
+// subject is the user ID.
+type Claims struct {
+	jwt.RegisteredClaims
+	Username string `json:"username"`
+	Email    string `json:"email,omitempty"`
+	Role     string `json:"role"`
+	// SessionID identifies the login, shared by the tokens refreshed from it
+	SessionID string `json:"sid"`
+	// Generation must match the user's, so bumping it ends every session
+	Generation int `json:"gen"`
+}
+
+// TokenPair is a short-lived access token with the refresh token that
+// replaces it
+type TokenPair struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"` // seconds
+}
+
+// refreshTokenRecord is a refresh token as kept in the store. Each refresh
+// token is used once; presenting a used one again means it was stolen, and
+// ends the whole session.
+type refreshTokenRecord struct {
+	ID         string `json:"id"`
+	UserID     string `json:"user_id"`
+	SessionID  string `json:"session_id"`
+	Generation int    `json:"generation"`
+	SecretHash string `json:"secret_hash"`
+	ExpiresAt  string `json:"expires_at"`
+	UsedAt     string `json:"used_at,omitempty"`
+}
+
+// Refresh exchanges a refresh token for a new token pair. The refresh token
+// cannot be used again.
+func (s *AuthService) Refresh(ctx context.Context, refreshToken string) (*TokenPair, error) {
+	id, secret, ok := strings.Cut(refreshToken, ".")
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+
+	record, ok := s.refreshTokens.Get(id)
+	if !ok || subtle.ConstantTimeCompare([]byte(record.SecretHash), []byte(hashSecret(secret))) != 1 {
+		return nil, ErrInvalidToken
+	}
+
+	now := s.options.Clock.Now()
+	if s.revokedID("sid:" + record.SessionID) {
+		return nil, fmt.Errorf("%w: session revoked", ErrInvalidToken)
+	}
+	if expiresAt, err := time.Parse(time.RFC3339, record.ExpiresAt); err != nil || !now.Before(expiresAt) {
+		return nil, fmt.Errorf("%w: refresh token expired", ErrInvalidToken)
+	}
+
+	// Mark the token used atomically so concurrent refreshes cannot both win
+	_, err := s.refreshTokens.Update(id, func(r *refreshTokenRecord) error {
+		if r.UsedAt != "" {
+			return ErrInvalidToken
+		}
+		r.UsedAt = now.Format(time.RFC3339)
+		return nil
+	})
+	if errors.Is(err, ErrInvalidToken) {
+		log.Warnf("Refresh token of session %s was reused, revoking the session", record.SessionID)
+		if err := s.revokeSession(record.SessionID, now.Add(s.options.RefreshTokenTTL)); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: refresh token already used", ErrInvalidToken)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	user, ok := s.users.Get(record.UserID)
+	if !ok || user.Generation != record.Generation {
+		return nil, ErrInvalidToken
+	}
+
+	return s.issueTokens(user, record.SessionID)
+}
+
+// Logout ends the session of an access token: the token and the refresh
+// tokens of its session are revoked
+func (s *AuthService) Logout(ctx context.Context, tokenString string) error {
+	claims, err := s.parse(tokenString)
+	if err != nil {
+		return err
+	}
+
+	if err := s.revoke(claims.ID, claims.ExpiresAt.Time); err != nil {
+		return err
+	}
+
+	return s.revokeSession(claims.SessionID, s.options.Clock.Now().Add(s.options.RefreshTokenTTL))
+}
+
+// RevokeSessions ends every session of a user
+func (s *AuthService) RevokeSessions(ctx context.Context, userID string) error {
+	log.Infof("Revoking sessions of user with ID: %s", userID)
+
+	_, err := s.users.Update(userID, func(r *userRecord) error {
+		r.Generation++
+		return nil
+	})
+	if errors.Is(err, store.ErrNotFound) {
+		return ErrUserNotFound
+	}
+
+	return err
+}
+
+// ValidateToken validates an access token and returns its user
+func (s *AuthService) ValidateToken(ctx context.Context, tokenString string) (*User, error) {
+	claims, err := s.parse(tokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.revokedID(claims.ID) || s.revokedID("sid:"+claims.SessionID) {
+		return nil, fmt.Errorf("%w: token revoked", ErrInvalidToken)
+	}
+
+	// Load the user so deleted users and role changes take effect immediately
+	record, ok := s.users.Get(claims.Subject)
+	if !ok || record.Generation != claims.Generation {
+		return nil, ErrInvalidToken
+	}
+
+	user := record.User
+	return &user, nil
+}
+
+// JWKS returns the public keys access tokens are signed with
+func (s *AuthService) JWKS() map[string]interface{} {
+	return s.options.Keys.JWKS()
+}
+
+// issueTokens signs an access token and creates a refresh token for a
+// user; an empty sessionID starts a new session
+func (s *AuthService) issueTokens(record userRecord, sessionID string) (*TokenPair, error) {
+	if sessionID == "" {
+		sessionID = store.NewID()
+	}
+
+	now := s.options.Clock.Now()
+	claims := Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        store.NewID(),
+			Issuer:    s.options.Issuer,
+			Subject:   record.ID,
+			Audience:  jwt.ClaimStrings{s.options.Audience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(s.options.AccessTokenTTL)),
+		},
+		Username:   record.Username,
+		Email:      record.Email,
+		Role:       record.Role,
+		SessionID:  sessionID,
+		Generation: record.Generation,
+	}
+
+	accessToken, err := s.options.Keys.Sign(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+
+	refresh := refreshTokenRecord{
+		ID:         store.NewID(),
+		UserID:     record.ID,
+		SessionID:  sessionID,
+		Generation: record.Generation,
+		SecretHash: hashSecret(secret),
+		ExpiresAt:  now.Add(s.options.RefreshTokenTTL).Format(time.RFC3339),
+	}
+	if err := s.refreshTokens.Put(refresh.ID, refresh); err != nil {
+		return nil, err
+	}
+	s.pruneRefreshTokens(now)
+
+	return &TokenPair{
+		AccessToken:  accessToken,
+		RefreshToken: refresh.ID + "." + secret,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(s.options.AccessTokenTTL.Seconds()),
+	}, nil
+}
+
+// parse verifies the signature, issuer, audience and expiry of an access token
+func (s *AuthService) parse(tokenString string) (*Claims, error) {
+	parser := jwt.NewParser(
+		jwt.WithValidMethods(s.options.Keys.Methods()),
+		jwt.WithIssuer(s.options.Issuer),
+		jwt.WithAudience(s.options.Audience),
+		jwt.WithExpirationRequired(),
+		jwt.WithTimeFunc(s.options.Clock.Now),
+	)
+
+	claims := &Claims{}
+	if _, err := parser.ParseWithClaims(tokenString, claims, s.options.Keys.verificationKey); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	if claims.ID == "" || claims.Subject == "" || claims.SessionID == "" {
+		return nil, fmt.Errorf("%w: missing claims", ErrInvalidToken)
+	}
+
+	return claims, nil
+}
+
+// revokeSession revokes the access and refresh tokens of a session
+func (s *AuthService) revokeSession(sessionID string, until time.Time) error {
+	return s.revoke("sid:"+sessionID, until)
+}
+
+// revocation is an entry of the revocation list, kept until the revoked
+// token would have expired anyway
+type revocation struct {
+	ID        string `json:"id"`
+	ExpiresAt string `json:"expires_at"`
+}
+
+// revoke adds an ID to the revocation list until it expires
+func (s *AuthService) revoke(id string, until time.Time) error {
+	now := s.options.Clock.Now()
+	for _, entry := range s.revoked.List() {
+		if exp, err := time.Parse(time.RFC3339, entry.ExpiresAt); err == nil && now.After(exp) {
+			if err := s.revoked.Delete(entry.ID); err != nil {
+				return err
+			}
+		}
+	}
+
+	return s.revoked.Put(id, revocation{ID: id, ExpiresAt: until.Format(time.RFC3339)})
+}
+
+// revokedID reports whether an ID is on the revocation list
+func (s *AuthService) revokedID(id string) bool {
+	_, revoked := s.revoked.Get(id)
+	return revoked
+}
+
+// pruneRefreshTokens drops refresh tokens that expired
+func (s *AuthService) pruneRefreshTokens(now time.Time) {
+	for _, record := range s.refreshTokens.List() {
+		if exp, err := time.Parse(time.RFC3339, record.ExpiresAt); err == nil && now.After(exp) {
+			if err := s.refreshTokens.Delete(record.ID); err != nil {
+				log.Warnf("Failed to prune refresh token %s: %v", record.ID, err)
+			}
+		}
+	}
+}
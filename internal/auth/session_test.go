@@ -0,0 +1,186 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock tests move by hand
+type fakeClock struct {
+	now time.Time
+}
+
+// Now returns the time the clock was set to
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+// newTestAuthService creates an in-memory service with a user alice
+func newTestAuthService(t *testing.T, clock *fakeClock) (*AuthService, *User) {
+	t.Helper()
+
+	service, err := NewAuthService(AuthOptions{
+		Keys:            NewHMACKeySet("test-secret-test-secret-test-secret"),
+		Issuer:          "image-updater",
+		Audience:        "image-updater",
+		AccessTokenTTL:  15 * time.Minute,
+		RefreshTokenTTL: 24 * time.Hour,
+		Clock:           clock,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := service.CreateUser(context.Background(), User{Username: "alice", Role: RoleViewer}, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return service, user
+}
+
+func TestRefresh(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		// present returns the refresh token presented after logging in with
+		// the tokens of the login
+		present func(t *testing.T, service *AuthService, clock *fakeClock, user *User, login *TokenPair) string
+		wantErr bool
+	}{
+		{
+			name: "unused token",
+			present: func(t *testing.T, service *AuthService, clock *fakeClock, user *User, login *TokenPair) string {
+				return login.RefreshToken
+			},
+		},
+		{
+			name: "rotated token",
+			present: func(t *testing.T, service *AuthService, clock *fakeClock, user *User, login *TokenPair) string {
+				next, err := service.Refresh(ctx, login.RefreshToken)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return next.RefreshToken
+			},
+		},
+		{
+			name: "reused token",
+			present: func(t *testing.T, service *AuthService, clock *fakeClock, user *User, login *TokenPair) string {
+				if _, err := service.Refresh(ctx, login.RefreshToken); err != nil {
+					t.Fatal(err)
+				}
+				return login.RefreshToken
+			},
+			wantErr: true,
+		},
+		{
+			name: "expired token",
+			present: func(t *testing.T, service *AuthService, clock *fakeClock, user *User, login *TokenPair) string {
+				clock.now = clock.now.Add(25 * time.Hour)
+				return login.RefreshToken
+			},
+			wantErr: true,
+		},
+		{
+			name: "wrong secret",
+			present: func(t *testing.T, service *AuthService, clock *fakeClock, user *User, login *TokenPair) string {
+				return login.RefreshToken + "x"
+			},
+			wantErr: true,
+		},
+		{
+			name: "malformed token",
+			present: func(t *testing.T, service *AuthService, clock *fakeClock, user *User, login *TokenPair) string {
+				return "not-a-refresh-token"
+			},
+			wantErr: true,
+		},
+		{
+			name: "logged out session",
+			present: func(t *testing.T, service *AuthService, clock *fakeClock, user *User, login *TokenPair) string {
+				if err := service.Logout(ctx, login.AccessToken); err != nil {
+					t.Fatal(err)
+				}
+				return login.RefreshToken
+			},
+			wantErr: true,
+		},
+		{
+			name: "sessions of the user revoked",
+			present: func(t *testing.T, service *AuthService, clock *fakeClock, user *User, login *TokenPair) string {
+				if err := service.RevokeSessions(ctx, user.ID); err != nil {
+					t.Fatal(err)
+				}
+				return login.RefreshToken
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := &fakeClock{now: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}
+			service, user := newTestAuthService(t, clock)
+			login, err := service.Login(ctx, "alice", "password")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tokens, err := service.Refresh(ctx, tt.present(t, service, clock, user, login))
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidToken) {
+					t.Fatalf("expected ErrInvalidToken, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := service.ValidateToken(ctx, tokens.AccessToken); err != nil {
+				t.Fatalf("refreshed access token rejected: %v", err)
+			}
+		})
+	}
+}
+
+func TestRefreshReuseEndsSession(t *testing.T) {
+	ctx := context.Background()
+	clock := &fakeClock{now: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}
+	service, _ := newTestAuthService(t, clock)
+
+	login, err := service.Login(ctx, "alice", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := service.Login(ctx, "alice", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The legitimate client rotates its token, then a thief replays the old one
+	rotated, err := service.Refresh(ctx, login.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.Refresh(ctx, login.RefreshToken); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("reused refresh token accepted: %v", err)
+	}
+
+	// Every token of the session is revoked, other sessions are not
+	if _, err := service.Refresh(ctx, rotated.RefreshToken); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("rotated refresh token still accepted: %v", err)
+	}
+	for name, token := range map[string]string{"login": login.AccessToken, "rotated": rotated.AccessToken} {
+		if _, err := service.ValidateToken(ctx, token); !errors.Is(err, ErrInvalidToken) {
+			t.Fatalf("%s access token still accepted: %v", name, err)
+		}
+	}
+	if _, err := service.ValidateToken(ctx, other.AccessToken); err != nil {
+		t.Fatalf("other session ended: %v", err)
+	}
+	if _, err := service.Refresh(ctx, other.RefreshToken); err != nil {
+		t.Fatalf("other session ended: %v", err)
+	}
+}
@@ -0,0 +1,311 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jpfaria/image-updater/internal/store"
+	"github.com/xgodev/boost/wrapper/log"
+)
+
+// APITokenPrefix starts every API token so they can be told apart from JWTs
+const APITokenPrefix = "iut_"
+
+// Kinds of API tokens
+const (
+	TokenKindPersonal       = "personal"
+	TokenKindServiceAccount = "service_account"
+)
+
+// lastUsedResolution limits how often token use is written to the store
+const lastUsedResolution = time.Minute
+
+// Errors returned for API tokens
+var (
+	ErrTokenNotFound       = errors.New("API token not found")
+	ErrInvalidTokenRequest = errors.New("invalid API token request")
+)
+
+// APIToken is a long-lived token for scripts and CI pipelines. Its secret
+// is only returned when the token is created.
+type APIToken struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	UserID string `json:"user_id"`
+	Kind   string `json:"kind"`
+	// Scopes limit the token to permission or permission:target entries,
+	// where target is an environment name or ID, an application or a team
+	Scopes     []string `json:"scopes"`
+	ExpiresAt  string   `json:"expires_at,omitempty"`
+	CreatedAt  string   `json:"created_at"`
+	CreatedBy  string   `json:"created_by"`
+	LastUsedAt string   `json:"last_used_at,omitempty"`
+	LastUsedIP string   `json:"last_used_ip,omitempty"`
+	RevokedAt  string   `json:"revoked_at,omitempty"`
+}
+
+// apiTokenRecord is an API token as kept in the token store
+type apiTokenRecord struct {
+	APIToken
+	SecretHash string `json:"secret_hash"`
+}
+
+// IsAPIToken reports whether a bearer token is an API token rather than a JWT
+func IsAPIToken(token string) bool {
+	return strings.HasPrefix(token, APITokenPrefix)
+}
+
+// CreateServiceAccount creates a user that can only authenticate with API tokens
+func (s *AuthService) CreateServiceAccount(ctx context.Context, name, role string) (*User, error) {
+	log.Infof("Creating service account: %s", name)
+
+	user := User{Username: name, Role: role, ServiceAccount: true}
+	if err := validateUser(user); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.findByUsername(name); exists {
+		return nil, ErrUserExists
+	}
+
+	now := time.Now().Format(time.RFC3339)
+	user.ID = store.NewID()
+	record := userRecord{
+		User:      user,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	if err := s.users.Put(user.ID, record); err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// ListServiceAccounts lists the service accounts
+func (s *AuthService) ListServiceAccounts(ctx context.Context) ([]User, error) {
+	users := make([]User, 0)
+	for _, record := range s.users.List() {
+		if record.ServiceAccount {
+			users = append(users, record.User)
+		}
+	}
+
+	return users, nil
+}
+
+// CreateAPIToken creates a token for a user and returns it with its secret.
+// Personal tokens belong to human users, service account tokens to service
+// accounts. A zero expiresAt creates a token that does not expire.
+func (s *AuthService) CreateAPIToken(ctx context.Context, userID, name string, scopes []string, expiresAt time.Time, createdBy string) (*APIToken, string, error) {
+	log.Infof("Creating API token %s for user with ID: %s", name, userID)
+
+	owner, ok := s.users.Get(userID)
+	if !ok {
+		return nil, "", ErrUserNotFound
+	}
+
+	if name == "" {
+		return nil, "", fmt.Errorf("%w: name is required", ErrInvalidTokenRequest)
+	}
+	if len(scopes) == 0 {
+		return nil, "", fmt.Errorf("%w: at least one scope is required", ErrInvalidTokenRequest)
+	}
+	for _, scope := range scopes {
+		permission, target, hasTarget := strings.Cut(scope, ":")
+		if !knownPermission(permission) {
+			return nil, "", fmt.Errorf("%w: unknown permission in scope %q", ErrInvalidTokenRequest, scope)
+		}
+		if hasTarget && target == "" {
+			return nil, "", fmt.Errorf("%w: empty target in scope %q", ErrInvalidTokenRequest, scope)
+		}
+	}
+
+	now := time.Now()
+	if !expiresAt.IsZero() && !expiresAt.After(now) {
+		return nil, "", fmt.Errorf("%w: expiry must be in the future", ErrInvalidTokenRequest)
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(secret)
+
+	kind := TokenKindPersonal
+	if owner.ServiceAccount {
+		kind = TokenKindServiceAccount
+	}
+
+	token := APIToken{
+		ID:        store.NewID(),
+		Name:      name,
+		UserID:    userID,
+		Kind:      kind,
+		Scopes:    scopes,
+		CreatedAt: now.Format(time.RFC3339),
+		CreatedBy: createdBy,
+	}
+	if !expiresAt.IsZero() {
+		token.ExpiresAt = expiresAt.Format(time.RFC3339)
+	}
+
+	record := apiTokenRecord{APIToken: token, SecretHash: hashSecret(encoded)}
+	if err := s.tokens.Put(token.ID, record); err != nil {
+		return nil, "", err
+	}
+
+	return &token, APITokenPrefix + token.ID + "_" + encoded, nil
+}
+
+// ListAPITokens lists the tokens of a user, or all tokens when userID is empty
+func (s *AuthService) ListAPITokens(ctx context.Context, userID string) ([]APIToken, error) {
+	tokens := make([]APIToken, 0)
+	for _, record := range s.tokens.List() {
+		if userID == "" || record.UserID == userID {
+			tokens = append(tokens, record.APIToken)
+		}
+	}
+
+	return tokens, nil
+}
+
+// GetAPIToken gets a token by ID
+func (s *AuthService) GetAPIToken(ctx context.Context, id string) (*APIToken, error) {
+	record, ok := s.tokens.Get(id)
+	if !ok {
+		return nil, ErrTokenNotFound
+	}
+
+	return &record.APIToken, nil
+}
+
+// RevokeAPIToken revokes a token; revoked tokens stay listed
+func (s *AuthService) RevokeAPIToken(ctx context.Context, id string) (*APIToken, error) {
+	log.Infof("Revoking API token with ID: %s", id)
+
+	record, err := s.tokens.Update(id, func(r *apiTokenRecord) error {
+		if r.RevokedAt == "" {
+			r.RevokedAt = time.Now().Format(time.RFC3339)
+		}
+		return nil
+	})
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, ErrTokenNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &record.APIToken, nil
+}
+
+// ValidateAPIToken checks an API token and returns its user, restricted to
+// the token's scopes. sourceIP is recorded as the last place of use.
+func (s *AuthService) ValidateAPIToken(ctx context.Context, tokenString, sourceIP string) (*User, error) {
+	id, secret, ok := strings.Cut(strings.TrimPrefix(tokenString, APITokenPrefix), "_")
+	if !ok || !IsAPIToken(tokenString) {
+		return nil, ErrInvalidToken
+	}
+
+	record, ok := s.tokens.Get(id)
+	if !ok || subtle.ConstantTimeCompare([]byte(record.SecretHash), []byte(hashSecret(secret))) != 1 {
+		return nil, ErrInvalidToken
+	}
+
+	now := time.Now()
+	if record.RevokedAt != "" {
+		return nil, fmt.Errorf("%w: token revoked", ErrInvalidToken)
+	}
+	if record.ExpiresAt != "" {
+		if expiresAt, err := time.Parse(time.RFC3339, record.ExpiresAt); err != nil || !now.Before(expiresAt) {
+			return nil, fmt.Errorf("%w: token expired", ErrInvalidToken)
+		}
+	}
+
+	owner, ok := s.users.Get(record.UserID)
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+
+	s.touch(record, sourceIP, now)
+
+	user := owner.User
+	user.TokenID = record.ID
+	user.Scopes = record.Scopes
+	return &user, nil
+}
+
+// touch records the use of a token, at most once per lastUsedResolution
+// unless the source IP changes
+func (s *AuthService) touch(record apiTokenRecord, sourceIP string, now time.Time) {
+	if last, err := time.Parse(time.RFC3339, record.LastUsedAt); err == nil && now.Sub(last) < lastUsedResolution && record.LastUsedIP == sourceIP {
+		return
+	}
+
+	_, err := s.tokens.Update(record.ID, func(r *apiTokenRecord) error {
+		r.LastUsedAt = now.Format(time.RFC3339)
+		r.LastUsedIP = sourceIP
+		return nil
+	})
+	if err != nil {
+		log.Warnf("Failed to record use of API token %s: %v", record.ID, err)
+	}
+}
+
+// deleteUserTokens removes the API tokens of a deleted user
+func (s *AuthService) deleteUserTokens(userID string) error {
+	for _, record := range s.tokens.List() {
+		if record.UserID == userID {
+			if err := s.tokens.Delete(record.ID); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// scopesAllow reports whether token scopes allow a permission on a resource.
+// Any scope on a resource also allows viewing it. An empty target matches
+// nothing, rather than every resource lacking one of the fields.
+func scopesAllow(scopes []string, permission string, resource Resource) bool {
+	for _, scope := range scopes {
+		scoped, target, hasTarget := strings.Cut(scope, ":")
+		if scoped != permission && permission != PermissionView {
+			continue
+		}
+		if hasTarget && target == "" {
+			continue
+		}
+		if !hasTarget || target == resource.Environment || target == resource.EnvironmentName ||
+			target == resource.Name || target == resource.Application || target == resource.Team {
+			return true
+		}
+	}
+
+	return false
+}
+
+// knownPermission reports whether a permission exists
+func knownPermission(permission string) bool {
+	return grants(RoleAdmin, permission)
+}
+
+// hashSecret hashes a token secret; secrets are random so a fast hash suffices
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,67 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestScopesAllow(t *testing.T) {
+	production := Resource{Kind: "environment", Name: "production", Team: "payments", Application: "checkout", Environment: "env-1", EnvironmentName: "production"}
+	team := Resource{Kind: "team", Name: "payments", Team: "payments"}
+
+	tests := []struct {
+		name       string
+		scopes     []string
+		permission string
+		resource   Resource
+		want       bool
+	}{
+		{"unscoped permission", []string{"deploy"}, PermissionDeploy, production, true},
+		{"other permission", []string{"deploy"}, PermissionApprove, production, false},
+		{"any scope allows viewing", []string{"deploy:production"}, PermissionView, production, true},
+		{"environment name", []string{"deploy:production"}, PermissionDeploy, production, true},
+		{"environment ID", []string{"deploy:env-1"}, PermissionDeploy, production, true},
+		{"application", []string{"deploy:checkout"}, PermissionDeploy, production, true},
+		{"team", []string{"deploy:payments"}, PermissionDeploy, production, true},
+		{"other environment", []string{"deploy:staging"}, PermissionDeploy, production, false},
+		{"view scope on another team", []string{"view:billing"}, PermissionView, team, false},
+		{"empty target", []string{"deploy:"}, PermissionDeploy, team, false},
+		{"empty target does not allow viewing", []string{"view:"}, PermissionView, team, false},
+		{"one of several scopes", []string{"approve:staging", "deploy:checkout"}, PermissionDeploy, production, true},
+		{"no scopes", nil, PermissionView, production, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := scopesAllow(tt.scopes, tt.permission, tt.resource); got != tt.want {
+				t.Fatalf("scopesAllow(%q, %q) = %v, want %v", tt.scopes, tt.permission, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateAPITokenScopes(t *testing.T) {
+	ctx := context.Background()
+	service, user := newTestAuthService(t, &fakeClock{now: time.Now()})
+
+	tests := []struct {
+		name    string
+		scopes  []string
+		wantErr bool
+	}{
+		{name: "permission", scopes: []string{"deploy"}},
+		{name: "permission on a target", scopes: []string{"deploy:production", "view"}},
+		{name: "no scopes", wantErr: true},
+		{name: "unknown permission", scopes: []string{"destroy:production"}, wantErr: true},
+		{name: "empty target", scopes: []string{"deploy:"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := service.CreateAPIToken(ctx, user.ID, "ci", tt.scopes, time.Time{}, "admin")
+			if tt.wantErr != errors.Is(err, ErrInvalidTokenRequest) {
+				t.Fatalf("CreateAPIToken(%q) error = %v, want error %v", tt.scopes, err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,20 @@
+package clock
+
+import "time"
+
+// Clock provides the current time so time-dependent code can be tested
+type Clock interface {
+	Now() time.Time
+}
+
+// Real returns a Clock backed by the system time
+func Real() Clock {
+	return realClock{}
+}
+
+type realClock struct{}
+
+// Now returns the current system time
+func (realClock) Now() time.Time {
+	return time.Now()
+}
@@ -1,16 +1,31 @@
 package config
 
 import (
+	"errors"
+	"fmt"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // Config holds the application configuration
 type Config struct {
-	Server   ServerConfig
-	Database DatabaseConfig
-	Docker   DockerConfig
-	Git      GitConfig
+	// File is the manifest declaring teams, repositories, images and
+	// environments; empty keeps the built-in ones
+	File string
+	// WatchFile reloads the manifest when the file changes; it is also
+	// reloaded on SIGHUP
+	WatchFile  bool
+	Server     ServerConfig
+	Database   DatabaseConfig
+	Docker     DockerConfig
+	Git        GitConfig
+	Deployment DeploymentConfig
+	Webhook    WebhookConfig
+	Auth       AuthConfig
+	Audit      AuditConfig
 }
 
 // ServerConfig holds the server configuration
@@ -27,14 +42,29 @@ type DatabaseConfig struct {
 	User     string
 	Password string
 	Name     string
+	Path     string // directory for file-backed storage
 }
 
 // DockerConfig holds the Docker registry configuration
 type DockerConfig struct {
 	RegistryURL      string
-	PollingInterval  int // in seconds
-	CredentialsPath  string
+	PollingInterval  int    // in seconds
+	CredentialsPath  string // Docker config.json with auths and credential helpers
 	DefaultNamespace string
+	Username         string
+	Password         string
+	Token            string // bearer token, used instead of the password
+	CacheDir         string // registry response cache, <DB_PATH>/registry-cache by default
+	CacheSize        int    // in megabytes, 0 disables the cache
+	// DiscoveryInterval is the time between scans of the registry catalogs
+	// for new repositories, in seconds; 0 scans only on request
+	DiscoveryInterval int
+	// SignatureKeyFiles are the PEM public keys cosign signatures of images
+	// are verified with
+	SignatureKeyFiles []string
+	// VulnerabilityAttestations reads the vulnerability attestations signed
+	// with these keys from the registry when no report was uploaded
+	VulnerabilityAttestations bool
 }
 
 // GitConfig holds the Git repository configuration
@@ -45,55 +75,388 @@ type GitConfig struct {
 	Username      string
 	Password      string
 	SSHKeyPath    string
+	CloneDir      string // working copies, <DB_PATH>/git by default
 }
 
-// Load loads the configuration from environment variables
+// DeploymentConfig holds the deployment workflow configuration
+type DeploymentConfig struct {
+	ApprovalTimeout    int // in seconds
+	SchedulerInterval  int // in seconds
+	DriftCheckInterval int // in seconds, 0 disables drift detection
+	AdoptDrift         bool
+}
+
+// WebhookConfig holds the webhook authentication configuration
+type WebhookConfig struct {
+	Secret               string // applies to sources without their own secret
+	Mode                 string // hmac or bearer
+	TimestampHeader      string
+	SignedHeaders        bool // the HMAC covers the timestamp and delivery ID
+	AllowUnauthenticated bool
+	TimestampTolerance   int // in seconds
+	ReplayWindow         int // in seconds
+	Sources              map[string]WebhookSourceConfig
+	Workers              int
+	MaxAttempts          int
+	RetryBackoff         int // in seconds
+	DeliveryRetention    int // in seconds, how long finished deliveries are kept
+}
+
+// WebhookSourceConfig holds the authentication settings of one webhook source
+type WebhookSourceConfig struct {
+	Secret          string
+	Mode            string
+	SignatureHeader string
+	TimestampHeader string
+	DeliveryHeader  string
+	SignedHeaders   bool
+}
+
+// AuthConfig holds the authentication configuration
+type AuthConfig struct {
+	JWTSecret string // signs HS256 tokens when no signing key file is set
+	// SigningKeyFile is a PEM RSA or Ed25519 private key tokens are signed
+	// with; PreviousKeyFiles are still accepted after a key rotation
+	SigningKeyFile    string
+	PreviousKeyFiles  []string
+	Issuer            string
+	Audience          string
+	TokenTTL          int // lifetime of access tokens, in seconds
+	RefreshTokenTTL   int // in seconds
+	BootstrapUsername string
+	BootstrapPassword string // generated and logged once when empty
+	OIDC              OIDCConfig
+}
+
+// OIDCConfig holds the OpenID Connect single sign-on configuration
+type OIDCConfig struct {
+	Issuer       string // empty disables OIDC login
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       string // space separated
+	GroupsClaim  string
+	// GroupMappings maps identity provider groups to roles as comma
+	// separated group=role or group=role@scope:target entries
+	GroupMappings string
+	DefaultRole   string
+}
+
+// AuditConfig holds the audit log configuration
+type AuditConfig struct {
+	CheckpointInterval int // in seconds, 0 disables signed checkpoints
+	// SigningKeyFile is the private key checkpoints are signed with; a key
+	// is generated in the database directory when empty
+	SigningKeyFile   string
+	PreviousKeyFiles []string // keys older checkpoints were signed with
+}
+
+// Load loads the configuration from environment variables. Every value
+// that cannot be parsed or is out of range is reported in the returned
+// error, rather than silently replaced by its default. Secrets can be read
+// from files named by the same variable with a _FILE suffix, e.g.
+// GIT_PASSWORD_FILE.
 func Load() (*Config, error) {
+	env := &loader{}
+
 	cfg := &Config{
+		File:      env.str("CONFIG_FILE", ""),
+		WatchFile: env.bool("CONFIG_WATCH", true),
 		Server: ServerConfig{
-			Port: getEnvInt("SERVER_PORT", 8080),
-			Host: getEnvStr("SERVER_HOST", "0.0.0.0"),
+			Port: env.int("SERVER_PORT", 8080),
+			Host: env.str("SERVER_HOST", "0.0.0.0"),
 		},
 		Database: DatabaseConfig{
-			Type:     getEnvStr("DB_TYPE", "sqlite"),
-			Host:     getEnvStr("DB_HOST", "localhost"),
-			Port:     getEnvInt("DB_PORT", 5432),
-			User:     getEnvStr("DB_USER", "postgres"),
-			Password: getEnvStr("DB_PASSWORD", "postgres"),
-			Name:     getEnvStr("DB_NAME", "image_updater"),
+			Type:     env.str("DB_TYPE", "sqlite"),
+			Host:     env.str("DB_HOST", "localhost"),
+			Port:     env.int("DB_PORT", 5432),
+			User:     env.str("DB_USER", "postgres"),
+			Password: env.secret("DB_PASSWORD", "postgres"),
+			Name:     env.str("DB_NAME", "image_updater"),
+			Path:     env.str("DB_PATH", "data"),
 		},
 		Docker: DockerConfig{
-			RegistryURL:      getEnvStr("DOCKER_REGISTRY_URL", "docker.io"),
-			PollingInterval:  getEnvInt("DOCKER_POLLING_INTERVAL", 300),
-			CredentialsPath:  getEnvStr("DOCKER_CREDENTIALS_PATH", ""),
-			DefaultNamespace: getEnvStr("DOCKER_DEFAULT_NAMESPACE", "library"),
+			RegistryURL:       env.str("DOCKER_REGISTRY_URL", "docker.io"),
+			PollingInterval:   env.seconds("DOCKER_POLLING_INTERVAL", 300),
+			CredentialsPath:   env.str("DOCKER_CREDENTIALS_PATH", ""),
+			DefaultNamespace:  env.str("DOCKER_DEFAULT_NAMESPACE", "library"),
+			Username:          env.str("DOCKER_USERNAME", ""),
+			Password:          env.secret("DOCKER_PASSWORD", ""),
+			Token:             env.secret("DOCKER_TOKEN", ""),
+			CacheDir:          env.str("DOCKER_CACHE_DIR", ""),
+			CacheSize:         env.int("DOCKER_CACHE_SIZE", 256),
+			DiscoveryInterval: env.seconds("DOCKER_DISCOVERY_INTERVAL", 3600),
+			SignatureKeyFiles: env.list("DOCKER_SIGNATURE_KEYS"),
+
+			VulnerabilityAttestations: env.bool("DOCKER_VULNERABILITY_ATTESTATIONS", false),
 		},
 		Git: GitConfig{
-			DefaultBranch: getEnvStr("GIT_DEFAULT_BRANCH", "main"),
-			CommitMessage: getEnvStr("GIT_COMMIT_MESSAGE", "Update image version to %s"),
-			AuthType:      getEnvStr("GIT_AUTH_TYPE", "https"),
-			Username:      getEnvStr("GIT_USERNAME", ""),
-			Password:      getEnvStr("GIT_PASSWORD", ""),
-			SSHKeyPath:    getEnvStr("GIT_SSH_KEY_PATH", ""),
+			DefaultBranch: env.str("GIT_DEFAULT_BRANCH", "main"),
+			CommitMessage: env.str("GIT_COMMIT_MESSAGE", "Update image version to %s"),
+			AuthType:      env.str("GIT_AUTH_TYPE", "https"),
+			Username:      env.str("GIT_USERNAME", ""),
+			Password:      env.secret("GIT_PASSWORD", ""),
+			SSHKeyPath:    env.str("GIT_SSH_KEY_PATH", ""),
+			CloneDir:      env.str("GIT_CLONE_DIR", ""),
+		},
+		Deployment: DeploymentConfig{
+			ApprovalTimeout:    env.seconds("DEPLOY_APPROVAL_TIMEOUT", 86400),
+			SchedulerInterval:  env.seconds("DEPLOY_SCHEDULER_INTERVAL", 30),
+			DriftCheckInterval: env.seconds("DEPLOY_DRIFT_CHECK_INTERVAL", 300),
+			AdoptDrift:         env.bool("DEPLOY_ADOPT_DRIFT", false),
 		},
+		Webhook: WebhookConfig{
+			Secret:               env.secret("WEBHOOK_SECRET", ""),
+			Mode:                 env.str("WEBHOOK_MODE", "hmac"),
+			TimestampHeader:      env.str("WEBHOOK_TIMESTAMP_HEADER", ""),
+			SignedHeaders:        env.bool("WEBHOOK_SIGNED_HEADERS", false),
+			AllowUnauthenticated: env.bool("WEBHOOK_ALLOW_UNAUTHENTICATED", false),
+			TimestampTolerance:   env.seconds("WEBHOOK_TIMESTAMP_TOLERANCE", 300),
+			ReplayWindow:         env.seconds("WEBHOOK_REPLAY_WINDOW", 86400),
+			Sources:              loadWebhookSources(env),
+			Workers:              env.int("WEBHOOK_WORKERS", 4),
+			MaxAttempts:          env.int("WEBHOOK_MAX_ATTEMPTS", 5),
+			RetryBackoff:         env.seconds("WEBHOOK_RETRY_BACKOFF", 10),
+			DeliveryRetention:    env.seconds("WEBHOOK_DELIVERY_RETENTION", 604800),
+		},
+		Auth: AuthConfig{
+			JWTSecret:         env.secret("JWT_SECRET", ""),
+			SigningKeyFile:    env.str("AUTH_SIGNING_KEY_FILE", ""),
+			PreviousKeyFiles:  env.list("AUTH_PREVIOUS_KEY_FILES"),
+			Issuer:            env.str("AUTH_ISSUER", "image-updater"),
+			Audience:          env.str("AUTH_AUDIENCE", "image-updater"),
+			TokenTTL:          env.seconds("AUTH_TOKEN_TTL", 900),
+			RefreshTokenTTL:   env.seconds("AUTH_REFRESH_TOKEN_TTL", 604800),
+			BootstrapUsername: env.str("AUTH_BOOTSTRAP_USERNAME", "admin"),
+			BootstrapPassword: env.secret("AUTH_BOOTSTRAP_PASSWORD", ""),
+			OIDC: OIDCConfig{
+				Issuer:        env.str("OIDC_ISSUER", ""),
+				ClientID:      env.str("OIDC_CLIENT_ID", ""),
+				ClientSecret:  env.secret("OIDC_CLIENT_SECRET", ""),
+				RedirectURL:   env.str("OIDC_REDIRECT_URL", ""),
+				Scopes:        env.str("OIDC_SCOPES", "openid profile email"),
+				GroupsClaim:   env.str("OIDC_GROUPS_CLAIM", "groups"),
+				GroupMappings: env.str("OIDC_GROUP_MAPPINGS", ""),
+				DefaultRole:   env.str("OIDC_DEFAULT_ROLE", ""),
+			},
+		},
+		Audit: AuditConfig{
+			CheckpointInterval: env.seconds("AUDIT_CHECKPOINT_INTERVAL", 3600),
+			SigningKeyFile:     env.str("AUDIT_SIGNING_KEY_FILE", ""),
+			PreviousKeyFiles:   env.list("AUDIT_PREVIOUS_KEY_FILES"),
+		},
+	}
+
+	cfg.validate(env)
+	if err := errors.Join(env.errs...); err != nil {
+		return nil, fmt.Errorf("invalid configuration:\n%w", err)
 	}
 
 	return cfg, nil
 }
 
-// Helper functions to get environment variables with defaults
-func getEnvStr(key, defaultValue string) string {
+// validate checks the ranges and choices of the loaded values
+func (c *Config) validate(env *loader) {
+	env.check(c.Server.Port > 0 && c.Server.Port <= 65535, "SERVER_PORT must be between 1 and 65535")
+	env.check(c.Database.Port > 0 && c.Database.Port <= 65535, "DB_PORT must be between 1 and 65535")
+	env.check(c.Docker.PollingInterval > 0, "DOCKER_POLLING_INTERVAL must be positive")
+	env.check(c.Docker.CacheSize >= 0, "DOCKER_CACHE_SIZE cannot be negative")
+	env.check(c.Git.AuthType == "https" || c.Git.AuthType == "ssh", "GIT_AUTH_TYPE must be https or ssh")
+	env.check(strings.Contains(c.Git.CommitMessage, "%s"), "GIT_COMMIT_MESSAGE must contain %s for the image tag")
+	env.check(c.Deployment.ApprovalTimeout > 0, "DEPLOY_APPROVAL_TIMEOUT must be positive")
+	env.check(c.Deployment.SchedulerInterval > 0, "DEPLOY_SCHEDULER_INTERVAL must be positive")
+	env.check(c.Webhook.Mode == "hmac" || c.Webhook.Mode == "bearer", "WEBHOOK_MODE must be hmac or bearer")
+	env.check(c.Webhook.TimestampTolerance > 0, "WEBHOOK_TIMESTAMP_TOLERANCE must be positive")
+	sources := make([]string, 0, len(c.Webhook.Sources))
+	for name := range c.Webhook.Sources {
+		sources = append(sources, name)
+	}
+	sort.Strings(sources)
+	for _, name := range sources {
+		mode := c.Webhook.Sources[name].Mode
+		env.check(mode == "" || mode == "hmac" || mode == "bearer", fmt.Sprintf("WEBHOOK_%s_MODE must be hmac or bearer", strings.ToUpper(name)))
+	}
+	env.check(c.Webhook.Workers > 0, "WEBHOOK_WORKERS must be positive")
+	env.check(c.Webhook.MaxAttempts > 0, "WEBHOOK_MAX_ATTEMPTS must be positive")
+	env.check(c.Webhook.DeliveryRetention > 0, "WEBHOOK_DELIVERY_RETENTION must be positive")
+	env.check(c.Auth.TokenTTL > 0, "AUTH_TOKEN_TTL must be positive")
+	env.check(c.Auth.RefreshTokenTTL > 0, "AUTH_REFRESH_TOKEN_TTL must be positive")
+}
+
+// Redacted returns a copy of the configuration with every secret replaced,
+// safe to print
+func (c *Config) Redacted() *Config {
+	redacted := *c
+	redact(&redacted.Database.Password)
+	redact(&redacted.Docker.Password)
+	redact(&redacted.Docker.Token)
+	redact(&redacted.Git.Password)
+	redact(&redacted.Webhook.Secret)
+	redact(&redacted.Auth.JWTSecret)
+	redact(&redacted.Auth.BootstrapPassword)
+	redact(&redacted.Auth.OIDC.ClientSecret)
+
+	redacted.Webhook.Sources = make(map[string]WebhookSourceConfig, len(c.Webhook.Sources))
+	for name, source := range c.Webhook.Sources {
+		redact(&source.Secret)
+		redacted.Webhook.Sources[name] = source
+	}
+
+	return &redacted
+}
+
+// redact replaces a secret that is set
+func redact(secret *string) {
+	if *secret != "" {
+		*secret = "REDACTED"
+	}
+}
+
+// loadWebhookSources reads the per-source webhook settings declared as
+// WEBHOOK_<SOURCE>_SECRET, WEBHOOK_<SOURCE>_MODE and so on
+func loadWebhookSources(env *loader) map[string]WebhookSourceConfig {
+	sources := make(map[string]WebhookSourceConfig)
+
+	for _, variable := range os.Environ() {
+		key, _, _ := strings.Cut(variable, "=")
+		key = strings.TrimSuffix(key, "_FILE")
+		if !strings.HasPrefix(key, "WEBHOOK_") || !strings.HasSuffix(key, "_SECRET") {
+			continue
+		}
+
+		prefix := strings.TrimSuffix(key, "SECRET")
+		name := strings.TrimSuffix(strings.TrimPrefix(prefix, "WEBHOOK_"), "_")
+		if name == "" {
+			continue
+		}
+
+		if _, seen := sources[strings.ToLower(name)]; seen {
+			continue
+		}
+
+		sources[strings.ToLower(name)] = WebhookSourceConfig{
+			Secret:          env.secret(key, ""),
+			Mode:            env.str(prefix+"MODE", ""),
+			SignatureHeader: env.str(prefix+"SIGNATURE_HEADER", ""),
+			TimestampHeader: env.str(prefix+"TIMESTAMP_HEADER", ""),
+			DeliveryHeader:  env.str(prefix+"DELIVERY_HEADER", ""),
+			SignedHeaders:   env.bool(prefix+"SIGNED_HEADERS", false),
+		}
+	}
+
+	return sources
+}
+
+// loader reads environment variables, collecting the values it cannot use
+type loader struct {
+	errs []error
+}
+
+// check records a problem unless ok holds
+func (l *loader) check(ok bool, message string) {
+	if !ok {
+		l.errs = append(l.errs, errors.New(message))
+	}
+}
+
+// str returns a variable or its default
+func (l *loader) str(key, defaultValue string) string {
 	if value, exists := os.LookupEnv(key); exists {
 		return value
 	}
 	return defaultValue
 }
 
-func getEnvInt(key string, defaultValue int) int {
-	if value, exists := os.LookupEnv(key); exists {
-		if intValue, err := strconv.Atoi(value); err == nil {
-			return intValue
+// secret returns a variable, or the content of the file named by
+// <key>_FILE with the trailing newline removed
+func (l *loader) secret(key, defaultValue string) string {
+	file, fromFile := os.LookupEnv(key + "_FILE")
+	if !fromFile {
+		return l.str(key, defaultValue)
+	}
+
+	if _, exists := os.LookupEnv(key); exists {
+		l.errs = append(l.errs, fmt.Errorf("%s and %s_FILE are both set, use only one", key, key))
+		return defaultValue
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		l.errs = append(l.errs, fmt.Errorf("%s_FILE: %w", key, err))
+		return defaultValue
+	}
+
+	return strings.TrimRight(string(data), "\r\n")
+}
+
+// int returns an integer variable or its default
+func (l *loader) int(key string, defaultValue int) int {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return defaultValue
+	}
+
+	intValue, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		l.errs = append(l.errs, fmt.Errorf("%s: %q is not an integer", key, value))
+		return defaultValue
+	}
+	return intValue
+}
+
+// bool returns a boolean variable or its default
+func (l *loader) bool(key string, defaultValue bool) bool {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return defaultValue
+	}
+
+	boolValue, err := strconv.ParseBool(strings.TrimSpace(value))
+	if err != nil {
+		l.errs = append(l.errs, fmt.Errorf("%s: %q is not a boolean", key, value))
+		return defaultValue
+	}
+	return boolValue
+}
+
+// seconds returns a duration variable in seconds. Values are either a
+// number of seconds or a duration such as 5m or 1h30m.
+func (l *loader) seconds(key string, defaultValue int) int {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return defaultValue
+	}
+	value = strings.TrimSpace(value)
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			l.errs = append(l.errs, fmt.Errorf("%s: %q cannot be negative", key, value))
+			return defaultValue
 		}
+		return seconds
+	}
+
+	duration, err := time.ParseDuration(value)
+	switch {
+	case err != nil:
+		l.errs = append(l.errs, fmt.Errorf("%s: %q is neither a number of seconds nor a duration such as 5m", key, value))
+	case duration < 0:
+		l.errs = append(l.errs, fmt.Errorf("%s: %q cannot be negative", key, value))
+	case duration%time.Second != 0:
+		l.errs = append(l.errs, fmt.Errorf("%s: %q must be a whole number of seconds", key, value))
+	default:
+		return int(duration / time.Second)
 	}
 	return defaultValue
 }
+
+// list returns a comma separated variable
+func (l *loader) list(key string) []string {
+	values := make([]string, 0)
+	for _, value := range strings.Split(os.Getenv(key), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
@@ -0,0 +1,202 @@
+package config
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// setenv sets environment variables for the duration of a test
+func setenv(t *testing.T, env map[string]string) {
+	t.Helper()
+
+	for key, value := range env {
+		t.Setenv(key, value)
+	}
+}
+
+// writeSecret writes a secret file and returns its path
+func writeSecret(t *testing.T, content string) string {
+	t.Helper()
+
+	file := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestLoad(t *testing.T) {
+	setenv(t, map[string]string{
+		"SERVER_PORT":                 " 9090 ",
+		"CONFIG_WATCH":                "false",
+		"DOCKER_POLLING_INTERVAL":     "90",
+		"DEPLOY_APPROVAL_TIMEOUT":     "1h30m",
+		"WEBHOOK_TIMESTAMP_TOLERANCE": "5m",
+		"WEBHOOK_MODE":                "bearer",
+		"DOCKER_SIGNATURE_KEYS":       "a.pub, ,b.pub",
+	})
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Server.Port != 9090 || cfg.WatchFile || cfg.Docker.PollingInterval != 90 {
+		t.Fatalf("unexpected values %+v", cfg)
+	}
+	if cfg.Deployment.ApprovalTimeout != 5400 || cfg.Webhook.TimestampTolerance != 300 || cfg.Webhook.Mode != "bearer" {
+		t.Fatalf("unexpected durations %+v %+v", cfg.Deployment, cfg.Webhook)
+	}
+	if len(cfg.Docker.SignatureKeyFiles) != 2 || cfg.Docker.SignatureKeyFiles[1] != "b.pub" {
+		t.Fatalf("unexpected list %v", cfg.Docker.SignatureKeyFiles)
+	}
+	if cfg.Server.Host != "0.0.0.0" || cfg.Git.AuthType != "https" || cfg.Webhook.Workers != 4 {
+		t.Fatalf("defaults not applied %+v", cfg)
+	}
+}
+
+func TestLoadRejectsInvalidValues(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want []string // every problem the error must report
+	}{
+		{name: "not an integer", env: map[string]string{"SERVER_PORT": "http"}, want: []string{`SERVER_PORT: "http" is not an integer`}},
+		{name: "port out of range", env: map[string]string{"SERVER_PORT": "70000"}, want: []string{"SERVER_PORT must be between 1 and 65535"}},
+		{name: "not a boolean", env: map[string]string{"CONFIG_WATCH": "maybe"}, want: []string{`CONFIG_WATCH: "maybe" is not a boolean`}},
+		{name: "negative seconds", env: map[string]string{"DOCKER_POLLING_INTERVAL": "-5"}, want: []string{`DOCKER_POLLING_INTERVAL: "-5" cannot be negative`}},
+		{name: "fraction of a second", env: map[string]string{"DOCKER_POLLING_INTERVAL": "1.5s"}, want: []string{"must be a whole number of seconds"}},
+		{name: "not a duration", env: map[string]string{"DEPLOY_APPROVAL_TIMEOUT": "soon"}, want: []string{"is neither a number of seconds nor a duration"}},
+		{name: "zero approval timeout", env: map[string]string{"DEPLOY_APPROVAL_TIMEOUT": "0"}, want: []string{"DEPLOY_APPROVAL_TIMEOUT must be positive"}},
+		{name: "unknown Git auth type", env: map[string]string{"GIT_AUTH_TYPE": "ftp"}, want: []string{"GIT_AUTH_TYPE must be https or ssh"}},
+		{name: "commit message without tag", env: map[string]string{"GIT_COMMIT_MESSAGE": "Update image"}, want: []string{"GIT_COMMIT_MESSAGE must contain %s"}},
+		{name: "unknown webhook mode", env: map[string]string{"WEBHOOK_MODE": "basic"}, want: []string{"WEBHOOK_MODE must be hmac or bearer"}},
+		{name: "zero timestamp tolerance", env: map[string]string{"WEBHOOK_TIMESTAMP_TOLERANCE": "0"}, want: []string{"WEBHOOK_TIMESTAMP_TOLERANCE must be positive"}},
+		{
+			name: "unknown webhook source mode",
+			env:  map[string]string{"WEBHOOK_HARBOR_SECRET": "s3cret", "WEBHOOK_HARBOR_MODE": "token"},
+			want: []string{"WEBHOOK_HARBOR_MODE must be hmac or bearer"},
+		},
+		{
+			name: "every problem reported",
+			env:  map[string]string{"SERVER_PORT": "0", "WEBHOOK_WORKERS": "none", "AUTH_TOKEN_TTL": "0"},
+			want: []string{"SERVER_PORT must be between", `WEBHOOK_WORKERS: "none" is not an integer`, "AUTH_TOKEN_TTL must be positive"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setenv(t, tt.env)
+
+			_, err := Load()
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Fatalf("error %q does not report %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadSecretFiles(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		check   func(cfg *Config) bool
+		wantErr string
+	}{
+		{
+			name:  "secret from a file",
+			env:   map[string]string{"GIT_PASSWORD_FILE": writeSecret(t, "s3cret\r\n")},
+			check: func(cfg *Config) bool { return cfg.Git.Password == "s3cret" },
+		},
+		{
+			name: "webhook source secret from a file",
+			env:  map[string]string{"WEBHOOK_GITHUB_SECRET_FILE": writeSecret(t, "hook-secret\n"), "WEBHOOK_GITHUB_MODE": "bearer"},
+			check: func(cfg *Config) bool {
+				return cfg.Webhook.Sources["github"].Secret == "hook-secret" && cfg.Webhook.Sources["github"].Mode == "bearer"
+			},
+		},
+		{
+			name:  "secret keeps inner newlines",
+			env:   map[string]string{"JWT_SECRET_FILE": writeSecret(t, "line1\nline2\n")},
+			check: func(cfg *Config) bool { return cfg.Auth.JWTSecret == "line1\nline2" },
+		},
+		{
+			name:    "variable and file both set",
+			env:     map[string]string{"DB_PASSWORD": "inline", "DB_PASSWORD_FILE": writeSecret(t, "from-file")},
+			wantErr: "DB_PASSWORD and DB_PASSWORD_FILE are both set",
+		},
+		{
+			name:    "missing file",
+			env:     map[string]string{"OIDC_CLIENT_SECRET_FILE": filepath.Join(t.TempDir(), "missing")},
+			wantErr: "OIDC_CLIENT_SECRET_FILE",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setenv(t, tt.env)
+
+			cfg, err := Load()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected an error reporting %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.check(cfg) {
+				t.Fatalf("unexpected configuration %+v", cfg)
+			}
+		})
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	// Redacted is what --print-config prints
+	secrets := map[string]string{
+		"DB_PASSWORD":             "db-secret",
+		"DOCKER_PASSWORD":         "docker-secret",
+		"DOCKER_TOKEN":            "docker-token",
+		"GIT_PASSWORD":            "git-secret",
+		"WEBHOOK_SECRET":          "webhook-secret",
+		"WEBHOOK_HARBOR_SECRET":   "harbor-secret",
+		"JWT_SECRET":              "jwt-secret",
+		"AUTH_BOOTSTRAP_PASSWORD": "bootstrap-secret",
+		"OIDC_CLIENT_SECRET":      "oidc-secret",
+	}
+	setenv(t, secrets)
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(cfg.Redacted())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, secret := range secrets {
+		if strings.Contains(string(data), secret) {
+			t.Fatalf("%s printed: %s", key, data)
+		}
+	}
+	if got := strings.Count(string(data), `"REDACTED"`); got != len(secrets) {
+		t.Fatalf("%d secrets redacted, want %d: %s", got, len(secrets), data)
+	}
+	if !strings.Contains(string(data), `"Issuer":"image-updater"`) {
+		t.Fatalf("settings missing from the printed configuration: %s", data)
+	}
+
+	// The configuration itself keeps its secrets
+	if cfg.Git.Password != "git-secret" || cfg.Webhook.Sources["harbor"].Secret != "harbor-secret" {
+		t.Fatalf("Redacted() changed the configuration %+v", cfg)
+	}
+}
@@ -0,0 +1,71 @@
+package config
+
+import (
+	"reflect"
+	"sort"
+)
+
+// ManifestDiff lists the entries a new manifest adds, removes and changes,
+// named like "environments/my-app-staging"
+type ManifestDiff struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+	Changed []string `json:"changed"`
+}
+
+// Empty reports whether the manifests declare the same entries
+func (d ManifestDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// Diff compares the manifest with the next one. A nil manifest declares
+// nothing.
+func (m *Manifest) Diff(next *Manifest) ManifestDiff {
+	if m == nil {
+		m = &Manifest{}
+	}
+	if next == nil {
+		next = &Manifest{}
+	}
+
+	diff := ManifestDiff{Added: []string{}, Removed: []string{}, Changed: []string{}}
+	compare(&diff, "teams", index(m.Teams, func(t TeamSpec) string { return t.Name }), index(next.Teams, func(t TeamSpec) string { return t.Name }))
+	compare(&diff, "repositories", index(m.Repositories, func(r RepositorySpec) string { return r.ID }), index(next.Repositories, func(r RepositorySpec) string { return r.ID }))
+	compare(&diff, "registries", index(m.Registries, func(r RegistrySpec) string { return r.Host }), index(next.Registries, func(r RegistrySpec) string { return r.Host }))
+	compare(&diff, "images", index(m.Images, func(i ImageSpec) string { return i.ID }), index(next.Images, func(i ImageSpec) string { return i.ID }))
+	compare(&diff, "environments", index(m.Environments, func(e EnvironmentSpec) string { return e.ID }), index(next.Environments, func(e EnvironmentSpec) string { return e.ID }))
+
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Strings(diff.Changed)
+
+	return diff
+}
+
+// index maps manifest entries by ID
+func index[T any](entries []T, id func(T) string) map[string]T {
+	m := make(map[string]T, len(entries))
+	for _, entry := range entries {
+		m[id(entry)] = entry
+	}
+	return m
+}
+
+// compare adds the differences between two sets of entries to diff
+func compare[T any](diff *ManifestDiff, kind string, old, next map[string]T) {
+	for id, entry := range next {
+		previous, ok := old[id]
+		switch {
+		case !ok:
+			diff.Added = append(diff.Added, kind+"/"+id)
+		case !reflect.DeepEqual(previous, entry):
+			diff.Changed = append(diff.Changed, kind+"/"+id)
+		}
+	}
+
+	for id := range old {
+		if _, ok := next[id]; !ok {
+			diff.Removed = append(diff.Removed, kind+"/"+id)
+		}
+	}
+}
@@ -0,0 +1,568 @@
+package config
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/jpfaria/image-updater/internal/docker"
+	"github.com/jpfaria/image-updater/internal/model"
+	"gopkg.in/yaml.v3"
+)
+
+// Manifest declares the teams, Git repositories, container registries,
+// images and environments the service manages, so the whole setup can live
+// in Git. It is read from a YAML or JSON file.
+type Manifest struct {
+	Teams        []TeamSpec        `yaml:"teams"`
+	Repositories []RepositorySpec  `yaml:"repositories"`
+	Registries   []RegistrySpec    `yaml:"registries"`
+	Images       []ImageSpec       `yaml:"images"`
+	Environments []EnvironmentSpec `yaml:"environments"`
+
+	// Revision identifies the content the manifest was read from
+	Revision string `yaml:"-"`
+}
+
+// TeamSpec declares a team
+type TeamSpec struct {
+	Name        string          `yaml:"name"`
+	Description string          `yaml:"description"`
+	Discovery   []DiscoverySpec `yaml:"discovery"`
+}
+
+// DiscoverySpec declares which repositories of a registry catalog become
+// candidate images of the team. Patterns are matched against repository
+// paths, e.g. payments/* or payments/** for any depth.
+type DiscoverySpec struct {
+	Registry       string   `yaml:"registry"` // defaults to docker.io
+	Include        []string `yaml:"include"`
+	Exclude        []string `yaml:"exclude"`
+	UpdateStrategy string   `yaml:"update_strategy"` // of the candidate images, semver by default
+	TagPattern     string   `yaml:"tag_pattern"`
+}
+
+// RepositorySpec declares a Git repository holding values files
+type RepositorySpec struct {
+	ID     string `yaml:"id"` // defaults to the name
+	Name   string `yaml:"name"`
+	URL    string `yaml:"url"`
+	Branch string `yaml:"branch"` // defaults to main
+	Team   string `yaml:"team"`
+}
+
+// RegistrySpec declares how to reach a container registry. Secrets are read
+// from files, so the manifest itself can be committed.
+type RegistrySpec struct {
+	Host         string  `yaml:"host"` // as images name it, e.g. ghcr.io
+	URL          string  `yaml:"url"`  // defaults to https://<host>
+	Auth         string  `yaml:"auth"` // none, basic, bearer, keychain, ecr or gcp
+	Username     string  `yaml:"username"`
+	PasswordFile string  `yaml:"password_file"`
+	TokenFile    string  `yaml:"token_file"`
+	TLS          TLSSpec `yaml:"tls"`
+	RateLimit    float64 `yaml:"rate_limit"` // requests per second
+	Burst        int     `yaml:"burst"`
+	Mirror       string  `yaml:"mirror"` // base URL of a pull-through cache
+	ECR          ECRSpec `yaml:"ecr"`
+	GCP          GCPSpec `yaml:"gcp"`
+	PlainHTTP    bool    `yaml:"plain_http"` // allows http URLs, for local registries
+	Proxy        string  `yaml:"proxy"`      // proxy URL or direct; defaults to HTTPS_PROXY
+}
+
+// ECRSpec declares the AWS credentials ECR tokens are minted with. Those
+// left out are read from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN.
+type ECRSpec struct {
+	Region              string `yaml:"region"` // defaults to the region of the host
+	AccessKeyID         string `yaml:"access_key_id"`
+	SecretAccessKeyFile string `yaml:"secret_access_key_file"`
+	SessionTokenFile    string `yaml:"session_token_file"`
+	Endpoint            string `yaml:"endpoint"` // overrides the ECR API URL
+}
+
+// GCPSpec declares the service account Artifact Registry tokens are minted
+// for
+type GCPSpec struct {
+	KeyFile  string `yaml:"key_file"`  // defaults to GOOGLE_APPLICATION_CREDENTIALS
+	TokenURL string `yaml:"token_url"` // overrides the token endpoint
+}
+
+// TLSSpec declares the TLS settings of a registry
+type TLSSpec struct {
+	CAFile             string `yaml:"ca_file"`
+	CertFile           string `yaml:"cert_file"` // client certificate for mutual TLS
+	KeyFile            string `yaml:"key_file"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+// ImageSpec declares a tracked image
+type ImageSpec struct {
+	ID             string `yaml:"id"`       // defaults to the name
+	Registry       string `yaml:"registry"` // defaults to docker.io
+	Namespace      string `yaml:"namespace"`
+	Name           string `yaml:"name"`
+	Team           string `yaml:"team"`
+	UpdateStrategy string `yaml:"update_strategy"` // semver, latest or digest
+	TagPattern     string `yaml:"tag_pattern"`
+}
+
+// EnvironmentSpec declares an environment and where its image is written
+type EnvironmentSpec struct {
+	ID                string `yaml:"id"` // defaults to application-name
+	Name              string `yaml:"name"`
+	Application       string `yaml:"application"`
+	Repository        string `yaml:"repository"` // ID of a declared repository
+	File              string `yaml:"file"`
+	KeyPath           string `yaml:"key_path"`   // defaults to image.tag
+	WriteBack         string `yaml:"write_back"` // commit or branch
+	Image             string `yaml:"image"`      // ID of a declared image
+	RequiredApprovals int    `yaml:"required_approvals"`
+	RequireSignature  bool   `yaml:"require_signature"` // only deploy tags signed with a trusted key
+	// VulnerabilityPolicy blocks tags whose scan reports exceed it
+	VulnerabilityPolicy *VulnerabilityPolicySpec `yaml:"vulnerability_policy"`
+}
+
+// VulnerabilityPolicySpec limits the vulnerabilities of deployed tags, e.g.
+// max: {critical: 0} blocks tags with a critical vulnerability
+type VulnerabilityPolicySpec struct {
+	Max           map[string]int `yaml:"max"` // per severity, counting the more severe ones too
+	RequireReport bool           `yaml:"require_report"`
+	IgnoreUnfixed bool           `yaml:"ignore_unfixed"`
+	Allow         []string       `yaml:"allow"` // accepted vulnerability IDs
+}
+
+// Defaults of manifest entries
+const (
+	defaultRegistry  = "docker.io"
+	defaultNamespace = "library"
+	defaultBranch    = "main"
+	defaultKeyPath   = "image.tag"
+)
+
+// idPattern matches the IDs used in API paths
+var idPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// LoadManifest reads, completes and validates a manifest file. All problems
+// are reported at once, each with the entry it was found in.
+func LoadManifest(file string) (*Manifest, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read configuration file: %w", err)
+	}
+
+	manifest, err := ParseManifest(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration file %s: %w", file, err)
+	}
+
+	return manifest, nil
+}
+
+// ParseManifest decodes a manifest from YAML or JSON, fills in defaults and
+// validates it
+func ParseManifest(data []byte) (*Manifest, error) {
+	manifest := &Manifest{}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(manifest); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, errors.New("the file is empty")
+		}
+		return nil, err
+	}
+
+	manifest.setDefaults()
+	if err := manifest.Validate(); err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(data)
+	manifest.Revision = hex.EncodeToString(sum[:6])
+
+	return manifest, nil
+}
+
+// setDefaults fills in the optional fields
+func (m *Manifest) setDefaults() {
+	for i := range m.Teams {
+		for j := range m.Teams[i].Discovery {
+			rule := &m.Teams[i].Discovery[j]
+			if rule.Registry == "" {
+				rule.Registry = defaultRegistry
+			}
+			if rule.UpdateStrategy == "" {
+				rule.UpdateStrategy = model.UpdateStrategySemver
+			}
+		}
+	}
+
+	for i := range m.Repositories {
+		r := &m.Repositories[i]
+		if r.ID == "" {
+			r.ID = r.Name
+		}
+		if r.Branch == "" {
+			r.Branch = defaultBranch
+		}
+	}
+
+	for i := range m.Registries {
+		r := &m.Registries[i]
+		if r.Auth == "" {
+			_, ecr := docker.ECRRegion(r.Host)
+			switch {
+			case ecr:
+				r.Auth = docker.AuthECR
+			case r.TokenFile != "":
+				r.Auth = docker.AuthBearer
+			case r.Username != "":
+				r.Auth = docker.AuthBasic
+			default:
+				r.Auth = docker.AuthKeychain
+			}
+		}
+	}
+
+	for i := range m.Images {
+		image := &m.Images[i]
+		if image.ID == "" {
+			image.ID = image.Name
+		}
+		if image.Registry == "" {
+			image.Registry = defaultRegistry
+		}
+		if image.Namespace == "" {
+			image.Namespace = defaultNamespace
+		}
+		if image.UpdateStrategy == "" {
+			image.UpdateStrategy = model.UpdateStrategySemver
+		}
+	}
+
+	for i := range m.Environments {
+		env := &m.Environments[i]
+		if env.ID == "" && env.Application != "" && env.Name != "" {
+			env.ID = env.Application + "-" + env.Name
+		}
+		if env.KeyPath == "" {
+			env.KeyPath = defaultKeyPath
+		}
+		if env.WriteBack == "" {
+			env.WriteBack = model.WriteBackCommit
+		}
+	}
+}
+
+// Validate checks the manifest and returns every problem found
+func (m *Manifest) Validate() error {
+	var errs []error
+	fail := func(entry, format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("%s: %s", entry, fmt.Sprintf(format, args...)))
+	}
+
+	teams := make(map[string]bool, len(m.Teams))
+	for i, team := range m.Teams {
+		entry := fmt.Sprintf("teams[%d]", i)
+		switch {
+		case team.Name == "":
+			fail(entry, "name is required")
+		case teams[team.Name]:
+			fail(entry, "team %q is declared twice", team.Name)
+		}
+		teams[team.Name] = true
+
+		for j, rule := range team.Discovery {
+			entry := fmt.Sprintf("teams[%d].discovery[%d]", i, j)
+			if strings.Contains(rule.Registry, "/") {
+				fail(entry, "registry %q must be a host name, e.g. ghcr.io", rule.Registry)
+			}
+			if len(rule.Include) == 0 {
+				fail(entry, "include needs at least one pattern")
+			}
+			for _, pattern := range append(append([]string{}, rule.Include...), rule.Exclude...) {
+				if _, err := docker.MatchRepository(pattern, ""); err != nil {
+					fail(entry, "%v", err)
+				}
+			}
+			checkUpdateStrategy(fail, entry, rule.UpdateStrategy)
+			if _, err := regexp.Compile(rule.TagPattern); err != nil {
+				fail(entry, "tag_pattern is not a valid regular expression: %v", err)
+			}
+		}
+	}
+	checkTeam := func(entry, team string) {
+		if team != "" && !teams[team] {
+			fail(entry, "team %q is not declared", team)
+		}
+	}
+
+	repositories := make(map[string]bool, len(m.Repositories))
+	for i, r := range m.Repositories {
+		entry := label("repositories", i, r.ID)
+		if r.Name == "" {
+			fail(entry, "name is required")
+		}
+		checkID(fail, entry, r.ID, repositories)
+		if err := checkRepositoryURL(r.URL); err != nil {
+			fail(entry, "url %s", err)
+		}
+		checkTeam(entry, r.Team)
+	}
+
+	registries := make(map[string]bool, len(m.Registries))
+	for i, r := range m.Registries {
+		entry := label("registries", i, r.Host)
+		switch {
+		case r.Host == "":
+			fail(entry, "host is required")
+		case strings.ContainsAny(r.Host, "/ "):
+			fail(entry, "host %q must be a host name, e.g. ghcr.io", r.Host)
+		case registries[r.Host]:
+			fail(entry, "host %q is declared twice", r.Host)
+		}
+		registries[r.Host] = true
+
+		if err := checkRegistryURL(r.URL); err != nil {
+			fail(entry, "url %s", err)
+		}
+		if err := checkRegistryURL(r.Mirror); err != nil {
+			fail(entry, "mirror %s", err)
+		}
+		if !r.PlainHTTP {
+			if strings.HasPrefix(r.URL, "http://") {
+				fail(entry, "url %q uses plain HTTP, set plain_http to allow it", r.URL)
+			}
+			if strings.HasPrefix(r.Mirror, "http://") {
+				fail(entry, "mirror %q uses plain HTTP, set plain_http to allow it", r.Mirror)
+			}
+		}
+		if (r.TLS.CertFile == "") != (r.TLS.KeyFile == "") {
+			fail(entry, "tls.cert_file and tls.key_file must be set together")
+		}
+		if r.Proxy != "" && r.Proxy != "direct" {
+			if u, err := url.Parse(r.Proxy); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5") {
+				fail(entry, "proxy %q must be an http, https or socks5 URL, or direct", r.Proxy)
+			}
+		}
+		switch r.Auth {
+		case docker.AuthNone, docker.AuthKeychain:
+		case docker.AuthBasic:
+			if r.Username == "" || r.PasswordFile == "" {
+				fail(entry, "basic auth requires username and password_file")
+			}
+		case docker.AuthBearer:
+			if r.TokenFile == "" {
+				fail(entry, "bearer auth requires token_file")
+			}
+		case docker.AuthECR:
+			if _, ok := docker.ECRRegion(r.Host); !ok && r.ECR.Region == "" {
+				fail(entry, "ecr auth requires ecr.region when the host is not an ECR registry")
+			}
+			if err := checkRegistryURL(r.ECR.Endpoint); err != nil {
+				fail(entry, "ecr.endpoint %s", err)
+			}
+		case docker.AuthGCP:
+			if err := checkRegistryURL(r.GCP.TokenURL); err != nil {
+				fail(entry, "gcp.token_url %s", err)
+			}
+		default:
+			fail(entry, "auth %q must be none, basic, bearer, keychain, ecr or gcp", r.Auth)
+		}
+		if r.RateLimit < 0 {
+			fail(entry, "rate_limit cannot be negative")
+		}
+		if r.Burst < 0 {
+			fail(entry, "burst cannot be negative")
+		}
+	}
+
+	images := make(map[string]bool, len(m.Images))
+	for i, image := range m.Images {
+		entry := label("images", i, image.ID)
+		if image.Name == "" {
+			fail(entry, "name is required")
+		}
+		checkID(fail, entry, image.ID, images)
+		checkUpdateStrategy(fail, entry, image.UpdateStrategy)
+		if _, err := regexp.Compile(image.TagPattern); err != nil {
+			fail(entry, "tag_pattern is not a valid regular expression: %v", err)
+		}
+		checkTeam(entry, image.Team)
+	}
+
+	environments := make(map[string]bool, len(m.Environments))
+	names := make(map[string]bool, len(m.Environments))
+	for i, env := range m.Environments {
+		entry := label("environments", i, env.ID)
+		if env.Name == "" {
+			fail(entry, "name is required")
+		}
+		if env.Application == "" {
+			fail(entry, "application is required")
+		}
+		if env.Name != "" && env.Application != "" {
+			if key := env.Application + "/" + env.Name; names[key] {
+				fail(entry, "environment %s is declared twice", key)
+			} else {
+				names[key] = true
+			}
+		}
+		checkID(fail, entry, env.ID, environments)
+
+		switch {
+		case env.Repository == "":
+			fail(entry, "repository is required")
+		case !repositories[env.Repository]:
+			fail(entry, "repository %q is not declared", env.Repository)
+		}
+		if err := checkFilePath(env.File); err != nil {
+			fail(entry, "file %s", err)
+		}
+		for _, segment := range strings.Split(env.KeyPath, ".") {
+			if segment == "" {
+				fail(entry, "key_path %q has an empty segment", env.KeyPath)
+				break
+			}
+		}
+		switch env.WriteBack {
+		case model.WriteBackCommit, model.WriteBackBranch:
+		default:
+			fail(entry, "write_back %q must be commit or branch", env.WriteBack)
+		}
+		if env.Image != "" && !images[env.Image] {
+			fail(entry, "image %q is not declared", env.Image)
+		}
+		if env.RequiredApprovals < 0 {
+			fail(entry, "required_approvals cannot be negative")
+		}
+		if env.RequireSignature && env.Image == "" {
+			fail(entry, "require_signature needs the image the environment deploys")
+		}
+		if policy := env.VulnerabilityPolicy; policy != nil {
+			if env.Image == "" {
+				fail(entry, "vulnerability_policy needs the image the environment deploys")
+			}
+			severities := make([]string, 0, len(policy.Max))
+			for severity := range policy.Max {
+				severities = append(severities, severity)
+			}
+			sort.Strings(severities)
+			for _, severity := range severities {
+				if !slices.Contains(model.Severities, severity) {
+					fail(entry, "vulnerability_policy severity %q must be one of %s", severity, strings.Join(model.Severities, ", "))
+				}
+				if policy.Max[severity] < 0 {
+					fail(entry, "vulnerability_policy max of %s cannot be negative", severity)
+				}
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// label names a manifest entry in error messages, e.g. environments[1] "my-app-staging"
+func label(kind string, i int, id string) string {
+	if id == "" {
+		return fmt.Sprintf("%s[%d]", kind, i)
+	}
+	return fmt.Sprintf("%s[%d] %q", kind, i, id)
+}
+
+// checkID checks that an ID can be used in API paths and is unique
+func checkID(fail func(entry, format string, args ...interface{}), entry, id string, seen map[string]bool) {
+	switch {
+	case id == "":
+		fail(entry, "id is required")
+	case !idPattern.MatchString(id):
+		fail(entry, "id %q may only contain letters, digits, dots, dashes and underscores", id)
+	case seen[id]:
+		fail(entry, "id %q is declared twice", id)
+	}
+	seen[id] = true
+}
+
+// checkUpdateStrategy checks that an update strategy is known
+func checkUpdateStrategy(fail func(entry, format string, args ...interface{}), entry, strategy string) {
+	switch strategy {
+	case model.UpdateStrategySemver, model.UpdateStrategyLatest, model.UpdateStrategyDigest:
+	default:
+		fail(entry, "update_strategy %q must be semver, latest or digest", strategy)
+	}
+}
+
+// checkRepositoryURL accepts HTTP(S), SSH and scp-like Git URLs
+func checkRepositoryURL(raw string) error {
+	if raw == "" {
+		return errors.New("is required")
+	}
+
+	// scp-like syntax, e.g. git@github.com:org/repo.git
+	if !strings.Contains(raw, "://") {
+		if host, repo, ok := strings.Cut(raw, ":"); ok && host != "" && repo != "" {
+			return nil
+		}
+		return fmt.Errorf("%q is not a Git URL", raw)
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("%q is not a Git URL: %v", raw, err)
+	}
+	switch u.Scheme {
+	case "https", "http", "ssh", "git", "file":
+	default:
+		return fmt.Errorf("%q has unsupported scheme %q", raw, u.Scheme)
+	}
+	if u.Host == "" && u.Scheme != "file" {
+		return fmt.Errorf("%q has no host", raw)
+	}
+
+	return nil
+}
+
+// checkRegistryURL accepts empty or HTTP(S) base URLs
+func checkRegistryURL(raw string) error {
+	if raw == "" {
+		return nil
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("%q is not a URL: %v", raw, err)
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return fmt.Errorf("%q must be an http or https URL", raw)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("%q has no host", raw)
+	}
+
+	return nil
+}
+
+// checkFilePath accepts relative paths that stay inside the repository
+func checkFilePath(file string) error {
+	switch {
+	case file == "":
+		return errors.New("is required")
+	case path.IsAbs(file):
+		return fmt.Errorf("%q must be relative to the repository root", file)
+	case path.Clean(file) != file || strings.HasPrefix(file, "../") || file == "..":
+		return fmt.Errorf("%q must be a clean path inside the repository", file)
+	}
+
+	return nil
+}
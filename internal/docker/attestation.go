@@ -0,0 +1,132 @@
+package docker
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/xgodev/boost/wrapper/log"
+)
+
+// Conventions of cosign attestations stored in registries
+const (
+	// dsseEnvelopeType is the media type of attestation layers, and the
+	// artifact type of attestations attached through the referrers API
+	dsseEnvelopeType = "application/vnd.dsse.envelope.v1+json"
+	// inTotoPayloadType is the payload type of in-toto statements
+	inTotoPayloadType = "application/vnd.in-toto+json"
+)
+
+// Attestation is an in-toto statement about an image digest signed with a
+// trusted key
+type Attestation struct {
+	PredicateType string
+	Predicate     json.RawMessage
+	Key           string // name of the key that verified it
+}
+
+// dsseEnvelope wraps a signed payload
+type dsseEnvelope struct {
+	PayloadType string `json:"payloadType"`
+	Payload     string `json:"payload"`
+	Signatures  []struct {
+		KeyID string `json:"keyid"`
+		Sig   string `json:"sig"`
+	} `json:"signatures"`
+}
+
+// inTotoStatement is the payload of an attestation
+type inTotoStatement struct {
+	PredicateType string `json:"predicateType"`
+	Subject       []struct {
+		Name   string            `json:"name"`
+		Digest map[string]string `json:"digest"`
+	} `json:"subject"`
+	Predicate json.RawMessage `json:"predicate"`
+}
+
+// Attestations reads the attestations of a digest, under the
+// sha256-<digest>.att tag cosign attest writes and through the referrers
+// API. Only attestations signed with one of the keys and made about the
+// digest are returned; others are skipped, as anyone able to push to the
+// repository can attach them.
+func (c *Client) Attestations(ctx context.Context, namespace, repository, digest string, keys []PublicKey) ([]Attestation, error) {
+	log.Infof("Reading attestations of %s/%s@%s", namespace, repository, digest)
+
+	manifests, err := c.attachedManifests(ctx, namespace, repository, digest, ".att", dsseEnvelopeType)
+	if err != nil {
+		return nil, err
+	}
+
+	attestations := make([]Attestation, 0)
+	for _, manifest := range manifests {
+		for _, layer := range manifest.Layers {
+			if layer.MediaType != dsseEnvelopeType {
+				continue
+			}
+			body, err := c.GetBlob(ctx, namespace, repository, layer.Digest)
+			if err != nil {
+				return nil, err
+			}
+
+			attestation, err := openEnvelope(body, digest, keys)
+			if err != nil {
+				log.Warnf("Skipping attestation %s of %s/%s@%s: %v", layer.Digest, namespace, repository, digest, err)
+				continue
+			}
+			attestations = append(attestations, *attestation)
+		}
+	}
+
+	return attestations, nil
+}
+
+// openEnvelope verifies a DSSE envelope and returns the statement it holds
+func openEnvelope(body []byte, digest string, keys []PublicKey) (*Attestation, error) {
+	var envelope dsseEnvelope
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return nil, fmt.Errorf("invalid envelope: %w", err)
+	}
+	if envelope.PayloadType != inTotoPayloadType {
+		return nil, fmt.Errorf("payload of type %q", envelope.PayloadType)
+	}
+	payload, err := base64.StdEncoding.DecodeString(envelope.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("payload is not valid base64: %w", err)
+	}
+
+	// Signatures are made over the pre-authentication encoding of the
+	// payload, which binds its type
+	signed := []byte(fmt.Sprintf("DSSEv1 %d %s %d %s", len(envelope.PayloadType), envelope.PayloadType, len(payload), payload))
+
+	var key PublicKey
+	verified := false
+	for _, signature := range envelope.Signatures {
+		sig, err := base64.StdEncoding.DecodeString(signature.Sig)
+		if err != nil {
+			continue
+		}
+		if key, verified = verifyPayload(keys, signed, sig); verified {
+			break
+		}
+	}
+	if !verified {
+		return nil, fmt.Errorf("none of the %d signatures matches a trusted key", len(envelope.Signatures))
+	}
+
+	var statement inTotoStatement
+	if err := json.Unmarshal(payload, &statement); err != nil {
+		return nil, fmt.Errorf("invalid statement: %w", err)
+	}
+
+	algorithm, hex, _ := strings.Cut(digest, ":")
+	for _, subject := range statement.Subject {
+		if subject.Digest[algorithm] == hex {
+			return &Attestation{PredicateType: statement.PredicateType, Predicate: statement.Predicate, Key: key.Name}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("the statement is not about %s", digest)
+}
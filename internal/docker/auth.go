@@ -0,0 +1,183 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultTokenTTL is assumed for registry tokens issued without expires_in
+const defaultTokenTTL = 60 * time.Second
+
+// challenge is a parsed WWW-Authenticate: Bearer header
+type challenge struct {
+	realm   string
+	service string
+	scope   string
+}
+
+// registryToken is a bearer token issued by a registry's token service
+type registryToken struct {
+	value     string
+	expiresAt time.Time
+}
+
+// tokenCache keeps registry tokens by repository
+type tokenCache struct {
+	mu     sync.Mutex
+	tokens map[string]registryToken
+}
+
+// get returns a token that is still valid
+func (t *tokenCache) get(key string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	token, ok := t.tokens[key]
+	if !ok || time.Now().After(token.expiresAt) {
+		return ""
+	}
+	return token.value
+}
+
+// put stores a token
+func (t *tokenCache) put(key string, token registryToken) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.tokens == nil {
+		t.tokens = make(map[string]registryToken)
+	}
+	t.tokens[key] = token
+}
+
+// tokenKey identifies the repository a registry URL is about, as tokens are
+// scoped to repositories
+func tokenKey(u *url.URL) string {
+	path := u.Path
+	for _, marker := range []string{"/tags/", "/manifests/", "/blobs/", "/referrers/"} {
+		if i := strings.Index(path, marker); i >= 0 {
+			path = path[:i]
+			break
+		}
+	}
+	return u.Host + path
+}
+
+// parseChallenge reads a Bearer challenge, returning false for other schemes
+func parseChallenge(header string) (challenge, bool) {
+	scheme, params, _ := strings.Cut(header, " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return challenge{}, false
+	}
+
+	var result challenge
+	for params != "" {
+		var param string
+		param, params = nextParam(params)
+		key, value, _ := strings.Cut(param, "=")
+		value = strings.Trim(value, `"`)
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "realm":
+			result.realm = value
+		case "service":
+			result.service = value
+		case "scope":
+			result.scope = value
+		}
+	}
+
+	return result, result.realm != ""
+}
+
+// nextParam splits the first auth-param off a list, honouring quoted commas
+func nextParam(params string) (string, string) {
+	quoted := false
+	for i, r := range params {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == ',' && !quoted:
+			return strings.TrimSpace(params[:i]), strings.TrimSpace(params[i+1:])
+		}
+	}
+	return strings.TrimSpace(params), ""
+}
+
+// fetchToken asks the token service named by a challenge for a bearer token.
+// An identity token is exchanged with the OAuth2 refresh token grant;
+// otherwise the user name and password, if any, are sent as basic auth.
+func (c *Client) fetchToken(ctx context.Context, ch challenge, credentials *Credentials) (registryToken, error) {
+	var req *http.Request
+	var err error
+
+	if credentials != nil && credentials.IdentityToken != "" {
+		form := url.Values{
+			"grant_type":    {"refresh_token"},
+			"refresh_token": {credentials.IdentityToken},
+			"service":       {ch.service},
+			"client_id":     {"image-updater"},
+		}
+		if ch.scope != "" {
+			form.Set("scope", ch.scope)
+		}
+		req, err = http.NewRequestWithContext(ctx, "POST", ch.realm, strings.NewReader(form.Encode()))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	} else {
+		query := url.Values{}
+		if ch.service != "" {
+			query.Set("service", ch.service)
+		}
+		if ch.scope != "" {
+			query.Set("scope", ch.scope)
+		}
+		realm := ch.realm
+		if len(query) > 0 {
+			realm += "?" + query.Encode()
+		}
+		req, err = http.NewRequestWithContext(ctx, "GET", realm, nil)
+		if err == nil && credentials != nil && credentials.Username != "" {
+			req.SetBasicAuth(credentials.Username, credentials.Password)
+		}
+	}
+	if err != nil {
+		return registryToken{}, fmt.Errorf("failed to create token request: %w", err)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return registryToken{}, fmt.Errorf("failed to request registry token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return registryToken{}, fmt.Errorf("failed to get registry token: %w", statusError(resp))
+	}
+
+	var result struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return registryToken{}, fmt.Errorf("failed to decode registry token: %w", err)
+	}
+
+	token := registryToken{value: result.Token, expiresAt: time.Now().Add(defaultTokenTTL)}
+	if token.value == "" {
+		token.value = result.AccessToken
+	}
+	if result.ExpiresIn > 0 {
+		// Renew a little early so a token does not expire in flight
+		token.expiresAt = time.Now().Add(time.Duration(result.ExpiresIn)*time.Second - 5*time.Second)
+	}
+
+	return token, nil
+}
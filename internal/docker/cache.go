@@ -0,0 +1,293 @@
+package docker
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xgodev/boost/wrapper/log"
+)
+
+// maxCachedBody is the largest response body kept in the cache
+const maxCachedBody = 4 << 20
+
+// cachedHeaders are the response headers kept with a cached body
+var cachedHeaders = []string{"Content-Type", "Docker-Content-Digest", "ETag", "Link"}
+
+// Cache keeps registry responses so they are not downloaded again: responses
+// with an ETag are revalidated with If-None-Match, and manifests and blobs
+// addressed by digest, which never change, are served without asking the
+// registry. Entries are written to a directory, so a restart does not start
+// cold, and the least recently used are evicted beyond a size. An empty
+// directory keeps entries in memory only.
+type Cache struct {
+	dir      string
+	maxBytes int64
+
+	mu      sync.Mutex
+	entries map[string]*cacheIndex // by file name
+	size    int64
+}
+
+// cacheIndex is what is known of an entry without reading it
+type cacheIndex struct {
+	size     int64
+	lastUsed time.Time
+	entry    *cacheEntry // kept in memory when there is no directory
+}
+
+// cacheEntry is a stored response
+type cacheEntry struct {
+	Key       string      `json:"key"`
+	Status    int         `json:"status"`
+	Header    http.Header `json:"header"`
+	Body      []byte      `json:"body"`
+	Immutable bool        `json:"immutable"`
+	StoredAt  time.Time   `json:"stored_at"`
+}
+
+// NewCache opens the cache stored in dir, holding at most maxBytes
+func NewCache(dir string, maxBytes int64) (*Cache, error) {
+	c := &Cache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		entries:  make(map[string]*cacheIndex),
+	}
+	if dir == "" {
+		return c, nil
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create registry cache: %w", err)
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read registry cache: %w", err)
+	}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		c.entries[file.Name()] = &cacheIndex{size: info.Size(), lastUsed: info.ModTime()}
+		c.size += info.Size()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.evict()
+
+	log.Infof("Opened registry cache %s with %d entries (%d bytes)", dir, len(c.entries), c.size)
+	return c, nil
+}
+
+// cacheKey identifies a response by method, URL and Accept header, as
+// registries answer with a different manifest per accepted media type
+func cacheKey(req *http.Request) string {
+	return req.Method + " " + req.URL.String() + " " + req.Header.Get("Accept")
+}
+
+// cacheable reports whether a request may be answered from the cache
+func cacheable(req *http.Request) bool {
+	return req.Method == http.MethodGet || req.Method == http.MethodHead
+}
+
+// immutable reports whether a URL addresses content by digest
+func immutable(req *http.Request) bool {
+	return strings.Contains(req.URL.Path, "/manifests/sha256:") || strings.Contains(req.URL.Path, "/blobs/sha256:")
+}
+
+// get returns the entry stored under key
+func (c *Cache) get(key string) *cacheEntry {
+	name := fileName(key)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	index, ok := c.entries[name]
+	if !ok {
+		return nil
+	}
+	index.lastUsed = time.Now()
+	if c.dir == "" {
+		return index.entry
+	}
+
+	path := filepath.Join(c.dir, name)
+	data, err := os.ReadFile(path)
+	if err == nil {
+		var entry cacheEntry
+		if err = json.Unmarshal(data, &entry); err == nil && entry.Key == key {
+			os.Chtimes(path, index.lastUsed, index.lastUsed)
+			return &entry
+		}
+	}
+
+	// An unreadable entry is dropped
+	c.remove(name)
+	return nil
+}
+
+// put stores an entry
+func (c *Cache) put(entry *cacheEntry) {
+	name := fileName(entry.Key)
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	size := int64(len(data))
+	if size > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.dir != "" {
+		path := filepath.Join(c.dir, name)
+		temp := path + ".tmp"
+		if err := os.WriteFile(temp, data, 0600); err != nil {
+			log.Warnf("Failed to write registry cache entry: %v", err)
+			return
+		}
+		if err := os.Rename(temp, path); err != nil {
+			log.Warnf("Failed to write registry cache entry: %v", err)
+			os.Remove(temp)
+			return
+		}
+	}
+
+	if previous, ok := c.entries[name]; ok {
+		c.size -= previous.size
+	}
+	index := &cacheIndex{size: size, lastUsed: time.Now()}
+	if c.dir == "" {
+		index.entry = entry
+	}
+	c.entries[name] = index
+	c.size += size
+
+	c.evict()
+}
+
+// evict removes the least recently used entries beyond the size; callers
+// must hold c.mu
+func (c *Cache) evict() {
+	if c.size <= c.maxBytes {
+		return
+	}
+
+	names := make([]string, 0, len(c.entries))
+	for name := range c.entries {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return c.entries[names[i]].lastUsed.Before(c.entries[names[j]].lastUsed)
+	})
+
+	for _, name := range names {
+		if c.size <= c.maxBytes {
+			return
+		}
+		c.remove(name)
+	}
+}
+
+// remove drops an entry; callers must hold c.mu
+func (c *Cache) remove(name string) {
+	if index, ok := c.entries[name]; ok {
+		c.size -= index.size
+		delete(c.entries, name)
+	}
+	if c.dir != "" {
+		if err := os.Remove(filepath.Join(c.dir, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Warnf("Failed to remove registry cache entry: %v", err)
+		}
+	}
+}
+
+// fileName is the name an entry is stored under
+func fileName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:]) + ".json"
+}
+
+// etag returns the ETag of an entry, which may be nil
+func (e *cacheEntry) etag() string {
+	if e == nil {
+		return ""
+	}
+	return e.Header.Get("ETag")
+}
+
+// response rebuilds the response of an entry
+func (e *cacheEntry) response(req *http.Request) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.Status, http.StatusText(e.Status)),
+		StatusCode:    e.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        e.Header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(e.Body)),
+		ContentLength: int64(len(e.Body)),
+		Request:       req,
+	}
+}
+
+// store keeps a successful response that can be reused, returning it with
+// its body still readable
+func (c *Cache) store(key string, req *http.Request, resp *http.Response) *http.Response {
+	if resp.StatusCode != http.StatusOK || (resp.Header.Get("ETag") == "" && !immutable(req)) {
+		return resp
+	}
+	if resp.ContentLength > maxCachedBody {
+		return resp
+	}
+
+	original := resp.Body
+	body, err := io.ReadAll(io.LimitReader(original, maxCachedBody+1))
+	if err != nil || len(body) > maxCachedBody {
+		// Not kept: hand back what was read followed by the rest
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), original), original}
+		return resp
+	}
+	original.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	header := make(http.Header)
+	for _, name := range cachedHeaders {
+		if value := resp.Header.Get(name); value != "" {
+			header.Set(name, value)
+		}
+	}
+
+	c.put(&cacheEntry{
+		Key:       key,
+		Status:    resp.StatusCode,
+		Header:    header,
+		Body:      body,
+		Immutable: immutable(req),
+		StoredAt:  time.Now(),
+	})
+
+	return resp
+}
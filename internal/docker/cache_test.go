@@ -0,0 +1,214 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testRegistry serves tag lists with an ETag and manifests by digest, and
+// counts the requests it gets
+type testRegistry struct {
+	mu       sync.Mutex
+	tags     []string
+	etag     string
+	status   int // answered instead when set
+	requests int
+	// conditional counts the requests revalidating a cached response
+	conditional int
+}
+
+func (r *testRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.requests++
+	if r.status != 0 {
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(r.status)
+		return
+	}
+
+	switch {
+	case strings.HasSuffix(req.URL.Path, "/tags/list"):
+		if match := req.Header.Get("If-None-Match"); match != "" {
+			r.conditional++
+			if match == r.etag {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+		w.Header().Set("ETag", r.etag)
+		fmt.Fprintf(w, `{"name":"team/app","tags":["%s"]}`, strings.Join(r.tags, `","`))
+	case strings.Contains(req.URL.Path, "/manifests/"):
+		reference := req.URL.Path[strings.LastIndex(req.URL.Path, "/")+1:]
+		digest := reference
+		if !strings.HasPrefix(reference, "sha256:") {
+			digest = "sha256:" + strings.Repeat("1", 64)
+		}
+		w.Header().Set("Docker-Content-Digest", digest)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// set changes what the registry answers
+func (r *testRegistry) set(fn func(r *testRegistry)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fn(r)
+}
+
+// counts returns the number of requests and conditional requests
+func (r *testRegistry) counts() (int, int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.requests, r.conditional
+}
+
+// newCachedClient starts a registry and returns a client caching in dir
+func newCachedClient(t *testing.T, registry *testRegistry, dir string) *Client {
+	t.Helper()
+
+	server := httptest.NewServer(registry)
+	t.Cleanup(server.Close)
+
+	cache, err := NewCache(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := NewClient(server.URL, nil)
+	client.cache = cache
+	return client
+}
+
+// tagNames lists the tags of team/app
+func tagNames(t *testing.T, client *Client) ([]string, error) {
+	t.Helper()
+
+	tags, err := client.ListTags(context.Background(), "team", "app")
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		names = append(names, tag.Name)
+	}
+	return names, nil
+}
+
+func TestCacheRevalidatesWithETag(t *testing.T) {
+	registry := &testRegistry{tags: []string{"1.0"}, etag: `"v1"`}
+	client := newCachedClient(t, registry, "")
+
+	for i := 0; i < 2; i++ {
+		names, err := tagNames(t, client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(names, ",") != "1.0" {
+			t.Fatalf("tags = %v", names)
+		}
+	}
+	if requests, conditional := registry.counts(); requests != 2 || conditional != 1 {
+		t.Fatalf("%d requests, %d conditional, want 2 and 1", requests, conditional)
+	}
+
+	// A changed list has a new ETag and replaces the cached one
+	registry.set(func(r *testRegistry) {
+		r.tags = []string{"1.0", "1.1"}
+		r.etag = `"v2"`
+	})
+	names, err := tagNames(t, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(names, ",") != "1.0,1.1" {
+		t.Fatalf("tags = %v after a change", names)
+	}
+}
+
+func TestCacheServesDigestsWithoutAsking(t *testing.T) {
+	ctx := context.Background()
+	digest := "sha256:" + strings.Repeat("a", 64)
+	registry := &testRegistry{}
+	dir := t.TempDir()
+	client := newCachedClient(t, registry, dir)
+
+	for i := 0; i < 2; i++ {
+		got, err := client.GetImageDigest(ctx, "team", "app", digest)
+		if err != nil || got != digest {
+			t.Fatalf("GetImageDigest() = %q, %v", got, err)
+		}
+	}
+	if requests, _ := registry.counts(); requests != 1 {
+		t.Fatalf("%d requests for a manifest by digest, want 1", requests)
+	}
+
+	// Tags can move: without an ETag they are not cached
+	for i := 0; i < 2; i++ {
+		if _, err := client.GetImageDigest(ctx, "team", "app", "latest"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if requests, _ := registry.counts(); requests != 3 {
+		t.Fatalf("%d requests, want a request for each tag lookup", requests)
+	}
+
+	// Entries outlive the process
+	cache, err := NewCache(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened := NewClient(client.baseURL, nil)
+	reopened.cache = cache
+	if got, err := reopened.GetImageDigest(ctx, "team", "app", digest); err != nil || got != digest {
+		t.Fatalf("GetImageDigest() = %q, %v after a restart", got, err)
+	}
+	if requests, _ := registry.counts(); requests != 3 {
+		t.Fatalf("%d requests, the stored entry was not used after a restart", requests)
+	}
+}
+
+func TestCacheServesStaleEntries(t *testing.T) {
+	tests := []struct {
+		status    int
+		wantStale bool
+		wantErr   error // without a cached entry
+	}{
+		{status: http.StatusServiceUnavailable, wantStale: true, wantErr: ErrUnavailable},
+		{status: http.StatusTooManyRequests, wantStale: true, wantErr: ErrRateLimited},
+		{status: http.StatusNotFound, wantErr: ErrNotFound},
+		{status: http.StatusUnauthorized, wantErr: ErrUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			registry := &testRegistry{tags: []string{"1.0"}, etag: `"v1"`}
+			client := newCachedClient(t, registry, "")
+			if _, err := tagNames(t, client); err != nil {
+				t.Fatal(err)
+			}
+
+			registry.set(func(r *testRegistry) { r.status = tt.status })
+			names, err := tagNames(t, client)
+			if tt.wantStale {
+				if err != nil || strings.Join(names, ",") != "1.0" {
+					t.Fatalf("stale entry not served: %v, %v", names, err)
+				}
+			} else if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+
+			// Without a cached entry the failure is reported
+			_, err = client.ListTags(context.Background(), "team", "other")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v without a cached entry, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/xgodev/boost/wrapper/log"
+)
+
+// catalogPageSize is the number of repositories asked for per catalog page
+const catalogPageSize = 1000
+
+// Catalog lists the repositories of the registry, following the pages of
+// the /v2/_catalog endpoint. Registries that do not offer the catalog, such
+// as Docker Hub, answer with ErrNotFound or ErrUnauthorized.
+func (c *Client) Catalog(ctx context.Context) ([]string, error) {
+	log.Infof("Listing the repositories of %s", c.baseURL)
+
+	next := fmt.Sprintf("%s/v2/_catalog?n=%d", c.baseURL, catalogPageSize)
+	repositories := make([]string, 0)
+	for next != "" {
+		req, err := http.NewRequestWithContext(ctx, "GET", next, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %w", err)
+		}
+
+		resp, err := c.do(ctx, req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to execute request: %w", err)
+		}
+
+		var page struct {
+			Repositories []string `json:"repositories"`
+		}
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("failed to list repositories: %w", statusError(resp))
+		} else if decodeErr := json.NewDecoder(resp.Body).Decode(&page); decodeErr != nil {
+			err = fmt.Errorf("failed to decode response: %w", decodeErr)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		repositories = append(repositories, page.Repositories...)
+		next = nextPage(req.URL, resp.Header.Get("Link"))
+	}
+
+	return repositories, nil
+}
+
+// nextPage returns the URL of the next page named by a Link header, e.g.
+// </v2/_catalog?last=b&n=100>; rel="next", or "" on the last page
+func nextPage(current *url.URL, header string) string {
+	for _, link := range strings.Split(header, ",") {
+		target, params, ok := strings.Cut(strings.TrimSpace(link), ";")
+		if !ok || !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+			continue
+		}
+		if !strings.Contains(strings.ReplaceAll(params, " ", ""), `rel="next"`) {
+			continue
+		}
+
+		next, err := current.Parse(strings.Trim(target, "<>"))
+		if err != nil || next.String() == current.String() {
+			return ""
+		}
+		return next.String()
+	}
+
+	return ""
+}
+
+// MatchRepository reports whether a repository path matches a pattern.
+// Each segment of the pattern is matched like path.Match, and a last
+// segment of ** matches one or more segments, so payments/** matches
+// payments/api and payments/jobs/billing.
+func MatchRepository(pattern, repository string) (bool, error) {
+	patterns := strings.Split(pattern, "/")
+	for i, p := range patterns {
+		if p == "**" && i != len(patterns)-1 {
+			return false, fmt.Errorf("pattern %q: ** must be the last segment", pattern)
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return false, fmt.Errorf("pattern %q: %w", pattern, err)
+		}
+	}
+
+	segments := strings.Split(repository, "/")
+	for i, p := range patterns {
+		if p == "**" {
+			return len(segments) > i, nil
+		}
+		if i >= len(segments) {
+			return false, nil
+		}
+		if matched, _ := path.Match(p, segments[i]); !matched {
+			return false, nil
+		}
+	}
+
+	return len(segments) == len(patterns), nil
+}
+
+// SplitRepository splits a repository path into the namespace and name of
+// a model.Image; the name is the last segment
+func SplitRepository(repository string) (namespace, name string) {
+	if i := strings.LastIndex(repository, "/"); i >= 0 {
+		return repository[:i], repository[i+1:]
+	}
+	return "", repository
+}
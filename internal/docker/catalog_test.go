@@ -0,0 +1,161 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// catalogRegistry serves a catalog in pages of pageSize repositories,
+// linking each page to the next one
+type catalogRegistry struct {
+	repositories []string
+	pageSize     int
+	status       int // answered instead when set
+	pages        int
+}
+
+func (r *catalogRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/v2/_catalog" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if r.status != 0 {
+		w.WriteHeader(r.status)
+		return
+	}
+	r.pages++
+
+	start := 0
+	if last := req.URL.Query().Get("last"); last != "" {
+		for start < len(r.repositories) && r.repositories[start] <= last {
+			start++
+		}
+	}
+	end := min(start+r.pageSize, len(r.repositories))
+	if end < len(r.repositories) {
+		next := url.Values{"last": {r.repositories[end-1]}, "n": {strconv.Itoa(r.pageSize)}}
+		w.Header().Set("Link", `</v2/_catalog?`+next.Encode()+`>; rel="next"`)
+	}
+	json.NewEncoder(w).Encode(map[string][]string{"repositories": r.repositories[start:end]})
+}
+
+func TestCatalog(t *testing.T) {
+	repositories := []string{"payments/api", "payments/jobs/billing", "shop/checkout", "shop/web", "tools/ci"}
+
+	tests := []struct {
+		name      string
+		registry  *catalogRegistry
+		want      []string
+		wantPages int
+		wantErr   error
+	}{
+		{name: "one page", registry: &catalogRegistry{repositories: repositories, pageSize: 10}, want: repositories, wantPages: 1},
+		{name: "pages", registry: &catalogRegistry{repositories: repositories, pageSize: 2}, want: repositories, wantPages: 3},
+		{name: "empty", registry: &catalogRegistry{pageSize: 2}, want: []string{}, wantPages: 1},
+		{name: "catalog not offered", registry: &catalogRegistry{status: http.StatusNotFound}, wantErr: ErrNotFound},
+		{name: "catalog refused", registry: &catalogRegistry{status: http.StatusUnauthorized}, wantErr: ErrUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(tt.registry)
+			defer server.Close()
+
+			got, err := NewClient(server.URL, nil).Catalog(context.Background())
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") || (tt.want != nil && got == nil) {
+				t.Fatalf("Catalog() = %v, want %v", got, tt.want)
+			}
+			if tt.registry.pages != tt.wantPages {
+				t.Fatalf("%d pages asked for, want %d", tt.registry.pages, tt.wantPages)
+			}
+		})
+	}
+}
+
+func TestNextPage(t *testing.T) {
+	current, err := url.Parse("https://registry.example.com/v2/_catalog?n=100")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{name: "relative", header: `</v2/_catalog?last=b&n=100>; rel="next"`, want: "https://registry.example.com/v2/_catalog?last=b&n=100"},
+		{name: "absolute", header: `<https://cdn.example.com/v2/_catalog?last=b>; rel="next"`, want: "https://cdn.example.com/v2/_catalog?last=b"},
+		{name: "among other links", header: `</v2/_catalog?n=100>; rel="first", </v2/_catalog?last=c&n=100>; rel = "next"`, want: "https://registry.example.com/v2/_catalog?last=c&n=100"},
+		{name: "last page"},
+		{name: "no next link", header: `</v2/_catalog?n=100>; rel="first"`},
+		{name: "not a link", header: `/v2/_catalog?last=b; rel="next"`},
+		{name: "same page", header: `</v2/_catalog?n=100>; rel="next"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nextPage(current, tt.header); got != tt.want {
+				t.Fatalf("nextPage() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchRepository(t *testing.T) {
+	tests := []struct {
+		pattern    string
+		repository string
+		want       bool
+		wantErr    bool
+	}{
+		{pattern: "payments/api", repository: "payments/api", want: true},
+		{pattern: "payments/*", repository: "payments/api", want: true},
+		{pattern: "payments/*", repository: "payments/jobs/billing"},
+		{pattern: "payments/**", repository: "payments/jobs/billing", want: true},
+		{pattern: "payments/**", repository: "payments"},
+		{pattern: "pay*/api-?", repository: "payments/api-1", want: true},
+		{pattern: "*", repository: "payments/api"},
+		{pattern: "shop/web", repository: "shop"},
+		{pattern: "**/api", repository: "payments/api", wantErr: true},
+		{pattern: "payments/[", repository: "payments/api", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.repository, func(t *testing.T) {
+			got, err := MatchRepository(tt.pattern, tt.repository)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("MatchRepository() error = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("MatchRepository() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitRepository(t *testing.T) {
+	tests := []struct {
+		repository    string
+		wantNamespace string
+		wantName      string
+	}{
+		{repository: "payments/api", wantNamespace: "payments", wantName: "api"},
+		{repository: "payments/jobs/billing", wantNamespace: "payments/jobs", wantName: "billing"},
+		{repository: "nginx", wantName: "nginx"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.repository, func(t *testing.T) {
+			namespace, name := SplitRepository(tt.repository)
+			if namespace != tt.wantNamespace || name != tt.wantName {
+				t.Fatalf("SplitRepository() = %q, %q, want %q, %q", namespace, name, tt.wantNamespace, tt.wantName)
+			}
+		})
+	}
+}
@@ -3,9 +3,10 @@ package docker
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/jpfaria/image-updater/internal/model"
@@ -16,7 +17,17 @@ import (
 type Client struct {
 	baseURL     string
 	credentials *Credentials
+	provider    CredentialProvider
 	httpClient  *http.Client
+	tokens      tokenCache
+	limiter     *rateLimiter
+	quota       quota
+	breaker     breaker
+	mirror      string
+	cache       *Cache
+	// now and wait tell the time and pause between attempts
+	now  func() time.Time
+	wait func(ctx context.Context, d time.Duration) error
 }
 
 // Credentials represents Docker registry credentials
@@ -24,6 +35,9 @@ type Credentials struct {
 	Username string
 	Password string
 	Token    string
+	// IdentityToken is an OAuth2 refresh token, exchanged with the
+	// registry's token service for access tokens
+	IdentityToken string
 }
 
 // NewClient creates a new Docker registry client
@@ -34,15 +48,32 @@ func NewClient(baseURL string, credentials *Credentials) *Client {
 		httpClient: &http.Client{
 			Timeout: 30 * time.Second,
 		},
+		now:  time.Now,
+		wait: sleep,
 	}
 }
 
+// NewKeychainClient creates a Docker registry client that looks up its
+// credentials in a keychain on every request, so rotated credentials are
+// picked up
+func NewKeychainClient(baseURL string, keychain *Keychain) *Client {
+	return NewProviderClient(baseURL, keychain)
+}
+
+// NewProviderClient creates a Docker registry client that asks a provider
+// for its credentials on every request
+func NewProviderClient(baseURL string, provider CredentialProvider) *Client {
+	client := NewClient(baseURL, nil)
+	client.provider = provider
+	return client
+}
+
 // ListTags lists all tags for a Docker image
 func (c *Client) ListTags(ctx context.Context, namespace, repository string) ([]model.Tag, error) {
 	log.Infof("Listing tags for %s/%s", namespace, repository)
 
 	// Construct URL for Docker Registry API v2
-	url := fmt.Sprintf("%s/v2/%s/%s/tags/list", c.baseURL, namespace, repository)
+	url := fmt.Sprintf("%s/v2/%s/tags/list", c.baseURL, repositoryPath(namespace, repository))
 
 	// Create request
 	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
@@ -50,17 +81,8 @@ func (c *Client) ListTags(ctx context.Context, namespace, repository string) ([]
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
-	// Add authentication if provided
-	if c.credentials != nil {
-		if c.credentials.Token != "" {
-			req.Header.Set("Authorization", "Bearer "+c.credentials.Token)
-		} else if c.credentials.Username != "" && c.credentials.Password != "" {
-			req.SetBasicAuth(c.credentials.Username, c.credentials.Password)
-		}
-	}
-
 	// Execute request
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(ctx, req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to execute request: %w", err)
 	}
@@ -68,8 +90,7 @@ func (c *Client) ListTags(ctx context.Context, namespace, repository string) ([]
 
 	// Check response status
 	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("failed to list tags: %s - %s", resp.Status, string(body))
+		return nil, fmt.Errorf("failed to list tags: %w", statusError(resp))
 	}
 
 	// Parse response
@@ -98,12 +119,21 @@ func (c *Client) ListTags(ctx context.Context, namespace, repository string) ([]
 	return tags, nil
 }
 
+// repositoryPath joins the namespace and name of a repository; repositories
+// of private registries may have no namespace
+func repositoryPath(namespace, repository string) string {
+	if namespace == "" {
+		return repository
+	}
+	return namespace + "/" + repository
+}
+
 // GetImageDigest gets the digest for a specific image tag
 func (c *Client) GetImageDigest(ctx context.Context, namespace, repository, tag string) (string, error) {
 	log.Infof("Getting digest for %s/%s:%s", namespace, repository, tag)
 
 	// Construct URL for Docker Registry API v2
-	url := fmt.Sprintf("%s/v2/%s/%s/manifests/%s", c.baseURL, namespace, repository, tag)
+	url := fmt.Sprintf("%s/v2/%s/manifests/%s", c.baseURL, repositoryPath(namespace, repository), tag)
 
 	// Create request
 	req, err := http.NewRequestWithContext(ctx, "HEAD", url, nil)
@@ -111,20 +141,12 @@ func (c *Client) GetImageDigest(ctx context.Context, namespace, repository, tag
 		return "", fmt.Errorf("failed to create request: %w", err)
 	}
 
-	// Add accept header for manifest v2
-	req.Header.Set("Accept", "application/vnd.docker.distribution.manifest.v2+json")
-
-	// Add authentication if provided
-	if c.credentials != nil {
-		if c.credentials.Token != "" {
-			req.Header.Set("Authorization", "Bearer "+c.credentials.Token)
-		} else if c.credentials.Username != "" && c.credentials.Password != "" {
-			req.SetBasicAuth(c.credentials.Username, c.credentials.Password)
-		}
-	}
+	// Accept every manifest type, so multi-platform images get the digest
+	// of their index, which is the one pulled and signed
+	req.Header.Set("Accept", manifestAccept)
 
 	// Execute request
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(ctx, req)
 	if err != nil {
 		return "", fmt.Errorf("failed to execute request: %w", err)
 	}
@@ -132,8 +154,7 @@ func (c *Client) GetImageDigest(ctx context.Context, namespace, repository, tag
 
 	// Check response status
 	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("failed to get digest: %s - %s", resp.Status, string(body))
+		return "", fmt.Errorf("failed to get digest: %w", statusError(resp))
 	}
 
 	// Get digest from header
@@ -144,3 +165,187 @@ func (c *Client) GetImageDigest(ctx context.Context, namespace, repository, tag
 
 	return digest, nil
 }
+
+// do executes a request, answering it from the cache when possible. A
+// cached response is revalidated with its ETag, unless it is addressed by
+// digest and cannot change. When the registry is unavailable or rate
+// limited, a cached response is returned rather than an error.
+func (c *Client) do(ctx context.Context, req *http.Request) (*http.Response, error) {
+	if c.cache == nil || !cacheable(req) {
+		return c.fetch(ctx, req)
+	}
+
+	key := cacheKey(req)
+	entry := c.cache.get(key)
+	if entry != nil && entry.Immutable {
+		return entry.response(req), nil
+	}
+	if etag := entry.etag(); etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	resp, err := c.fetch(ctx, req)
+	if entry != nil && stale(resp, err) {
+		if err == nil {
+			resp.Body.Close()
+		}
+		log.Warnf("Registry unavailable or rate limited, serving %s from the cache stored at %s", req.URL.Path, entry.StoredAt.Format(time.RFC3339))
+		return entry.response(req), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotModified && entry != nil {
+		resp.Body.Close()
+		return entry.response(req), nil
+	}
+
+	return c.cache.store(key, req, resp), nil
+}
+
+// stale reports whether a cached response should be served instead of the
+// outcome of a request: the registry could not be reached, answered with a
+// server error or refused the request for its rate limit
+func stale(resp *http.Response, err error) bool {
+	if err != nil {
+		return errors.Is(err, ErrUnavailable) || errors.Is(err, ErrRateLimited)
+	}
+	return resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests
+}
+
+// fetch executes a request, authenticating it. Requests failing with a
+// transient error are retried with backoff, and none is sent while the
+// registry's circuit breaker is open. Transport failures are returned as a
+// RegistryError.
+func (c *Client) fetch(ctx context.Context, req *http.Request) (*http.Response, error) {
+	if err := c.breaker.allow(c.now()); err != nil {
+		return nil, err
+	}
+
+	for attempt := 0; ; attempt++ {
+		if err := c.throttle(ctx); err != nil {
+			c.breaker.abort()
+			return nil, err
+		}
+
+		resp, err := c.attempt(ctx, req)
+		wait, retry := backoff(attempt, resp, err)
+		if !retry {
+			c.breaker.record(failed(resp, err), c.now())
+			var registryErr *RegistryError
+			if err != nil && !cancelled(err) && !errors.As(err, &registryErr) {
+				err = &RegistryError{Kind: ErrUnavailable, URL: req.URL.Redacted(), Err: err}
+			}
+			return resp, err
+		}
+
+		if err == nil {
+			log.Warnf("Registry answered %s for %s, retrying in %s", resp.Status, req.URL.Path, wait)
+			resp.Body.Close()
+		} else {
+			log.Warnf("Registry request %s failed, retrying in %s: %v", req.URL.Path, wait, err)
+		}
+		if err := c.wait(ctx, wait); err != nil {
+			c.breaker.abort()
+			return nil, err
+		}
+	}
+}
+
+// throttle waits for the client's rate limit and the registry's quota
+func (c *Client) throttle(ctx context.Context) error {
+	if c.limiter != nil {
+		if err := c.limiter.wait(ctx); err != nil {
+			return err
+		}
+	}
+	delay, err := c.quota.delay(c.now())
+	if err != nil || delay <= 0 {
+		return err
+	}
+	return c.wait(ctx, delay)
+}
+
+// attempt sends a request once, to the mirror first if there is one
+func (c *Client) attempt(ctx context.Context, req *http.Request) (*http.Response, error) {
+	if c.mirror != "" && strings.HasPrefix(req.URL.String(), c.baseURL) {
+		mirrored, err := http.NewRequestWithContext(ctx, req.Method, c.mirror+strings.TrimPrefix(req.URL.String(), c.baseURL), nil)
+		if err == nil {
+			mirrored.Header = req.Header.Clone()
+			// Registry credentials are not sent to the mirror
+			resp, err := c.send(ctx, mirrored, nil)
+			if err == nil && resp.StatusCode < http.StatusBadRequest {
+				return resp, nil
+			}
+			if err == nil {
+				resp.Body.Close()
+				err = fmt.Errorf("%s", resp.Status)
+			}
+			log.Warnf("Mirror %s failed for %s, using the registry: %v", c.mirror, req.URL.Path, err)
+		}
+	}
+
+	credentials, err := c.resolveCredentials(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.send(ctx, req, credentials)
+	if err == nil {
+		c.quota.update(resp.Header, c.now())
+	}
+	return resp, err
+}
+
+// send executes a request with credentials. Registries using token
+// authentication answer 401 with a Bearer challenge; a token is then
+// obtained from their token service and the request sent again.
+func (c *Client) send(ctx context.Context, req *http.Request, credentials *Credentials) (*http.Response, error) {
+	// A token obtained for the same repository before is reused
+	key := tokenKey(req.URL)
+	if token := c.tokens.get(key); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else if credentials != nil {
+		if credentials.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+credentials.Token)
+		} else if credentials.Username != "" && credentials.Password != "" {
+			req.SetBasicAuth(credentials.Username, credentials.Password)
+		}
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	ch, ok := parseChallenge(resp.Header.Get("WWW-Authenticate"))
+	if !ok {
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	token, err := c.fetchToken(ctx, ch, credentials)
+	if err != nil {
+		return nil, err
+	}
+	c.tokens.put(key, token)
+
+	retry := req.Clone(ctx)
+	retry.Header.Set("Authorization", "Bearer "+token.value)
+	return c.httpClient.Do(retry)
+}
+
+// resolveCredentials returns the static credentials or those the provider
+// supplies for the registry host
+func (c *Client) resolveCredentials(ctx context.Context) (*Credentials, error) {
+	if c.provider == nil {
+		return c.credentials, nil
+	}
+
+	credentials, err := c.provider.Credentials(ctx, c.baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get registry credentials: %w", err)
+	}
+	return credentials, nil
+}
@@ -0,0 +1,230 @@
+package docker
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/xgodev/boost/wrapper/log"
+)
+
+// Conventions of cosign signatures stored in registries
+const (
+	// cosignPayloadType is the media type of the signed payload layers
+	cosignPayloadType = "application/vnd.dev.cosign.simplesigning.v1+json"
+	// cosignArtifactType marks signatures attached through the referrers API
+	cosignArtifactType = "application/vnd.dev.cosign.artifact.sig.v1+json"
+	// cosignSignatureAnnotation holds the base64 signature of a payload layer
+	cosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+	// cosignPayloadKind is the type of the simple signing payload
+	cosignPayloadKind = "cosign container image signature"
+)
+
+// PublicKey is a key image signatures are verified with
+type PublicKey struct {
+	Name        string // file name, reported with verified signatures
+	Fingerprint string // SHA-256 of the DER encoded key
+	key         crypto.PublicKey
+}
+
+// LoadPublicKeys reads PEM public keys, as written by cosign generate-key-pair
+func LoadPublicKeys(files []string) ([]PublicKey, error) {
+	keys := make([]PublicKey, 0, len(files))
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read public key: %w", err)
+		}
+		key, err := ParsePublicKey(filepath.Base(file), data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// ParsePublicKey parses a PEM ECDSA, RSA or Ed25519 public key
+func ParsePublicKey(name string, data []byte) (PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return PublicKey{}, errors.New("no PEM public key found")
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return PublicKey{}, fmt.Errorf("invalid public key: %w", err)
+	}
+	switch key.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey, ed25519.PublicKey:
+	default:
+		return PublicKey{}, fmt.Errorf("unsupported public key type %T", key)
+	}
+
+	sum := sha256.Sum256(block.Bytes)
+	return PublicKey{Name: name, Fingerprint: hex.EncodeToString(sum[:]), key: key}, nil
+}
+
+// verify checks a signature of payload made with the key
+func (k PublicKey) verify(payload, signature []byte) bool {
+	digest := sha256.Sum256(payload)
+
+	switch key := k.key.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(key, digest[:], signature)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil ||
+			rsa.VerifyPSS(key, crypto.SHA256, digest[:], signature, nil) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, payload, signature)
+	}
+	return false
+}
+
+// SignatureVerification is the outcome of verifying the signatures of an
+// image digest
+type SignatureVerification struct {
+	Verified bool
+	Key      string // name of the key that verified the signature
+	// Reason explains why no signature could be verified
+	Reason string
+	// Signatures is the number of signatures found
+	Signatures int
+}
+
+// simpleSigning is the payload cosign signs
+type simpleSigning struct {
+	Critical struct {
+		Type  string `json:"type"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+	} `json:"critical"`
+}
+
+// VerifySignature looks for cosign signatures of a digest, under the
+// sha256-<digest>.sig tag and through the referrers API, and checks them
+// against the keys. An unsigned image or signatures no key verifies are
+// reported in the result; errors are failures to read the registry.
+func (c *Client) VerifySignature(ctx context.Context, namespace, repository, digest string, keys []PublicKey) (*SignatureVerification, error) {
+	log.Infof("Verifying signatures of %s/%s@%s", namespace, repository, digest)
+
+	manifests, err := c.attachedManifests(ctx, namespace, repository, digest, ".sig", cosignArtifactType)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &SignatureVerification{}
+	reason := ""
+	for _, manifest := range manifests {
+		for _, layer := range manifest.Layers {
+			encoded, ok := layer.Annotations[cosignSignatureAnnotation]
+			if layer.MediaType != cosignPayloadType || !ok {
+				continue
+			}
+			result.Signatures++
+
+			signature, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				reason = "a signature is not valid base64"
+				continue
+			}
+			payload, err := c.GetBlob(ctx, namespace, repository, layer.Digest)
+			if err != nil {
+				return nil, err
+			}
+
+			key, ok := verifyPayload(keys, payload, signature)
+			if !ok {
+				continue
+			}
+			if err := checkPayload(payload, digest); err != nil {
+				reason = err.Error()
+				continue
+			}
+
+			result.Verified = true
+			result.Key = key.Name
+			return result, nil
+		}
+	}
+
+	switch {
+	case result.Signatures == 0:
+		result.Reason = "no cosign signature found"
+	case reason != "":
+		result.Reason = reason
+	default:
+		result.Reason = fmt.Sprintf("none of the %d signatures matches a trusted key", result.Signatures)
+	}
+
+	return result, nil
+}
+
+// attachedManifests returns the manifests cosign attached to a digest, under
+// the sha256-<digest><suffix> tag and as referrers of the artifact type
+func (c *Client) attachedManifests(ctx context.Context, namespace, repository, digest, suffix, artifactType string) ([]*Manifest, error) {
+	manifests := make([]*Manifest, 0)
+
+	legacy, err := c.GetManifest(ctx, namespace, repository, referrersTagName(digest)+suffix)
+	switch {
+	case err == nil:
+		manifests = append(manifests, legacy)
+	case !errors.Is(err, ErrNotFound):
+		return nil, err
+	}
+
+	referrers, err := c.Referrers(ctx, namespace, repository, digest, artifactType)
+	if err != nil {
+		return nil, err
+	}
+	for _, referrer := range referrers {
+		manifest, err := c.GetManifest(ctx, namespace, repository, referrer.Digest)
+		if err != nil {
+			return nil, err
+		}
+		manifests = append(manifests, manifest)
+	}
+
+	return manifests, nil
+}
+
+// verifyPayload returns the key a signature of payload was made with
+func verifyPayload(keys []PublicKey, payload, signature []byte) (PublicKey, bool) {
+	for _, key := range keys {
+		if key.verify(payload, signature) {
+			return key, true
+		}
+	}
+	return PublicKey{}, false
+}
+
+// checkPayload checks that a signed payload is a cosign signature of digest,
+// so a signature cannot be copied to another image
+func checkPayload(payload []byte, digest string) error {
+	var signed simpleSigning
+	if err := json.Unmarshal(payload, &signed); err != nil {
+		return fmt.Errorf("the signed payload is not valid JSON: %v", err)
+	}
+	if !strings.EqualFold(signed.Critical.Type, cosignPayloadKind) {
+		return fmt.Errorf("the signed payload is of type %q", signed.Critical.Type)
+	}
+	if signed.Critical.Image.DockerManifestDigest != digest {
+		return fmt.Errorf("the signature is for digest %s", signed.Critical.Image.DockerManifestDigest)
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package docker
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"testing"
+)
+
+// signingKey is a test key pair in the forms cosign uses
+type signingKey struct {
+	name   string
+	public PublicKey
+	sign   func(payload []byte) []byte
+}
+
+// newSigningKeys returns an ECDSA, an RSA and an Ed25519 key pair
+func newSigningKeys(t *testing.T) []signingKey {
+	t.Helper()
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPublic, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digest := func(payload []byte) []byte {
+		sum := sha256.Sum256(payload)
+		return sum[:]
+	}
+	keys := []signingKey{
+		{name: "ecdsa", sign: func(payload []byte) []byte {
+			signature, _ := ecdsa.SignASN1(rand.Reader, ecKey, digest(payload))
+			return signature
+		}},
+		{name: "rsa", sign: func(payload []byte) []byte {
+			signature, _ := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest(payload))
+			return signature
+		}},
+		{name: "ed25519", sign: func(payload []byte) []byte {
+			return ed25519.Sign(edPrivate, payload)
+		}},
+	}
+	for i, public := range []crypto.PublicKey{&ecKey.PublicKey, &rsaKey.PublicKey, edPublic} {
+		der, err := x509.MarshalPKIXPublicKey(public)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[i].public, err = ParsePublicKey(keys[i].name+".pub", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return keys
+}
+
+// cosignPayload returns a simple signing payload of a digest
+func cosignPayload(kind, digest string) []byte {
+	return []byte(fmt.Sprintf(`{"critical":{"identity":{"docker-reference":"registry.example.com/app"},"image":{"docker-manifest-digest":%q},"type":%q},"optional":null}`, digest, kind))
+}
+
+func TestCosignSignatureBinding(t *testing.T) {
+	const digest = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+	const other = "sha256:2222222222222222222222222222222222222222222222222222222222222222"
+
+	keys := newSigningKeys(t)
+	trusted := []PublicKey{keys[0].public, keys[1].public, keys[2].public}
+
+	for _, key := range keys {
+		tests := []struct {
+			name      string
+			payload   []byte
+			signed    []byte // payload the signature is made over, payload when nil
+			keys      []PublicKey
+			verified  bool
+			wantBound bool
+		}{
+			{name: "signature of the digest", payload: cosignPayload(cosignPayloadKind, digest), keys: trusted, verified: true, wantBound: true},
+			{name: "payload type is case insensitive", payload: cosignPayload("Cosign Container Image Signature", digest), keys: trusted, verified: true, wantBound: true},
+			{name: "signature copied from another image", payload: cosignPayload(cosignPayloadKind, other), keys: trusted, verified: true},
+			{name: "payload of another type", payload: cosignPayload("atomic container signature", digest), keys: trusted, verified: true},
+			{name: "payload is not JSON", payload: []byte("not json"), keys: trusted, verified: true},
+			{name: "untrusted key", payload: cosignPayload(cosignPayloadKind, digest), keys: []PublicKey{}},
+			{name: "payload changed after signing", payload: cosignPayload(cosignPayloadKind, digest), signed: cosignPayload(cosignPayloadKind, other), keys: trusted},
+		}
+		for _, tt := range tests {
+			t.Run(key.name+"/"+tt.name, func(t *testing.T) {
+				signed := tt.signed
+				if signed == nil {
+					signed = tt.payload
+				}
+
+				verifiedBy, ok := verifyPayload(tt.keys, tt.payload, key.sign(signed))
+				if ok != tt.verified {
+					t.Fatalf("verified = %v, want %v", ok, tt.verified)
+				}
+				if ok && verifiedBy.Fingerprint != key.public.Fingerprint {
+					t.Fatalf("verified by %s, want %s", verifiedBy.Name, key.public.Name)
+				}
+				if !ok {
+					return
+				}
+
+				err := checkPayload(tt.payload, digest)
+				if bound := err == nil; bound != tt.wantBound {
+					t.Fatalf("checkPayload() = %v, want bound %v", err, tt.wantBound)
+				}
+			})
+		}
+	}
+}
+
+func TestParsePublicKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr bool
+	}{
+		{name: "not PEM", data: []byte("ssh-ed25519 AAAA"), wantErr: true},
+		{name: "private key block", data: pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte{1}}), wantErr: true},
+		{name: "invalid key", data: pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: []byte{1}}), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParsePublicKey("key.pub", tt.data); (err != nil) != tt.wantErr {
+				t.Fatalf("ParsePublicKey() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
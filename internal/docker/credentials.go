@@ -0,0 +1,244 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xgodev/boost/wrapper/log"
+)
+
+// helperTTL is how long credentials returned by a credential helper are
+// reused before the helper is run again
+const helperTTL = 5 * time.Minute
+
+// dockerHubServer is the server Docker stores Docker Hub credentials under
+const dockerHubServer = "https://index.docker.io/v1/"
+
+// Keychain resolves registry credentials from a Docker config.json, the
+// file docker login writes. Static credentials are read from auths, and
+// credHelpers and credsStore name docker-credential-* programs that are run
+// following the credential helper protocol. The file is read again when it
+// changes.
+type Keychain struct {
+	path string
+	now  func() time.Time
+
+	mu      sync.Mutex
+	file    *configFile
+	modTime time.Time
+	size    int64
+	helped  map[string]helperEntry // credentials from helpers, by host
+}
+
+// configFile is the part of a Docker config.json about credentials
+type configFile struct {
+	Auths       map[string]authEntry `json:"auths"`
+	CredHelpers map[string]string    `json:"credHelpers"`
+	CredsStore  string               `json:"credsStore"`
+}
+
+// authEntry is an entry of auths
+type authEntry struct {
+	Auth          string `json:"auth"` // base64 of username:password
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	IdentityToken string `json:"identitytoken"`
+	RegistryToken string `json:"registrytoken"`
+}
+
+// helperEntry is a cached credential helper answer
+type helperEntry struct {
+	credentials *Credentials
+	expiresAt   time.Time
+}
+
+// helperOutput is what a credential helper prints for get
+type helperOutput struct {
+	ServerURL string `json:"ServerURL"`
+	Username  string `json:"Username"`
+	Secret    string `json:"Secret"`
+}
+
+// NewKeychain reads the Docker config.json at path
+func NewKeychain(path string) (*Keychain, error) {
+	k := &Keychain{path: path, now: time.Now}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if err := k.reload(); err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// Credentials returns the credentials for a registry host, or nil when the
+// file has none for it
+func (k *Keychain) Credentials(ctx context.Context, host string) (*Credentials, error) {
+	host = registryHost(host)
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if err := k.reload(); err != nil {
+		// Keep using what was read before rather than losing access
+		log.Warnf("Failed to reload Docker credentials %s: %v", k.path, err)
+	}
+
+	helper := k.file.CredHelpers[host]
+	if helper == "" {
+		for server, name := range k.file.CredHelpers {
+			if registryHost(server) == host {
+				helper = name
+				break
+			}
+		}
+	}
+	if helper != "" {
+		return k.fromHelper(ctx, helper, host)
+	}
+
+	for server, entry := range k.file.Auths {
+		if registryHost(server) == host {
+			return entry.credentials()
+		}
+	}
+
+	if k.file.CredsStore != "" {
+		return k.fromHelper(ctx, k.file.CredsStore, host)
+	}
+
+	return nil, nil
+}
+
+// reload reads the file again when it changed; callers must hold k.mu
+func (k *Keychain) reload() error {
+	info, err := os.Stat(k.path)
+	if err != nil {
+		return fmt.Errorf("failed to read Docker credentials: %w", err)
+	}
+	if k.file != nil && info.ModTime().Equal(k.modTime) && info.Size() == k.size {
+		return nil
+	}
+
+	data, err := os.ReadFile(k.path)
+	if err != nil {
+		return fmt.Errorf("failed to read Docker credentials: %w", err)
+	}
+
+	file := &configFile{}
+	if err := json.Unmarshal(data, file); err != nil {
+		return fmt.Errorf("failed to decode Docker credentials %s: %w", k.path, err)
+	}
+	for server, entry := range file.Auths {
+		if _, err := entry.credentials(); err != nil {
+			return fmt.Errorf("invalid Docker credentials for %s: %w", server, err)
+		}
+	}
+
+	if k.file != nil {
+		log.Infof("Reloaded Docker credentials %s", k.path)
+	}
+	k.file = file
+	k.modTime = info.ModTime()
+	k.size = info.Size()
+	k.helped = make(map[string]helperEntry)
+
+	return nil
+}
+
+// fromHelper runs docker-credential-<helper> get for a host; callers must
+// hold k.mu
+func (k *Keychain) fromHelper(ctx context.Context, helper, host string) (*Credentials, error) {
+	if entry, ok := k.helped[host]; ok && k.now().Before(entry.expiresAt) {
+		return entry.credentials, nil
+	}
+
+	server := host
+	if host == "docker.io" {
+		server = dockerHubServer
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(server)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		message := strings.TrimSpace(stdout.String() + stderr.String())
+		// The protocol reports a missing entry on stdout with this message
+		if strings.Contains(message, "credentials not found") {
+			k.helped[host] = helperEntry{expiresAt: k.now().Add(helperTTL)}
+			return nil, nil
+		}
+		return nil, fmt.Errorf("credential helper %s failed for %s: %v: %s", helper, host, err, message)
+	}
+
+	var output helperOutput
+	if err := json.Unmarshal(stdout.Bytes(), &output); err != nil {
+		return nil, fmt.Errorf("credential helper %s returned invalid output: %w", helper, err)
+	}
+
+	credentials := &Credentials{Username: output.Username, Password: output.Secret}
+	// Helpers return identity tokens with this user name
+	if output.Username == "<token>" {
+		credentials = &Credentials{IdentityToken: output.Secret}
+	}
+
+	k.helped[host] = helperEntry{credentials: credentials, expiresAt: k.now().Add(helperTTL)}
+	return credentials, nil
+}
+
+// credentials decodes an auths entry
+func (e authEntry) credentials() (*Credentials, error) {
+	credentials := &Credentials{
+		Username:      e.Username,
+		Password:      e.Password,
+		Token:         e.RegistryToken,
+		IdentityToken: e.IdentityToken,
+	}
+
+	if e.Auth != "" {
+		decoded, err := base64.StdEncoding.DecodeString(e.Auth)
+		if err != nil {
+			return nil, errors.New("auth is not valid base64")
+		}
+		username, password, ok := strings.Cut(string(decoded), ":")
+		if !ok {
+			return nil, errors.New("auth is not username:password")
+		}
+		credentials.Username, credentials.Password = username, password
+	}
+
+	return credentials, nil
+}
+
+// registryHost reduces a registry address, as found in config.json keys or
+// image references, to its host; the aliases of Docker Hub become docker.io
+func registryHost(server string) string {
+	server = strings.ToLower(strings.TrimSpace(server))
+	if strings.Contains(server, "://") {
+		if u, err := url.Parse(server); err == nil {
+			server = u.Host
+		}
+	}
+	server, _, _ = strings.Cut(server, "/")
+
+	switch server {
+	case "index.docker.io", "registry-1.docker.io", "registry.hub.docker.com":
+		return "docker.io"
+	}
+
+	return server
+}
@@ -0,0 +1,206 @@
+package docker
+
+import (
+	"context"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeDockerConfig writes a Docker config.json into dir and returns its path
+func writeDockerConfig(t *testing.T, dir, content string) string {
+	t.Helper()
+
+	path := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// installHelper puts a docker-credential-fake program on the PATH that knows
+// ghcr.io and gcr.io, and returns the file counting its runs
+func installHelper(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	runs := filepath.Join(dir, "runs")
+	script := `#!/bin/sh
+echo run >> "` + runs + `"
+read server
+case "$server" in
+ghcr.io) echo '{"ServerURL":"ghcr.io","Username":"bot","Secret":"helper-secret"}' ;;
+gcr.io) echo '{"ServerURL":"gcr.io","Username":"<token>","Secret":"refresh-token"}' ;;
+*) echo "credentials not found in native keychain"; exit 1 ;;
+esac
+`
+	if err := os.WriteFile(filepath.Join(dir, "docker-credential-fake"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return runs
+}
+
+// helperRuns returns how many times the credential helper ran
+func helperRuns(t *testing.T, runs string) int {
+	t.Helper()
+
+	data, err := os.ReadFile(runs)
+	if os.IsNotExist(err) {
+		return 0
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Count(string(data), "run")
+}
+
+func TestKeychainAuths(t *testing.T) {
+	basic := base64.StdEncoding.EncodeToString([]byte("alice:pa:ss"))
+	path := writeDockerConfig(t, t.TempDir(), `{"auths":{
+		"https://index.docker.io/v1/": {"auth": "`+basic+`"},
+		"registry.example.com:5000": {"username": "bob", "password": "secret"},
+		"quay.io": {"identitytoken": "refresh-token"},
+		"https://harbor.example.com/v2/": {"registrytoken": "bearer-token"}
+	}}`)
+
+	keychain, err := NewKeychain(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host string
+		want *Credentials
+	}{
+		{host: "docker.io", want: &Credentials{Username: "alice", Password: "pa:ss"}},
+		{host: "registry-1.docker.io", want: &Credentials{Username: "alice", Password: "pa:ss"}},
+		{host: "Registry.Example.com:5000", want: &Credentials{Username: "bob", Password: "secret"}},
+		{host: "quay.io", want: &Credentials{IdentityToken: "refresh-token"}},
+		{host: "harbor.example.com", want: &Credentials{Token: "bearer-token"}},
+		{host: "registry.example.com"},
+		{host: "ghcr.io"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			got, err := keychain.Credentials(context.Background(), tt.host)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+				t.Fatalf("Credentials() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeychainRejectsInvalidFiles(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{name: "not JSON", content: `auths: {}`, wantErr: "failed to decode"},
+		{name: "auth not base64", content: `{"auths":{"quay.io":{"auth":"%%%"}}}`, wantErr: "auth is not valid base64"},
+		{
+			name:    "auth without password",
+			content: `{"auths":{"quay.io":{"auth":"` + base64.StdEncoding.EncodeToString([]byte("alice")) + `"}}}`,
+			wantErr: "auth is not username:password",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewKeychain(writeDockerConfig(t, t.TempDir(), tt.content))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected an error reporting %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+
+	if _, err := NewKeychain(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Fatal("expected an error for a missing file")
+	}
+}
+
+func TestKeychainReloads(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	path := writeDockerConfig(t, dir, `{"auths":{"quay.io":{"username":"alice","password":"old"}}}`)
+
+	keychain, err := NewKeychain(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeDockerConfig(t, dir, `{"auths":{"quay.io":{"username":"alice","password":"rotated"}}}`)
+	got, err := keychain.Credentials(ctx, "quay.io")
+	if err != nil || got == nil || got.Password != "rotated" {
+		t.Fatalf("Credentials() = %+v, %v after a change", got, err)
+	}
+
+	// A broken file keeps the credentials read before
+	writeDockerConfig(t, dir, `{"auths":`)
+	got, err = keychain.Credentials(ctx, "quay.io")
+	if err != nil || got == nil || got.Password != "rotated" {
+		t.Fatalf("Credentials() = %+v, %v after a broken change", got, err)
+	}
+}
+
+func TestKeychainHelpers(t *testing.T) {
+	ctx := context.Background()
+	runs := installHelper(t)
+	path := writeDockerConfig(t, t.TempDir(), `{
+		"auths": {"ghcr.io": {"username": "static", "password": "static"}, "quay.io": {"username": "carol", "password": "secret"}},
+		"credHelpers": {"https://ghcr.io": "fake", "missing.example.com": "absent"},
+		"credsStore": "fake"
+	}`)
+
+	keychain, err := NewKeychain(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	keychain.now = func() time.Time { return now }
+
+	tests := []struct {
+		name     string
+		host     string
+		want     *Credentials
+		wantErr  bool
+		wantRuns int // runs of the helper so far
+	}{
+		{name: "credHelpers over auths", host: "ghcr.io", want: &Credentials{Username: "bot", Password: "helper-secret"}, wantRuns: 1},
+		{name: "answer reused", host: "ghcr.io", want: &Credentials{Username: "bot", Password: "helper-secret"}, wantRuns: 1},
+		{name: "auths over credsStore", host: "quay.io", want: &Credentials{Username: "carol", Password: "secret"}, wantRuns: 1},
+		{name: "identity token from credsStore", host: "gcr.io", want: &Credentials{IdentityToken: "refresh-token"}, wantRuns: 2},
+		{name: "not found in credsStore", host: "registry.example.com", wantRuns: 3},
+		{name: "missing answer reused", host: "registry.example.com", wantRuns: 3},
+		{name: "helper not installed", host: "missing.example.com", wantErr: true, wantRuns: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := keychain.Credentials(ctx, tt.host)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Credentials() error = %v, want error %v", err, tt.wantErr)
+			}
+			if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+				t.Fatalf("Credentials() = %+v, want %+v", got, tt.want)
+			}
+			if n := helperRuns(t, runs); n != tt.wantRuns {
+				t.Fatalf("helper ran %d times, want %d", n, tt.wantRuns)
+			}
+		})
+	}
+
+	// Answers are asked for again once they expire
+	now = now.Add(helperTTL)
+	if _, err := keychain.Credentials(ctx, "ghcr.io"); err != nil {
+		t.Fatal(err)
+	}
+	if n := helperRuns(t, runs); n != 4 {
+		t.Fatalf("helper ran %d times, want an expired answer replaced", n)
+	}
+}
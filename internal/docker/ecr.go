@@ -0,0 +1,199 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ecrTarget is the API operation minting registry passwords
+const ecrTarget = "AmazonEC2ContainerRegistry_V20150921.GetAuthorizationToken"
+
+// ecrHostPattern matches ECR registry hosts, capturing the region
+var ecrHostPattern = regexp.MustCompile(`^\d+\.dkr\.ecr(?:-fips)?\.([a-z0-9-]+)\.amazonaws\.com(?:\.cn)?$`)
+
+// ECROptions configures the ECR token source
+type ECROptions struct {
+	Region          string
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string // set for temporary credentials
+	// Endpoint is the ECR API URL, https://api.ecr.<region>.amazonaws.com
+	// by default
+	Endpoint string
+}
+
+// ECRTokenSource mints Amazon ECR registry passwords with the
+// GetAuthorizationToken API, signing requests with AWS Signature Version 4
+type ECRTokenSource struct {
+	options    ECROptions
+	httpClient *http.Client
+	now        func() time.Time
+}
+
+// NewECRTokenSource creates an ECR token source
+func NewECRTokenSource(options ECROptions) (*ECRTokenSource, error) {
+	if options.Region == "" {
+		return nil, errors.New("ECR region is required")
+	}
+	if options.AccessKeyID == "" || options.SecretAccessKey == "" {
+		return nil, errors.New("ECR requires an AWS access key ID and secret access key")
+	}
+	if options.Endpoint == "" {
+		options.Endpoint = fmt.Sprintf("https://api.ecr.%s.amazonaws.com", options.Region)
+	}
+
+	return &ECRTokenSource{
+		options:    options,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+		now:        time.Now,
+	}, nil
+}
+
+// ECRRegion returns the region of an ECR registry host, e.g.
+// 123456789012.dkr.ecr.eu-west-1.amazonaws.com
+func ECRRegion(host string) (string, bool) {
+	match := ecrHostPattern.FindStringSubmatch(registryHost(host))
+	if match == nil {
+		return "", false
+	}
+	return match[1], true
+}
+
+// Token calls GetAuthorizationToken
+func (s *ECRTokenSource) Token(ctx context.Context) (*Credentials, time.Time, error) {
+	body := []byte("{}")
+
+	req, err := http.NewRequestWithContext(ctx, "POST", s.options.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to create ECR request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", ecrTarget)
+	s.sign(req, body)
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to call ECR: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, time.Time{}, fmt.Errorf("failed to get ECR authorization token: %s - %s", resp.Status, string(message))
+	}
+
+	var result struct {
+		AuthorizationData []struct {
+			AuthorizationToken string  `json:"authorizationToken"`
+			ExpiresAt          float64 `json:"expiresAt"` // seconds since the epoch
+		} `json:"authorizationData"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to decode ECR authorization token: %w", err)
+	}
+	if len(result.AuthorizationData) == 0 {
+		return nil, time.Time{}, errors.New("ECR returned no authorization token")
+	}
+
+	data := result.AuthorizationData[0]
+	decoded, err := base64.StdEncoding.DecodeString(data.AuthorizationToken)
+	if err != nil {
+		return nil, time.Time{}, errors.New("ECR authorization token is not valid base64")
+	}
+	username, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return nil, time.Time{}, errors.New("ECR authorization token is not username:password")
+	}
+
+	expiresAt := time.Unix(0, int64(data.ExpiresAt*float64(time.Second)))
+	return &Credentials{Username: username, Password: password}, expiresAt, nil
+}
+
+// sign adds an AWS Signature Version 4 to a request
+func (s *ECRTokenSource) sign(req *http.Request, body []byte) {
+	signV4(req, body, "ecr", s.options, s.now().UTC())
+}
+
+// signV4 signs a request to an AWS service with Signature Version 4
+func signV4(req *http.Request, body []byte, service string, options ECROptions, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if options.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", options.SessionToken)
+	}
+
+	// Every header set so far is signed, with the host
+	headers := map[string]string{"host": req.URL.Host}
+	names := []string{"host"}
+	for name := range req.Header {
+		lower := strings.ToLower(name)
+		headers[lower] = strings.TrimSpace(req.Header.Get(name))
+		names = append(names, lower)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		sha256Hex(body),
+	}, "\n")
+
+	scope := date + "/" + options.Region + "/" + service + "/aws4_request"
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+options.SecretAccessKey), date)
+	key = hmacSHA256(key, options.Region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		options.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// canonicalQuery encodes query parameters as Signature Version 4 expects
+func canonicalQuery(query url.Values) string {
+	return strings.ReplaceAll(query.Encode(), "+", "%20")
+}
+
+// sha256Hex returns the hex SHA-256 of data
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of data
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,106 @@
+package docker
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignV4(t *testing.T) {
+	// Cases of the AWS Signature Version 4 test suite
+	options := ECROptions{
+		Region:          "us-east-1",
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	}
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	credential := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, "
+
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		want   string
+	}{
+		{
+			name:   "get vanilla",
+			method: "GET",
+			url:    "https://example.amazonaws.com/",
+			want:   credential + "SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		},
+		{
+			name:   "query parameters in key order",
+			method: "GET",
+			url:    "https://example.amazonaws.com/?Param2=value2&Param1=value1",
+			want:   credential + "SignedHeaders=host;x-amz-date, Signature=b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500",
+		},
+		{
+			name:   "post vanilla",
+			method: "POST",
+			url:    "https://example.amazonaws.com/",
+			want:   credential + "SignedHeaders=host;x-amz-date, Signature=5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, tt.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			signV4(req, nil, "service", options, now)
+
+			if got := req.Header.Get("X-Amz-Date"); got != "20150830T123600Z" {
+				t.Fatalf("X-Amz-Date = %q", got)
+			}
+			if got := req.Header.Get("Authorization"); got != tt.want {
+				t.Fatalf("Authorization = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSignV4SessionToken(t *testing.T) {
+	options := ECROptions{Region: "eu-west-1", AccessKeyID: "AKID", SecretAccessKey: "secret", SessionToken: "session"}
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	sign := func(token string) string {
+		options := options
+		options.SessionToken = token
+		req, _ := http.NewRequest("POST", "https://api.ecr.eu-west-1.amazonaws.com", nil)
+		req.Header.Set("X-Amz-Target", ecrTarget)
+		signV4(req, []byte("{}"), "ecr", options, now)
+		return req.Header.Get("Authorization")
+	}
+
+	authorization := sign("session")
+	if !strings.Contains(authorization, "SignedHeaders=host;x-amz-date;x-amz-security-token;x-amz-target,") {
+		t.Fatalf("session token and target not signed: %s", authorization)
+	}
+	if authorization == sign("other") {
+		t.Fatal("signature does not cover the session token")
+	}
+}
+
+func TestECRRegion(t *testing.T) {
+	tests := []struct {
+		host   string
+		region string
+		ok     bool
+	}{
+		{"123456789012.dkr.ecr.eu-west-1.amazonaws.com", "eu-west-1", true},
+		{"https://123456789012.dkr.ecr.us-east-2.amazonaws.com/", "us-east-2", true},
+		{"123456789012.dkr.ecr-fips.us-gov-west-1.amazonaws.com", "us-gov-west-1", true},
+		{"123456789012.dkr.ecr.cn-north-1.amazonaws.com.cn", "cn-north-1", true},
+		{"public.ecr.aws", "", false},
+		{"registry.example.com", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			region, ok := ECRRegion(tt.host)
+			if region != tt.region || ok != tt.ok {
+				t.Fatalf("ECRRegion(%q) = %q, %v, want %q, %v", tt.host, region, ok, tt.region, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package docker
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kinds of registry failures, matched with errors.Is
+var (
+	ErrNotFound     = errors.New("not found in the registry")
+	ErrUnauthorized = errors.New("the registry refused the credentials")
+	ErrRateLimited  = errors.New("the registry rate limit was reached")
+	ErrUnavailable  = errors.New("the registry is unavailable")
+)
+
+// RegistryError is a failed registry request
+type RegistryError struct {
+	Kind       error  // one of the errors above, nil for other failures
+	Status     int    // HTTP status, 0 when no response was received
+	URL        string // request URL
+	Message    string // start of the response body, or why the request was not sent
+	RetryAfter time.Duration
+	Err        error // transport error
+}
+
+// Error describes the failure
+func (e *RegistryError) Error() string {
+	var b strings.Builder
+	if e.Kind != nil {
+		b.WriteString(e.Kind.Error())
+	} else {
+		b.WriteString("registry request failed")
+	}
+	if e.Status != 0 {
+		fmt.Fprintf(&b, ": %d %s", e.Status, http.StatusText(e.Status))
+	}
+	if e.URL != "" {
+		fmt.Fprintf(&b, " (%s)", e.URL)
+	}
+	if e.Message != "" {
+		b.WriteString(": " + e.Message)
+	}
+	if e.Err != nil {
+		b.WriteString(": " + e.Err.Error())
+	}
+	return b.String()
+}
+
+// Unwrap returns the kind and the transport error
+func (e *RegistryError) Unwrap() []error {
+	return []error{e.Kind, e.Err}
+}
+
+// statusError builds the error of a response that was not successful
+func statusError(resp *http.Response) *RegistryError {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+
+	err := &RegistryError{
+		Status:     resp.StatusCode,
+		URL:        resp.Request.URL.Redacted(),
+		Message:    strings.TrimSpace(string(body)),
+		RetryAfter: retryAfter(resp.Header.Get("Retry-After")),
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		err.Kind = ErrNotFound
+	case resp.StatusCode == http.StatusUnauthorized, resp.StatusCode == http.StatusForbidden:
+		err.Kind = ErrUnauthorized
+	case resp.StatusCode == http.StatusTooManyRequests:
+		err.Kind = ErrRateLimited
+	case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode >= http.StatusInternalServerError:
+		err.Kind = ErrUnavailable
+	}
+
+	return err
+}
+
+// retryAfter parses a Retry-After header, given in seconds or as a date
+func retryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(strings.TrimSpace(header)); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(header); err == nil {
+		if wait := time.Until(at); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
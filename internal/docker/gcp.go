@@ -0,0 +1,146 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Defaults of the GCP token exchange
+const (
+	gcpTokenURL = "https://oauth2.googleapis.com/token"
+	gcpScope    = "https://www.googleapis.com/auth/cloud-platform"
+	// gcpUsername is the user name Artifact Registry expects with an access
+	// token as password
+	gcpUsername = "oauth2accesstoken"
+)
+
+// GCPOptions configures the GCP token source
+type GCPOptions struct {
+	// KeyFile is the JSON key of a service account
+	KeyFile string
+	// TokenURL overrides the token endpoint of the key file
+	TokenURL string
+}
+
+// GCPTokenSource mints Google Artifact Registry access tokens by exchanging
+// a JWT signed with a service account key (RFC 7523)
+type GCPTokenSource struct {
+	email      string
+	keyID      string
+	key        interface{}
+	tokenURL   string
+	httpClient *http.Client
+	now        func() time.Time
+}
+
+// serviceAccountKey is the part of a service account JSON key used here
+type serviceAccountKey struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// NewGCPTokenSource reads a service account key
+func NewGCPTokenSource(options GCPOptions) (*GCPTokenSource, error) {
+	data, err := os.ReadFile(options.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read GCP service account key: %w", err)
+	}
+
+	var account serviceAccountKey
+	if err := json.Unmarshal(data, &account); err != nil {
+		return nil, fmt.Errorf("failed to decode GCP service account key %s: %w", options.KeyFile, err)
+	}
+	if account.Type != "service_account" || account.ClientEmail == "" {
+		return nil, fmt.Errorf("%s is not a GCP service account key", options.KeyFile)
+	}
+
+	key, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(account.PrivateKey))
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key in %s: %w", options.KeyFile, err)
+	}
+
+	tokenURL := options.TokenURL
+	if tokenURL == "" {
+		tokenURL = account.TokenURI
+	}
+	if tokenURL == "" {
+		tokenURL = gcpTokenURL
+	}
+
+	return &GCPTokenSource{
+		email:      account.ClientEmail,
+		keyID:      account.PrivateKeyID,
+		key:        key,
+		tokenURL:   tokenURL,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+		now:        time.Now,
+	}, nil
+}
+
+// Token exchanges a signed assertion for an access token
+func (s *GCPTokenSource) Token(ctx context.Context) (*Credentials, time.Time, error) {
+	now := s.now()
+
+	assertion := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":   s.email,
+		"scope": gcpScope,
+		"aud":   s.tokenURL,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if s.keyID != "" {
+		assertion.Header["kid"] = s.keyID
+	}
+	signed, err := assertion.SignedString(s.key)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to sign GCP assertion: %w", err)
+	}
+
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {signed},
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", s.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to create GCP token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to call GCP token endpoint: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, time.Time{}, fmt.Errorf("failed to get GCP access token: %s - %s", resp.Status, string(message))
+	}
+
+	var result struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to decode GCP access token: %w", err)
+	}
+	if result.AccessToken == "" {
+		return nil, time.Time{}, errors.New("GCP returned no access token")
+	}
+
+	expiresAt := now.Add(time.Duration(result.ExpiresIn) * time.Second)
+	return &Credentials{Username: gcpUsername, Password: result.AccessToken}, expiresAt, nil
+}
@@ -0,0 +1,123 @@
+package docker
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestGCPTokenExchange(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		keyID    string
+		status   int
+		response string
+		wantErr  bool
+	}{
+		{name: "access token", keyID: "key-1", status: http.StatusOK, response: `{"access_token":"ya29.token","expires_in":3599}`},
+		{name: "no key ID", status: http.StatusOK, response: `{"access_token":"ya29.token","expires_in":3599}`},
+		{name: "rejected assertion", status: http.StatusBadRequest, response: `{"error":"invalid_grant"}`, wantErr: true},
+		{name: "no access token", status: http.StatusOK, response: `{"expires_in":3599}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var claims jwt.MapClaims
+			var header map[string]interface{}
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if err := r.ParseForm(); err != nil {
+					t.Error(err)
+				}
+				if grant := r.PostForm.Get("grant_type"); grant != "urn:ietf:params:oauth:grant-type:jwt-bearer" {
+					t.Errorf("grant_type = %q", grant)
+				}
+				token, err := jwt.Parse(r.PostForm.Get("assertion"), func(*jwt.Token) (interface{}, error) {
+					return &key.PublicKey, nil
+				}, jwt.WithValidMethods([]string{"RS256"}), jwt.WithTimeFunc(func() time.Time { return now }))
+				if err != nil {
+					t.Errorf("invalid assertion: %v", err)
+				} else {
+					claims, header = token.Claims.(jwt.MapClaims), token.Header
+				}
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.response))
+			}))
+			defer server.Close()
+
+			source, err := NewGCPTokenSource(GCPOptions{KeyFile: writeServiceAccountKey(t, key, tt.keyID, server.URL)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			source.now = func() time.Time { return now }
+
+			credentials, expiresAt, err := source.Token(context.Background())
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if credentials.Username != gcpUsername || credentials.Password != "ya29.token" {
+				t.Fatalf("unexpected credentials %+v", credentials)
+			}
+			if !expiresAt.Equal(now.Add(3599 * time.Second)) {
+				t.Fatalf("expires at %v", expiresAt)
+			}
+			if claims["iss"] != "ci@project.iam.gserviceaccount.com" || claims["aud"] != server.URL || claims["scope"] != gcpScope {
+				t.Fatalf("unexpected claims %v", claims)
+			}
+			if claims["iat"] != float64(now.Unix()) || claims["exp"] != float64(now.Add(time.Hour).Unix()) {
+				t.Fatalf("unexpected lifetime %v", claims)
+			}
+			if kid, _ := header["kid"].(string); kid != tt.keyID {
+				t.Fatalf("kid = %q, want %q", kid, tt.keyID)
+			}
+		})
+	}
+}
+
+// writeServiceAccountKey writes a service account JSON key using tokenURL
+func writeServiceAccountKey(t *testing.T, key *rsa.PrivateKey, keyID, tokenURL string) string {
+	t.Helper()
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(serviceAccountKey{
+		Type:         "service_account",
+		ClientEmail:  "ci@project.iam.gserviceaccount.com",
+		PrivateKeyID: keyID,
+		PrivateKey:   string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		TokenURI:     tokenURL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(t.TempDir(), "key.json")
+	if err := os.WriteFile(file, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
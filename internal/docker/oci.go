@@ -0,0 +1,201 @@
+package docker
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/xgodev/boost/wrapper/log"
+)
+
+// Media types of manifests
+const (
+	MediaTypeOCIManifest    = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeOCIIndex       = "application/vnd.oci.image.index.v1+json"
+	MediaTypeDockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerList     = "application/vnd.docker.distribution.manifest.list.v2+json"
+)
+
+// manifestAccept is the Accept header of manifest requests; registries
+// would otherwise convert or refuse the manifests of multi-platform images
+var manifestAccept = strings.Join([]string{MediaTypeOCIIndex, MediaTypeOCIManifest, MediaTypeDockerList, MediaTypeDockerManifest}, ", ")
+
+// maxManifestSize and maxBlobSize bound what is read into memory; only
+// small blobs such as signature payloads are downloaded
+const (
+	maxManifestSize = 4 << 20
+	maxBlobSize     = 4 << 20
+)
+
+// Descriptor points to content in a repository
+type Descriptor struct {
+	MediaType    string            `json:"mediaType"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Digest       string            `json:"digest"`
+	Size         int64             `json:"size"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+}
+
+// Manifest is an image manifest or index
+type Manifest struct {
+	MediaType    string            `json:"mediaType"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Config       *Descriptor       `json:"config,omitempty"`
+	Layers       []Descriptor      `json:"layers,omitempty"`
+	Manifests    []Descriptor      `json:"manifests,omitempty"`
+	Subject      *Descriptor       `json:"subject,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+
+	// Digest is the digest of the manifest as stored
+	Digest string `json:"-"`
+}
+
+// GetManifest gets the manifest of a tag or digest
+func (c *Client) GetManifest(ctx context.Context, namespace, repository, reference string) (*Manifest, error) {
+	log.Infof("Getting manifest %s/%s:%s", namespace, repository, reference)
+
+	url := fmt.Sprintf("%s/v2/%s/manifests/%s", c.baseURL, repositoryPath(namespace, repository), reference)
+	body, resp, err := c.read(ctx, url, manifestAccept, maxManifestSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get manifest: %w", err)
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to decode manifest: %w", err)
+	}
+	if manifest.MediaType == "" {
+		manifest.MediaType = resp.Header.Get("Content-Type")
+	}
+
+	sum := sha256.Sum256(body)
+	manifest.Digest = "sha256:" + hex.EncodeToString(sum[:])
+	if strings.HasPrefix(reference, "sha256:") && reference != manifest.Digest {
+		return nil, fmt.Errorf("manifest %s has digest %s", reference, manifest.Digest)
+	}
+
+	return &manifest, nil
+}
+
+// GetBlob downloads a small blob and checks its digest
+func (c *Client) GetBlob(ctx context.Context, namespace, repository, digest string) ([]byte, error) {
+	log.Infof("Getting blob %s from %s/%s", digest, namespace, repository)
+
+	if !strings.HasPrefix(digest, "sha256:") {
+		return nil, fmt.Errorf("unsupported digest %q", digest)
+	}
+
+	url := fmt.Sprintf("%s/v2/%s/blobs/%s", c.baseURL, repositoryPath(namespace, repository), digest)
+	body, _, err := c.read(ctx, url, "", maxBlobSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get blob: %w", err)
+	}
+
+	sum := sha256.Sum256(body)
+	if "sha256:"+hex.EncodeToString(sum[:]) != digest {
+		return nil, fmt.Errorf("blob %s does not match its digest", digest)
+	}
+
+	return body, nil
+}
+
+// Referrers lists the artifacts attached to a manifest, such as signatures
+// and attestations, keeping those of artifactType unless it is empty. The
+// referrers API is used, falling back to the sha256-<digest> tag of
+// registries that do not offer it.
+func (c *Client) Referrers(ctx context.Context, namespace, repository, digest, artifactType string) ([]Descriptor, error) {
+	log.Infof("Listing referrers of %s/%s@%s", namespace, repository, digest)
+
+	next := fmt.Sprintf("%s/v2/%s/referrers/%s", c.baseURL, repositoryPath(namespace, repository), digest)
+	if artifactType != "" {
+		next += "?artifactType=" + url.QueryEscape(artifactType)
+	}
+
+	descriptors := make([]Descriptor, 0)
+	for next != "" {
+		body, resp, err := c.read(ctx, next, MediaTypeOCIIndex, maxManifestSize)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) && len(descriptors) == 0 {
+				return c.referrersTag(ctx, namespace, repository, digest, artifactType)
+			}
+			return nil, fmt.Errorf("failed to list referrers: %w", err)
+		}
+
+		var index Manifest
+		if err := json.Unmarshal(body, &index); err != nil {
+			return nil, fmt.Errorf("failed to decode referrers: %w", err)
+		}
+		descriptors = append(descriptors, filterArtifacts(index.Manifests, artifactType)...)
+		next = nextPage(resp.Request.URL, resp.Header.Get("Link"))
+	}
+
+	return descriptors, nil
+}
+
+// referrersTag reads the referrers index kept under the sha256-<digest> tag
+func (c *Client) referrersTag(ctx context.Context, namespace, repository, digest, artifactType string) ([]Descriptor, error) {
+	index, err := c.GetManifest(ctx, namespace, repository, referrersTagName(digest))
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return []Descriptor{}, nil
+		}
+		return nil, err
+	}
+
+	return filterArtifacts(index.Manifests, artifactType), nil
+}
+
+// referrersTagName returns the tag of a digest in the tag schema, e.g.
+// sha256-0123abcd
+func referrersTagName(digest string) string {
+	return strings.Replace(digest, ":", "-", 1)
+}
+
+// filterArtifacts keeps the descriptors of an artifact type
+func filterArtifacts(descriptors []Descriptor, artifactType string) []Descriptor {
+	filtered := make([]Descriptor, 0, len(descriptors))
+	for _, descriptor := range descriptors {
+		if artifactType == "" || descriptor.ArtifactType == artifactType {
+			filtered = append(filtered, descriptor)
+		}
+	}
+	return filtered
+}
+
+// read gets a URL and returns its body, which must not exceed limit
+func (c *Client) read(ctx context.Context, url, accept string, limit int64) ([]byte, *http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+
+	resp, err := c.do(ctx, req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp, statusError(resp)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, resp, fmt.Errorf("failed to read response: %w", err)
+	}
+	if int64(len(body)) > limit {
+		return nil, resp, fmt.Errorf("response of %s exceeds %d bytes", req.URL.Path, limit)
+	}
+
+	return body, resp, nil
+}
@@ -0,0 +1,157 @@
+package docker
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// PoolOptions configures a Pool
+type PoolOptions struct {
+	// Keychain supplies credentials to registries using AuthKeychain and to
+	// those not in the catalogue
+	Keychain *Keychain
+	// DefaultRegistry is the registry of images that name none
+	DefaultRegistry string
+	// DefaultCredentials are used for the default registry when it is not
+	// in the catalogue
+	DefaultCredentials *Credentials
+	// Cache keeps the responses of every registry, nil for none
+	Cache *Cache
+}
+
+// Pool keeps a client per registry, built from the registry catalogue.
+// Registries that are not in the catalogue are reached over HTTPS with the
+// keychain's credentials.
+type Pool struct {
+	options PoolOptions
+
+	mu         sync.RWMutex
+	registries map[string]Registry
+	clients    map[string]*Client
+}
+
+// NewPool creates a pool with an empty catalogue
+func NewPool(options PoolOptions) *Pool {
+	return &Pool{
+		options:    options,
+		registries: make(map[string]Registry),
+		clients:    make(map[string]*Client),
+	}
+}
+
+// Catalogue is a set of registries with their clients built, ready to
+// replace the catalogue of a pool
+type Catalogue struct {
+	registries map[string]Registry
+	clients    map[string]*Client
+}
+
+// Len returns the number of registries in the catalogue
+func (c *Catalogue) Len() int {
+	return len(c.registries)
+}
+
+// Prepare builds the clients of a new catalogue without changing the pool,
+// so an invalid entry is reported before anything is replaced
+func (p *Pool) Prepare(registries []Registry) (*Catalogue, error) {
+	catalogue := &Catalogue{
+		registries: make(map[string]Registry, len(registries)),
+		clients:    make(map[string]*Client, len(registries)),
+	}
+	for _, registry := range registries {
+		client, err := NewRegistryClient(registry, p.options.Keychain)
+		if err != nil {
+			return nil, err
+		}
+		client.cache = p.options.Cache
+		host := registryHost(registry.Host)
+		catalogue.registries[host] = registry
+		catalogue.clients[host] = client
+	}
+
+	return catalogue, nil
+}
+
+// Swap replaces the catalogue with one built by Prepare
+func (p *Pool) Swap(catalogue *Catalogue) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.registries = catalogue.registries
+	p.clients = catalogue.clients
+}
+
+// Client returns the client of a registry, as named by model.Image.Registry;
+// an empty name is the default registry
+func (p *Pool) Client(registry string) (*Client, error) {
+	if registry == "" {
+		registry = p.options.DefaultRegistry
+	}
+	host := registryHost(registry)
+
+	p.mu.RLock()
+	client, ok := p.clients[host]
+	p.mu.RUnlock()
+	if ok {
+		return client, nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if client, ok := p.clients[host]; ok {
+		return client, nil
+	}
+
+	client, err := NewRegistryClient(p.fallback(host), p.options.Keychain)
+	if err != nil {
+		return nil, err
+	}
+	client.cache = p.options.Cache
+	p.clients[host] = client
+
+	return client, nil
+}
+
+// Registries returns the catalogue, ordered by host
+func (p *Pool) Registries() []Registry {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	registries := make([]Registry, 0, len(p.registries))
+	for _, registry := range p.registries {
+		registries = append(registries, registry)
+	}
+	sort.Slice(registries, func(i, j int) bool {
+		return registries[i].Host < registries[j].Host
+	})
+
+	return registries
+}
+
+// fallback describes a registry that is not in the catalogue
+func (p *Pool) fallback(host string) Registry {
+	registry := Registry{Host: host, Auth: AuthKeychain}
+	if host != registryHost(p.options.DefaultRegistry) {
+		return registry
+	}
+
+	// The default registry may be given as a URL, e.g. http://localhost:5000,
+	// which allows plain HTTP
+	if strings.Contains(p.options.DefaultRegistry, "://") {
+		registry.URL = p.options.DefaultRegistry
+		registry.PlainHTTP = strings.HasPrefix(registry.URL, "http://")
+	}
+
+	credentials := p.options.DefaultCredentials
+	if credentials != nil && *credentials != (Credentials{}) {
+		registry.Auth = AuthBasic
+		if credentials.Token != "" {
+			registry.Auth = AuthBearer
+		}
+		registry.Credentials = credentials
+	}
+
+	return registry
+}
@@ -0,0 +1,200 @@
+package docker
+
+import "testing"
+
+func TestPoolCatalogue(t *testing.T) {
+	cache, err := NewCache("", 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := NewPool(PoolOptions{DefaultRegistry: "docker.io", Cache: cache})
+
+	catalogue, err := pool.Prepare([]Registry{
+		{Host: "quay.io", Auth: AuthNone},
+		{Host: "https://GHCR.io", URL: "https://ghcr.example.com/", Auth: AuthBasic, Credentials: &Credentials{Username: "bot", Password: "secret"}},
+		{Host: "index.docker.io", Auth: AuthNone, Mirror: "https://mirror.example.com/"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if catalogue.Len() != 3 {
+		t.Fatalf("Len() = %d, want 3", catalogue.Len())
+	}
+	if len(pool.Registries()) != 0 {
+		t.Fatal("Prepare changed the pool")
+	}
+	pool.Swap(catalogue)
+
+	tests := []struct {
+		registry    string
+		wantURL     string
+		wantMirror  string
+		wantBasicAs string
+	}{
+		{registry: "quay.io", wantURL: "https://quay.io"},
+		{registry: "ghcr.io", wantURL: "https://ghcr.example.com", wantBasicAs: "bot"},
+		{registry: "", wantURL: "https://registry-1.docker.io", wantMirror: "https://mirror.example.com"},
+		{registry: "registry-1.docker.io", wantURL: "https://registry-1.docker.io", wantMirror: "https://mirror.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.registry, func(t *testing.T) {
+			client, err := pool.Client(tt.registry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if client.baseURL != tt.wantURL || client.mirror != tt.wantMirror || client.cache != cache {
+				t.Fatalf("client of %s, mirror %s, cache %v", client.baseURL, client.mirror, client.cache)
+			}
+			if tt.wantBasicAs != "" && (client.credentials == nil || client.credentials.Username != tt.wantBasicAs) {
+				t.Fatalf("credentials %+v, want the catalogue's", client.credentials)
+			}
+		})
+	}
+
+	registries := pool.Registries()
+	if len(registries) != 3 || registries[0].Host != "https://GHCR.io" || registries[1].Host != "index.docker.io" || registries[2].Host != "quay.io" {
+		t.Fatalf("Registries() = %+v, want them ordered by host", registries)
+	}
+
+	// An invalid entry fails the whole catalogue and leaves the pool alone
+	if _, err := pool.Prepare([]Registry{{Host: "quay.io"}, {Host: "local", URL: "http://localhost:5000"}}); err == nil {
+		t.Fatal("expected plain HTTP to be refused")
+	}
+	if len(pool.Registries()) != 3 {
+		t.Fatal("failed Prepare changed the pool")
+	}
+}
+
+func TestPoolFallback(t *testing.T) {
+	keychain, err := NewKeychain(writeDockerConfig(t, t.TempDir(), `{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		options      PoolOptions
+		registry     string
+		wantURL      string
+		wantKeychain bool
+		wantCreds    *Credentials
+	}{
+		{
+			name:         "registry outside the catalogue",
+			options:      PoolOptions{Keychain: keychain, DefaultRegistry: "docker.io"},
+			registry:     "registry.example.com",
+			wantURL:      "https://registry.example.com",
+			wantKeychain: true,
+		},
+		{
+			name:         "default registry",
+			options:      PoolOptions{Keychain: keychain, DefaultRegistry: "docker.io"},
+			registry:     "",
+			wantURL:      "https://registry-1.docker.io",
+			wantKeychain: true,
+		},
+		{
+			name:         "default registry as a plain HTTP URL",
+			options:      PoolOptions{Keychain: keychain, DefaultRegistry: "http://localhost:5000"},
+			registry:     "",
+			wantURL:      "http://localhost:5000",
+			wantKeychain: true,
+		},
+		{
+			name:      "default credentials",
+			options:   PoolOptions{Keychain: keychain, DefaultRegistry: "docker.io", DefaultCredentials: &Credentials{Username: "alice", Password: "secret"}},
+			registry:  "docker.io",
+			wantURL:   "https://registry-1.docker.io",
+			wantCreds: &Credentials{Username: "alice", Password: "secret"},
+		},
+		{
+			name:      "default token",
+			options:   PoolOptions{Keychain: keychain, DefaultRegistry: "https://harbor.example.com", DefaultCredentials: &Credentials{Token: "t0ken"}},
+			registry:  "harbor.example.com",
+			wantURL:   "https://harbor.example.com",
+			wantCreds: &Credentials{Token: "t0ken"},
+		},
+		{
+			name:         "default credentials only for the default registry",
+			options:      PoolOptions{Keychain: keychain, DefaultRegistry: "docker.io", DefaultCredentials: &Credentials{Username: "alice", Password: "secret"}},
+			registry:     "quay.io",
+			wantURL:      "https://quay.io",
+			wantKeychain: true,
+		},
+		{
+			name:         "empty default credentials",
+			options:      PoolOptions{Keychain: keychain, DefaultRegistry: "docker.io", DefaultCredentials: &Credentials{}},
+			registry:     "docker.io",
+			wantURL:      "https://registry-1.docker.io",
+			wantKeychain: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := NewPool(tt.options)
+
+			client, err := pool.Client(tt.registry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if client.baseURL != tt.wantURL {
+				t.Fatalf("client of %s, want %s", client.baseURL, tt.wantURL)
+			}
+			if (client.provider == CredentialProvider(keychain)) != tt.wantKeychain {
+				t.Fatalf("provider %v, want the keychain %v", client.provider, tt.wantKeychain)
+			}
+			if (client.credentials == nil) != (tt.wantCreds == nil) || (client.credentials != nil && *client.credentials != *tt.wantCreds) {
+				t.Fatalf("credentials %+v, want %+v", client.credentials, tt.wantCreds)
+			}
+
+			// Fallback clients are built once and kept outside the catalogue
+			again, err := pool.Client(tt.registry)
+			if err != nil || again != client {
+				t.Fatalf("Client() built a second client: %v", err)
+			}
+			if len(pool.Registries()) != 0 {
+				t.Fatal("fallback registry added to the catalogue")
+			}
+		})
+	}
+}
+
+func TestPoolSwapDropsClients(t *testing.T) {
+	pool := NewPool(PoolOptions{DefaultRegistry: "docker.io"})
+	catalogue, err := pool.Prepare([]Registry{{Host: "quay.io", Auth: AuthNone}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.Swap(catalogue)
+	before, err := pool.Client("quay.io")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	catalogue, err = pool.Prepare([]Registry{{Host: "quay.io", URL: "https://quay.example.com", Auth: AuthNone}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.Swap(catalogue)
+	after, err := pool.Client("quay.io")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after == before || after.baseURL != "https://quay.example.com" {
+		t.Fatalf("client of %s kept after a swap", after.baseURL)
+	}
+
+	// A registry left out of the new catalogue gets a fallback client
+	catalogue, err = pool.Prepare(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.Swap(catalogue)
+	fallback, err := pool.Client("quay.io")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fallback == after || fallback.baseURL != "https://quay.io" {
+		t.Fatalf("client of %s kept after leaving the catalogue", fallback.baseURL)
+	}
+}
@@ -0,0 +1,64 @@
+package docker
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// refreshMargin is how long before they expire minted credentials are
+// replaced, so none expires while a request is in flight
+const refreshMargin = 5 * time.Minute
+
+// CredentialProvider supplies the credentials of a registry host when a
+// request is made. Keychain is one; TokenProvider is another.
+type CredentialProvider interface {
+	Credentials(ctx context.Context, host string) (*Credentials, error)
+}
+
+// TokenSource mints short-lived registry credentials from cloud
+// credentials, returning when they expire
+type TokenSource interface {
+	Token(ctx context.Context) (*Credentials, time.Time, error)
+}
+
+// TokenProvider is a CredentialProvider that keeps the credentials minted by
+// a TokenSource and mints new ones before they expire
+type TokenProvider struct {
+	source TokenSource
+
+	mu          sync.Mutex
+	credentials *Credentials
+	refreshAt   time.Time
+}
+
+// NewTokenProvider creates a provider minting credentials with source
+func NewTokenProvider(source TokenSource) *TokenProvider {
+	return &TokenProvider{source: source}
+}
+
+// Credentials returns the current credentials, minting new ones when they
+// are about to expire
+func (p *TokenProvider) Credentials(ctx context.Context, host string) (*Credentials, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.credentials != nil && time.Now().Before(p.refreshAt) {
+		return p.credentials, nil
+	}
+
+	credentials, expiresAt, err := p.source.Token(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// Replace them refreshMargin before they expire, or halfway through
+	// their life when that is shorter
+	margin := refreshMargin
+	if lifetime := time.Until(expiresAt); lifetime < 2*margin {
+		margin = lifetime / 2
+	}
+	p.credentials = credentials
+	p.refreshAt = expiresAt.Add(-margin)
+
+	return credentials, nil
+}
@@ -0,0 +1,243 @@
+package docker
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xgodev/boost/wrapper/log"
+)
+
+// Ways a client authenticates to a registry
+const (
+	AuthNone     = "none"     // anonymous
+	AuthBasic    = "basic"    // user name and password
+	AuthBearer   = "bearer"   // a static token
+	AuthKeychain = "keychain" // the Docker config.json keychain
+	AuthECR      = "ecr"      // tokens minted by Amazon ECR
+	AuthGCP      = "gcp"      // tokens minted for a GCP service account
+)
+
+// Registry describes how to reach a container registry
+type Registry struct {
+	// Host is how images name the registry, e.g. ghcr.io
+	Host string
+	// URL is the base URL of the registry API, https://<host> by default
+	URL         string
+	Auth        string
+	Credentials *Credentials
+	TLS         TLSConfig
+	// RateLimit is the number of requests per second sent to the registry,
+	// 0 for no limit; Burst requests may be sent at once
+	RateLimit float64
+	Burst     int
+	// Mirror is the base URL of a pull-through cache that is asked first
+	Mirror string
+	// ECR and GCP configure the token providers of AuthECR and AuthGCP
+	ECR ECROptions
+	GCP GCPOptions
+	// PlainHTTP allows talking HTTP to the registry and its mirror, for
+	// local registries; http URLs are refused without it
+	PlainHTTP bool
+	// Proxy is the URL of the proxy to use, "direct" for none; by default
+	// HTTPS_PROXY, HTTP_PROXY and NO_PROXY apply
+	Proxy string
+}
+
+// TLSConfig holds the TLS settings of a registry
+type TLSConfig struct {
+	CAFile string // PEM bundle trusted in addition to the system roots
+	// CertFile and KeyFile hold the client certificate presented to
+	// registries requiring mutual TLS
+	CertFile           string
+	KeyFile            string
+	InsecureSkipVerify bool
+}
+
+// NewRegistryClient creates a client for a registry described in the
+// catalogue. The keychain is only used with AuthKeychain.
+func NewRegistryClient(registry Registry, keychain *Keychain) (*Client, error) {
+	baseURL := registry.URL
+	if baseURL == "" {
+		baseURL = defaultURL(registry.Host, registry.PlainHTTP)
+	}
+	for _, u := range []string{baseURL, registry.Mirror} {
+		if strings.HasPrefix(u, "http://") && !registry.PlainHTTP {
+			return nil, fmt.Errorf("registry %s: %s uses plain HTTP, which must be allowed explicitly", registry.Host, u)
+		}
+	}
+	if registry.PlainHTTP || registry.TLS.InsecureSkipVerify {
+		log.Warnf("Registry %s is reached without verifying its identity (plain HTTP: %t, skip TLS verification: %t)",
+			registry.Host, registry.PlainHTTP, registry.TLS.InsecureSkipVerify)
+	}
+
+	client := NewClient(strings.TrimSuffix(baseURL, "/"), nil)
+	client.mirror = strings.TrimSuffix(registry.Mirror, "/")
+
+	switch registry.Auth {
+	case AuthNone:
+	case AuthBasic, AuthBearer:
+		client.credentials = registry.Credentials
+	case AuthKeychain, "":
+		if keychain != nil {
+			client.provider = keychain
+		}
+	case AuthECR:
+		source, err := NewECRTokenSource(registry.ECR)
+		if err != nil {
+			return nil, fmt.Errorf("registry %s: %w", registry.Host, err)
+		}
+		client.provider = NewTokenProvider(source)
+	case AuthGCP:
+		source, err := NewGCPTokenSource(registry.GCP)
+		if err != nil {
+			return nil, fmt.Errorf("registry %s: %w", registry.Host, err)
+		}
+		client.provider = NewTokenProvider(source)
+	default:
+		return nil, fmt.Errorf("registry %s: unknown auth type %q", registry.Host, registry.Auth)
+	}
+
+	transport, err := newTransport(registry.TLS, registry.Proxy)
+	if err != nil {
+		return nil, fmt.Errorf("registry %s: %w", registry.Host, err)
+	}
+	client.httpClient.Transport = transport
+
+	if registry.RateLimit > 0 {
+		client.limiter = newRateLimiter(registry.RateLimit, registry.Burst)
+	}
+
+	return client, nil
+}
+
+// newTransport returns an HTTP transport using the TLS and proxy settings.
+// Every file is read here, so a bad setting fails when the catalogue is
+// loaded rather than on the first request.
+func newTransport(config TLSConfig, proxy string) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+
+	if config.CAFile != "" {
+		pem, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("CA bundle %s holds no PEM certificate", config.CAFile)
+		}
+		transport.TLSClientConfig.RootCAs = roots
+	}
+
+	if config.CertFile != "" || config.KeyFile != "" {
+		if config.CertFile == "" || config.KeyFile == "" {
+			return nil, errors.New("a client certificate needs both a certificate and a key file")
+		}
+		certificate, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse client certificate: %w", err)
+		}
+		if now := time.Now(); now.After(leaf.NotAfter) || now.Before(leaf.NotBefore) {
+			return nil, fmt.Errorf("client certificate %s is only valid from %s to %s",
+				config.CertFile, leaf.NotBefore.Format(time.RFC3339), leaf.NotAfter.Format(time.RFC3339))
+		}
+		transport.TLSClientConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	switch proxy {
+	case "":
+	case "direct":
+		transport.Proxy = nil
+	default:
+		proxyURL, err := url.Parse(proxy)
+		if err != nil || proxyURL.Host == "" {
+			return nil, fmt.Errorf("proxy %q is not a URL", proxy)
+		}
+		switch proxyURL.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return nil, fmt.Errorf("proxy %q must be an http, https or socks5 URL", proxy)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	return transport, nil
+}
+
+// defaultURL returns the API URL of a registry host; Docker Hub serves its
+// API from another host than the one images are named by
+func defaultURL(host string, plainHTTP bool) string {
+	if registryHost(host) == "docker.io" {
+		return "https://registry-1.docker.io"
+	}
+	if plainHTTP {
+		return "http://" + host
+	}
+	return "https://" + host
+}
+
+// rateLimiter spaces requests out to a number per second, letting a burst
+// through at once
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	burst    int
+	next     time.Time // when the request after the burst may be sent
+}
+
+// newRateLimiter creates a limiter of perSecond requests
+func newRateLimiter(perSecond float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		interval: time.Duration(float64(time.Second) / perSecond),
+		burst:    burst,
+	}
+}
+
+// wait blocks until a request may be sent or ctx is done
+func (l *rateLimiter) wait(ctx context.Context) error {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	allowedAt := l.next.Add(-time.Duration(l.burst-1) * l.interval)
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+
+	delay := allowedAt.Sub(now)
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
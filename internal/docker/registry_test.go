@@ -0,0 +1,276 @@
+package docker
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for TLS tests
+type testCA struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	pem         []byte
+}
+
+// newTestCA creates a self-signed CA
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCA{
+		certificate: certificate,
+		key:         key,
+		pem:         pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+// issue returns a certificate valid from notBefore to notAfter, for a server
+// on 127.0.0.1 when server is set and for client authentication otherwise
+func (ca *testCA) issue(t *testing.T, server bool, notBefore, notAfter time.Time) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if server {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		template.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1)}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.certificate, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// writeKeyPair writes a certificate and its key as PEM files and returns
+// their paths
+func writeKeyPair(t *testing.T, certificate tls.Certificate) (string, string) {
+	t.Helper()
+
+	der, err := x509.MarshalECPrivateKey(certificate.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "client.crt")
+	keyFile := filepath.Join(dir, "client.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Certificate[0]}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// writeFile writes content into a temporary file and returns its path
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestNewRegistryClient(t *testing.T) {
+	keychain, err := NewKeychain(writeDockerConfig(t, t.TempDir(), `{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		registry     Registry
+		wantErr      string
+		wantURL      string
+		wantKeychain bool
+	}{
+		{name: "HTTPS by default", registry: Registry{Host: "quay.io"}, wantURL: "https://quay.io", wantKeychain: true},
+		{name: "Docker Hub", registry: Registry{Host: "docker.io", Auth: AuthNone}, wantURL: "https://registry-1.docker.io"},
+		{name: "plain HTTP allowed", registry: Registry{Host: "localhost:5000", Auth: AuthNone, PlainHTTP: true}, wantURL: "http://localhost:5000"},
+		{name: "plain HTTP URL", registry: Registry{Host: "local", URL: "http://localhost:5000"}, wantErr: "must be allowed explicitly"},
+		{name: "plain HTTP mirror", registry: Registry{Host: "quay.io", Mirror: "http://mirror:5000"}, wantErr: "must be allowed explicitly"},
+		{name: "unknown auth", registry: Registry{Host: "quay.io", Auth: "kerberos"}, wantErr: `unknown auth type "kerberos"`},
+		{name: "ECR without region", registry: Registry{Host: "ecr", Auth: AuthECR}, wantErr: "ECR region is required"},
+		{name: "GCP without key", registry: Registry{Host: "gcr.io", Auth: AuthGCP, GCP: GCPOptions{KeyFile: "missing.json"}}, wantErr: "GCP service account key"},
+		{name: "invalid proxy", registry: Registry{Host: "quay.io", Proxy: "ftp://proxy:21"}, wantErr: "registry quay.io: proxy"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := NewRegistryClient(tt.registry, keychain)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected an error reporting %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if client.baseURL != tt.wantURL {
+				t.Fatalf("client of %s, want %s", client.baseURL, tt.wantURL)
+			}
+			if (client.provider == CredentialProvider(keychain)) != tt.wantKeychain {
+				t.Fatalf("provider %v, want the keychain %v", client.provider, tt.wantKeychain)
+			}
+		})
+	}
+}
+
+func TestNewTransportRejectsInvalidSettings(t *testing.T) {
+	ca := newTestCA(t)
+	now := time.Now()
+	certFile, keyFile := writeKeyPair(t, ca.issue(t, false, now.Add(-time.Hour), now.Add(time.Hour)))
+	expiredCert, expiredKey := writeKeyPair(t, ca.issue(t, false, now.Add(-2*time.Hour), now.Add(-time.Hour)))
+	otherCert, _ := writeKeyPair(t, ca.issue(t, false, now.Add(-time.Hour), now.Add(time.Hour)))
+
+	tests := []struct {
+		name    string
+		config  TLSConfig
+		proxy   string
+		wantErr string
+	}{
+		{name: "missing CA bundle", config: TLSConfig{CAFile: filepath.Join(t.TempDir(), "ca.pem")}, wantErr: "failed to read CA bundle"},
+		{name: "CA bundle without certificate", config: TLSConfig{CAFile: writeFile(t, "ca.pem", "not a certificate")}, wantErr: "holds no PEM certificate"},
+		{name: "certificate without key", config: TLSConfig{CertFile: certFile}, wantErr: "needs both a certificate and a key file"},
+		{name: "key without certificate", config: TLSConfig{KeyFile: keyFile}, wantErr: "needs both a certificate and a key file"},
+		{name: "key of another certificate", config: TLSConfig{CertFile: otherCert, KeyFile: keyFile}, wantErr: "failed to load client certificate"},
+		{name: "expired certificate", config: TLSConfig{CertFile: expiredCert, KeyFile: expiredKey}, wantErr: "is only valid from"},
+		{name: "proxy not a URL", proxy: "proxy:3128", wantErr: "is not a URL"},
+		{name: "proxy scheme", proxy: "ftp://proxy:21", wantErr: "must be an http, https or socks5 URL"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newTransport(tt.config, tt.proxy)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected an error reporting %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestNewTransportProxy(t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet, "https://quay.io/v2/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		proxy string
+		want  string // proxy used for req, empty for none
+	}{
+		{proxy: "direct"},
+		{proxy: "http://proxy.example.com:3128", want: "http://proxy.example.com:3128"},
+		{proxy: "socks5://proxy.example.com:1080", want: "socks5://proxy.example.com:1080"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.proxy, func(t *testing.T) {
+			transport, err := newTransport(TLSConfig{}, tt.proxy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.want == "" {
+				if transport.Proxy != nil {
+					t.Fatal("proxy used with direct")
+				}
+				return
+			}
+			proxyURL, err := transport.Proxy(req)
+			if err != nil || proxyURL == nil || proxyURL.String() != tt.want {
+				t.Fatalf("proxy = %v, %v, want %s", proxyURL, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegistryTLS(t *testing.T) {
+	ca := newTestCA(t)
+	now := time.Now()
+	clientCert, clientKey := writeKeyPair(t, ca.issue(t, false, now.Add(-time.Hour), now.Add(time.Hour)))
+	caFile := writeFile(t, "ca.pem", string(ca.pem))
+
+	serverCert := ca.issue(t, true, now.Add(-time.Hour), now.Add(time.Hour))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.certificate)
+
+	tests := []struct {
+		name       string
+		config     TLSConfig
+		clientAuth tls.ClientAuthType
+		wantErr    bool
+	}{
+		{name: "unknown CA", wantErr: true},
+		{name: "CA bundle", config: TLSConfig{CAFile: caFile}},
+		{name: "verification skipped", config: TLSConfig{InsecureSkipVerify: true}},
+		{name: "client certificate", config: TLSConfig{CAFile: caFile, CertFile: clientCert, KeyFile: clientKey}, clientAuth: tls.RequireAndVerifyClientCert},
+		{name: "client certificate missing", config: TLSConfig{CAFile: caFile}, clientAuth: tls.RequireAndVerifyClientCert, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			server.TLS = &tls.Config{Certificates: []tls.Certificate{serverCert}, ClientCAs: clientCAs, ClientAuth: tt.clientAuth}
+			server.StartTLS()
+			defer server.Close()
+
+			client, err := NewRegistryClient(Registry{Host: "registry", URL: server.URL, Auth: AuthNone, TLS: tt.config}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.httpClient.Get(server.URL + "/v2/")
+			if err == nil {
+				resp.Body.Close()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("request error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,242 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Retry policy of registry requests
+const (
+	maxAttempts   = 4
+	baseBackoff   = 500 * time.Millisecond
+	maxBackoff    = 30 * time.Second
+	maxRetryAfter = time.Minute // a registry asking to wait longer is not retried
+)
+
+// Circuit breaker settings: after breakerThreshold failed requests in a row
+// the registry is not called for breakerCooldown, then one request probes it
+const (
+	breakerThreshold = 5
+	breakerCooldown  = 30 * time.Second
+)
+
+// quotaReserve is the fraction of the rate limit quota below which requests
+// are spread over the rest of the window
+const quotaReserve = 0.1
+
+// backoff returns how long to wait before retrying a request, honouring
+// Retry-After; false means the request should not be retried
+func backoff(attempt int, resp *http.Response, err error) (time.Duration, bool) {
+	if attempt+1 >= maxAttempts {
+		return 0, false
+	}
+
+	if err != nil {
+		// Failed token requests are retried like any response
+		var registryErr *RegistryError
+		if errors.As(err, &registryErr) && registryErr.Status != 0 {
+			if !transient(registryErr.Status) {
+				return 0, false
+			}
+			if registryErr.RetryAfter > 0 {
+				return registryErr.RetryAfter, registryErr.RetryAfter <= maxRetryAfter
+			}
+			return jitter(attempt), true
+		}
+		// Transport errors are retried, cancellations are not
+		return jitter(attempt), !cancelled(err)
+	}
+
+	if !transient(resp.StatusCode) {
+		return 0, false
+	}
+	if wait := retryAfter(resp.Header.Get("Retry-After")); wait > 0 {
+		return wait, wait <= maxRetryAfter
+	}
+	return jitter(attempt), true
+}
+
+// transient reports whether a status may go away on its own
+func transient(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusRequestTimeout,
+		http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// jitter returns an exponential backoff with full jitter, between half and
+// all of the nominal delay
+func jitter(attempt int) time.Duration {
+	delay := baseBackoff << attempt
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// sleep waits for d or until ctx is done
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// breaker stops calling a registry that keeps failing
+type breaker struct {
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// allow returns an error while the circuit is open. Once the cooldown is
+// over a single request is let through to probe the registry.
+func (b *breaker) allow(now time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < breakerThreshold {
+		return nil
+	}
+
+	if wait := b.openUntil.Sub(now); wait > 0 || b.probing {
+		return &RegistryError{
+			Kind:       ErrUnavailable,
+			Message:    "not called after repeated failures",
+			RetryAfter: wait,
+		}
+	}
+
+	b.probing = true
+	return nil
+}
+
+// record counts a request, ended at now, as failed or successful
+func (b *breaker) record(failed bool, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+	if !failed {
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.failures >= breakerThreshold {
+		b.openUntil = now.Add(breakerCooldown)
+	}
+}
+
+// abort ends a request that was given up before reaching the registry
+func (b *breaker) abort() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+}
+
+// failed reports whether a request counts against the breaker: the
+// registry could not be reached or answered with a server error
+func failed(resp *http.Response, err error) bool {
+	status := 0
+	if err == nil {
+		status = resp.StatusCode
+	} else {
+		var registryErr *RegistryError
+		if !errors.As(err, &registryErr) {
+			return !cancelled(err)
+		}
+		status = registryErr.Status
+	}
+	return status >= http.StatusInternalServerError || status == http.StatusRequestTimeout
+}
+
+// cancelled reports whether a request failed because its context ended
+func cancelled(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// quota follows the ratelimit-limit and ratelimit-remaining headers of
+// registries such as Docker Hub, and spreads the requests left over the
+// rest of the window when few remain, instead of running into 429s
+type quota struct {
+	mu        sync.Mutex
+	notBefore time.Time
+}
+
+// delay returns how long after now the next request may be sent. Rather
+// than holding a request for long, it fails with ErrRateLimited.
+func (q *quota) delay(now time.Time) (time.Duration, error) {
+	q.mu.Lock()
+	delay := q.notBefore.Sub(now)
+	q.mu.Unlock()
+
+	if delay > maxRetryAfter {
+		return 0, &RegistryError{
+			Kind:       ErrRateLimited,
+			Message:    "the remaining quota is kept for later requests",
+			RetryAfter: delay,
+		}
+	}
+	return delay, nil
+}
+
+// update reads the quota headers of a response received at now
+func (q *quota) update(header http.Header, now time.Time) {
+	limit, window, ok := parseRateLimit(header.Get("RateLimit-Limit"))
+	if !ok || limit == 0 || window == 0 {
+		return
+	}
+	remaining, _, ok := parseRateLimit(header.Get("RateLimit-Remaining"))
+	if !ok || float64(remaining) >= float64(limit)*quotaReserve {
+		return
+	}
+
+	// Below the reserve, requests are sent no faster than the window gives
+	// them back
+	spacing := window / time.Duration(limit)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.notBefore = now.Add(spacing)
+}
+
+// parseRateLimit parses a value like "100;w=21600"
+func parseRateLimit(value string) (int, time.Duration, bool) {
+	if value == "" {
+		return 0, 0, false
+	}
+
+	count, params, _ := strings.Cut(value, ";")
+	n, err := strconv.Atoi(strings.TrimSpace(count))
+	if err != nil || n < 0 {
+		return 0, 0, false
+	}
+
+	window := time.Duration(0)
+	for _, param := range strings.Split(params, ";") {
+		if key, v, ok := strings.Cut(strings.TrimSpace(param), "="); ok && key == "w" {
+			if seconds, err := strconv.Atoi(v); err == nil {
+				window = time.Duration(seconds) * time.Second
+			}
+		}
+	}
+
+	return n, window, true
+}
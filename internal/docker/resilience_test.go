@@ -0,0 +1,451 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testClock is a clock that only moves when a client waits
+type testClock struct {
+	mu    sync.Mutex
+	now   time.Time
+	waits []time.Duration
+}
+
+// Now returns the current time
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Wait records a pause and moves the clock past it
+func (c *testClock) Wait(ctx context.Context, d time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.waits = append(c.waits, d)
+	c.now = c.now.Add(d)
+	return ctx.Err()
+}
+
+// Advance moves the clock
+func (c *testClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// Waits returns the pauses so far and forgets them
+func (c *testClock) Waits() []time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	waits := c.waits
+	c.waits = nil
+	return waits
+}
+
+// scriptedRegistry answers tag lists with the statuses it is given, then
+// with 200, and counts the requests it gets
+type scriptedRegistry struct {
+	mu       sync.Mutex
+	statuses []int
+	header   http.Header // sent with every response
+	requests int
+}
+
+func (r *scriptedRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.requests++
+	for key, values := range r.header {
+		w.Header()[key] = values
+	}
+	if len(r.statuses) > 0 {
+		status := r.statuses[0]
+		r.statuses = r.statuses[1:]
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+	}
+	fmt.Fprint(w, `{"name":"team/app","tags":["1.0"]}`)
+}
+
+// script sets the next statuses and returns the requests received so far
+func (r *scriptedRegistry) script(statuses ...int) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.statuses = statuses
+	return r.requests
+}
+
+// newScriptedClient starts a registry and returns a client on a test clock
+func newScriptedClient(t *testing.T, registry *scriptedRegistry) (*Client, *testClock) {
+	t.Helper()
+
+	server := httptest.NewServer(registry)
+	t.Cleanup(server.Close)
+
+	clock := &testClock{now: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}
+	client := NewClient(server.URL, nil)
+	client.now = clock.Now
+	client.wait = clock.Wait
+	return client, clock
+}
+
+func TestBackoff(t *testing.T) {
+	response := func(status int, retryAfter string) *http.Response {
+		resp := &http.Response{StatusCode: status, Header: http.Header{}}
+		if retryAfter != "" {
+			resp.Header.Set("Retry-After", retryAfter)
+		}
+		return resp
+	}
+
+	tests := []struct {
+		name      string
+		attempt   int
+		resp      *http.Response
+		err       error
+		wantRetry bool
+		wantMin   time.Duration
+		wantMax   time.Duration
+	}{
+		{name: "server error", resp: response(http.StatusServiceUnavailable, ""), wantRetry: true, wantMin: baseBackoff / 2, wantMax: baseBackoff},
+		{name: "exponential", attempt: 2, resp: response(http.StatusBadGateway, ""), wantRetry: true, wantMin: 2 * baseBackoff, wantMax: 4 * baseBackoff},
+		{name: "Retry-After", resp: response(http.StatusTooManyRequests, "3"), wantRetry: true, wantMin: 3 * time.Second, wantMax: 3 * time.Second},
+		{name: "Retry-After too long", resp: response(http.StatusTooManyRequests, "120")},
+		{name: "last attempt", attempt: maxAttempts - 1, resp: response(http.StatusServiceUnavailable, "")},
+		{name: "not found", resp: response(http.StatusNotFound, "")},
+		{name: "unauthorized", resp: response(http.StatusUnauthorized, "")},
+		{name: "transport error", err: errors.New("connection reset"), wantRetry: true, wantMin: baseBackoff / 2, wantMax: baseBackoff},
+		{name: "cancelled", err: fmt.Errorf("request: %w", context.Canceled)},
+		{name: "deadline", err: context.DeadlineExceeded},
+		{
+			name:      "failed token request",
+			err:       &RegistryError{Kind: ErrUnavailable, Status: http.StatusBadGateway, RetryAfter: 2 * time.Second},
+			wantRetry: true, wantMin: 2 * time.Second, wantMax: 2 * time.Second,
+		},
+		{name: "refused token request", err: &RegistryError{Kind: ErrUnauthorized, Status: http.StatusUnauthorized}},
+		{name: "token request without a response", err: &RegistryError{Err: errors.New("connection refused")}, wantRetry: true, wantMin: baseBackoff / 2, wantMax: baseBackoff},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wait, retry := backoff(tt.attempt, tt.resp, tt.err)
+			if retry != tt.wantRetry {
+				t.Fatalf("backoff() retry = %v, want %v", retry, tt.wantRetry)
+			}
+			if retry && (wait < tt.wantMin || wait > tt.wantMax) {
+				t.Fatalf("backoff() = %s, want between %s and %s", wait, tt.wantMin, tt.wantMax)
+			}
+		})
+	}
+}
+
+func TestJitter(t *testing.T) {
+	for attempt := 0; attempt < 10; attempt++ {
+		nominal := baseBackoff << attempt
+		if nominal > maxBackoff {
+			nominal = maxBackoff
+		}
+		for i := 0; i < 100; i++ {
+			if d := jitter(attempt); d < nominal/2 || d > nominal {
+				t.Fatalf("jitter(%d) = %s, want between %s and %s", attempt, d, nominal/2, nominal)
+			}
+		}
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	var b breaker
+
+	// Successes reset the count of failures in a row
+	for i := 0; i < breakerThreshold-1; i++ {
+		b.record(true, now)
+	}
+	b.record(false, now)
+	for i := 0; i < breakerThreshold-1; i++ {
+		b.record(true, now)
+	}
+	if err := b.allow(now); err != nil {
+		t.Fatalf("circuit opened below the threshold: %v", err)
+	}
+
+	b.record(true, now)
+	err := b.allow(now.Add(time.Second))
+	var registryErr *RegistryError
+	if !errors.Is(err, ErrUnavailable) || !errors.As(err, &registryErr) || registryErr.RetryAfter != breakerCooldown-time.Second {
+		t.Fatalf("expected the circuit open for the cooldown, got %v", err)
+	}
+	if err := b.allow(now.Add(breakerCooldown - time.Nanosecond)); !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("circuit closed before the cooldown: %v", err)
+	}
+
+	// One request probes the registry once the cooldown is over
+	now = now.Add(breakerCooldown)
+	if err := b.allow(now); err != nil {
+		t.Fatalf("probe refused: %v", err)
+	}
+	if err := b.allow(now); !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("second request let through while probing: %v", err)
+	}
+
+	// A failed probe opens the circuit for another cooldown
+	b.record(true, now)
+	if err := b.allow(now.Add(breakerCooldown - time.Nanosecond)); !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("circuit closed after a failed probe: %v", err)
+	}
+
+	// A probe given up lets another through
+	now = now.Add(breakerCooldown)
+	if err := b.allow(now); err != nil {
+		t.Fatalf("probe refused: %v", err)
+	}
+	b.abort()
+	if err := b.allow(now); err != nil {
+		t.Fatalf("probe refused after an aborted one: %v", err)
+	}
+
+	// A successful probe closes the circuit
+	b.record(false, now)
+	for i := 0; i < breakerThreshold; i++ {
+		if err := b.allow(now); err != nil {
+			t.Fatalf("circuit still open after a successful probe: %v", err)
+		}
+	}
+}
+
+func TestFailed(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		err    error
+		want   bool
+	}{
+		{name: "success", status: http.StatusOK},
+		{name: "not found", status: http.StatusNotFound},
+		{name: "rate limited", status: http.StatusTooManyRequests},
+		{name: "server error", status: http.StatusInternalServerError, want: true},
+		{name: "timeout", status: http.StatusRequestTimeout, want: true},
+		{name: "transport error", err: errors.New("connection refused"), want: true},
+		{name: "cancelled", err: context.Canceled},
+		{name: "failed token request", err: &RegistryError{Status: http.StatusServiceUnavailable}, want: true},
+		{name: "refused token request", err: &RegistryError{Status: http.StatusUnauthorized}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resp *http.Response
+			if tt.err == nil {
+				resp = &http.Response{StatusCode: tt.status}
+			}
+			if got := failed(resp, tt.err); got != tt.want {
+				t.Fatalf("failed() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQuota(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	header := func(limit, remaining string) http.Header {
+		return http.Header{"Ratelimit-Limit": {limit}, "Ratelimit-Remaining": {remaining}}
+	}
+
+	var q quota
+	q.update(header("100;w=100", "10;w=100"), now)
+	if delay, err := q.delay(now); err != nil || delay > 0 {
+		t.Fatalf("delay() = %s, %v above the reserve", delay, err)
+	}
+
+	// Below the reserve requests are spaced by the window over the limit
+	q.update(header("100;w=100", "9;w=100"), now)
+	if delay, err := q.delay(now); err != nil || delay != time.Second {
+		t.Fatalf("delay() = %s, %v, want 1s", delay, err)
+	}
+	if delay, err := q.delay(now.Add(time.Second)); err != nil || delay > 0 {
+		t.Fatalf("delay() = %s, %v once the spacing passed", delay, err)
+	}
+
+	// Spacing longer than a request may be held fails fast
+	q.update(header("10;w=3600", "0;w=3600"), now)
+	_, err := q.delay(now)
+	var registryErr *RegistryError
+	if !errors.Is(err, ErrRateLimited) || !errors.As(err, &registryErr) || registryErr.RetryAfter != 6*time.Minute {
+		t.Fatalf("expected ErrRateLimited for 6m, got %v", err)
+	}
+
+	// Headers without a window are ignored
+	var other quota
+	other.update(header("100", "0"), now)
+	if delay, err := other.delay(now); err != nil || delay > 0 {
+		t.Fatalf("delay() = %s, %v without a window", delay, err)
+	}
+}
+
+func TestParseRateLimit(t *testing.T) {
+	tests := []struct {
+		value      string
+		wantCount  int
+		wantWindow time.Duration
+		wantOK     bool
+	}{
+		{value: "100;w=21600", wantCount: 100, wantWindow: 6 * time.Hour, wantOK: true},
+		{value: " 76 ; w=21600 ", wantCount: 76, wantWindow: 6 * time.Hour, wantOK: true},
+		{value: "100;burst=10;w=60", wantCount: 100, wantWindow: time.Minute, wantOK: true},
+		{value: "100", wantCount: 100, wantOK: true},
+		{value: ""},
+		{value: "many;w=60"},
+		{value: "-1;w=60"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			count, window, ok := parseRateLimit(tt.value)
+			if count != tt.wantCount || window != tt.wantWindow || ok != tt.wantOK {
+				t.Fatalf("parseRateLimit() = %d, %s, %v, want %d, %s, %v", count, window, ok, tt.wantCount, tt.wantWindow, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestFetchRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		statuses     []int
+		retryAfter   string
+		wantErr      error
+		wantRequests int
+		wantWaits    []time.Duration // exact pauses, when Retry-After sets them
+	}{
+		{name: "success", statuses: []int{http.StatusOK}, wantRequests: 1},
+		{name: "transient failures", statuses: []int{http.StatusServiceUnavailable, http.StatusBadGateway}, wantRequests: 3},
+		{name: "Retry-After", statuses: []int{http.StatusTooManyRequests}, retryAfter: "2", wantRequests: 2, wantWaits: []time.Duration{2 * time.Second}},
+		{name: "Retry-After too long", statuses: []int{http.StatusTooManyRequests}, retryAfter: "3600", wantRequests: 1, wantErr: ErrRateLimited},
+		{
+			name:         "attempts exhausted",
+			statuses:     []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable},
+			wantRequests: maxAttempts, wantErr: ErrUnavailable,
+		},
+		{name: "not found", statuses: []int{http.StatusNotFound}, wantRequests: 1, wantErr: ErrNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := &scriptedRegistry{statuses: tt.statuses}
+			if tt.retryAfter != "" {
+				registry.header = http.Header{"Retry-After": {tt.retryAfter}}
+			}
+			client, clock := newScriptedClient(t, registry)
+
+			_, err := client.ListTags(context.Background(), "team", "app")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+			if requests := registry.script(); requests != tt.wantRequests {
+				t.Fatalf("%d requests, want %d", requests, tt.wantRequests)
+			}
+
+			waits := clock.Waits()
+			if len(waits) != tt.wantRequests-1 {
+				t.Fatalf("%d pauses, want one between attempts: %v", len(waits), waits)
+			}
+			for i, wait := range waits {
+				if tt.wantWaits != nil {
+					if wait != tt.wantWaits[i] {
+						t.Fatalf("pauses %v, want %v", waits, tt.wantWaits)
+					}
+					continue
+				}
+				if nominal := baseBackoff << i; wait < nominal/2 || wait > nominal {
+					t.Fatalf("pause %d of %s, want between %s and %s", i, wait, nominal/2, nominal)
+				}
+			}
+		})
+	}
+}
+
+func TestFetchCircuitBreaker(t *testing.T) {
+	ctx := context.Background()
+	registry := &scriptedRegistry{}
+	client, clock := newScriptedClient(t, registry)
+
+	failing := make([]int, breakerThreshold*maxAttempts)
+	for i := range failing {
+		failing[i] = http.StatusInternalServerError
+	}
+	registry.script(failing...)
+	for i := 0; i < breakerThreshold; i++ {
+		if _, err := client.ListTags(ctx, "team", "app"); !errors.Is(err, ErrUnavailable) {
+			t.Fatalf("expected ErrUnavailable, got %v", err)
+		}
+	}
+
+	// The registry is left alone while the circuit is open
+	before := registry.script()
+	clock.Advance(breakerCooldown / 2)
+	_, err := client.ListTags(ctx, "team", "app")
+	var registryErr *RegistryError
+	if !errors.As(err, &registryErr) || registryErr.Kind != ErrUnavailable || registryErr.Status != 0 {
+		t.Fatalf("expected the circuit open, got %v", err)
+	}
+	if requests := registry.script(); requests != before {
+		t.Fatalf("%d requests sent while the circuit was open", requests-before)
+	}
+
+	// Once the cooldown is over a successful probe closes it
+	clock.Advance(breakerCooldown / 2)
+	for i := 0; i < 2; i++ {
+		if _, err := client.ListTags(ctx, "team", "app"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if requests := registry.script(); requests != before+2 {
+		t.Fatalf("%d requests after the cooldown, want 2", requests-before)
+	}
+}
+
+func TestFetchFollowsQuota(t *testing.T) {
+	ctx := context.Background()
+	registry := &scriptedRegistry{header: http.Header{
+		"Ratelimit-Limit":     {"100;w=21600"},
+		"Ratelimit-Remaining": {"5;w=21600"},
+	}}
+	client, clock := newScriptedClient(t, registry)
+
+	if _, err := client.ListTags(ctx, "team", "app"); err != nil {
+		t.Fatal(err)
+	}
+	if waits := clock.Waits(); len(waits) != 0 {
+		t.Fatalf("first request held for %v", waits)
+	}
+
+	// 100 requests in 6 hours leave 216s between requests, longer than a
+	// request is held
+	_, err := client.ListTags(ctx, "team", "app")
+	var registryErr *RegistryError
+	if !errors.As(err, &registryErr) || registryErr.Kind != ErrRateLimited || registryErr.RetryAfter != 216*time.Second {
+		t.Fatalf("expected ErrRateLimited for 216s, got %v", err)
+	}
+	if requests := registry.script(); requests != 1 {
+		t.Fatalf("%d requests, the quota was not kept", requests)
+	}
+
+	// Shorter spacing is waited for
+	registry.header.Set("Ratelimit-Limit", "100;w=100")
+	clock.Advance(216 * time.Second)
+	if _, err := client.ListTags(ctx, "team", "app"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.ListTags(ctx, "team", "app"); err != nil {
+		t.Fatal(err)
+	}
+	if waits := clock.Waits(); len(waits) != 1 || waits[0] != time.Second {
+		t.Fatalf("pauses %v, want 1s", waits)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/go-git/go-git/v5"
@@ -19,6 +20,7 @@ import (
 
 // Client handles Git repository operations
 type Client struct {
+	mu          sync.Mutex // serialises the use of the working copies
 	auth        transport.AuthMethod
 	cloneDir    string
 	defaultUser string
@@ -36,8 +38,8 @@ func NewClient(authType, username, password, sshKeyPath, cloneDir string) (*Clie
 		if err != nil {
 			return nil, fmt.Errorf("failed to create SSH auth: %w", err)
 		}
-	} else {
-		// Default to HTTPS
+	} else if username != "" || password != "" {
+		// Default to HTTPS, anonymous without credentials
 		auth = &http.BasicAuth{
 			Username: username,
 			Password: password,
@@ -127,12 +129,14 @@ func (c *Client) GetFile(ctx context.Context, repoDir, filePath string) (*model.
 	lastCommit, err := c.getLastCommitForFile(repo, filePath)
 	if err != nil {
 		log.Warnf("Failed to get last commit for file: %v", err)
+		lastCommit = commit
 	}
 
 	return &model.File{
 		Path:       filePath,
 		Type:       "file",
 		LastCommit: lastCommit.Hash.String(),
+		LastAuthor: lastCommit.Author.Name,
 		LastUpdate: lastCommit.Author.When.Format(time.RFC3339),
 		Content:    content,
 	}, nil
@@ -148,6 +152,22 @@ func (c *Client) UpdateFile(ctx context.Context, repoDir, filePath, content, com
 		return fmt.Errorf("failed to open repository: %w", err)
 	}
 
+	if err := c.commit(repo, repoDir, filePath, content, commitMessage); err != nil {
+		return err
+	}
+
+	// Push the changes
+	if err := repo.Push(&git.PushOptions{
+		Auth: c.auth,
+	}); err != nil {
+		return fmt.Errorf("failed to push changes: %w", err)
+	}
+
+	return nil
+}
+
+// commit writes a file to the working copy and commits it
+func (c *Client) commit(repo *git.Repository, repoDir, filePath, content, commitMessage string) error {
 	// Get the worktree
 	worktree, err := repo.Worktree()
 	if err != nil {
@@ -185,13 +205,6 @@ func (c *Client) UpdateFile(ctx context.Context, repoDir, filePath, content, com
 		return fmt.Errorf("failed to commit changes: %w", err)
 	}
 
-	// Push the changes
-	if err := repo.Push(&git.PushOptions{
-		Auth: c.auth,
-	}); err != nil {
-		return fmt.Errorf("failed to push changes: %w", err)
-	}
-
 	return nil
 }
 
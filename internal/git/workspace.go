@@ -0,0 +1,244 @@
+package git
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/jpfaria/image-updater/internal/model"
+	"github.com/xgodev/boost/wrapper/log"
+)
+
+// ErrFileNotFound is returned when a path does not exist on a branch
+var ErrFileNotFound = errors.New("file not found")
+
+// Repositories are kept cloned under the clone directory, one working copy
+// per URL and branch, and brought up to date with the remote before every
+// read and write so hand edits made in Git are seen.
+
+// ReadFile reads a file from the tracked branch of a repository
+func (c *Client) ReadFile(ctx context.Context, repository model.Repository, path string) (*model.File, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	repo, err := c.sync(ctx, repository)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.readFile(repo, path)
+}
+
+// ListFiles lists the files of the tracked branch of a repository
+func (c *Client) ListFiles(ctx context.Context, repository model.Repository) ([]model.File, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	repo, err := c.sync(ctx, repository)
+	if err != nil {
+		return nil, err
+	}
+
+	head, err := headCommit(repo)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := head.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tree: %w", err)
+	}
+
+	files := make([]model.File, 0)
+	err = tree.Files().ForEach(func(f *object.File) error {
+		files = append(files, model.File{
+			Path:       f.Name,
+			Type:       "file",
+			LastCommit: head.Hash.String(),
+			LastUpdate: head.Author.When.Format(time.RFC3339),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files: %w", err)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+
+	return files, nil
+}
+
+// WriteFile commits a file and pushes it. An empty branch, or the tracked
+// branch, commits on top of the tracked branch; another branch is created
+// from the tracked branch, replacing any previous commits on it.
+func (c *Client) WriteFile(ctx context.Context, repository model.Repository, branch, path, content, message string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	repo, err := c.sync(ctx, repository)
+	if err != nil {
+		return err
+	}
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return fmt.Errorf("failed to get worktree: %w", err)
+	}
+
+	tracked := plumbing.NewBranchReferenceName(repository.Branch)
+	target := tracked
+	if branch != "" && branch != repository.Branch {
+		target = plumbing.NewBranchReferenceName(branch)
+
+		head, err := repo.Head()
+		if err != nil {
+			return fmt.Errorf("failed to get HEAD: %w", err)
+		}
+		if err := repo.Storer.SetReference(plumbing.NewHashReference(target, head.Hash())); err != nil {
+			return fmt.Errorf("failed to create branch %s: %w", branch, err)
+		}
+		if err := worktree.Checkout(&git.CheckoutOptions{Branch: target, Force: true}); err != nil {
+			return fmt.Errorf("failed to check out branch %s: %w", branch, err)
+		}
+		// The next sync resets the working copy to the tracked branch
+		defer func() {
+			if err := worktree.Checkout(&git.CheckoutOptions{Branch: tracked, Force: true}); err != nil {
+				log.Warnf("Failed to check out %s again: %v", repository.Branch, err)
+			}
+		}()
+	}
+
+	if err := c.commit(repo, worktree.Filesystem.Root(), path, content, message); err != nil {
+		return err
+	}
+
+	// Branches of their own are force pushed, as they are rebuilt from the
+	// tracked branch on every write
+	refSpec := gitconfig.RefSpec(target.String() + ":" + target.String())
+	if target != tracked {
+		refSpec = "+" + refSpec
+	}
+	if err := repo.PushContext(ctx, &git.PushOptions{Auth: c.auth, RefSpecs: []gitconfig.RefSpec{refSpec}}); err != nil {
+		return fmt.Errorf("failed to push changes: %w", err)
+	}
+
+	return nil
+}
+
+// sync returns the working copy of a repository, cloned on first use and
+// otherwise reset to the remote state of the tracked branch
+func (c *Client) sync(ctx context.Context, repository model.Repository) (*git.Repository, error) {
+	sum := sha256.Sum256([]byte(repository.URL + "#" + repository.Branch))
+	dir := filepath.Join(c.cloneDir, hex.EncodeToString(sum[:8]))
+	tracked := plumbing.NewBranchReferenceName(repository.Branch)
+
+	repo, err := git.PlainOpen(dir)
+	if errors.Is(err, git.ErrRepositoryNotExists) {
+		log.Infof("Cloning repository %s (branch: %s)", repository.URL, repository.Branch)
+
+		// A full clone, as drift reports the last commit of values files
+		repo, err = git.PlainCloneContext(ctx, dir, false, &git.CloneOptions{
+			URL:           repository.URL,
+			Auth:          c.auth,
+			SingleBranch:  true,
+			ReferenceName: tracked,
+		})
+		if err != nil {
+			os.RemoveAll(dir)
+			return nil, fmt.Errorf("failed to clone repository: %w", err)
+		}
+		return repo, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open repository: %w", err)
+	}
+
+	remote := plumbing.NewRemoteReferenceName("origin", repository.Branch)
+	err = repo.FetchContext(ctx, &git.FetchOptions{
+		Auth:     c.auth,
+		RefSpecs: []gitconfig.RefSpec{gitconfig.RefSpec("+" + tracked.String() + ":" + remote.String())},
+		Force:    true,
+	})
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return nil, fmt.Errorf("failed to fetch repository: %w", err)
+	}
+
+	ref, err := repo.Reference(remote, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w", remote, err)
+	}
+	if err := repo.Storer.SetReference(plumbing.NewHashReference(tracked, ref.Hash())); err != nil {
+		return nil, fmt.Errorf("failed to update %s: %w", tracked, err)
+	}
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get worktree: %w", err)
+	}
+	if err := worktree.Checkout(&git.CheckoutOptions{Branch: tracked, Force: true}); err != nil {
+		return nil, fmt.Errorf("failed to check out %s: %w", repository.Branch, err)
+	}
+	if err := worktree.Reset(&git.ResetOptions{Commit: ref.Hash(), Mode: git.HardReset}); err != nil {
+		return nil, fmt.Errorf("failed to reset to %s: %w", remote, err)
+	}
+
+	return repo, nil
+}
+
+// readFile reads a file and its last commit from HEAD
+func (c *Client) readFile(repo *git.Repository, path string) (*model.File, error) {
+	head, err := headCommit(repo)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := head.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tree: %w", err)
+	}
+
+	file, err := tree.File(path)
+	if errors.Is(err, object.ErrFileNotFound) {
+		return nil, fmt.Errorf("%w: %s", ErrFileNotFound, path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file: %w", err)
+	}
+	content, err := file.Contents()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file content: %w", err)
+	}
+
+	last, err := c.getLastCommitForFile(repo, path)
+	if err != nil {
+		log.Warnf("Failed to get last commit for file: %v", err)
+		last = head
+	}
+
+	return &model.File{
+		Path:       path,
+		Type:       "file",
+		LastCommit: last.Hash.String(),
+		LastAuthor: last.Author.Name,
+		LastUpdate: last.Author.When.Format(time.RFC3339),
+		Content:    content,
+	}, nil
+}
+
+// headCommit returns the commit HEAD points to
+func headCommit(repo *git.Repository) (*object.Commit, error) {
+	ref, err := repo.Head()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get HEAD: %w", err)
+	}
+	commit, err := repo.CommitObject(ref.Hash())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get commit: %w", err)
+	}
+	return commit, nil
+}
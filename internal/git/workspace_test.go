@@ -0,0 +1,154 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/jpfaria/image-updater/internal/model"
+)
+
+// newRemote creates a bare repository holding values.yaml on main and
+// returns a repository pointing to it
+func newRemote(t *testing.T) model.Repository {
+	t.Helper()
+
+	remote := filepath.Join(t.TempDir(), "remote.git")
+	if _, err := git.PlainInit(remote, true); err != nil {
+		t.Fatal(err)
+	}
+	repository := model.Repository{ID: "r", URL: remote, Branch: "main"}
+	handEdit(t, repository, "values.yaml", "image:\n  tag: 1.0.0\n", "alice")
+
+	return repository
+}
+
+// handEdit commits a file to the remote from another working copy, as a
+// person editing the repository would
+func handEdit(t *testing.T, repository model.Repository, path, content, author string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	repo, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.CreateRemote(&gitconfig.RemoteConfig{Name: "origin", URLs: []string{repository.URL}}); err != nil {
+		t.Fatal(err)
+	}
+	err = repo.Fetch(&git.FetchOptions{RefSpecs: []gitconfig.RefSpec{"+refs/heads/main:refs/heads/main"}})
+	worktree, _ := repo.Worktree()
+	switch {
+	case err == nil:
+		if err := worktree.Checkout(&git.CheckoutOptions{Branch: plumbing.NewBranchReferenceName("main"), Force: true}); err != nil {
+			t.Fatal(err)
+		}
+	case errors.Is(err, transport.ErrEmptyRemoteRepository):
+		if err := repo.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, plumbing.NewBranchReferenceName("main"))); err != nil {
+			t.Fatal(err)
+		}
+	default:
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, path), []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := worktree.Add(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := worktree.Commit("edit "+path, &git.CommitOptions{Author: &object.Signature{Name: author, Email: author + "@example.com", When: time.Now()}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Push(&git.PushOptions{RefSpecs: []gitconfig.RefSpec{"refs/heads/main:refs/heads/main"}}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientSeesHandEdits(t *testing.T) {
+	ctx := context.Background()
+	repository := newRemote(t)
+	client, err := NewClient("https", "", "", "", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := client.ReadFile(ctx, repository, "values.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file.Content != "image:\n  tag: 1.0.0\n" || file.LastAuthor != "alice" {
+		t.Fatalf("unexpected file %+v", file)
+	}
+
+	handEdit(t, repository, "values.yaml", "image:\n  tag: 9.9.9\n", "bob")
+
+	file, err = client.ReadFile(ctx, repository, "values.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file.Content != "image:\n  tag: 9.9.9\n" || file.LastAuthor != "bob" {
+		t.Fatalf("hand edit not seen: %+v", file)
+	}
+
+	if _, err := client.ReadFile(ctx, repository, "missing.yaml"); !errors.Is(err, ErrFileNotFound) {
+		t.Fatalf("expected ErrFileNotFound, got %v", err)
+	}
+}
+
+func TestClientWriteFile(t *testing.T) {
+	ctx := context.Background()
+	repository := newRemote(t)
+	client, err := NewClient("https", "", "", "", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		branch string
+		want   string // content of values.yaml on main afterwards
+	}{
+		{name: "tracked branch", branch: "", want: "image:\n  tag: 2.0.0\n"},
+		{name: "branch of its own", branch: "image-updater/app-prod", want: "image:\n  tag: 2.0.0\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := "image:\n  tag: 2.0.0\n"
+			if tt.branch != "" {
+				content = "image:\n  tag: 3.0.0\n"
+			}
+			if err := client.WriteFile(ctx, repository, tt.branch, "values.yaml", content, "update"); err != nil {
+				t.Fatal(err)
+			}
+
+			file, err := client.ReadFile(ctx, repository, "values.yaml")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if file.Content != tt.want {
+				t.Fatalf("main has %q, want %q", file.Content, tt.want)
+			}
+
+			if tt.branch != "" {
+				other := repository
+				other.Branch = tt.branch
+				file, err := client.ReadFile(ctx, other, "values.yaml")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if file.Content != content {
+					t.Fatalf("%s has %q, want %q", tt.branch, file.Content, content)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jpfaria/image-updater/internal/audit"
+	"github.com/labstack/echo/v4"
+	"github.com/xgodev/boost/wrapper/log"
+)
+
+// AuditHandler handles audit log requests
+type AuditHandler struct {
+	log *audit.Log
+}
+
+// NewAuditHandler creates a new audit log handler
+func NewAuditHandler(auditLog *audit.Log) *AuditHandler {
+	return &AuditHandler{
+		log: auditLog,
+	}
+}
+
+// ListEvents lists the audit events matching the query parameters, newest first
+func (h *AuditHandler) ListEvents(c echo.Context) error {
+	log.Info("Listing audit events")
+
+	filter, err := auditFilter(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]interface{}{
+			"status":  "error",
+			"message": err.Error(),
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data":   h.log.Query(filter),
+	})
+}
+
+// ExportEvents downloads the audit events matching the query parameters as
+// JSON Lines or, with format=csv, as CSV
+func (h *AuditHandler) ExportEvents(c echo.Context) error {
+	filter, err := auditFilter(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]interface{}{
+			"status":  "error",
+			"message": err.Error(),
+		})
+	}
+
+	format := c.QueryParam("format")
+	log.Infof("Exporting audit events as %s", format)
+
+	events := h.log.Query(filter)
+	res := c.Response()
+
+	switch format {
+	case "", "jsonl":
+		res.Header().Set(echo.HeaderContentType, "application/x-ndjson")
+		res.Header().Set(echo.HeaderContentDisposition, `attachment; filename="audit.jsonl"`)
+		res.WriteHeader(http.StatusOK)
+		return audit.WriteJSONLines(res, events)
+	case "csv":
+		res.Header().Set(echo.HeaderContentType, "text/csv")
+		res.Header().Set(echo.HeaderContentDisposition, `attachment; filename="audit.csv"`)
+		res.WriteHeader(http.StatusOK)
+		return audit.WriteCSV(res, events)
+	}
+
+	return c.JSON(http.StatusBadRequest, map[string]interface{}{
+		"status":  "error",
+		"message": "format must be jsonl or csv",
+	})
+}
+
+// Verify walks the hash chain of the audit log and reports the first broken
+// link. A broken chain is answered with 409 Conflict.
+func (h *AuditHandler) Verify(c echo.Context) error {
+	log.Info("Verifying audit log")
+
+	result, err := h.log.Verify(c.Request().Context())
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	status := http.StatusOK
+	if !result.Valid {
+		log.Warnf("Audit log chain is broken at event %d: %s", result.Broken.Index, result.Broken.Reason)
+		status = http.StatusConflict
+	}
+
+	return c.JSON(status, map[string]interface{}{
+		"status": "success",
+		"data":   result,
+	})
+}
+
+// ListCheckpoints lists the signed checkpoints of the audit log
+func (h *AuditHandler) ListCheckpoints(c echo.Context) error {
+	log.Info("Listing audit checkpoints")
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data":   h.log.Checkpoints(),
+	})
+}
+
+// CreateCheckpoint signs a checkpoint of the audit log right away
+func (h *AuditHandler) CreateCheckpoint(c echo.Context) error {
+	checkpoint, err := h.log.Checkpoint(c.Request().Context())
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	if checkpoint == nil {
+		return c.JSON(http.StatusConflict, map[string]interface{}{
+			"status":  "error",
+			"message": "The audit log has no events to checkpoint",
+		})
+	}
+
+	return c.JSON(http.StatusCreated, map[string]interface{}{
+		"status": "success",
+		"data":   checkpoint,
+	})
+}
+
+// ExportCheckpoints downloads the signed checkpoints as JSON Lines, to be
+// kept outside the service
+func (h *AuditHandler) ExportCheckpoints(c echo.Context) error {
+	log.Info("Exporting audit checkpoints")
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "application/x-ndjson")
+	res.Header().Set(echo.HeaderContentDisposition, `attachment; filename="audit_checkpoints.jsonl"`)
+	res.WriteHeader(http.StatusOK)
+
+	encoder := json.NewEncoder(res)
+	for _, checkpoint := range h.log.Checkpoints() {
+		if err := encoder.Encode(checkpoint); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// auditFilter reads an audit filter from the query parameters; since and
+// until are RFC 3339 times
+func auditFilter(c echo.Context) (audit.Filter, error) {
+	filter := audit.Filter{
+		Actor:      c.QueryParam("actor"),
+		Action:     c.QueryParam("action"),
+		TargetType: c.QueryParam("target_type"),
+		TargetID:   c.QueryParam("target_id"),
+		Outcome:    c.QueryParam("outcome"),
+	}
+
+	var err error
+	if since := c.QueryParam("since"); since != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			return filter, errors.New("since must be an RFC 3339 time")
+		}
+	}
+	if until := c.QueryParam("until"); until != "" {
+		if filter.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			return filter, errors.New("until must be an RFC 3339 time")
+		}
+	}
+	if limit := c.QueryParam("limit"); limit != "" {
+		if filter.Limit, err = strconv.Atoi(limit); err != nil || filter.Limit < 0 {
+			return filter, errors.New("limit must be a positive number")
+		}
+	}
+
+	return filter, nil
+}
@@ -0,0 +1,247 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"path"
+
+	"github.com/jpfaria/image-updater/internal/audit"
+	"github.com/jpfaria/image-updater/internal/auth"
+	"github.com/labstack/echo/v4"
+	"github.com/xgodev/boost/wrapper/log"
+)
+
+// AuthHandler handles authentication related requests
+type AuthHandler struct {
+	service *auth.AuthService
+	oidc    *auth.OIDCProvider // nil when single sign-on is disabled
+}
+
+// NewAuthHandler creates a new authentication handler
+func NewAuthHandler(service *auth.AuthService, oidc *auth.OIDCProvider) *AuthHandler {
+	return &AuthHandler{
+		service: service,
+		oidc:    oidc,
+	}
+}
+
+// Login authenticates a user and returns a token
+func (h *AuthHandler) Login(c echo.Context) error {
+	// Parse request body
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]interface{}{
+			"status":  "error",
+			"message": "Invalid request body",
+		})
+	}
+
+	event := auditEvent(c, "auth.login", "users", "")
+	event.Actor = req.Username
+
+	tokens, err := h.service.Login(c.Request().Context(), req.Username, req.Password)
+	if err != nil {
+		log.Warnf("Failed login for user %s", req.Username)
+		return errorResponse(c, err)
+	}
+
+	return tokenResponse(c, tokens)
+}
+
+// OIDCLogin redirects to the identity provider to start a single sign-on login
+func (h *AuthHandler) OIDCLogin(c echo.Context) error {
+	if h.oidc == nil {
+		return c.JSON(http.StatusNotFound, map[string]interface{}{
+			"status":  "error",
+			"message": "OIDC login is not configured",
+		})
+	}
+
+	redirect, state, err := h.oidc.AuthCodeURL(c.Request().Context())
+	if err != nil {
+		log.Errorf("Failed to start OIDC login: %v", err)
+		return errorResponse(c, err)
+	}
+
+	// Only the browser that started the login may complete it
+	c.SetCookie(stateCookie(c, state, int(auth.OIDCLoginTTL.Seconds())))
+
+	return c.Redirect(http.StatusFound, redirect)
+}
+
+// OIDCCallback completes a single sign-on login and returns a token
+func (h *AuthHandler) OIDCCallback(c echo.Context) error {
+	if h.oidc == nil {
+		return c.JSON(http.StatusNotFound, map[string]interface{}{
+			"status":  "error",
+			"message": "OIDC login is not configured",
+		})
+	}
+
+	if reason := c.QueryParam("error"); reason != "" {
+		log.Warnf("OIDC login failed at the identity provider: %s", reason)
+		return c.JSON(http.StatusUnauthorized, map[string]interface{}{
+			"status":  "error",
+			"message": "Login failed: " + reason + " " + c.QueryParam("error_description"),
+		})
+	}
+
+	event := auditEvent(c, "auth.oidc_login", "users", "")
+
+	state := c.QueryParam("state")
+	cookie, err := c.Cookie(oidcStateCookie)
+	c.SetCookie(stateCookie(c, "", -1))
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		log.Warnf("OIDC login state does not match the browser that started it")
+		return errorResponse(c, fmt.Errorf("%w: login state does not match", auth.ErrInvalidCredentials))
+	}
+
+	tokens, err := h.service.LoginOIDC(c.Request().Context(), h.oidc, c.QueryParam("code"), state)
+	if err != nil {
+		log.Warnf("Failed OIDC login: %v", err)
+		return errorResponse(c, err)
+	}
+	h.identify(c, event, tokens)
+
+	return tokenResponse(c, tokens)
+}
+
+// Refresh exchanges a refresh token for new tokens
+func (h *AuthHandler) Refresh(c echo.Context) error {
+	// Parse request body
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	if err := c.Bind(&req); err != nil || req.RefreshToken == "" {
+		return c.JSON(http.StatusBadRequest, map[string]interface{}{
+			"status":  "error",
+			"message": "Invalid request body",
+		})
+	}
+
+	event := auditEvent(c, "auth.refresh", "users", "")
+
+	tokens, err := h.service.Refresh(c.Request().Context(), req.RefreshToken)
+	if err != nil {
+		log.Warnf("Failed token refresh: %v", err)
+		return errorResponse(c, err)
+	}
+	h.identify(c, event, tokens)
+
+	return tokenResponse(c, tokens)
+}
+
+// Logout ends the session of the token used for the request
+func (h *AuthHandler) Logout(c echo.Context) error {
+	token, _ := c.Get("token").(string)
+	if user := currentUser(c); user != nil {
+		auditEvent(c, "auth.logout", "users", user.ID)
+	}
+
+	if err := h.service.Logout(c.Request().Context(), token); err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"status":  "success",
+		"message": "Logged out",
+	})
+}
+
+// Me returns the authenticated user with its role bindings
+func (h *AuthHandler) Me(c echo.Context) error {
+	user := currentUser(c)
+	if user == nil {
+		return c.JSON(http.StatusUnauthorized, map[string]interface{}{
+			"status":  "error",
+			"message": "Authentication required",
+		})
+	}
+
+	bindings, err := h.service.ListRoleBindings(c.Request().Context(), user.ID)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data": struct {
+			*auth.User
+			Bindings []auth.RoleBinding `json:"bindings"`
+		}{user, bindings},
+	})
+}
+
+// ChangePassword changes the password of the authenticated user
+func (h *AuthHandler) ChangePassword(c echo.Context) error {
+	user := currentUser(c)
+	log.Infof("Changing password of user %s", user.Username)
+	auditEvent(c, "auth.password_change", "users", user.ID)
+
+	// Parse request body
+	var req struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]interface{}{
+			"status":  "error",
+			"message": "Invalid request body",
+		})
+	}
+
+	if err := h.service.ChangePassword(c.Request().Context(), user.ID, req.CurrentPassword, req.NewPassword); err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"status":  "success",
+		"message": "Password changed",
+	})
+}
+
+// identify attributes the audit event of a login to the user the tokens
+// were issued to
+func (h *AuthHandler) identify(c echo.Context, event *audit.Event, tokens *auth.TokenPair) {
+	if user, err := h.service.ValidateToken(c.Request().Context(), tokens.AccessToken); err == nil {
+		event.Actor = user.Username
+		event.TargetID = user.ID
+	}
+}
+
+// oidcStateCookie holds the state of the OIDC login a browser started
+const oidcStateCookie = "oidc_state"
+
+// stateCookie returns the OIDC state cookie, scoped to the login and
+// callback routes and lax so the redirect back from the identity provider
+// carries it; a negative max age clears it
+func stateCookie(c echo.Context, state string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     path.Dir(c.Request().URL.Path),
+		MaxAge:   maxAge,
+		Secure:   c.Scheme() == "https",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// tokenResponse writes the tokens of a session; token repeats the access
+// token for clients of the single token login
+func tokenResponse(c echo.Context, tokens *auth.TokenPair) error {
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data": struct {
+			*auth.TokenPair
+			Token string `json:"token"`
+		}{tokens, tokens.AccessToken},
+	})
+}
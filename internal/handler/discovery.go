@@ -0,0 +1,132 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/jpfaria/image-updater/internal/audit"
+	"github.com/jpfaria/image-updater/internal/auth"
+	"github.com/jpfaria/image-updater/internal/model"
+	"github.com/jpfaria/image-updater/internal/service"
+	"github.com/labstack/echo/v4"
+	"github.com/xgodev/boost/wrapper/log"
+)
+
+// DiscoveryHandler handles the images discovered in registry catalogs
+type DiscoveryHandler struct {
+	service     *service.DiscoveryService
+	authService *auth.AuthService
+}
+
+// NewDiscoveryHandler creates a new discovery handler
+func NewDiscoveryHandler(service *service.DiscoveryService, authService *auth.AuthService) *DiscoveryHandler {
+	return &DiscoveryHandler{
+		service:     service,
+		authService: authService,
+	}
+}
+
+// ListCandidates lists the candidate images, optionally filtered by status
+func (h *DiscoveryHandler) ListCandidates(c echo.Context) error {
+	log.Info("Listing candidate images")
+
+	candidates, err := h.service.ListCandidates(c.Request().Context(), c.QueryParam("status"))
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	// Only list the candidates of the teams the user can see
+	visible := make([]model.ImageCandidate, 0, len(candidates))
+	for _, candidate := range candidates {
+		if h.authService.Can(currentUser(c), auth.PermissionView, imageResource(&candidate.Image)) {
+			visible = append(visible, candidate)
+		}
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data":   visible,
+	})
+}
+
+// Discover scans the registry catalogs for new candidate images
+func (h *DiscoveryHandler) Discover(c echo.Context) error {
+	log.Info("Discovering images")
+
+	event := auditEvent(c, "image.discover", "image_candidates", "")
+
+	candidates, err := h.service.Discover(c.Request().Context())
+	if err != nil {
+		// Candidates found in the registries that could be read are kept
+		event.Error = err.Error()
+		return c.JSON(http.StatusBadGateway, map[string]interface{}{
+			"status":  "error",
+			"message": err.Error(),
+			"data":    candidates,
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data":   candidates,
+	})
+}
+
+// ApproveCandidate starts tracking a candidate image
+func (h *DiscoveryHandler) ApproveCandidate(c echo.Context) error {
+	return h.decide(c, "image.approve", h.service.ApproveCandidate)
+}
+
+// RejectCandidate declines a candidate image
+func (h *DiscoveryHandler) RejectCandidate(c echo.Context) error {
+	return h.decide(c, "image.reject", h.service.RejectCandidate)
+}
+
+// decide handles a decision on a candidate using the given service operation
+func (h *DiscoveryHandler) decide(c echo.Context, action string, fn func(ctx context.Context, id, user, comment string) (*model.ImageCandidate, error)) error {
+	id := c.Param("id")
+	ctx := c.Request().Context()
+
+	event := auditEvent(c, action, "image_candidates", id)
+
+	user := currentUser(c)
+	if user == nil {
+		return c.JSON(http.StatusUnauthorized, map[string]interface{}{
+			"status":  "error",
+			"message": "Authentication required",
+		})
+	}
+
+	candidate, err := h.service.GetCandidate(ctx, id)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	event.Before = audit.Snapshot(candidate)
+
+	// Tracking an image is administered by its team
+	if err := authorize(c, h.authService, auth.PermissionAdmin, imageResource(&candidate.Image)); err != nil {
+		return errorResponse(c, err)
+	}
+
+	var req struct {
+		Comment string `json:"comment"`
+	}
+
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]interface{}{
+			"status":  "error",
+			"message": "Invalid request body",
+		})
+	}
+
+	candidate, err = fn(ctx, id, user.Username, req.Comment)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	event.After = audit.Snapshot(candidate)
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data":   candidate,
+	})
+}
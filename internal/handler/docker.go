@@ -3,43 +3,51 @@ package handler
 import (
 	"net/http"
 
+	"github.com/jpfaria/image-updater/internal/auth"
+	"github.com/jpfaria/image-updater/internal/model"
+	"github.com/jpfaria/image-updater/internal/service"
 	"github.com/labstack/echo/v4"
 	"github.com/xgodev/boost/wrapper/log"
 )
 
 // DockerHandler handles Docker image related requests
 type DockerHandler struct {
-	// Add service dependencies here
+	service         *service.DockerService
+	signatures      *service.SignatureService
+	vulnerabilities *service.VulnerabilityService
+	authService     *auth.AuthService
 }
 
 // NewDockerHandler creates a new Docker handler
-func NewDockerHandler() *DockerHandler {
-	return &DockerHandler{}
+func NewDockerHandler(service *service.DockerService, signatures *service.SignatureService, vulnerabilities *service.VulnerabilityService, authService *auth.AuthService) *DockerHandler {
+	return &DockerHandler{
+		service:         service,
+		signatures:      signatures,
+		vulnerabilities: vulnerabilities,
+		authService:     authService,
+	}
 }
 
 // ListImages lists all Docker images
 func (h *DockerHandler) ListImages(c echo.Context) error {
 	log.Info("Listing Docker images")
-	
-	// Mock response for now
-	images := []map[string]interface{}{
-		{
-			"id":        "1",
-			"name":      "nginx",
-			"registry":  "docker.io",
-			"namespace": "library",
-		},
-		{
-			"id":        "2",
-			"name":      "postgres",
-			"registry":  "docker.io",
-			"namespace": "library",
-		},
+
+	images, err := h.service.ListImages(c.Request().Context())
+	if err != nil {
+		return errorResponse(c, err)
 	}
-	
+
+	// Only list the images the user can see
+	visible := make([]model.Image, 0, len(images))
+	for _, image := range images {
+		if h.authService.Can(currentUser(c), auth.PermissionView, imageResource(&image)) {
+			visible = append(visible, image)
+		}
+	}
+
 	return c.JSON(http.StatusOK, map[string]interface{}{
 		"status": "success",
-		"data":   images,
+		"data":   visible,
 	})
 }
 
@@ -47,16 +55,12 @@ func (h *DockerHandler) ListImages(c echo.Context) error {
 func (h *DockerHandler) GetImage(c echo.Context) error {
 	id := c.Param("id")
 	log.Infof("Getting Docker image with ID: %s", id)
-	
-	// Mock response for now
-	image := map[string]interface{}{
-		"id":        id,
-		"name":      "nginx",
-		"registry":  "docker.io",
-		"namespace": "library",
-		"latest_tag": "1.25.1",
+
+	image, err := h.authorize(c, id, auth.PermissionView)
+	if err != nil {
+		return errorResponse(c, err)
 	}
-	
+
 	return c.JSON(http.StatusOK, map[string]interface{}{
 		"status": "success",
 		"data":   image,
@@ -67,40 +71,87 @@ func (h *DockerHandler) GetImage(c echo.Context) error {
 func (h *DockerHandler) ListTags(c echo.Context) error {
 	id := c.Param("id")
 	log.Infof("Listing tags for Docker image with ID: %s", id)
-	
-	// Mock response for now
-	tags := []map[string]interface{}{
-		{
-			"name":       "1.25.1",
-			"digest":     "sha256:abcdef1234567890",
-			"created_at": "2025-05-01T10:00:00Z",
-		},
-		{
-			"name":       "1.25.0",
-			"digest":     "sha256:1234567890abcdef",
-			"created_at": "2025-04-15T10:00:00Z",
-		},
-		{
-			"name":       "1.24.0",
-			"digest":     "sha256:9876543210abcdef",
-			"created_at": "2025-03-20T10:00:00Z",
-		},
+
+	image, err := h.authorize(c, id, auth.PermissionView)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	tags, err := h.service.ListTags(c.Request().Context(), id)
+	if err != nil {
+		return errorResponse(c, err)
 	}
-	
+	h.signatures.AnnotateTags(image, tags)
+	h.vulnerabilities.AnnotateTags(image, tags)
+
 	return c.JSON(http.StatusOK, map[string]interface{}{
 		"status": "success",
 		"data":   tags,
 	})
 }
 
+// VerifyTag verifies the signature of a tag of a Docker image
+func (h *DockerHandler) VerifyTag(c echo.Context) error {
+	id := c.Param("id")
+	tag := c.Param("tag")
+	log.Infof("Verifying the signature of %s for Docker image with ID: %s", tag, id)
+
+	if _, err := h.authorize(c, id, auth.PermissionView); err != nil {
+		return errorResponse(c, err)
+	}
+
+	signature, err := h.signatures.VerifyTag(c.Request().Context(), id, tag)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data":   signature,
+	})
+}
+
 // RefreshTags refreshes the tags for a Docker image
 func (h *DockerHandler) RefreshTags(c echo.Context) error {
 	id := c.Param("id")
 	log.Infof("Refreshing tags for Docker image with ID: %s", id)
-	
-	// Mock response for now
+
+	auditEvent(c, "image.refresh", "images", id)
+
+	if _, err := h.authorize(c, id, auth.PermissionDeploy); err != nil {
+		return errorResponse(c, err)
+	}
+
+	if err := h.service.RefreshTags(c.Request().Context(), id); err != nil {
+		return errorResponse(c, err)
+	}
+
 	return c.JSON(http.StatusOK, map[string]interface{}{
 		"status":  "success",
 		"message": "Tags refreshed successfully",
 	})
 }
+
+// authorize loads an image and checks that the current user holds a
+// permission on it
+func (h *DockerHandler) authorize(c echo.Context, id, permission string) (*model.Image, error) {
+	image, err := h.service.GetImage(c.Request().Context(), id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := authorize(c, h.authService, permission, imageResource(image)); err != nil {
+		return nil, err
+	}
+
+	return image, nil
+}
+
+// imageResource describes an image for permission checks
+func imageResource(image *model.Image) auth.Resource {
+	return auth.Resource{
+		Kind: "image",
+		Name: image.Name,
+		Team: image.Team,
+	}
+}
@@ -1,47 +1,54 @@
 package handler
 
 import (
+	"context"
 	"net/http"
+	"time"
 
+	"github.com/jpfaria/image-updater/internal/audit"
+	"github.com/jpfaria/image-updater/internal/auth"
+	"github.com/jpfaria/image-updater/internal/model"
+	"github.com/jpfaria/image-updater/internal/service"
 	"github.com/labstack/echo/v4"
 	"github.com/xgodev/boost/wrapper/log"
 )
 
 // EnvironmentHandler handles environment related requests
 type EnvironmentHandler struct {
-	// Add service dependencies here
+	service     *service.EnvironmentService
+	authService *auth.AuthService
 }
 
 // NewEnvironmentHandler creates a new environment handler
-func NewEnvironmentHandler() *EnvironmentHandler {
-	return &EnvironmentHandler{}
+func NewEnvironmentHandler(service *service.EnvironmentService, authService *auth.AuthService) *EnvironmentHandler {
+	return &EnvironmentHandler{
+		service:     service,
+		authService: authService,
+	}
 }
 
 // ListEnvironments lists all environments
 func (h *EnvironmentHandler) ListEnvironments(c echo.Context) error {
 	log.Info("Listing environments")
-	
-	// Mock response for now
-	environments := []map[string]interface{}{
-		{
-			"id":            "1",
-			"name":          "production",
-			"application":   "my-app",
-			"values_path":   "my-app/production/values.yaml",
-			"current_image": "nginx:1.24.0",
-		},
-		{
-			"id":            "2",
-			"name":          "staging",
-			"application":   "my-app",
-			"values_path":   "my-app/staging/values.yaml",
-			"current_image": "nginx:1.25.0",
-		},
-	}
-	
+
+	ctx := c.Request().Context()
+
+	environments, err := h.service.ListEnvironments(ctx)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	// Only list the environments the user can see
+	visible := make([]model.Environment, 0, len(environments))
+	for _, environment := range environments {
+		if h.authService.Can(currentUser(c), auth.PermissionView, h.resource(ctx, &environment)) {
+			visible = append(visible, environment)
+		}
+	}
+
 	return c.JSON(http.StatusOK, map[string]interface{}{
 		"status": "success",
-		"data":   environments,
+		"data":   visible,
 	})
 }
 
@@ -49,35 +56,45 @@ func (h *EnvironmentHandler) ListEnvironments(c echo.Context) error {
 func (h *EnvironmentHandler) GetEnvironment(c echo.Context) error {
 	id := c.Param("id")
 	log.Infof("Getting environment with ID: %s", id)
-	
-	// Mock response for now
-	environment := map[string]interface{}{
-		"id":            id,
-		"name":          "production",
-		"application":   "my-app",
-		"values_path":   "my-app/production/values.yaml",
-		"current_image": "nginx:1.24.0",
-		"deployments": []map[string]interface{}{
-			{
-				"id":        "1",
-				"image_tag": "1.24.0",
-				"timestamp": "2025-04-15T10:00:00Z",
-				"user":      "admin",
-				"status":    "success",
-			},
-			{
-				"id":        "2",
-				"image_tag": "1.23.0",
-				"timestamp": "2025-03-10T10:00:00Z",
-				"user":      "admin",
-				"status":    "success",
-			},
-		},
-	}
-	
+
+	ctx := c.Request().Context()
+
+	environment, err := h.authorize(c, id, auth.PermissionView)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	deployments, err := h.service.GetDeployments(ctx, id)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
 	return c.JSON(http.StatusOK, map[string]interface{}{
 		"status": "success",
-		"data":   environment,
+		"data": struct {
+			*model.Environment
+			Deployments []model.Deployment `json:"deployments"`
+		}{environment, deployments},
+	})
+}
+
+// ListDeployments lists the deployments of an environment
+func (h *EnvironmentHandler) ListDeployments(c echo.Context) error {
+	id := c.Param("id")
+	log.Infof("Listing deployments for environment with ID: %s", id)
+
+	if _, err := h.authorize(c, id, auth.PermissionView); err != nil {
+		return errorResponse(c, err)
+	}
+
+	deployments, err := h.service.GetDeployments(c.Request().Context(), id)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data":   deployments,
 	})
 }
 
@@ -85,28 +102,252 @@ func (h *EnvironmentHandler) GetEnvironment(c echo.Context) error {
 func (h *EnvironmentHandler) DeployToEnvironment(c echo.Context) error {
 	id := c.Param("id")
 	log.Infof("Deploying to environment with ID: %s", id)
-	
+
+	event := auditEvent(c, "deployment.create", "environments", id)
+
+	environment, err := h.authorize(c, id, auth.PermissionDeploy)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	event.Before = audit.Snapshot(environment)
+
 	// Parse request body
 	var req struct {
-		ImageTag string `json:"image_tag"`
+		ImageTag    string    `json:"image_tag"`
+		ScheduledAt time.Time `json:"scheduled_at"`
 	}
-	
-	if err := c.Bind(&req); err != nil {
+
+	if err := c.Bind(&req); err != nil || req.ImageTag == "" {
 		return c.JSON(http.StatusBadRequest, map[string]interface{}{
 			"status":  "error",
 			"message": "Invalid request body",
 		})
 	}
-	
-	// Mock response for now
+
+	username := "anonymous"
+	if user := currentUser(c); user != nil {
+		username = user.Username
+	}
+
+	deployment, err := h.service.DeployToEnvironment(c.Request().Context(), id, req.ImageTag, username, req.ScheduledAt)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	event.After = audit.Snapshot(deployment)
+
+	switch deployment.Status {
+	case model.DeploymentStatusAwaitingApproval:
+		return c.JSON(http.StatusAccepted, map[string]interface{}{
+			"status":  "success",
+			"message": "Deployment awaiting approval",
+			"data":    deployment,
+		})
+	case model.DeploymentStatusScheduled:
+		return c.JSON(http.StatusAccepted, map[string]interface{}{
+			"status":  "success",
+			"message": "Deployment scheduled",
+			"data":    deployment,
+		})
+	}
+
 	return c.JSON(http.StatusOK, map[string]interface{}{
 		"status":  "success",
 		"message": "Deployment initiated",
-		"data": map[string]interface{}{
-			"deployment_id": "123",
-			"environment":   "production",
-			"image_tag":     req.ImageTag,
-			"status":        "pending",
-		},
+		"data":    deployment,
+	})
+}
+
+// CancelDeployment cancels a deployment that has not run yet
+func (h *EnvironmentHandler) CancelDeployment(c echo.Context) error {
+	id := c.Param("id")
+	deploymentID := c.Param("deployment_id")
+	log.Infof("Cancelling deployment %s in environment with ID: %s", deploymentID, id)
+
+	event := h.auditDeployment(c, "deployment.cancel", id, deploymentID)
+
+	if _, err := h.authorize(c, id, auth.PermissionDeploy); err != nil {
+		return errorResponse(c, err)
+	}
+
+	username := "anonymous"
+	if user := currentUser(c); user != nil {
+		username = user.Username
+	}
+
+	deployment, err := h.service.CancelDeployment(c.Request().Context(), id, deploymentID, username)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	event.After = audit.Snapshot(deployment)
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data":   deployment,
 	})
 }
+
+// RescheduleDeployment moves a deployment that has not run yet to a new time
+func (h *EnvironmentHandler) RescheduleDeployment(c echo.Context) error {
+	id := c.Param("id")
+	deploymentID := c.Param("deployment_id")
+	log.Infof("Rescheduling deployment %s in environment with ID: %s", deploymentID, id)
+
+	event := h.auditDeployment(c, "deployment.reschedule", id, deploymentID)
+
+	if _, err := h.authorize(c, id, auth.PermissionDeploy); err != nil {
+		return errorResponse(c, err)
+	}
+
+	// Parse request body
+	var req struct {
+		ScheduledAt time.Time `json:"scheduled_at"`
+	}
+
+	if err := c.Bind(&req); err != nil || req.ScheduledAt.IsZero() {
+		return c.JSON(http.StatusBadRequest, map[string]interface{}{
+			"status":  "error",
+			"message": "Invalid request body",
+		})
+	}
+
+	deployment, err := h.service.RescheduleDeployment(c.Request().Context(), id, deploymentID, req.ScheduledAt)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	event.After = audit.Snapshot(deployment)
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data":   deployment,
+	})
+}
+
+// Reconcile checks an environment for drift between Git and the recorded image
+func (h *EnvironmentHandler) Reconcile(c echo.Context) error {
+	id := c.Param("id")
+	log.Infof("Reconciling environment with ID: %s", id)
+
+	event := auditEvent(c, "environment.reconcile", "environments", id)
+
+	before, err := h.authorize(c, id, auth.PermissionDeploy)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	event.Before = audit.Snapshot(before)
+
+	// Parse request body
+	var req struct {
+		Adopt bool `json:"adopt"`
+	}
+
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]interface{}{
+			"status":  "error",
+			"message": "Invalid request body",
+		})
+	}
+
+	environment, err := h.service.DetectDrift(c.Request().Context(), id, req.Adopt)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	event.After = audit.Snapshot(environment)
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data":   environment,
+	})
+}
+
+// ApproveDeployment approves a deployment awaiting approval
+func (h *EnvironmentHandler) ApproveDeployment(c echo.Context) error {
+	return h.decide(c, "deployment.approve", h.service.ApproveDeployment)
+}
+
+// RejectDeployment rejects a deployment awaiting approval
+func (h *EnvironmentHandler) RejectDeployment(c echo.Context) error {
+	return h.decide(c, "deployment.reject", h.service.RejectDeployment)
+}
+
+// decide handles an approval decision using the given service operation
+func (h *EnvironmentHandler) decide(c echo.Context, action string, fn func(ctx context.Context, envID, deploymentID, user, comment string) (*model.Deployment, error)) error {
+	id := c.Param("id")
+	deploymentID := c.Param("deployment_id")
+
+	event := h.auditDeployment(c, action, id, deploymentID)
+
+	user := currentUser(c)
+	if user == nil {
+		return c.JSON(http.StatusUnauthorized, map[string]interface{}{
+			"status":  "error",
+			"message": "Authentication required",
+		})
+	}
+
+	if _, err := h.authorize(c, id, auth.PermissionApprove); err != nil {
+		return errorResponse(c, err)
+	}
+
+	// Parse request body
+	var req struct {
+		Comment string `json:"comment"`
+	}
+
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]interface{}{
+			"status":  "error",
+			"message": "Invalid request body",
+		})
+	}
+
+	deployment, err := fn(c.Request().Context(), id, deploymentID, user.Username, req.Comment)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	event.After = audit.Snapshot(deployment)
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data":   deployment,
+	})
+}
+
+// auditDeployment names the audit event of a request acting on a deployment
+// and captures the deployment as it was before the request
+func (h *EnvironmentHandler) auditDeployment(c echo.Context, action, envID, deploymentID string) *audit.Event {
+	event := auditEvent(c, action, "deployments", deploymentID)
+	if deployment, err := h.service.GetDeployment(c.Request().Context(), envID, deploymentID); err == nil {
+		event.Before = audit.Snapshot(deployment)
+	}
+
+	return event
+}
+
+// authorize loads an environment and checks that the current user holds a
+// permission on it
+func (h *EnvironmentHandler) authorize(c echo.Context, id, permission string) (*model.Environment, error) {
+	ctx := c.Request().Context()
+
+	environment, err := h.service.GetEnvironment(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := authorize(c, h.authService, permission, h.resource(ctx, environment)); err != nil {
+		return nil, err
+	}
+
+	return environment, nil
+}
+
+// resource describes an environment for permission checks
+func (h *EnvironmentHandler) resource(ctx context.Context, environment *model.Environment) auth.Resource {
+	return auth.Resource{
+		Kind:            "environment",
+		Name:            environment.Application + "/" + environment.Name,
+		Team:            h.service.Team(ctx, environment),
+		Application:     environment.Application,
+		Environment:     environment.ID,
+		EnvironmentName: environment.Name,
+	}
+}
@@ -3,45 +3,47 @@ package handler
 import (
 	"net/http"
 
+	"github.com/jpfaria/image-updater/internal/auth"
+	"github.com/jpfaria/image-updater/internal/model"
+	"github.com/jpfaria/image-updater/internal/service"
 	"github.com/labstack/echo/v4"
 	"github.com/xgodev/boost/wrapper/log"
 )
 
 // GitHandler handles Git repository related requests
 type GitHandler struct {
-	// Add service dependencies here
+	service     *service.GitService
+	authService *auth.AuthService
 }
 
 // NewGitHandler creates a new Git handler
-func NewGitHandler() *GitHandler {
-	return &GitHandler{}
+func NewGitHandler(service *service.GitService, authService *auth.AuthService) *GitHandler {
+	return &GitHandler{
+		service:     service,
+		authService: authService,
+	}
 }
 
 // ListRepositories lists all Git repositories
 func (h *GitHandler) ListRepositories(c echo.Context) error {
 	log.Info("Listing Git repositories")
-	
-	// Mock response for now
-	repositories := []map[string]interface{}{
-		{
-			"id":        "1",
-			"name":      "team-a-manifests",
-			"url":       "https://github.com/org/team-a-manifests.git",
-			"branch":    "main",
-			"team_name": "Team A",
-		},
-		{
-			"id":        "2",
-			"name":      "team-b-manifests",
-			"url":       "https://github.com/org/team-b-manifests.git",
-			"branch":    "main",
-			"team_name": "Team B",
-		},
+
+	repositories, err := h.service.ListRepositories(c.Request().Context())
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	// Only list the repositories the user can see
+	visible := make([]model.Repository, 0, len(repositories))
+	for _, repository := range repositories {
+		if h.authService.Can(currentUser(c), auth.PermissionView, repositoryResource(&repository)) {
+			visible = append(visible, repository)
+		}
 	}
-	
+
 	return c.JSON(http.StatusOK, map[string]interface{}{
 		"status": "success",
-		"data":   repositories,
+		"data":   visible,
 	})
 }
 
@@ -49,29 +51,16 @@ func (h *GitHandler) ListRepositories(c echo.Context) error {
 func (h *GitHandler) ListFiles(c echo.Context) error {
 	id := c.Param("id")
 	log.Infof("Listing files in Git repository with ID: %s", id)
-	
-	// Mock response for now
-	files := []map[string]interface{}{
-		{
-			"path":       "my-app/production/values.yaml",
-			"type":       "file",
-			"last_commit": "abc123",
-			"last_update": "2025-05-01T10:00:00Z",
-		},
-		{
-			"path":       "my-app/staging/values.yaml",
-			"type":       "file",
-			"last_commit": "def456",
-			"last_update": "2025-05-02T10:00:00Z",
-		},
-		{
-			"path":       "another-app",
-			"type":       "directory",
-			"last_commit": "ghi789",
-			"last_update": "2025-05-03T10:00:00Z",
-		},
+
+	if err := h.authorize(c, id, auth.PermissionView); err != nil {
+		return errorResponse(c, err)
 	}
-	
+
+	files, err := h.service.ListFiles(c.Request().Context(), id)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
 	return c.JSON(http.StatusOK, map[string]interface{}{
 		"status": "success",
 		"data":   files,
@@ -83,31 +72,37 @@ func (h *GitHandler) GetFile(c echo.Context) error {
 	id := c.Param("id")
 	path := c.Param("path")
 	log.Infof("Getting file %s from Git repository with ID: %s", path, id)
-	
-	// Mock response for now
-	fileContent := `# Values for my-app
-image:
-  repository: nginx
-  tag: 1.24.0
-  pullPolicy: IfNotPresent
-
-replicaCount: 2
-
-resources:
-  limits:
-    cpu: 100m
-    memory: 128Mi
-  requests:
-    cpu: 50m
-    memory: 64Mi`
-	
+
+	if err := h.authorize(c, id, auth.PermissionView); err != nil {
+		return errorResponse(c, err)
+	}
+
+	file, err := h.service.GetFile(c.Request().Context(), id, path)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
 	return c.JSON(http.StatusOK, map[string]interface{}{
 		"status": "success",
-		"data": map[string]interface{}{
-			"path":       path,
-			"content":    fileContent,
-			"last_commit": "abc123",
-			"last_update": "2025-05-01T10:00:00Z",
-		},
+		"data":   file,
 	})
 }
+
+// authorize checks that the current user holds a permission on a repository
+func (h *GitHandler) authorize(c echo.Context, id, permission string) error {
+	repository, err := h.service.GetRepository(c.Request().Context(), id)
+	if err != nil {
+		return err
+	}
+
+	return authorize(c, h.authService, permission, repositoryResource(repository))
+}
+
+// repositoryResource describes a repository for permission checks
+func repositoryResource(repository *model.Repository) auth.Resource {
+	return auth.Resource{
+		Kind: "repository",
+		Name: repository.Name,
+		Team: repository.TeamName,
+	}
+}
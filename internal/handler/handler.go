@@ -0,0 +1,106 @@
+package handler
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/jpfaria/image-updater/internal/audit"
+	"github.com/jpfaria/image-updater/internal/auth"
+	"github.com/jpfaria/image-updater/internal/docker"
+	"github.com/jpfaria/image-updater/internal/service"
+	"github.com/labstack/echo/v4"
+)
+
+// currentUser returns the user set by the JWT middleware, or nil
+func currentUser(c echo.Context) *auth.User {
+	user, _ := c.Get("user").(*auth.User)
+	return user
+}
+
+// authorize checks that the current user holds a permission on a resource
+func authorize(c echo.Context, authService *auth.AuthService, permission string, resource auth.Resource) error {
+	return authService.Authorize(c.Request().Context(), currentUser(c), permission, resource)
+}
+
+// auditEvent names the action and target of the request's audit event and
+// returns it so handlers can add before and after values. Requests outside
+// the audit middleware get an event that is never recorded.
+func auditEvent(c echo.Context, action, targetType, targetID string) *audit.Event {
+	event, ok := c.Get("audit").(*audit.Event)
+	if !ok {
+		event = &audit.Event{}
+	}
+
+	event.Action = action
+	event.TargetType = targetType
+	event.TargetID = targetID
+	return event
+}
+
+// errorResponse writes an error response with the status matching err
+func errorResponse(c echo.Context, err error) error {
+	if event, ok := c.Get("audit").(*audit.Event); ok {
+		event.Error = err.Error()
+	}
+
+	var permissionErr *auth.PermissionError
+	if errors.As(err, &permissionErr) {
+		return c.JSON(http.StatusForbidden, map[string]interface{}{
+			"status":     "error",
+			"message":    err.Error(),
+			"permission": permissionErr.Permission,
+		})
+	}
+
+	// Registries failing are told apart from failures of the service
+	var registryErr *docker.RegistryError
+	if errors.As(err, &registryErr) && registryErr.RetryAfter > 0 {
+		c.Response().Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(registryErr.RetryAfter.Seconds()))))
+	}
+
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, docker.ErrNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, docker.ErrUnauthorized):
+		status = http.StatusBadGateway
+	case errors.Is(err, docker.ErrRateLimited):
+		status = http.StatusTooManyRequests
+	case errors.Is(err, docker.ErrUnavailable):
+		status = http.StatusServiceUnavailable
+	case errors.Is(err, auth.ErrInvalidCredentials), errors.Is(err, auth.ErrInvalidToken):
+		status = http.StatusUnauthorized
+	case errors.Is(err, auth.ErrInvalidUser), errors.Is(err, auth.ErrInvalidTokenRequest):
+		status = http.StatusBadRequest
+	case errors.Is(err, auth.ErrUserExists):
+		status = http.StatusConflict
+	case errors.Is(err, service.ErrImageNotFound),
+		errors.Is(err, auth.ErrUserNotFound),
+		errors.Is(err, service.ErrEnvironmentNotFound),
+		errors.Is(err, service.ErrDeploymentNotFound),
+		errors.Is(err, service.ErrDeliveryNotFound),
+		errors.Is(err, service.ErrCandidateNotFound),
+		errors.Is(err, service.ErrReportNotFound),
+		errors.Is(err, service.ErrRepositoryNotFound),
+		errors.Is(err, service.ErrFileNotFound),
+		errors.Is(err, auth.ErrBindingNotFound),
+		errors.Is(err, auth.ErrTokenNotFound),
+		errors.Is(err, audit.ErrNoSigner):
+		status = http.StatusNotFound
+	case errors.Is(err, service.ErrForbidden):
+		status = http.StatusForbidden
+	case errors.Is(err, service.ErrInvalidState):
+		status = http.StatusConflict
+	case errors.Is(err, service.ErrInvalidArgument):
+		status = http.StatusBadRequest
+	case errors.Is(err, service.ErrPolicyViolation):
+		status = http.StatusUnprocessableEntity
+	}
+
+	return c.JSON(status, map[string]interface{}{
+		"status":  "error",
+		"message": err.Error(),
+	})
+}
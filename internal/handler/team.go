@@ -0,0 +1,48 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/jpfaria/image-updater/internal/auth"
+	"github.com/jpfaria/image-updater/internal/model"
+	"github.com/jpfaria/image-updater/internal/service"
+	"github.com/labstack/echo/v4"
+	"github.com/xgodev/boost/wrapper/log"
+)
+
+// TeamHandler handles team related requests
+type TeamHandler struct {
+	service     *service.TeamService
+	authService *auth.AuthService
+}
+
+// NewTeamHandler creates a new team handler
+func NewTeamHandler(service *service.TeamService, authService *auth.AuthService) *TeamHandler {
+	return &TeamHandler{
+		service:     service,
+		authService: authService,
+	}
+}
+
+// ListTeams lists all teams
+func (h *TeamHandler) ListTeams(c echo.Context) error {
+	log.Info("Listing teams")
+
+	teams, err := h.service.ListTeams(c.Request().Context())
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	// Only list the teams the user can see
+	visible := make([]model.Team, 0, len(teams))
+	for _, team := range teams {
+		if h.authService.Can(currentUser(c), auth.PermissionView, auth.Resource{Kind: "team", Name: team.Name, Team: team.Name}) {
+			visible = append(visible, team)
+		}
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data":   visible,
+	})
+}
@@ -0,0 +1,209 @@
+package handler
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/jpfaria/image-updater/internal/audit"
+	"github.com/jpfaria/image-updater/internal/auth"
+	"github.com/labstack/echo/v4"
+	"github.com/xgodev/boost/wrapper/log"
+)
+
+// TokenHandler handles API token and service account requests
+type TokenHandler struct {
+	service *auth.AuthService
+}
+
+// NewTokenHandler creates a new API token handler
+func NewTokenHandler(service *auth.AuthService) *TokenHandler {
+	return &TokenHandler{
+		service: service,
+	}
+}
+
+// tokenRequest is the body of token create requests
+type tokenRequest struct {
+	Name      string    `json:"name"`
+	Scopes    []string  `json:"scopes"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// ListTokens lists the API tokens of the authenticated user
+func (h *TokenHandler) ListTokens(c echo.Context) error {
+	user := currentUser(c)
+	log.Infof("Listing API tokens of user %s", user.Username)
+
+	tokens, err := h.service.ListAPITokens(c.Request().Context(), user.ID)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data":   tokens,
+	})
+}
+
+// CreateToken creates a personal API token for the authenticated user
+func (h *TokenHandler) CreateToken(c echo.Context) error {
+	return h.create(c, currentUser(c).ID)
+}
+
+// RevokeToken revokes an API token of the authenticated user; admins may
+// revoke any token
+func (h *TokenHandler) RevokeToken(c echo.Context) error {
+	id := c.Param("id")
+	ctx := c.Request().Context()
+	event := auditEvent(c, "token.revoke", "tokens", id)
+
+	token, err := h.service.GetAPIToken(ctx, id)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	event.Before = audit.Snapshot(token)
+
+	if user := currentUser(c); token.UserID != user.ID {
+		if err := authorize(c, h.service, auth.PermissionAdmin, auth.Resource{}); err != nil {
+			return errorResponse(c, err)
+		}
+	}
+
+	token, err = h.service.RevokeAPIToken(ctx, id)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	event.After = audit.Snapshot(token)
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data":   token,
+	})
+}
+
+// ListServiceAccounts lists the service accounts
+func (h *TokenHandler) ListServiceAccounts(c echo.Context) error {
+	log.Info("Listing service accounts")
+
+	accounts, err := h.service.ListServiceAccounts(c.Request().Context())
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data":   accounts,
+	})
+}
+
+// CreateServiceAccount creates a service account
+func (h *TokenHandler) CreateServiceAccount(c echo.Context) error {
+	var req struct {
+		Name string `json:"name"`
+		Role string `json:"role"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]interface{}{
+			"status":  "error",
+			"message": "Invalid request body",
+		})
+	}
+
+	event := auditEvent(c, "service_account.create", "users", "")
+
+	account, err := h.service.CreateServiceAccount(c.Request().Context(), req.Name, req.Role)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	event.TargetID = account.ID
+	event.After = audit.Snapshot(account)
+
+	return c.JSON(http.StatusCreated, map[string]interface{}{
+		"status": "success",
+		"data":   account,
+	})
+}
+
+// ListServiceAccountTokens lists the API tokens of a service account
+func (h *TokenHandler) ListServiceAccountTokens(c echo.Context) error {
+	id := c.Param("id")
+	log.Infof("Listing API tokens of service account with ID: %s", id)
+
+	ctx := c.Request().Context()
+
+	if _, err := h.serviceAccount(c, id); err != nil {
+		return errorResponse(c, err)
+	}
+
+	tokens, err := h.service.ListAPITokens(ctx, id)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data":   tokens,
+	})
+}
+
+// CreateServiceAccountToken creates an API token for a service account
+func (h *TokenHandler) CreateServiceAccountToken(c echo.Context) error {
+	id := c.Param("id")
+
+	if _, err := h.serviceAccount(c, id); err != nil {
+		return errorResponse(c, err)
+	}
+
+	return h.create(c, id)
+}
+
+// create creates an API token for a user and returns its secret once
+func (h *TokenHandler) create(c echo.Context, userID string) error {
+	event := auditEvent(c, "token.create", "tokens", "")
+
+	// Tokens cannot mint other tokens, which would outlive their revocation
+	if creator := currentUser(c); creator.TokenID != "" {
+		return c.JSON(http.StatusForbidden, map[string]interface{}{
+			"status":  "error",
+			"message": "API tokens cannot create API tokens",
+		})
+	}
+
+	var req tokenRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]interface{}{
+			"status":  "error",
+			"message": "Invalid request body",
+		})
+	}
+
+	token, secret, err := h.service.CreateAPIToken(c.Request().Context(), userID, req.Name, req.Scopes, req.ExpiresAt, currentUser(c).Username)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	// The secret is never audited, only the token's metadata
+	event.TargetID = token.ID
+	event.After = audit.Snapshot(token)
+
+	return c.JSON(http.StatusCreated, map[string]interface{}{
+		"status":  "success",
+		"message": "Store the token now, it cannot be shown again",
+		"data": struct {
+			*auth.APIToken
+			Token string `json:"token"`
+		}{token, secret},
+	})
+}
+
+// serviceAccount loads a user and checks that it is a service account
+func (h *TokenHandler) serviceAccount(c echo.Context, id string) (*auth.User, error) {
+	user, err := h.service.GetUser(c.Request().Context(), id)
+	if err != nil {
+		return nil, err
+	}
+	if !user.ServiceAccount {
+		return nil, auth.ErrUserNotFound
+	}
+
+	return user, nil
+}
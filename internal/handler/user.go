@@ -0,0 +1,237 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/jpfaria/image-updater/internal/audit"
+	"github.com/jpfaria/image-updater/internal/auth"
+	"github.com/labstack/echo/v4"
+	"github.com/xgodev/boost/wrapper/log"
+)
+
+// UserHandler handles user management requests
+type UserHandler struct {
+	service *auth.AuthService
+}
+
+// NewUserHandler creates a new user handler
+func NewUserHandler(service *auth.AuthService) *UserHandler {
+	return &UserHandler{
+		service: service,
+	}
+}
+
+// userRequest is the body of user create and update requests
+type userRequest struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	Role     string `json:"role"`
+	Password string `json:"password"`
+}
+
+// ListUsers lists all users
+func (h *UserHandler) ListUsers(c echo.Context) error {
+	log.Info("Listing users")
+
+	users, err := h.service.ListUsers(c.Request().Context())
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data":   users,
+	})
+}
+
+// GetUser gets a user by ID
+func (h *UserHandler) GetUser(c echo.Context) error {
+	id := c.Param("id")
+	log.Infof("Getting user with ID: %s", id)
+
+	user, err := h.service.GetUser(c.Request().Context(), id)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data":   user,
+	})
+}
+
+// CreateUser creates a user
+func (h *UserHandler) CreateUser(c echo.Context) error {
+	var req userRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]interface{}{
+			"status":  "error",
+			"message": "Invalid request body",
+		})
+	}
+
+	event := auditEvent(c, "user.create", "users", "")
+
+	user, err := h.service.CreateUser(c.Request().Context(), auth.User{
+		Username: req.Username,
+		Email:    req.Email,
+		Role:     req.Role,
+	}, req.Password)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	event.TargetID = user.ID
+	event.After = audit.Snapshot(user)
+
+	return c.JSON(http.StatusCreated, map[string]interface{}{
+		"status": "success",
+		"data":   user,
+	})
+}
+
+// UpdateUser updates the email, role and optionally the password of a user
+func (h *UserHandler) UpdateUser(c echo.Context) error {
+	id := c.Param("id")
+
+	var req userRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]interface{}{
+			"status":  "error",
+			"message": "Invalid request body",
+		})
+	}
+
+	ctx := c.Request().Context()
+	event := auditEvent(c, "user.update", "users", id)
+	if before, err := h.service.GetUser(ctx, id); err == nil {
+		event.Before = audit.Snapshot(before)
+	}
+
+	user, err := h.service.UpdateUser(ctx, id, auth.User{
+		Email: req.Email,
+		Role:  req.Role,
+	}, req.Password)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	event.After = audit.Snapshot(user)
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data":   user,
+	})
+}
+
+// DeleteUser deletes a user
+func (h *UserHandler) DeleteUser(c echo.Context) error {
+	id := c.Param("id")
+
+	if user := currentUser(c); user != nil && user.ID == id {
+		return c.JSON(http.StatusBadRequest, map[string]interface{}{
+			"status":  "error",
+			"message": "Users cannot delete themselves",
+		})
+	}
+
+	ctx := c.Request().Context()
+	event := auditEvent(c, "user.delete", "users", id)
+	if before, err := h.service.GetUser(ctx, id); err == nil {
+		event.Before = audit.Snapshot(before)
+	}
+
+	if err := h.service.DeleteUser(ctx, id); err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"status":  "success",
+		"message": "User deleted",
+	})
+}
+
+// ListRoleBindings lists the role bindings of a user
+func (h *UserHandler) ListRoleBindings(c echo.Context) error {
+	id := c.Param("id")
+	log.Infof("Listing role bindings of user with ID: %s", id)
+
+	ctx := c.Request().Context()
+
+	if _, err := h.service.GetUser(ctx, id); err != nil {
+		return errorResponse(c, err)
+	}
+
+	bindings, err := h.service.ListRoleBindings(ctx, id)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data":   bindings,
+	})
+}
+
+// CreateRoleBinding grants a user a role on a team, application or environment
+func (h *UserHandler) CreateRoleBinding(c echo.Context) error {
+	id := c.Param("id")
+
+	var req struct {
+		Role   string `json:"role"`
+		Scope  string `json:"scope"`
+		Target string `json:"target"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]interface{}{
+			"status":  "error",
+			"message": "Invalid request body",
+		})
+	}
+
+	event := auditEvent(c, "role_binding.create", "users", id)
+
+	binding, err := h.service.CreateRoleBinding(c.Request().Context(), auth.RoleBinding{
+		UserID: id,
+		Role:   req.Role,
+		Scope:  req.Scope,
+		Target: req.Target,
+	})
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	event.After = audit.Snapshot(binding)
+
+	return c.JSON(http.StatusCreated, map[string]interface{}{
+		"status": "success",
+		"data":   binding,
+	})
+}
+
+// DeleteRoleBinding removes a role binding of a user
+func (h *UserHandler) DeleteRoleBinding(c echo.Context) error {
+	id := c.Param("id")
+	bindingID := c.Param("binding_id")
+
+	ctx := c.Request().Context()
+	event := auditEvent(c, "role_binding.delete", "users", id)
+
+	bindings, err := h.service.ListRoleBindings(ctx, id)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	for _, binding := range bindings {
+		if binding.ID == bindingID {
+			event.Before = audit.Snapshot(binding)
+			if err := h.service.DeleteRoleBinding(ctx, bindingID); err != nil {
+				return errorResponse(c, err)
+			}
+
+			return c.JSON(http.StatusOK, map[string]interface{}{
+				"status":  "success",
+				"message": "Role binding deleted",
+			})
+		}
+	}
+
+	return errorResponse(c, auth.ErrBindingNotFound)
+}
@@ -0,0 +1,145 @@
+package handler
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/jpfaria/image-updater/internal/audit"
+	"github.com/jpfaria/image-updater/internal/auth"
+	"github.com/jpfaria/image-updater/internal/model"
+	"github.com/jpfaria/image-updater/internal/service"
+	"github.com/labstack/echo/v4"
+	"github.com/xgodev/boost/wrapper/log"
+)
+
+// maxReportSize bounds the size of uploaded scan reports
+const maxReportSize = 32 << 20
+
+// VulnerabilityHandler handles the vulnerability reports of images
+type VulnerabilityHandler struct {
+	service       *service.VulnerabilityService
+	dockerService *service.DockerService
+	authService   *auth.AuthService
+}
+
+// NewVulnerabilityHandler creates a new vulnerability handler
+func NewVulnerabilityHandler(service *service.VulnerabilityService, dockerService *service.DockerService, authService *auth.AuthService) *VulnerabilityHandler {
+	return &VulnerabilityHandler{
+		service:       service,
+		dockerService: dockerService,
+		authService:   authService,
+	}
+}
+
+// UploadReport stores a Trivy, Grype or SARIF report of an image digest.
+// The digest or tag query parameter names the scanned image when the report
+// does not; the format query parameter skips detection.
+func (h *VulnerabilityHandler) UploadReport(c echo.Context) error {
+	id := c.Param("id")
+	log.Infof("Uploading vulnerability report for Docker image with ID: %s", id)
+
+	event := auditEvent(c, "vulnerability_report.upload", "images", id)
+
+	if err := h.authorize(c, id, auth.PermissionScan); err != nil {
+		return errorResponse(c, err)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(c.Request().Body, maxReportSize+1))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]interface{}{
+			"status":  "error",
+			"message": "Invalid request body",
+		})
+	}
+	if len(body) > maxReportSize {
+		return c.JSON(http.StatusRequestEntityTooLarge, map[string]interface{}{
+			"status":  "error",
+			"message": "Report exceeds 32 MiB",
+		})
+	}
+
+	reference := c.QueryParam("digest")
+	if reference == "" {
+		reference = c.QueryParam("tag")
+	}
+	user := ""
+	if u := currentUser(c); u != nil {
+		user = u.Username
+	}
+
+	report, err := h.service.UploadReport(c.Request().Context(), id, reference, c.QueryParam("format"), body, user)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	event.After = reportSnapshot(report)
+
+	return c.JSON(http.StatusCreated, map[string]interface{}{
+		"status": "success",
+		"data":   report,
+	})
+}
+
+// GetReport gets the vulnerability report of a tag or digest
+func (h *VulnerabilityHandler) GetReport(c echo.Context) error {
+	id := c.Param("id")
+	reference := c.Param("reference")
+	log.Infof("Getting the vulnerability report of %s for Docker image with ID: %s", reference, id)
+
+	if err := h.authorize(c, id, auth.PermissionView); err != nil {
+		return errorResponse(c, err)
+	}
+
+	report, err := h.service.GetReport(c.Request().Context(), id, reference)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data":   report,
+	})
+}
+
+// ImportAttestation reads the signed vulnerability attestation of a tag or
+// digest from the registry
+func (h *VulnerabilityHandler) ImportAttestation(c echo.Context) error {
+	id := c.Param("id")
+	reference := c.Param("reference")
+	log.Infof("Importing the vulnerability attestation of %s for Docker image with ID: %s", reference, id)
+
+	event := auditEvent(c, "vulnerability_report.import", "images", id)
+
+	if err := h.authorize(c, id, auth.PermissionDeploy); err != nil {
+		return errorResponse(c, err)
+	}
+
+	report, err := h.service.ImportAttestation(c.Request().Context(), id, reference)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	event.After = reportSnapshot(report)
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data":   report,
+	})
+}
+
+// authorize checks that the current user holds a permission on an image
+func (h *VulnerabilityHandler) authorize(c echo.Context, id, permission string) error {
+	image, err := h.dockerService.GetImage(c.Request().Context(), id)
+	if err != nil {
+		return err
+	}
+
+	return authorize(c, h.authService, permission, imageResource(image))
+}
+
+// reportSnapshot records a report in the audit log without its findings,
+// which can number in the thousands
+func reportSnapshot(report *model.VulnerabilityReport) json.RawMessage {
+	summary := *report
+	summary.Vulnerabilities = nil
+	return audit.Snapshot(summary)
+}
@@ -1,46 +1,188 @@
 package handler
 
 import (
+	"errors"
+	"io"
 	"net/http"
 
+	"github.com/jpfaria/image-updater/internal/audit"
+	"github.com/jpfaria/image-updater/internal/service"
+	"github.com/jpfaria/image-updater/internal/webhook"
 	"github.com/labstack/echo/v4"
 	"github.com/xgodev/boost/wrapper/log"
 )
 
+// maxWebhookBodySize bounds the size of webhook payloads
+const maxWebhookBodySize = 1 << 20
+
 // WebhookHandler handles webhook related requests
 type WebhookHandler struct {
-	// Add service dependencies here
+	service  *service.WebhookService
+	verifier *webhook.Verifier
 }
 
 // NewWebhookHandler creates a new webhook handler
-func NewWebhookHandler() *WebhookHandler {
-	return &WebhookHandler{}
+func NewWebhookHandler(service *service.WebhookService, verifier *webhook.Verifier) *WebhookHandler {
+	return &WebhookHandler{
+		service:  service,
+		verifier: verifier,
+	}
 }
 
-// DockerWebhook handles Docker registry webhooks
+// DockerWebhook handles Docker registry webhooks, detecting the registry
+// from the payload
 func (h *WebhookHandler) DockerWebhook(c echo.Context) error {
 	log.Info("Received Docker webhook")
-	
-	// Parse request body
-	var req struct {
-		Repository string `json:"repository"`
-		Tag        string `json:"tag"`
-		Digest     string `json:"digest"`
-		Namespace  string `json:"namespace"`
-	}
-	
-	if err := c.Bind(&req); err != nil {
+
+	return h.handle(c, "")
+}
+
+// RegistryWebhook handles webhooks from the registry named in the route
+func (h *WebhookHandler) RegistryWebhook(c echo.Context) error {
+	source := c.Param("source")
+	log.Infof("Received %s webhook", source)
+
+	return h.handle(c, source)
+}
+
+// handle normalises a webhook payload and queues the resulting events for
+// processing; an empty source auto-detects the registry
+func (h *WebhookHandler) handle(c echo.Context, source string) error {
+	body, err := io.ReadAll(io.LimitReader(c.Request().Body, maxWebhookBodySize))
+	if err != nil {
 		return c.JSON(http.StatusBadRequest, map[string]interface{}{
 			"status":  "error",
 			"message": "Invalid request body",
 		})
 	}
-	
-	log.Infof("Docker webhook for %s/%s:%s", req.Namespace, req.Repository, req.Tag)
-	
-	// Mock response for now
-	return c.JSON(http.StatusOK, map[string]interface{}{
+
+	header := c.Request().Header
+
+	// The payload is only inspected to pick the source whose secret applies;
+	// nothing in it is trusted before verification
+	if source == "" {
+		if source, err = webhook.DetectSource(header, body); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]interface{}{
+				"status":  "error",
+				"message": err.Error(),
+			})
+		}
+	}
+
+	event := auditEvent(c, "webhook.receive", "webhooks", source)
+	event.Actor = "webhook:" + source
+
+	key, err := h.verifier.Verify(source, header, body)
+	if err != nil {
+		event.Error = err.Error()
+		status := http.StatusUnauthorized
+		if errors.Is(err, webhook.ErrReplayed) {
+			status = http.StatusConflict
+		}
+		return c.JSON(status, map[string]interface{}{
+			"status":  "error",
+			"message": err.Error(),
+		})
+	}
+
+	// The delivery ID is only remembered once the delivery is queued, so a
+	// delivery failing below can be sent again
+	queued := false
+	defer func() {
+		if queued {
+			h.verifier.Accept(key)
+		} else {
+			h.verifier.Release(key)
+		}
+	}()
+
+	events, err := webhook.Parse(source, header, body)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, webhook.ErrUnknownSource) {
+			status = http.StatusNotFound
+		}
+		return c.JSON(status, map[string]interface{}{
+			"status":  "error",
+			"message": err.Error(),
+		})
+	}
+
+	for _, event := range events {
+		log.Infof("Docker webhook for %s/%s:%s", event.Namespace, event.Repository, event.Tag)
+	}
+
+	delivery, err := h.service.Enqueue(c.Request().Context(), source, events)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	queued = true
+	event.TargetID = delivery.ID
+	event.After = audit.Snapshot(delivery)
+
+	return c.JSON(http.StatusAccepted, map[string]interface{}{
 		"status":  "success",
-		"message": "Webhook processed successfully",
+		"message": "Webhook accepted",
+		"data":    delivery,
+	})
+}
+
+// ListDeliveries lists webhook deliveries and their processing outcome
+func (h *WebhookHandler) ListDeliveries(c echo.Context) error {
+	log.Info("Listing webhook deliveries")
+
+	deliveries, err := h.service.ListDeliveries(c.Request().Context(), c.QueryParam("status"))
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data":   deliveries,
+	})
+}
+
+// GetDelivery gets a webhook delivery by ID
+func (h *WebhookHandler) GetDelivery(c echo.Context) error {
+	id := c.Param("id")
+	log.Infof("Getting webhook delivery with ID: %s", id)
+
+	delivery, err := h.service.GetDelivery(c.Request().Context(), id)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data":   delivery,
+	})
+}
+
+// Redeliver queues a webhook delivery for processing again
+func (h *WebhookHandler) Redeliver(c echo.Context) error {
+	id := c.Param("id")
+	log.Infof("Redelivering webhook delivery with ID: %s", id)
+
+	event := auditEvent(c, "webhook.redeliver", "webhooks", id)
+
+	delivery, err := h.service.Redeliver(c.Request().Context(), id)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+	event.After = audit.Snapshot(delivery)
+
+	return c.JSON(http.StatusAccepted, map[string]interface{}{
+		"status": "success",
+		"data":   delivery,
+	})
+}
+
+// Rejections reports the number of rejected deliveries by source and reason
+func (h *WebhookHandler) Rejections(c echo.Context) error {
+	log.Info("Listing webhook rejections")
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data":   h.verifier.Rejections(),
 	})
 }
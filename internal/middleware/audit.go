@@ -0,0 +1,86 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/jpfaria/image-updater/internal/audit"
+	"github.com/jpfaria/image-updater/internal/auth"
+	"github.com/labstack/echo/v4"
+	"github.com/xgodev/boost/wrapper/log"
+)
+
+// Audit is a middleware that records every state-changing request in the
+// audit log. Handlers name the action and add before and after values
+// through the event stored in the context as "audit".
+func Audit(auditLog *audit.Log) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			action := req.Method + " " + c.Path()
+
+			event := &audit.Event{
+				Actor:      "anonymous",
+				SourceIP:   c.RealIP(),
+				Action:     action,
+				TargetType: targetType(c.Path()),
+				TargetID:   c.Param("id"),
+			}
+			if user, ok := c.Get("user").(*auth.User); ok {
+				event.Actor = user.Username
+				event.TokenID = user.TokenID
+			}
+			c.Set("audit", event)
+
+			// Events recorded by services for this request name the same actor
+			c.SetRequest(req.WithContext(audit.WithActor(req.Context(), event.Actor, event.TokenID, event.SourceIP)))
+
+			err := next(c)
+
+			// Reads are only audited when the handler names an action, as
+			// the single sign-on callback does
+			if readOnly(req.Method) && event.Action == action {
+				return err
+			}
+
+			event.Status = c.Response().Status
+			var httpErr *echo.HTTPError
+			if errors.As(err, &httpErr) {
+				event.Status = httpErr.Code
+			} else if err != nil {
+				event.Status = http.StatusInternalServerError
+			}
+
+			switch {
+			case event.Status == http.StatusUnauthorized || event.Status == http.StatusForbidden:
+				event.Outcome = audit.OutcomeDenied
+			case event.Status >= http.StatusBadRequest:
+				event.Outcome = audit.OutcomeFailure
+			default:
+				event.Outcome = audit.OutcomeSuccess
+			}
+			if err != nil && event.Error == "" {
+				event.Error = err.Error()
+			}
+
+			if recordErr := auditLog.Record(req.Context(), *event); recordErr != nil {
+				log.Errorf("Failed to record audit event %s: %v", event.Action, recordErr)
+			}
+
+			return err
+		}
+	}
+}
+
+// targetType derives the kind of target from a route, e.g. "environments"
+// for /api/environments/:id/deploy
+func targetType(path string) string {
+	segments := strings.Split(strings.TrimPrefix(path, "/api/"), "/")
+	return segments[0]
+}
+
+// readOnly reports whether a request method does not change state
+func readOnly(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
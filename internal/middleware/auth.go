@@ -12,8 +12,12 @@ import (
 func JWTMiddleware(authService *auth.AuthService) echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
-			// Skip authentication for login and health check endpoints
-			if c.Path() == "/api/auth/login" || c.Path() == "/health" || c.Path() == "/api/webhooks/docker" {
+			// Skip authentication for login and health check endpoints;
+			// webhook deliveries are authenticated by their own secrets
+			isLogin := c.Path() == "/api/auth/login" || c.Path() == "/api/auth/refresh" ||
+				c.Path() == "/api/auth/oidc/login" || c.Path() == "/api/auth/oidc/callback"
+			isWebhookDelivery := c.Path() == "/api/webhooks/docker" || c.Path() == "/api/webhooks/:source"
+			if isLogin || c.Path() == "/health" || isWebhookDelivery {
 				return next(c)
 			}
 
@@ -28,15 +32,46 @@ func JWTMiddleware(authService *auth.AuthService) echo.MiddlewareFunc {
 				tokenString = tokenString[7:]
 			}
 
-			// Validate token
-			user, err := authService.ValidateToken(c.Request().Context(), tokenString)
+			// Validate token; API tokens are told apart from JWTs by their prefix
+			var user *auth.User
+			var err error
+			if auth.IsAPIToken(tokenString) {
+				user, err = authService.ValidateAPIToken(c.Request().Context(), tokenString, c.RealIP())
+			} else {
+				user, err = authService.ValidateToken(c.Request().Context(), tokenString)
+			}
 			if err != nil {
 				log.Errorf("Invalid token: %v", err)
 				return echo.NewHTTPError(401, "Invalid token")
 			}
 
-			// Set user in context
+			// Set user and token in context
 			c.Set("user", user)
+			c.Set("token", tokenString)
+
+			return next(c)
+		}
+	}
+}
+
+// RequirePermission is a middleware that only lets users holding a
+// permission globally through, for routes that are not scoped to a team,
+// application or environment
+func RequirePermission(authService *auth.AuthService, permission string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			user, ok := c.Get("user").(*auth.User)
+			if !ok {
+				return echo.NewHTTPError(401, "Authentication required")
+			}
+
+			if err := authService.Authorize(c.Request().Context(), user, permission, auth.Resource{}); err != nil {
+				return c.JSON(403, map[string]interface{}{
+					"status":     "error",
+					"message":    err.Error(),
+					"permission": permission,
+				})
+			}
 
 			return next(c)
 		}
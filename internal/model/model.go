@@ -1,37 +1,295 @@
 package model
 
+// Team represents a team owning repositories and images
+type Team struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+}
+
+// Image update strategies
+const (
+	// UpdateStrategySemver follows the highest semantic version tag
+	UpdateStrategySemver = "semver"
+	// UpdateStrategyLatest follows the most recently pushed tag
+	UpdateStrategyLatest = "latest"
+	// UpdateStrategyDigest follows the digest of a single mutable tag
+	UpdateStrategyDigest = "digest"
+)
+
 // Image represents a Docker image
 type Image struct {
-	ID        string `json:"id"`
-	Name      string `json:"name"`
-	Registry  string `json:"registry"`
-	Namespace string `json:"namespace"`
-	LatestTag string `json:"latest_tag,omitempty"`
+	ID             string `json:"id"`
+	Name           string `json:"name"`
+	Registry       string `json:"registry"`
+	Namespace      string `json:"namespace"`
+	Team           string `json:"team,omitempty"`
+	UpdateStrategy string `json:"update_strategy,omitempty"`
+	TagPattern     string `json:"tag_pattern,omitempty"` // regular expression tags must match
+	LatestTag      string `json:"latest_tag,omitempty"`
+	Source         string `json:"source,omitempty"`
+}
+
+// Image sources
+const (
+	// ImageSourceDiscovery marks an image found in a registry catalog and
+	// approved, rather than declared
+	ImageSourceDiscovery = "discovery"
+)
+
+// DiscoveryRule makes the repositories of a registry matching its patterns
+// candidates to be tracked as images of a team
+type DiscoveryRule struct {
+	Team     string `json:"team"`
+	Registry string `json:"registry"`
+	// Include and Exclude are patterns matched against repository paths,
+	// such as payments/* or payments/**, the latter matching any depth
+	Include        []string `json:"include"`
+	Exclude        []string `json:"exclude,omitempty"`
+	UpdateStrategy string   `json:"update_strategy,omitempty"`
+	TagPattern     string   `json:"tag_pattern,omitempty"`
+}
+
+// Image candidate statuses
+const (
+	CandidateStatusPending  = "pending"
+	CandidateStatusApproved = "approved"
+	CandidateStatusRejected = "rejected"
+)
+
+// ImageCandidate is a discovered repository waiting for a decision before
+// it is tracked as an image
+type ImageCandidate struct {
+	Image        Image  `json:"image"`
+	Status       string `json:"status"`
+	DiscoveredAt string `json:"discovered_at"`
+	DecidedBy    string `json:"decided_by,omitempty"`
+	DecidedAt    string `json:"decided_at,omitempty"`
+	Comment      string `json:"comment,omitempty"`
 }
 
 // Tag represents a Docker image tag
 type Tag struct {
-	Name      string `json:"name"`
+	Name            string               `json:"name"`
+	Digest          string               `json:"digest"`
+	CreatedAt       string               `json:"created_at"`
+	Signature       *Signature           `json:"signature,omitempty"`
+	Vulnerabilities *VulnerabilityCounts `json:"vulnerabilities,omitempty"`
+}
+
+// Signature statuses
+const (
+	SignatureStatusVerified = "verified"
+	SignatureStatusUnsigned = "unsigned"
+	// SignatureStatusInvalid is a signed image none of whose signatures is
+	// made with a trusted key
+	SignatureStatusInvalid = "invalid"
+)
+
+// Signature is the outcome of verifying the cosign signatures of a digest
+type Signature struct {
 	Digest    string `json:"digest"`
-	CreatedAt string `json:"created_at"`
+	Status    string `json:"status"`
+	Key       string `json:"key,omitempty"` // name of the key that verified it
+	Message   string `json:"message,omitempty"`
+	CheckedAt string `json:"checked_at"`
+}
+
+// Vulnerability severities, the most severe first
+const (
+	SeverityCritical = "critical"
+	SeverityHigh     = "high"
+	SeverityMedium   = "medium"
+	SeverityLow      = "low"
+	SeverityUnknown  = "unknown"
+)
+
+// Severities lists the vulnerability severities, the most severe first
+var Severities = []string{SeverityCritical, SeverityHigh, SeverityMedium, SeverityLow, SeverityUnknown}
+
+// Sources of vulnerability reports
+const (
+	ReportSourceUpload      = "upload"
+	ReportSourceAttestation = "attestation"
+)
+
+// Fix states of vulnerabilities
+const (
+	FixStateFixed    = "fixed"
+	FixStateNotFixed = "not-fixed"
+	FixStateWontFix  = "wont-fix"
+	FixStateUnknown  = "unknown" // the scanner did not tell
+)
+
+// Vulnerability is a vulnerability a scanner found in an image
+type Vulnerability struct {
+	ID               string `json:"id"`
+	Severity         string `json:"severity"`
+	Package          string `json:"package,omitempty"`
+	InstalledVersion string `json:"installed_version,omitempty"`
+	FixedVersion     string `json:"fixed_version,omitempty"`
+	FixState         string `json:"fix_state,omitempty"`
+	Title            string `json:"title,omitempty"`
+}
+
+// VulnerabilityCounts counts the vulnerabilities of an image by severity
+type VulnerabilityCounts struct {
+	Critical int `json:"critical"`
+	High     int `json:"high"`
+	Medium   int `json:"medium"`
+	Low      int `json:"low"`
+	Unknown  int `json:"unknown"`
 }
 
+// VulnerabilityReport is the latest scan report of an image digest
+type VulnerabilityReport struct {
+	ImageID         string              `json:"image_id"`
+	Digest          string              `json:"digest"`
+	Format          string              `json:"format"`
+	Scanner         string              `json:"scanner,omitempty"`
+	Source          string              `json:"source"`
+	UploadedBy      string              `json:"uploaded_by,omitempty"`
+	UploadedAt      string              `json:"uploaded_at"`
+	Counts          VulnerabilityCounts `json:"counts"`
+	Vulnerabilities []Vulnerability     `json:"vulnerabilities"`
+}
+
+// VulnerabilityPolicy limits the vulnerabilities of the tags deployed to
+// an environment
+type VulnerabilityPolicy struct {
+	// Max caps the vulnerabilities of a severity or higher, so high: 0
+	// blocks any high or critical vulnerability
+	Max           map[string]int `json:"max,omitempty"`
+	RequireReport bool           `json:"require_report,omitempty"` // tags without a report are not deployed
+	IgnoreUnfixed bool           `json:"ignore_unfixed,omitempty"` // vulnerabilities known to have no fix are not counted
+	Allow         []string       `json:"allow,omitempty"`          // vulnerability IDs accepted regardless of severity
+}
+
+// ImagePushedEvent is the normalised form of a registry push notification
+type ImagePushedEvent struct {
+	Source     string `json:"source"`
+	DeliveryID string `json:"delivery_id,omitempty"`
+	Registry   string `json:"registry,omitempty"`
+	Namespace  string `json:"namespace"`
+	Repository string `json:"repository"`
+	Tag        string `json:"tag"`
+	Digest     string `json:"digest,omitempty"`
+	Pusher     string `json:"pusher,omitempty"`
+	PushedAt   string `json:"pushed_at,omitempty"`
+}
+
+// Webhook delivery statuses
+const (
+	DeliveryStatusQueued    = "queued"
+	DeliveryStatusRetrying  = "retrying"
+	DeliveryStatusProcessed = "processed"
+	DeliveryStatusDuplicate = "duplicate"
+	DeliveryStatusDead      = "dead"
+)
+
+// WebhookDelivery represents a received webhook and its processing outcome
+type WebhookDelivery struct {
+	ID            string             `json:"id"`
+	Source        string             `json:"source"`
+	ReceivedAt    string             `json:"received_at"`
+	Events        []ImagePushedEvent `json:"events"`
+	Status        string             `json:"status"`
+	Attempts      int                `json:"attempts"`
+	NextAttemptAt string             `json:"next_attempt_at,omitempty"`
+	ProcessedAt   string             `json:"processed_at,omitempty"`
+	LastError     string             `json:"last_error,omitempty"`
+	ImageIDs      []string           `json:"image_ids,omitempty"`
+	Redelivered   bool               `json:"redelivered,omitempty"`
+}
+
+// Write-back modes of environments
+const (
+	// WriteBackCommit commits new tags to the tracked branch
+	WriteBackCommit = "commit"
+	// WriteBackBranch commits new tags to a branch of their own, to be
+	// merged by a pull request; the deployment lands when it is merged
+	WriteBackBranch = "branch"
+)
+
 // Environment represents a deployment environment
 type Environment struct {
-	ID           string `json:"id"`
-	Name         string `json:"name"`
-	Application  string `json:"application"`
-	ValuesPath   string `json:"values_path"`
-	CurrentImage string `json:"current_image,omitempty"`
+	ID                string `json:"id"`
+	Name              string `json:"name"`
+	Application       string `json:"application"`
+	RepositoryID      string `json:"repository_id"`
+	ValuesPath        string `json:"values_path"`
+	KeyPath           string `json:"key_path,omitempty"` // dotted path of the tag, image.tag when empty
+	WriteBack         string `json:"write_back,omitempty"`
+	ImageID           string `json:"image_id,omitempty"`
+	CurrentImage      string `json:"current_image,omitempty"`
+	RequiredApprovals int    `json:"required_approvals,omitempty"`
+	RequireSignature  bool   `json:"require_signature,omitempty"` // only tags with a verified signature are deployed
+	// VulnerabilityPolicy blocks tags whose scan reports exceed it
+	VulnerabilityPolicy *VulnerabilityPolicy `json:"vulnerability_policy,omitempty"`
+	Drift               *Drift               `json:"drift,omitempty"`
 }
 
+// Drift describes a values file whose image no longer matches the
+// image recorded as deployed
+type Drift struct {
+	ExpectedImage string `json:"expected_image"`
+	ActualImage   string `json:"actual_image"`
+	Commit        string `json:"commit"`
+	Author        string `json:"author"`
+	DetectedAt    string `json:"detected_at"`
+}
+
+// Deployment statuses
+const (
+	DeploymentStatusPending          = "pending"
+	DeploymentStatusAwaitingApproval = "awaiting_approval"
+	DeploymentStatusScheduled        = "scheduled"
+	DeploymentStatusRunning          = "running" // writing back to Git
+	DeploymentStatusCancelled        = "cancelled"
+	DeploymentStatusRejected         = "rejected"
+	DeploymentStatusExpired          = "expired"
+	DeploymentStatusSuccess          = "success"
+	DeploymentStatusFailed           = "failed"
+)
+
 // Deployment represents a deployment record
 type Deployment struct {
-	ID        string `json:"id"`
-	ImageTag  string `json:"image_tag"`
-	Timestamp string `json:"timestamp"`
+	ID                string     `json:"id"`
+	EnvironmentID     string     `json:"environment_id,omitempty"`
+	ImageTag          string     `json:"image_tag"`
+	Timestamp         string     `json:"timestamp"`
+	User              string     `json:"user"`
+	Status            string     `json:"status"`
+	Message           string     `json:"message,omitempty"`
+	RequiredApprovals int        `json:"required_approvals,omitempty"`
+	Approvals         []Approval `json:"approvals,omitempty"`
+	ExpiresAt         string     `json:"expires_at,omitempty"`
+	ScheduledAt       string     `json:"scheduled_at,omitempty"`
+	Source            string     `json:"source,omitempty"`
+	Commit            string     `json:"commit,omitempty"`
+	// Digest pins the tag to the digest the deployment gates checked, for
+	// environments requiring signed or scanned images
+	Digest string `json:"digest,omitempty"`
+}
+
+// Deployment sources
+const (
+	// DeploymentSourceExternal marks a deployment adopted from a change made
+	// directly in Git rather than through the service
+	DeploymentSourceExternal = "external"
+)
+
+// Approval decisions
+const (
+	ApprovalDecisionApproved = "approved"
+	ApprovalDecisionRejected = "rejected"
+)
+
+// Approval represents a decision taken on a gated deployment
+type Approval struct {
 	User      string `json:"user"`
-	Status    string `json:"status"`
+	Decision  string `json:"decision"`
+	Comment   string `json:"comment,omitempty"`
+	Timestamp string `json:"timestamp"`
 }
 
 // Repository represents a Git repository
@@ -48,6 +306,7 @@ type File struct {
 	Path       string `json:"path"`
 	Type       string `json:"type"` // "file" or "directory"
 	LastCommit string `json:"last_commit"`
+	LastAuthor string `json:"last_author,omitempty"`
 	LastUpdate string `json:"last_update"`
 	Content    string `json:"content,omitempty"`
 }
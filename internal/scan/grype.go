@@ -0,0 +1,114 @@
+package scan
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/jpfaria/image-updater/internal/model"
+)
+
+// grypeParser handles Grype JSON reports, grype -o json
+type grypeParser struct{}
+
+type grypeReport struct {
+	Matches []struct {
+		Vulnerability struct {
+			ID          string `json:"id"`
+			Severity    string `json:"severity"`
+			Description string `json:"description"`
+			Fix         struct {
+				Versions []string `json:"versions"`
+				State    string   `json:"state"`
+			} `json:"fix"`
+		} `json:"vulnerability"`
+		Artifact struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+		} `json:"artifact"`
+	} `json:"matches"`
+	Source *struct {
+		Type   string          `json:"type"`
+		Target json.RawMessage `json:"target"`
+	} `json:"source"`
+	Descriptor struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	} `json:"descriptor"`
+}
+
+// grypeImage is the target of a report on an image
+type grypeImage struct {
+	ManifestDigest string   `json:"manifestDigest"`
+	RepoDigests    []string `json:"repoDigests"`
+}
+
+func (p *grypeParser) Name() string {
+	return "grype"
+}
+
+func (p *grypeParser) Detect(body []byte) bool {
+	var report grypeReport
+	return json.Unmarshal(body, &report) == nil && report.Matches != nil && (report.Source != nil || report.Descriptor.Name == "grype")
+}
+
+func (p *grypeParser) Parse(body []byte) (*Report, error) {
+	var report grypeReport
+	if err := json.Unmarshal(body, &report); err != nil {
+		return nil, err
+	}
+
+	result := &Report{Scanner: strings.TrimSpace("Grype " + report.Descriptor.Version), Vulnerabilities: make([]model.Vulnerability, 0)}
+
+	// RepoDigests name the digest of the pulled manifest, which is the one
+	// tags point to; manifestDigest is that of the platform manifest
+	if report.Source != nil && report.Source.Type == "image" {
+		var target grypeImage
+		if json.Unmarshal(report.Source.Target, &target) == nil {
+			for _, reference := range target.RepoDigests {
+				if digest := digestOf(reference); digest != "" {
+					result.Digests = append(result.Digests, digest)
+				}
+			}
+			if target.ManifestDigest != "" {
+				result.Digests = append(result.Digests, target.ManifestDigest)
+			}
+		}
+	}
+
+	for _, match := range report.Matches {
+		fixed := ""
+		if match.Vulnerability.Fix.State == "fixed" {
+			fixed = strings.Join(match.Vulnerability.Fix.Versions, ", ")
+		}
+		result.Vulnerabilities = append(result.Vulnerabilities, model.Vulnerability{
+			ID:               match.Vulnerability.ID,
+			Severity:         normalizeSeverity(match.Vulnerability.Severity),
+			Package:          match.Artifact.Name,
+			InstalledVersion: match.Artifact.Version,
+			FixedVersion:     fixed,
+			FixState:         grypeFixState(match.Vulnerability.Fix.State),
+			Title:            firstLine(match.Vulnerability.Description),
+		})
+	}
+
+	return result, nil
+}
+
+// grypeFixState maps the fix state of a Grype match
+func grypeFixState(state string) string {
+	switch state {
+	case "fixed":
+		return model.FixStateFixed
+	case "not-fixed":
+		return model.FixStateNotFixed
+	case "wont-fix":
+		return model.FixStateWontFix
+	}
+	return model.FixStateUnknown
+}
+
+// firstLine returns the first line of a text
+func firstLine(text string) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(text), "\n")
+	return line
+}
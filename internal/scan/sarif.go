@@ -0,0 +1,150 @@
+package scan
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/jpfaria/image-updater/internal/model"
+)
+
+// sarifParser handles SARIF 2.1 reports, as written by trivy --format sarif
+// and grype -o sarif. SARIF names no image, so its uploads name the digest.
+type sarifParser struct{}
+
+type sarifReport struct {
+	Version string `json:"version"`
+	Runs    []struct {
+		Tool struct {
+			Driver struct {
+				Name    string      `json:"name"`
+				Version string      `json:"version"`
+				Rules   []sarifRule `json:"rules"`
+			} `json:"driver"`
+		} `json:"tool"`
+		Results []struct {
+			RuleID  string `json:"ruleId"`
+			Level   string `json:"level"`
+			Message struct {
+				Text string `json:"text"`
+			} `json:"message"`
+		} `json:"results"`
+	} `json:"runs"`
+}
+
+type sarifRule struct {
+	ID               string `json:"id"`
+	ShortDescription struct {
+		Text string `json:"text"`
+	} `json:"shortDescription"`
+	Properties struct {
+		SecuritySeverity string   `json:"security-severity"`
+		Tags             []string `json:"tags"`
+	} `json:"properties"`
+}
+
+func (p *sarifParser) Name() string {
+	return "sarif"
+}
+
+func (p *sarifParser) Detect(body []byte) bool {
+	var report sarifReport
+	return json.Unmarshal(body, &report) == nil && strings.HasPrefix(report.Version, "2.") && report.Runs != nil
+}
+
+func (p *sarifParser) Parse(body []byte) (*Report, error) {
+	var report sarifReport
+	if err := json.Unmarshal(body, &report); err != nil {
+		return nil, err
+	}
+
+	result := &Report{Vulnerabilities: make([]model.Vulnerability, 0)}
+	for _, run := range report.Runs {
+		driver := run.Tool.Driver
+		if result.Scanner == "" {
+			result.Scanner = strings.TrimSpace(driver.Name + " " + driver.Version)
+		}
+
+		rules := make(map[string]sarifRule, len(driver.Rules))
+		for _, rule := range driver.Rules {
+			rules[rule.ID] = rule
+		}
+
+		for _, finding := range run.Results {
+			rule := rules[finding.RuleID]
+			fields := messageFields(finding.Message.Text)
+
+			// Trivy writes an empty Fixed Version line for findings
+			// without a fix; other scanners do not tell
+			fixState := model.FixStateUnknown
+			if fixed, ok := fields["Fixed Version"]; ok && fixed != "" {
+				fixState = model.FixStateFixed
+			} else if ok {
+				fixState = model.FixStateNotFixed
+			}
+
+			result.Vulnerabilities = append(result.Vulnerabilities, model.Vulnerability{
+				ID:               finding.RuleID,
+				Severity:         sarifSeverity(rule, fields["Severity"], finding.Level),
+				Package:          fields["Package"],
+				InstalledVersion: fields["Installed Version"],
+				FixedVersion:     fields["Fixed Version"],
+				FixState:         fixState,
+				Title:            rule.ShortDescription.Text,
+			})
+		}
+	}
+
+	return result, nil
+}
+
+// sarifSeverity picks the most precise severity a finding carries: the
+// severity named by the scanner, then the CVSS score of the rule, as GitHub
+// code scanning reads it, then the SARIF level
+func sarifSeverity(rule sarifRule, named, level string) string {
+	if severity := normalizeSeverity(named); severity != model.SeverityUnknown {
+		return severity
+	}
+	for _, tag := range rule.Properties.Tags {
+		if severity := normalizeSeverity(tag); severity != model.SeverityUnknown {
+			return severity
+		}
+	}
+
+	if score, err := strconv.ParseFloat(rule.Properties.SecuritySeverity, 64); err == nil {
+		switch {
+		case score >= 9:
+			return model.SeverityCritical
+		case score >= 7:
+			return model.SeverityHigh
+		case score >= 4:
+			return model.SeverityMedium
+		case score > 0:
+			return model.SeverityLow
+		}
+	}
+
+	switch level {
+	case "error":
+		return model.SeverityHigh
+	case "warning":
+		return model.SeverityMedium
+	case "note":
+		return model.SeverityLow
+	}
+	return model.SeverityUnknown
+}
+
+// messageFields reads the "Name: value" lines of a result message, which
+// Trivy uses for the package and its versions
+func messageFields(text string) map[string]string {
+	fields := make(map[string]string)
+	for _, line := range strings.Split(text, "\n") {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		fields[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	return fields
+}
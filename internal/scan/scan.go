@@ -0,0 +1,179 @@
+package scan
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jpfaria/image-updater/internal/model"
+)
+
+// ErrUnknownFormat is returned when no parser exists for a report format
+var ErrUnknownFormat = errors.New("unknown scan report format")
+
+// Parser translates the report of a vulnerability scanner
+type Parser interface {
+	// Name returns the format name used in uploads
+	Name() string
+	// Detect reports whether the report looks like one of this format
+	Detect(body []byte) bool
+	// Parse extracts the vulnerabilities of the report
+	Parse(body []byte) (*Report, error)
+}
+
+// parsers lists the supported formats in detection order
+var parsers = []Parser{
+	&trivyParser{},
+	&grypeParser{},
+	&sarifParser{},
+}
+
+// Report is a normalised scan report
+type Report struct {
+	Format  string
+	Scanner string // name and version of the scanner, when reported
+	// Digests are the image digests the report names, if any
+	Digests         []string
+	Vulnerabilities []model.Vulnerability
+}
+
+// Formats returns the names of the supported formats
+func Formats() []string {
+	names := make([]string, 0, len(parsers))
+	for _, p := range parsers {
+		names = append(names, p.Name())
+	}
+	return names
+}
+
+// Parse normalises a report of the named format; an empty format is
+// detected from the report
+func Parse(format string, body []byte) (*Report, error) {
+	if format == "" {
+		detected, err := DetectFormat(body)
+		if err != nil {
+			return nil, err
+		}
+		format = detected
+	}
+
+	p, ok := parser(format)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownFormat, format)
+	}
+
+	report, err := p.Parse(body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s report: %w", p.Name(), err)
+	}
+	report.Format = p.Name()
+	report.Vulnerabilities = deduplicate(report.Vulnerabilities)
+
+	return report, nil
+}
+
+// DetectFormat returns the name of the format a report matches
+func DetectFormat(body []byte) (string, error) {
+	for _, p := range parsers {
+		if p.Detect(body) {
+			return p.Name(), nil
+		}
+	}
+
+	return "", fmt.Errorf("%w: the report is not one of %s", ErrUnknownFormat, strings.Join(Formats(), ", "))
+}
+
+// Count counts vulnerabilities by severity
+func Count(vulnerabilities []model.Vulnerability) model.VulnerabilityCounts {
+	var counts model.VulnerabilityCounts
+	for _, v := range vulnerabilities {
+		switch v.Severity {
+		case model.SeverityCritical:
+			counts.Critical++
+		case model.SeverityHigh:
+			counts.High++
+		case model.SeverityMedium:
+			counts.Medium++
+		case model.SeverityLow:
+			counts.Low++
+		default:
+			counts.Unknown++
+		}
+	}
+	return counts
+}
+
+// Rank orders severities, the most severe first; unknown severities rank
+// last
+func Rank(severity string) int {
+	for i, s := range model.Severities {
+		if s == severity {
+			return i
+		}
+	}
+	return len(model.Severities)
+}
+
+// parser returns the parser of a format
+func parser(name string) (Parser, bool) {
+	for _, p := range parsers {
+		if p.Name() == name {
+			return p, true
+		}
+	}
+
+	return nil, false
+}
+
+// normalizeSeverity maps the severities of the scanners to those of the
+// model
+func normalizeSeverity(severity string) string {
+	switch strings.ToLower(strings.TrimSpace(severity)) {
+	case "critical":
+		return model.SeverityCritical
+	case "high", "important":
+		return model.SeverityHigh
+	case "medium", "moderate":
+		return model.SeverityMedium
+	case "low", "negligible", "minor":
+		return model.SeverityLow
+	}
+	return model.SeverityUnknown
+}
+
+// deduplicate drops the vulnerabilities reported twice for a package, as
+// scanners do for packages found in several layers or targets, and orders
+// them by severity
+func deduplicate(vulnerabilities []model.Vulnerability) []model.Vulnerability {
+	seen := make(map[string]bool, len(vulnerabilities))
+	unique := make([]model.Vulnerability, 0, len(vulnerabilities))
+	for _, v := range vulnerabilities {
+		key := v.ID + " " + v.Package + " " + v.InstalledVersion
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		unique = append(unique, v)
+	}
+
+	sort.SliceStable(unique, func(i, j int) bool {
+		if Rank(unique[i].Severity) != Rank(unique[j].Severity) {
+			return Rank(unique[i].Severity) < Rank(unique[j].Severity)
+		}
+		return unique[i].ID < unique[j].ID
+	})
+
+	return unique
+}
+
+// digestOf returns the digest of a reference such as ghcr.io/acme/api@sha256:...
+func digestOf(reference string) string {
+	if _, digest, ok := strings.Cut(reference, "@"); ok {
+		return digest
+	}
+	if strings.HasPrefix(reference, "sha256:") {
+		return reference
+	}
+	return ""
+}
@@ -0,0 +1,80 @@
+package scan
+
+import (
+	"testing"
+
+	"github.com/jpfaria/image-updater/internal/model"
+)
+
+func TestParseFixState(t *testing.T) {
+	tests := []struct {
+		name   string
+		report string
+		want   map[string]string // fix state by vulnerability ID
+	}{
+		{
+			name: "trivy",
+			report: `{"SchemaVersion": 2, "ArtifactName": "app", "Results": [{"Vulnerabilities": [
+				{"VulnerabilityID": "CVE-1", "Severity": "HIGH", "FixedVersion": "1.2.3", "Status": "fixed"},
+				{"VulnerabilityID": "CVE-2", "Severity": "HIGH", "Status": "affected"},
+				{"VulnerabilityID": "CVE-3", "Severity": "HIGH", "Status": "will_not_fix"},
+				{"VulnerabilityID": "CVE-4", "Severity": "HIGH", "Status": "under_investigation"},
+				{"VulnerabilityID": "CVE-5", "Severity": "HIGH"}
+			]}]}`,
+			want: map[string]string{
+				"CVE-1": model.FixStateFixed,
+				"CVE-2": model.FixStateNotFixed,
+				"CVE-3": model.FixStateWontFix,
+				"CVE-4": model.FixStateUnknown,
+				"CVE-5": model.FixStateNotFixed,
+			},
+		},
+		{
+			name: "grype",
+			report: `{"descriptor": {"name": "grype"}, "matches": [
+				{"vulnerability": {"id": "CVE-1", "severity": "High", "fix": {"versions": ["1.2.3"], "state": "fixed"}}},
+				{"vulnerability": {"id": "CVE-2", "severity": "High", "fix": {"state": "not-fixed"}}},
+				{"vulnerability": {"id": "CVE-3", "severity": "High", "fix": {"state": "wont-fix"}}},
+				{"vulnerability": {"id": "CVE-4", "severity": "High", "fix": {"state": "unknown"}}}
+			]}`,
+			want: map[string]string{
+				"CVE-1": model.FixStateFixed,
+				"CVE-2": model.FixStateNotFixed,
+				"CVE-3": model.FixStateWontFix,
+				"CVE-4": model.FixStateUnknown,
+			},
+		},
+		{
+			name: "sarif",
+			report: `{"version": "2.1.0", "runs": [{"tool": {"driver": {"name": "Trivy"}}, "results": [
+				{"ruleId": "CVE-1", "level": "error", "message": {"text": "Package: a\nFixed Version: 1.2.3"}},
+				{"ruleId": "CVE-2", "level": "error", "message": {"text": "Package: b\nFixed Version: "}},
+				{"ruleId": "CVE-3", "level": "error", "message": {"text": "Package c is vulnerable"}}
+			]}]}`,
+			want: map[string]string{
+				"CVE-1": model.FixStateFixed,
+				"CVE-2": model.FixStateNotFixed,
+				"CVE-3": model.FixStateUnknown,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report, err := Parse("", []byte(tt.report))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Format != tt.name {
+				t.Fatalf("detected %s, want %s", report.Format, tt.name)
+			}
+			if len(report.Vulnerabilities) != len(tt.want) {
+				t.Fatalf("got %d vulnerabilities, want %d", len(report.Vulnerabilities), len(tt.want))
+			}
+			for _, v := range report.Vulnerabilities {
+				if v.FixState != tt.want[v.ID] {
+					t.Errorf("%s has fix state %q, want %q", v.ID, v.FixState, tt.want[v.ID])
+				}
+			}
+		})
+	}
+}
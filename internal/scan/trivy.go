@@ -0,0 +1,89 @@
+package scan
+
+import (
+	"encoding/json"
+
+	"github.com/jpfaria/image-updater/internal/model"
+)
+
+// trivyParser handles Trivy JSON reports, trivy image --format json
+type trivyParser struct{}
+
+type trivyReport struct {
+	SchemaVersion int    `json:"SchemaVersion"`
+	ArtifactName  string `json:"ArtifactName"`
+	Metadata      struct {
+		RepoDigests []string `json:"RepoDigests"`
+	} `json:"Metadata"`
+	Results []struct {
+		Target          string `json:"Target"`
+		Vulnerabilities []struct {
+			VulnerabilityID  string `json:"VulnerabilityID"`
+			PkgName          string `json:"PkgName"`
+			InstalledVersion string `json:"InstalledVersion"`
+			FixedVersion     string `json:"FixedVersion"`
+			Status           string `json:"Status"`
+			Severity         string `json:"Severity"`
+			Title            string `json:"Title"`
+		} `json:"Vulnerabilities"`
+	} `json:"Results"`
+}
+
+func (p *trivyParser) Name() string {
+	return "trivy"
+}
+
+func (p *trivyParser) Detect(body []byte) bool {
+	var report trivyReport
+	return json.Unmarshal(body, &report) == nil && report.SchemaVersion > 0 && report.ArtifactName != ""
+}
+
+func (p *trivyParser) Parse(body []byte) (*Report, error) {
+	var report trivyReport
+	if err := json.Unmarshal(body, &report); err != nil {
+		return nil, err
+	}
+
+	result := &Report{Scanner: "Trivy", Vulnerabilities: make([]model.Vulnerability, 0)}
+	for _, reference := range report.Metadata.RepoDigests {
+		if digest := digestOf(reference); digest != "" {
+			result.Digests = append(result.Digests, digest)
+		}
+	}
+
+	for _, target := range report.Results {
+		for _, v := range target.Vulnerabilities {
+			result.Vulnerabilities = append(result.Vulnerabilities, model.Vulnerability{
+				ID:               v.VulnerabilityID,
+				Severity:         normalizeSeverity(v.Severity),
+				Package:          v.PkgName,
+				InstalledVersion: v.InstalledVersion,
+				FixedVersion:     v.FixedVersion,
+				FixState:         trivyFixState(v.Status, v.FixedVersion),
+				Title:            v.Title,
+			})
+		}
+	}
+
+	return result, nil
+}
+
+// trivyFixState maps the status of a Trivy finding to a fix state. Reports
+// of Trivy before 0.35 carry no status, and leave the fixed version empty
+// for vulnerabilities without a fix, as trivy --ignore-unfixed reads it.
+func trivyFixState(status, fixedVersion string) string {
+	switch status {
+	case "fixed":
+		return model.FixStateFixed
+	case "affected", "fix_deferred", "end_of_life":
+		return model.FixStateNotFixed
+	case "will_not_fix":
+		return model.FixStateWontFix
+	case "":
+		if fixedVersion != "" {
+			return model.FixStateFixed
+		}
+		return model.FixStateNotFixed
+	}
+	return model.FixStateUnknown
+}
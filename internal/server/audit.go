@@ -0,0 +1,27 @@
+package server
+
+import (
+	"path/filepath"
+
+	"github.com/jpfaria/image-updater/internal/auth"
+	"github.com/jpfaria/image-updater/internal/config"
+	"github.com/xgodev/boost/wrapper/log"
+)
+
+// newAuditKeySet loads the keys audit checkpoints are signed with: the
+// configured key, or one generated in the database directory. Without a
+// database directory a generated key would not survive a restart, so
+// checkpoints are disabled.
+func newAuditKeySet(cfg *config.Config) (*auth.KeySet, error) {
+	switch {
+	case cfg.Audit.SigningKeyFile != "":
+		return auth.LoadKeySet(cfg.Audit.SigningKeyFile, cfg.Audit.PreviousKeyFiles)
+	case cfg.Database.Path != "":
+		return auth.LoadOrCreateKeySet(filepath.Join(cfg.Database.Path, "audit_signing_key.pem"), cfg.Audit.PreviousKeyFiles)
+	}
+
+	if cfg.Audit.CheckpointInterval > 0 {
+		log.Warnf("Audit checkpoints are disabled: set AUDIT_SIGNING_KEY_FILE or DB_PATH for a persistent signing key")
+	}
+	return nil, nil
+}
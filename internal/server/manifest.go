@@ -0,0 +1,276 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/jpfaria/image-updater/internal/config"
+	"github.com/jpfaria/image-updater/internal/docker"
+	"github.com/jpfaria/image-updater/internal/model"
+	"github.com/xgodev/boost/wrapper/log"
+)
+
+// manifestState is a manifest converted for the services, with its registry
+// clients built
+type manifestState struct {
+	teams        []model.Team
+	rules        []model.DiscoveryRule
+	repositories []model.Repository
+	catalogue    *docker.Catalogue
+	images       []model.Image
+	environments []model.Environment
+}
+
+// applyManifest loads the declared teams and their discovery rules,
+// repositories, registries, images and environments into the services.
+// Applying the same manifest twice leaves everything as it was.
+//
+// Every entry is converted and every registry client built first, so an
+// invalid manifest changes nothing. Each service then swaps in its part at
+// once, but the parts are stored one after another: when storing one fails,
+// the parts before it stay applied and a *partialApplyError names them.
+func (s *Server) applyManifest(ctx context.Context, manifest *config.Manifest) error {
+	state, err := s.prepareManifest(manifest)
+	if err != nil {
+		return err
+	}
+
+	parts := []struct {
+		name  string
+		apply func() error
+	}{
+		{"teams", func() error { return s.teamService.SyncTeams(ctx, state.teams) }},
+		{"repositories", func() error { return s.gitService.SyncRepositories(ctx, state.repositories) }},
+		{"registries", func() error { s.registries.Swap(state.catalogue); return nil }},
+		{"images", func() error { return s.dockerService.SyncImages(ctx, state.images) }},
+		{"environments", func() error { return s.environmentService.SyncEnvironments(ctx, state.environments) }},
+		{"discovery rules", func() error { return s.discoveryService.SyncRules(ctx, state.rules) }},
+	}
+
+	applied := make([]string, 0, len(parts))
+	for _, part := range parts {
+		if err := part.apply(); err != nil {
+			err = fmt.Errorf("failed to load %s: %w", part.name, err)
+			if len(applied) > 0 {
+				return &partialApplyError{Applied: applied, Err: err}
+			}
+			return err
+		}
+		applied = append(applied, part.name)
+	}
+
+	log.Infof("Loaded %d teams, %d repositories, %d registries, %d images and %d environments from the configuration file",
+		len(state.teams), len(state.repositories), state.catalogue.Len(), len(state.images), len(state.environments))
+
+	return nil
+}
+
+// partialApplyError reports a manifest whose first parts were applied
+// before storing the next one failed
+type partialApplyError struct {
+	Applied []string
+	Err     error
+}
+
+// Error describes the failure and the parts already applied
+func (e *partialApplyError) Error() string {
+	return fmt.Sprintf("%v (already applied: %s)", e.Err, strings.Join(e.Applied, ", "))
+}
+
+// Unwrap returns the error of the part that failed
+func (e *partialApplyError) Unwrap() error {
+	return e.Err
+}
+
+// prepareManifest converts a manifest for the services and builds its
+// registry clients, without changing anything
+func (s *Server) prepareManifest(manifest *config.Manifest) (*manifestState, error) {
+	teams := make([]model.Team, 0, len(manifest.Teams))
+	rules := make([]model.DiscoveryRule, 0)
+	for _, team := range manifest.Teams {
+		teams = append(teams, model.Team{
+			Name:        team.Name,
+			Description: team.Description,
+		})
+		for _, rule := range team.Discovery {
+			rules = append(rules, model.DiscoveryRule{
+				Team:           team.Name,
+				Registry:       rule.Registry,
+				Include:        rule.Include,
+				Exclude:        rule.Exclude,
+				UpdateStrategy: rule.UpdateStrategy,
+				TagPattern:     rule.TagPattern,
+			})
+		}
+	}
+
+	repositories := make([]model.Repository, 0, len(manifest.Repositories))
+	for _, repository := range manifest.Repositories {
+		repositories = append(repositories, model.Repository{
+			ID:       repository.ID,
+			Name:     repository.Name,
+			URL:      repository.URL,
+			Branch:   repository.Branch,
+			TeamName: repository.Team,
+		})
+	}
+
+	registries := make([]docker.Registry, 0, len(manifest.Registries))
+	for _, spec := range manifest.Registries {
+		registry, err := registryFromSpec(spec)
+		if err != nil {
+			return nil, err
+		}
+		registries = append(registries, registry)
+	}
+	catalogue, err := s.registries.Prepare(registries)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load registries: %w", err)
+	}
+
+	images := make([]model.Image, 0, len(manifest.Images))
+	for _, image := range manifest.Images {
+		images = append(images, model.Image{
+			ID:             image.ID,
+			Name:           image.Name,
+			Registry:       image.Registry,
+			Namespace:      image.Namespace,
+			Team:           image.Team,
+			UpdateStrategy: image.UpdateStrategy,
+			TagPattern:     image.TagPattern,
+		})
+	}
+
+	environments := make([]model.Environment, 0, len(manifest.Environments))
+	for _, env := range manifest.Environments {
+		var policy *model.VulnerabilityPolicy
+		if env.VulnerabilityPolicy != nil {
+			policy = &model.VulnerabilityPolicy{
+				Max:           env.VulnerabilityPolicy.Max,
+				RequireReport: env.VulnerabilityPolicy.RequireReport,
+				IgnoreUnfixed: env.VulnerabilityPolicy.IgnoreUnfixed,
+				Allow:         env.VulnerabilityPolicy.Allow,
+			}
+		}
+		environments = append(environments, model.Environment{
+			ID:                env.ID,
+			Name:              env.Name,
+			Application:       env.Application,
+			RepositoryID:      env.Repository,
+			ValuesPath:        env.File,
+			KeyPath:           env.KeyPath,
+			WriteBack:         env.WriteBack,
+			ImageID:           env.Image,
+			RequiredApprovals: env.RequiredApprovals,
+			RequireSignature:  env.RequireSignature,
+
+			VulnerabilityPolicy: policy,
+		})
+	}
+
+	return &manifestState{
+		teams:        teams,
+		rules:        rules,
+		repositories: repositories,
+		catalogue:    catalogue,
+		images:       images,
+		environments: environments,
+	}, nil
+}
+
+// registryFromSpec converts a declared registry, reading its secrets
+func registryFromSpec(spec config.RegistrySpec) (docker.Registry, error) {
+	registry := docker.Registry{
+		Host: spec.Host,
+		URL:  spec.URL,
+		Auth: spec.Auth,
+		TLS: docker.TLSConfig{
+			CAFile:             spec.TLS.CAFile,
+			CertFile:           spec.TLS.CertFile,
+			KeyFile:            spec.TLS.KeyFile,
+			InsecureSkipVerify: spec.TLS.InsecureSkipVerify,
+		},
+		RateLimit: spec.RateLimit,
+		Burst:     spec.Burst,
+		Mirror:    spec.Mirror,
+		PlainHTTP: spec.PlainHTTP,
+		Proxy:     spec.Proxy,
+	}
+
+	switch spec.Auth {
+	case docker.AuthBasic:
+		password, err := readSecret(spec.PasswordFile)
+		if err != nil {
+			return registry, fmt.Errorf("registry %s: %w", spec.Host, err)
+		}
+		registry.Credentials = &docker.Credentials{Username: spec.Username, Password: password}
+	case docker.AuthBearer:
+		token, err := readSecret(spec.TokenFile)
+		if err != nil {
+			return registry, fmt.Errorf("registry %s: %w", spec.Host, err)
+		}
+		registry.Credentials = &docker.Credentials{Token: token}
+	case docker.AuthECR:
+		ecr, err := ecrOptions(spec)
+		if err != nil {
+			return registry, fmt.Errorf("registry %s: %w", spec.Host, err)
+		}
+		registry.ECR = ecr
+	case docker.AuthGCP:
+		registry.GCP = docker.GCPOptions{
+			KeyFile:  spec.GCP.KeyFile,
+			TokenURL: spec.GCP.TokenURL,
+		}
+		if registry.GCP.KeyFile == "" {
+			registry.GCP.KeyFile = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+		}
+		if registry.GCP.KeyFile == "" {
+			return registry, fmt.Errorf("registry %s: gcp auth requires gcp.key_file or GOOGLE_APPLICATION_CREDENTIALS", spec.Host)
+		}
+	}
+
+	return registry, nil
+}
+
+// ecrOptions reads the AWS credentials of a registry, falling back to the
+// standard AWS environment variables
+func ecrOptions(spec config.RegistrySpec) (docker.ECROptions, error) {
+	options := docker.ECROptions{
+		Region:          spec.ECR.Region,
+		AccessKeyID:     spec.ECR.AccessKeyID,
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		Endpoint:        spec.ECR.Endpoint,
+	}
+	if options.Region == "" {
+		options.Region, _ = docker.ECRRegion(spec.Host)
+	}
+	if options.AccessKeyID == "" {
+		options.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+
+	var err error
+	if spec.ECR.SecretAccessKeyFile != "" {
+		if options.SecretAccessKey, err = readSecret(spec.ECR.SecretAccessKeyFile); err != nil {
+			return options, err
+		}
+	}
+	if spec.ECR.SessionTokenFile != "" {
+		if options.SessionToken, err = readSecret(spec.ECR.SessionTokenFile); err != nil {
+			return options, err
+		}
+	}
+
+	return options, nil
+}
+
+// readSecret reads a secret file without its trailing newline
+func readSecret(file string) (string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret: %w", err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
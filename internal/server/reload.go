@@ -0,0 +1,201 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/jpfaria/image-updater/internal/audit"
+	"github.com/jpfaria/image-updater/internal/config"
+	"github.com/xgodev/boost/wrapper/log"
+)
+
+// reloadDebounce groups the bursts of file events editors and ConfigMap
+// updates produce into a single reload
+const reloadDebounce = 500 * time.Millisecond
+
+// configState is the manifest the server runs with and the outcome of the
+// latest reload
+type configState struct {
+	mu       sync.Mutex
+	manifest *config.Manifest
+	status   ConfigStatus
+}
+
+// ConfigStatus describes the loaded configuration file
+type ConfigStatus struct {
+	File     string               `json:"file,omitempty"`
+	Revision string               `json:"revision,omitempty"`
+	LoadedAt string               `json:"loaded_at,omitempty"`
+	Reloads  int                  `json:"reloads"`
+	LastDiff *config.ManifestDiff `json:"last_diff,omitempty"`
+	// LastError is why the latest reload was rejected; the previous
+	// revision stays loaded
+	LastError   string `json:"last_error,omitempty"`
+	LastErrorAt string `json:"last_error_at,omitempty"`
+}
+
+// loadConfig applies the configuration file on startup
+func (s *Server) loadConfig(ctx context.Context) error {
+	manifest, err := config.LoadManifest(s.config.File)
+	if err != nil {
+		return err
+	}
+
+	s.configState.mu.Lock()
+	defer s.configState.mu.Unlock()
+
+	if err := s.applyManifest(ctx, manifest); err != nil {
+		return err
+	}
+
+	s.configState.manifest = manifest
+	s.configState.status = ConfigStatus{
+		File:     s.config.File,
+		Revision: manifest.Revision,
+		LoadedAt: time.Now().Format(time.RFC3339),
+	}
+
+	return nil
+}
+
+// reloadConfig reads the configuration file again and applies what changed.
+// An invalid file is rejected and the previous revision stays in effect.
+func (s *Server) reloadConfig(ctx context.Context) (ConfigStatus, error) {
+	s.configState.mu.Lock()
+	defer s.configState.mu.Unlock()
+
+	status := &s.configState.status
+	previous := s.configState.manifest
+
+	manifest, err := config.LoadManifest(s.config.File)
+	if err == nil && manifest.Revision == status.Revision {
+		status.LastError = ""
+		status.LastErrorAt = ""
+		return *status, nil
+	}
+
+	// applyManifest changes nothing when the manifest is invalid. Only
+	// failing to store a part leaves the parts before it applied, which the
+	// next reload of the file completes.
+	var diff config.ManifestDiff
+	if err == nil {
+		diff = previous.Diff(manifest)
+		err = s.applyManifest(ctx, manifest)
+	}
+
+	event := audit.Event{
+		Action:     "config.reload",
+		TargetType: "config",
+		TargetID:   s.config.File,
+		Before:     audit.Snapshot(map[string]string{"revision": status.Revision}),
+		Outcome:    audit.Outcome(err),
+	}
+
+	now := time.Now().Format(time.RFC3339)
+	var partial *partialApplyError
+	if err != nil {
+		if errors.As(err, &partial) {
+			log.Errorf("Partly applied configuration file %s over revision %s: %v", s.config.File, status.Revision, err)
+		} else {
+			log.Errorf("Rejected configuration file %s, keeping revision %s: %v", s.config.File, status.Revision, err)
+		}
+		status.LastError = err.Error()
+		status.LastErrorAt = now
+		event.Error = err.Error()
+	} else {
+		log.Infof("Reloaded configuration file %s: revision %s, %d added, %d removed, %d changed",
+			s.config.File, manifest.Revision, len(diff.Added), len(diff.Removed), len(diff.Changed))
+		s.configState.manifest = manifest
+		status.Revision = manifest.Revision
+		status.LoadedAt = now
+		status.Reloads++
+		status.LastDiff = &diff
+		status.LastError = ""
+		status.LastErrorAt = ""
+		event.After = audit.Snapshot(map[string]interface{}{"revision": manifest.Revision, "diff": diff})
+	}
+
+	if recordErr := s.auditLog.Record(ctx, event); recordErr != nil {
+		log.Errorf("Failed to record audit event %s: %v", event.Action, recordErr)
+	}
+
+	return *status, err
+}
+
+// configStatus returns the state of the configuration file
+func (s *Server) configStatus() ConfigStatus {
+	s.configState.mu.Lock()
+	defer s.configState.mu.Unlock()
+
+	return s.configState.status
+}
+
+// watchConfig reloads the configuration file on SIGHUP and, when enabled,
+// whenever the file changes, until ctx is cancelled
+func (s *Server) watchConfig(ctx context.Context) error {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	// The directory is watched rather than the file, so the file being
+	// replaced by a rename, as editors and Kubernetes ConfigMaps do, is seen
+	var changes <-chan fsnotify.Event
+	var watchErrors <-chan error
+	var watcher *fsnotify.Watcher
+	if s.config.WatchFile {
+		var err error
+		watcher, err = fsnotify.NewWatcher()
+		if err != nil {
+			signal.Stop(hangup)
+			return fmt.Errorf("failed to watch configuration file: %w", err)
+		}
+		if err := watcher.Add(filepath.Dir(s.config.File)); err != nil {
+			watcher.Close()
+			signal.Stop(hangup)
+			return fmt.Errorf("failed to watch configuration file: %w", err)
+		}
+		changes = watcher.Events
+		watchErrors = watcher.Errors
+	}
+
+	log.Infof("Watching configuration file %s (reload on change: %t)", s.config.File, s.config.WatchFile)
+
+	// Reloads not requested through the API are audited under this name
+	ctx = audit.WithActor(ctx, "system:config", "", "")
+
+	go func() {
+		defer signal.Stop(hangup)
+		if watcher != nil {
+			defer watcher.Close()
+		}
+
+		debounce := time.NewTimer(reloadDebounce)
+		debounce.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hangup:
+				log.Info("Received SIGHUP, reloading configuration file")
+				s.reloadConfig(ctx)
+			case <-changes:
+				debounce.Reset(reloadDebounce)
+			case err := <-watchErrors:
+				log.Warnf("Error watching configuration file: %v", err)
+			case <-debounce.C:
+				// Unchanged content is ignored by reloadConfig
+				s.reloadConfig(ctx)
+			}
+		}
+	}()
+
+	return nil
+}
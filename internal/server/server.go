@@ -2,9 +2,21 @@ package server
 
 import (
 	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
+	"github.com/jpfaria/image-updater/internal/audit"
+	"github.com/jpfaria/image-updater/internal/auth"
 	"github.com/jpfaria/image-updater/internal/config"
+	"github.com/jpfaria/image-updater/internal/docker"
+	"github.com/jpfaria/image-updater/internal/git"
 	"github.com/jpfaria/image-updater/internal/handler"
+	"github.com/jpfaria/image-updater/internal/middleware"
+	"github.com/jpfaria/image-updater/internal/service"
+	"github.com/jpfaria/image-updater/internal/store"
+	"github.com/jpfaria/image-updater/internal/webhook"
 	"github.com/labstack/echo/v4"
 	"github.com/xgodev/boost/factory/contrib/labstack/echo/v4"
 	"github.com/xgodev/boost/factory/contrib/labstack/echo/v4/plugins/native/cors"
@@ -16,6 +28,24 @@ import (
 type Server struct {
 	echo   *echo.Echo
 	config *config.Config
+
+	auditLog             *audit.Log
+	auditKeys            *auth.KeySet // nil when checkpoints are disabled
+	authService          *auth.AuthService
+	oidcProvider         *auth.OIDCProvider
+	teamService          *service.TeamService
+	dockerService        *service.DockerService
+	discoveryService     *service.DiscoveryService
+	signatureService     *service.SignatureService
+	vulnerabilityService *service.VulnerabilityService
+	registries           *docker.Pool
+	gitService           *service.GitService
+	environmentService   *service.EnvironmentService
+	scheduler            *service.Scheduler
+	reconciler           *service.Reconciler
+	webhookService       *service.WebhookService
+	webhookVerifier      *webhook.Verifier
+	configState          configState
 }
 
 // New creates a new server instance
@@ -31,10 +61,171 @@ func New(ctx context.Context, cfg *config.Config) (*Server, error) {
 		return nil, err
 	}
 
+	// Create services
+	keys, err := newKeySet(cfg.Auth)
+	if err != nil {
+		return nil, err
+	}
+
+	// Audit checkpoints are signed with keys of their own that outlive
+	// restarts and token key rotations
+	auditKeys, err := newAuditKeySet(cfg)
+	if err != nil {
+		return nil, err
+	}
+	auditOptions := audit.LogOptions{DataDir: cfg.Database.Path}
+	if auditKeys != nil {
+		auditOptions.Signer = auditKeys
+	}
+	auditLog, err := audit.NewLog(auditOptions)
+	if err != nil {
+		return nil, err
+	}
+	authService, err := auth.NewAuthService(auth.AuthOptions{
+		DataDir:         cfg.Database.Path,
+		Keys:            keys,
+		Issuer:          cfg.Auth.Issuer,
+		Audience:        cfg.Auth.Audience,
+		AccessTokenTTL:  time.Duration(cfg.Auth.TokenTTL) * time.Second,
+		RefreshTokenTTL: time.Duration(cfg.Auth.RefreshTokenTTL) * time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := authService.Bootstrap(ctx, cfg.Auth.BootstrapUsername, cfg.Auth.BootstrapPassword); err != nil {
+		return nil, err
+	}
+
+	oidcProvider, err := newOIDCProvider(cfg.Auth.OIDC)
+	if err != nil {
+		return nil, err
+	}
+
+	// Registry credentials are read from a Docker config.json when one is
+	// given, and read again whenever it changes
+	var registryKeychain *docker.Keychain
+	if cfg.Docker.CredentialsPath != "" {
+		registryKeychain, err = docker.NewKeychain(cfg.Docker.CredentialsPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	registryCache, err := newRegistryCache(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Registries are reached through clients built from the catalogue of the
+	// configuration file; the others use the keychain
+	registries := docker.NewPool(docker.PoolOptions{
+		Cache:           registryCache,
+		Keychain:        registryKeychain,
+		DefaultRegistry: cfg.Docker.RegistryURL,
+		DefaultCredentials: &docker.Credentials{
+			Username: cfg.Docker.Username,
+			Password: cfg.Docker.Password,
+			Token:    cfg.Docker.Token,
+		},
+	})
+
+	teamService := service.NewTeamService()
+	dockerService := service.NewDockerService(registries)
+	discoveryService, err := service.NewDiscoveryService(dockerService, registries, service.DiscoveryOptions{
+		DataDir:  cfg.Database.Path,
+		Interval: time.Duration(cfg.Docker.DiscoveryInterval) * time.Second,
+		Audit:    auditLog,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Tags deployed to environments requiring signed images must carry a
+	// cosign signature made with one of these keys
+	signatureKeys, err := docker.LoadPublicKeys(cfg.Docker.SignatureKeyFiles)
+	if err != nil {
+		return nil, err
+	}
+	signatureService, err := service.NewSignatureService(dockerService, registries, service.SignatureOptions{
+		DataDir: cfg.Database.Path,
+		Keys:    signatureKeys,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Scan reports are uploaded from CI or read from the signed attestations
+	// of images, and checked against the policies of environments
+	vulnerabilityService, err := service.NewVulnerabilityService(dockerService, registries, service.VulnerabilityOptions{
+		DataDir:          cfg.Database.Path,
+		Keys:             signatureKeys,
+		ReadAttestations: cfg.Docker.VulnerabilityAttestations,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	gitClient, err := newGitClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	gitService := service.NewGitService(gitClient)
+	environmentService, err := service.NewEnvironmentService(gitService, service.EnvironmentOptions{
+		DataDir:         cfg.Database.Path,
+		CommitMessage:   cfg.Git.CommitMessage,
+		ApprovalTimeout: time.Duration(cfg.Deployment.ApprovalTimeout) * time.Second,
+		Audit:           auditLog,
+		Gates:           []service.DeploymentGate{signatureService, vulnerabilityService},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	webhookService, err := service.NewWebhookService(dockerService, service.WebhookOptions{
+		DataDir:      cfg.Database.Path,
+		Workers:      cfg.Webhook.Workers,
+		MaxAttempts:  cfg.Webhook.MaxAttempts,
+		RetryBackoff: time.Duration(cfg.Webhook.RetryBackoff) * time.Second,
+		Audit:        auditLog,
+
+		DeliveryRetention: time.Duration(cfg.Webhook.DeliveryRetention) * time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	webhookOptions := webhookVerifierOptions(cfg.Webhook)
+	if err := webhookOptions.Validate(); err != nil {
+		return nil, err
+	}
+
 	// Create server instance
 	server := &Server{
-		echo:   echoServer,
-		config: cfg,
+		echo:                 echoServer,
+		config:               cfg,
+		auditLog:             auditLog,
+		auditKeys:            auditKeys,
+		authService:          authService,
+		oidcProvider:         oidcProvider,
+		teamService:          teamService,
+		dockerService:        dockerService,
+		discoveryService:     discoveryService,
+		signatureService:     signatureService,
+		vulnerabilityService: vulnerabilityService,
+		registries:           registries,
+		gitService:           gitService,
+		environmentService:   environmentService,
+		scheduler:            service.NewScheduler(environmentService, time.Duration(cfg.Deployment.SchedulerInterval)*time.Second),
+		reconciler:           service.NewReconciler(environmentService, time.Duration(cfg.Deployment.DriftCheckInterval)*time.Second, cfg.Deployment.AdoptDrift),
+		webhookService:       webhookService,
+		webhookVerifier:      webhook.NewVerifier(webhookOptions),
+	}
+
+	// Replace the built-in data with the declared one
+	if cfg.File != "" {
+		if err := server.loadConfig(ctx); err != nil {
+			return nil, err
+		}
 	}
 
 	// Register routes
@@ -45,6 +236,24 @@ func New(ctx context.Context, cfg *config.Config) (*Server, error) {
 
 // Start starts the server
 func (s *Server) Start(ctx context.Context) error {
+	// Start background workers
+	s.scheduler.Start(ctx)
+	s.webhookService.Start(ctx)
+	if s.config.Deployment.DriftCheckInterval > 0 {
+		s.reconciler.Start(ctx)
+	}
+	if s.config.Docker.DiscoveryInterval > 0 {
+		s.discoveryService.Start(ctx)
+	}
+	if s.config.File != "" {
+		if err := s.watchConfig(ctx); err != nil {
+			return err
+		}
+	}
+	if s.config.Audit.CheckpointInterval > 0 && s.auditKeys != nil {
+		s.auditLog.StartCheckpoints(ctx, time.Duration(s.config.Audit.CheckpointInterval)*time.Second)
+	}
+
 	// Configure server options
 	options := &echoserver.Options{
 		Port:       s.config.Server.Port,
@@ -60,33 +269,245 @@ func (s *Server) Start(ctx context.Context) error {
 // registerRoutes registers all API routes
 func (s *Server) registerRoutes() {
 	// API group
-	api := s.echo.Group("/api")
+	api := s.echo.Group("/api", middleware.JWTMiddleware(s.authService), middleware.Audit(s.auditLog))
+
+	// Authentication routes
+	authHandler := handler.NewAuthHandler(s.authService, s.oidcProvider)
+	api.POST("/auth/login", authHandler.Login)
+	api.GET("/auth/oidc/login", authHandler.OIDCLogin)
+	api.GET("/auth/oidc/callback", authHandler.OIDCCallback)
+	api.POST("/auth/refresh", authHandler.Refresh)
+	api.POST("/auth/logout", authHandler.Logout)
+	api.GET("/auth/me", authHandler.Me)
+	api.PUT("/auth/password", authHandler.ChangePassword)
+
+	// User management routes
+	userHandler := handler.NewUserHandler(s.authService)
+	requireAdmin := middleware.RequirePermission(s.authService, auth.PermissionAdmin)
+	users := api.Group("/users", requireAdmin)
+	users.GET("", userHandler.ListUsers)
+	users.POST("", userHandler.CreateUser)
+	users.GET("/:id", userHandler.GetUser)
+	users.PUT("/:id", userHandler.UpdateUser)
+	users.DELETE("/:id", userHandler.DeleteUser)
+	users.GET("/:id/bindings", userHandler.ListRoleBindings)
+	users.POST("/:id/bindings", userHandler.CreateRoleBinding)
+	users.DELETE("/:id/bindings/:binding_id", userHandler.DeleteRoleBinding)
+
+	// API token routes
+	tokenHandler := handler.NewTokenHandler(s.authService)
+	api.GET("/tokens", tokenHandler.ListTokens)
+	api.POST("/tokens", tokenHandler.CreateToken)
+	api.DELETE("/tokens/:id", tokenHandler.RevokeToken)
+	serviceAccounts := api.Group("/service-accounts", requireAdmin)
+	serviceAccounts.GET("", tokenHandler.ListServiceAccounts)
+	serviceAccounts.POST("", tokenHandler.CreateServiceAccount)
+	serviceAccounts.GET("/:id/tokens", tokenHandler.ListServiceAccountTokens)
+	serviceAccounts.POST("/:id/tokens", tokenHandler.CreateServiceAccountToken)
+
+	// Configuration routes
+	api.GET("/config", func(c echo.Context) error {
+		return c.JSON(200, map[string]interface{}{
+			"status": "success",
+			"data":   s.configStatus(),
+		})
+	})
+	api.POST("/config/reload", func(c echo.Context) error {
+		if s.config.File == "" {
+			return c.JSON(404, map[string]interface{}{
+				"status":  "error",
+				"message": "No configuration file is loaded",
+			})
+		}
+
+		status, err := s.reloadConfig(c.Request().Context())
+		if err != nil {
+			return c.JSON(422, map[string]interface{}{
+				"status":  "error",
+				"message": err.Error(),
+				"data":    status,
+			})
+		}
+
+		return c.JSON(200, map[string]interface{}{
+			"status": "success",
+			"data":   status,
+		})
+	}, requireAdmin)
+
+	// Team routes
+	teamHandler := handler.NewTeamHandler(s.teamService, s.authService)
+	api.GET("/teams", teamHandler.ListTeams)
 
 	// Docker image routes
-	dockerHandler := handler.NewDockerHandler()
+	dockerHandler := handler.NewDockerHandler(s.dockerService, s.signatureService, s.vulnerabilityService, s.authService)
 	api.GET("/images", dockerHandler.ListImages)
 	api.GET("/images/:id", dockerHandler.GetImage)
 	api.GET("/images/:id/tags", dockerHandler.ListTags)
+	api.POST("/images/:id/tags/:tag/verify", dockerHandler.VerifyTag)
 	api.POST("/images/:id/refresh", dockerHandler.RefreshTags)
 
+	// Vulnerability report routes
+	vulnerabilityHandler := handler.NewVulnerabilityHandler(s.vulnerabilityService, s.dockerService, s.authService)
+	api.POST("/images/:id/vulnerabilities", vulnerabilityHandler.UploadReport)
+	api.GET("/images/:id/vulnerabilities/:reference", vulnerabilityHandler.GetReport)
+	api.POST("/images/:id/vulnerabilities/:reference/import", vulnerabilityHandler.ImportAttestation)
+
+	// Image discovery routes
+	discoveryHandler := handler.NewDiscoveryHandler(s.discoveryService, s.authService)
+	api.POST("/images/discover", discoveryHandler.Discover, requireAdmin)
+	api.GET("/images/candidates", discoveryHandler.ListCandidates)
+	api.POST("/images/candidates/:id/approve", discoveryHandler.ApproveCandidate)
+	api.POST("/images/candidates/:id/reject", discoveryHandler.RejectCandidate)
+
 	// Environment routes
-	envHandler := handler.NewEnvironmentHandler()
+	envHandler := handler.NewEnvironmentHandler(s.environmentService, s.authService)
 	api.GET("/environments", envHandler.ListEnvironments)
 	api.GET("/environments/:id", envHandler.GetEnvironment)
 	api.POST("/environments/:id/deploy", envHandler.DeployToEnvironment)
+	api.GET("/environments/:id/deployments", envHandler.ListDeployments)
+	api.POST("/environments/:id/deployments/:deployment_id/approve", envHandler.ApproveDeployment)
+	api.POST("/environments/:id/deployments/:deployment_id/reject", envHandler.RejectDeployment)
+	api.POST("/environments/:id/deployments/:deployment_id/cancel", envHandler.CancelDeployment)
+	api.PUT("/environments/:id/deployments/:deployment_id/schedule", envHandler.RescheduleDeployment)
+	api.POST("/environments/:id/reconcile", envHandler.Reconcile)
 
 	// Git routes
-	gitHandler := handler.NewGitHandler()
+	gitHandler := handler.NewGitHandler(s.gitService, s.authService)
 	api.GET("/repositories", gitHandler.ListRepositories)
 	api.GET("/repositories/:id/files", gitHandler.ListFiles)
 	api.GET("/repositories/:id/files/:path", gitHandler.GetFile)
 
 	// Webhook routes
-	webhookHandler := handler.NewWebhookHandler()
+	webhookHandler := handler.NewWebhookHandler(s.webhookService, s.webhookVerifier)
 	api.POST("/webhooks/docker", webhookHandler.DockerWebhook)
+	api.POST("/webhooks/:source", webhookHandler.RegistryWebhook)
+	api.GET("/webhooks/rejections", webhookHandler.Rejections, requireAdmin)
+	api.GET("/webhooks/deliveries", webhookHandler.ListDeliveries, requireAdmin)
+	api.GET("/webhooks/deliveries/:id", webhookHandler.GetDelivery, requireAdmin)
+	api.POST("/webhooks/deliveries/:id/redeliver", webhookHandler.Redeliver, requireAdmin)
+
+	// Audit log routes
+	auditHandler := handler.NewAuditHandler(s.auditLog)
+	api.GET("/audit", auditHandler.ListEvents, requireAdmin)
+	api.GET("/audit/export", auditHandler.ExportEvents, requireAdmin)
+	api.GET("/audit/verify", auditHandler.Verify, requireAdmin)
+	api.GET("/audit/checkpoints", auditHandler.ListCheckpoints, requireAdmin)
+	api.POST("/audit/checkpoints", auditHandler.CreateCheckpoint, requireAdmin)
+	api.GET("/audit/checkpoints/export", auditHandler.ExportCheckpoints, requireAdmin)
+
+	// Public keys of the access tokens, for services verifying them
+	s.echo.GET("/.well-known/jwks.json", func(c echo.Context) error {
+		return c.JSON(200, s.authService.JWKS())
+	})
+
+	// Public keys of the audit checkpoints, for auditors verifying exports
+	if s.auditKeys != nil {
+		s.echo.GET("/.well-known/audit-jwks.json", func(c echo.Context) error {
+			return c.JSON(200, s.auditKeys.JWKS())
+		})
+	}
 
 	// Health check
 	s.echo.GET("/health", func(c echo.Context) error {
 		return c.JSON(200, map[string]string{"status": "ok"})
 	})
 }
+
+// webhookVerifierOptions converts the webhook configuration into verifier options
+func webhookVerifierOptions(cfg config.WebhookConfig) webhook.VerifierOptions {
+	options := webhook.VerifierOptions{
+		Sources: make(map[string]webhook.SourceOptions, len(cfg.Sources)),
+		Default: webhook.SourceOptions{
+			Secret:          cfg.Secret,
+			Mode:            cfg.Mode,
+			TimestampHeader: cfg.TimestampHeader,
+			SignedHeaders:   cfg.SignedHeaders,
+		},
+		AllowUnauthenticated: cfg.AllowUnauthenticated,
+		TimestampTolerance:   time.Duration(cfg.TimestampTolerance) * time.Second,
+		ReplayWindow:         time.Duration(cfg.ReplayWindow) * time.Second,
+	}
+
+	for name, source := range cfg.Sources {
+		options.Sources[name] = webhook.SourceOptions{
+			Secret:          source.Secret,
+			Mode:            source.Mode,
+			SignatureHeader: source.SignatureHeader,
+			TimestampHeader: source.TimestampHeader,
+			DeliveryHeader:  source.DeliveryHeader,
+			SignedHeaders:   source.SignedHeaders,
+		}
+	}
+
+	return options
+}
+
+// newKeySet loads the keys access tokens are signed with: an RSA or Ed25519
+// key file when configured, the shared JWT secret otherwise
+func newKeySet(cfg config.AuthConfig) (*auth.KeySet, error) {
+	if cfg.SigningKeyFile != "" {
+		return auth.LoadKeySet(cfg.SigningKeyFile, cfg.PreviousKeyFiles)
+	}
+
+	secret := cfg.JWTSecret
+	if secret == "" {
+		// Tokens will not survive a restart
+		secret = store.NewID() + store.NewID()
+	}
+
+	return auth.NewHMACKeySet(secret), nil
+}
+
+// newOIDCProvider creates the OIDC provider, or returns nil when single
+// sign-on is not configured
+func newOIDCProvider(cfg config.OIDCConfig) (*auth.OIDCProvider, error) {
+	if cfg.Issuer == "" {
+		return nil, nil
+	}
+
+	mappings, err := auth.ParseGroupMappings(cfg.GroupMappings)
+	if err != nil {
+		return nil, err
+	}
+
+	return auth.NewOIDCProvider(auth.OIDCOptions{
+		Issuer:        cfg.Issuer,
+		ClientID:      cfg.ClientID,
+		ClientSecret:  cfg.ClientSecret,
+		RedirectURL:   cfg.RedirectURL,
+		Scopes:        strings.Fields(cfg.Scopes),
+		GroupsClaim:   cfg.GroupsClaim,
+		GroupMappings: mappings,
+		DefaultRole:   cfg.DefaultRole,
+	})
+}
+
+// newGitClient creates the client values files are read from and
+// committed to, keeping working copies under the clone directory
+func newGitClient(cfg *config.Config) (*git.Client, error) {
+	dir := cfg.Git.CloneDir
+	if dir == "" && cfg.Database.Path != "" {
+		dir = filepath.Join(cfg.Database.Path, "git")
+	}
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "image-updater-git")
+	}
+
+	return git.NewClient(cfg.Git.AuthType, cfg.Git.Username, cfg.Git.Password, cfg.Git.SSHKeyPath, dir)
+}
+
+// newRegistryCache opens the cache of registry responses, or returns nil
+// when it is disabled
+func newRegistryCache(cfg *config.Config) (*docker.Cache, error) {
+	if cfg.Docker.CacheSize == 0 {
+		return nil, nil
+	}
+
+	dir := cfg.Docker.CacheDir
+	if dir == "" && cfg.Database.Path != "" {
+		dir = filepath.Join(cfg.Database.Path, "registry-cache")
+	}
+
+	return docker.NewCache(dir, int64(cfg.Docker.CacheSize)<<20)
+}
@@ -0,0 +1,324 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jpfaria/image-updater/internal/audit"
+	"github.com/jpfaria/image-updater/internal/clock"
+	"github.com/jpfaria/image-updater/internal/docker"
+	"github.com/jpfaria/image-updater/internal/model"
+	"github.com/jpfaria/image-updater/internal/store"
+	"github.com/xgodev/boost/wrapper/log"
+)
+
+// DiscoveryOptions holds the settings of the discovery service
+type DiscoveryOptions struct {
+	DataDir  string        // empty keeps candidates in memory
+	Interval time.Duration // between catalog scans
+	Clock    clock.Clock   // defaults to the system clock
+	Audit    *audit.Log    // nil records nothing
+}
+
+// DiscoveryService reads the catalogs of registries and proposes the
+// repositories matching the discovery rules of the teams as candidate
+// images. A candidate is only tracked once approved; a rejected one is not
+// proposed again.
+type DiscoveryService struct {
+	dockerService *DockerService
+	registries    *docker.Pool
+	candidates    *store.Collection[model.ImageCandidate]
+	options       DiscoveryOptions
+
+	// scanning serialises catalog scans
+	scanning sync.Mutex
+
+	mu    sync.RWMutex
+	rules []model.DiscoveryRule
+}
+
+// NewDiscoveryService creates a new discovery service. Candidates approved
+// before a restart are tracked again.
+func NewDiscoveryService(dockerService *DockerService, registries *docker.Pool, options DiscoveryOptions) (*DiscoveryService, error) {
+	if options.Clock == nil {
+		options.Clock = clock.Real()
+	}
+
+	candidates, err := store.NewCollection[model.ImageCandidate](options.DataDir, "image_candidates")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &DiscoveryService{
+		dockerService: dockerService,
+		registries:    registries,
+		candidates:    candidates,
+		options:       options,
+	}
+
+	for _, candidate := range candidates.List() {
+		if candidate.Status != model.CandidateStatusApproved {
+			continue
+		}
+		if err := dockerService.track(candidate.Image); err != nil && !errors.Is(err, ErrInvalidState) {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// Start scans the catalogs in the background until ctx is cancelled
+func (s *DiscoveryService) Start(ctx context.Context) {
+	log.Infof("Starting image discovery (interval: %s)", s.options.Interval)
+
+	// Candidates found in the background are audited under the job's name
+	ctx = audit.WithActor(ctx, "system:discovery", "", "")
+
+	go func() {
+		ticker := time.NewTicker(s.options.Interval)
+		defer ticker.Stop()
+
+		for {
+			if _, err := s.Discover(ctx); err != nil {
+				log.Errorf("Image discovery failed: %v", err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// SyncRules replaces the discovery rules
+func (s *DiscoveryService) SyncRules(ctx context.Context, rules []model.DiscoveryRule) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rules = append([]model.DiscoveryRule{}, rules...)
+	return nil
+}
+
+// ListRules lists the discovery rules
+func (s *DiscoveryService) ListRules(ctx context.Context) ([]model.DiscoveryRule, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append([]model.DiscoveryRule{}, s.rules...), nil
+}
+
+// Discover reads the catalog of every registry named by a rule and proposes
+// the untracked repositories matching a rule. It returns the new
+// candidates; a registry that cannot be read does not stop the others.
+func (s *DiscoveryService) Discover(ctx context.Context) ([]model.ImageCandidate, error) {
+	s.scanning.Lock()
+	defer s.scanning.Unlock()
+
+	rules, _ := s.ListRules(ctx)
+
+	// Each catalog is read once, whatever the number of rules using it
+	hosts := make([]string, 0)
+	byHost := make(map[string][]model.DiscoveryRule)
+	for _, rule := range rules {
+		host := normalizeRegistry(rule.Registry)
+		if _, ok := byHost[host]; !ok {
+			hosts = append(hosts, host)
+		}
+		byHost[host] = append(byHost[host], rule)
+	}
+
+	var errs []error
+	found := make([]model.ImageCandidate, 0)
+	for _, host := range hosts {
+		client, err := s.registries.Client(host)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("registry %s: %w", host, err))
+			continue
+		}
+		repositories, err := client.Catalog(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("registry %s: %w", host, err))
+			continue
+		}
+
+		for _, repository := range repositories {
+			rule := matchRule(byHost[host], repository)
+			if rule == nil {
+				continue
+			}
+			candidate, err := s.propose(ctx, *rule, repository)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			if candidate != nil {
+				found = append(found, *candidate)
+			}
+		}
+	}
+
+	log.Infof("Discovered %d new candidate images in %d registries", len(found), len(hosts))
+	return found, errors.Join(errs...)
+}
+
+// ListCandidates lists the candidate images, only those with the given
+// status unless it is empty
+func (s *DiscoveryService) ListCandidates(ctx context.Context, status string) ([]model.ImageCandidate, error) {
+	log.Info("Listing candidate images")
+
+	candidates := make([]model.ImageCandidate, 0)
+	for _, candidate := range s.candidates.List() {
+		if status == "" || candidate.Status == status {
+			candidates = append(candidates, candidate)
+		}
+	}
+
+	return candidates, nil
+}
+
+// GetCandidate gets a candidate image by ID
+func (s *DiscoveryService) GetCandidate(ctx context.Context, id string) (*model.ImageCandidate, error) {
+	candidate, ok := s.candidates.Get(id)
+	if !ok {
+		return nil, ErrCandidateNotFound
+	}
+
+	return &candidate, nil
+}
+
+// ApproveCandidate tracks a pending candidate as an image
+func (s *DiscoveryService) ApproveCandidate(ctx context.Context, id, user, comment string) (*model.ImageCandidate, error) {
+	log.Infof("Approving candidate image %s", id)
+
+	return s.decide(id, user, comment, model.CandidateStatusApproved, func(candidate *model.ImageCandidate) error {
+		return s.dockerService.track(candidate.Image)
+	})
+}
+
+// RejectCandidate declines a pending candidate, which is then no longer
+// proposed
+func (s *DiscoveryService) RejectCandidate(ctx context.Context, id, user, comment string) (*model.ImageCandidate, error) {
+	log.Infof("Rejecting candidate image %s", id)
+
+	return s.decide(id, user, comment, model.CandidateStatusRejected, nil)
+}
+
+// decide records a decision on a pending candidate, applying it first when
+// apply is set; a candidate whose decision fails stays pending
+func (s *DiscoveryService) decide(id, user, comment, status string, apply func(candidate *model.ImageCandidate) error) (*model.ImageCandidate, error) {
+	candidate, err := s.candidates.Update(id, func(c *model.ImageCandidate) error {
+		if c.Status != model.CandidateStatusPending {
+			return fmt.Errorf("%w: candidate is %s", ErrInvalidState, c.Status)
+		}
+		if apply != nil {
+			if err := apply(c); err != nil {
+				return err
+			}
+		}
+
+		c.Status = status
+		c.DecidedBy = user
+		c.DecidedAt = s.options.Clock.Now().Format(time.RFC3339)
+		c.Comment = comment
+		return nil
+	})
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, ErrCandidateNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &candidate, nil
+}
+
+// propose records a repository as a candidate unless it is tracked or was
+// proposed before
+func (s *DiscoveryService) propose(ctx context.Context, rule model.DiscoveryRule, repository string) (*model.ImageCandidate, error) {
+	namespace, name := docker.SplitRepository(repository)
+	image := model.Image{
+		Registry:       rule.Registry,
+		Namespace:      namespace,
+		Name:           name,
+		Team:           rule.Team,
+		UpdateStrategy: rule.UpdateStrategy,
+		TagPattern:     rule.TagPattern,
+		Source:         model.ImageSourceDiscovery,
+	}
+
+	if s.dockerService.findImage(image.Registry, image.Namespace, image.Name) != nil {
+		return nil, nil
+	}
+	for _, candidate := range s.candidates.List() {
+		if imageRepository(candidate.Image) == imageRepository(image) {
+			return nil, nil
+		}
+	}
+
+	image.ID = s.candidateID(image)
+	candidate := model.ImageCandidate{
+		Image:        image,
+		Status:       model.CandidateStatusPending,
+		DiscoveredAt: s.options.Clock.Now().Format(time.RFC3339),
+	}
+	if err := s.candidates.Put(image.ID, candidate); err != nil {
+		return nil, err
+	}
+
+	log.Infof("Discovered candidate image %s for team %s", imageRepository(image), rule.Team)
+	if err := s.options.Audit.Record(ctx, audit.Event{
+		Action:     "image.discover",
+		TargetType: "image_candidates",
+		TargetID:   image.ID,
+		After:      audit.Snapshot(candidate),
+	}); err != nil {
+		log.Errorf("Failed to record audit event image.discover: %v", err)
+	}
+
+	return &candidate, nil
+}
+
+// candidateID derives the ID of a candidate from its repository path, with
+// a suffix when another image or candidate already uses it
+func (s *DiscoveryService) candidateID(image model.Image) string {
+	id := strings.ReplaceAll(strings.TrimPrefix(image.Namespace+"/"+image.Name, "/"), "/", "-")
+
+	_, tracked := s.dockerService.images.Get(id)
+	_, proposed := s.candidates.Get(id)
+	if !tracked && !proposed {
+		return id
+	}
+
+	sum := sha256.Sum256([]byte(imageRepository(image)))
+	return id + "-" + hex.EncodeToString(sum[:3])
+}
+
+// matchRule returns the first rule including a repository without
+// excluding it
+func matchRule(rules []model.DiscoveryRule, repository string) *model.DiscoveryRule {
+	for i, rule := range rules {
+		if matchAny(rule.Include, repository) && !matchAny(rule.Exclude, repository) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// matchAny reports whether a repository matches one of the patterns
+func matchAny(patterns []string, repository string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := docker.MatchRepository(pattern, repository); matched {
+			return true
+		}
+	}
+	return false
+}
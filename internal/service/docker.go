@@ -4,135 +4,317 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 
+	"github.com/jpfaria/image-updater/internal/docker"
 	"github.com/jpfaria/image-updater/internal/model"
+	"github.com/jpfaria/image-updater/internal/store"
 	"github.com/xgodev/boost/wrapper/log"
 )
 
 // DockerService handles Docker registry operations
 type DockerService struct {
-	// Add dependencies here
+	images     *store.Collection[model.Image]
+	tags       *store.Collection[[]model.Tag] // keyed by image ID
+	registries *docker.Pool
 }
 
-// NewDockerService creates a new Docker service
-func NewDockerService() *DockerService {
-	return &DockerService{}
+// NewDockerService creates a new Docker service reaching registries through
+// the given pool
+func NewDockerService(registries *docker.Pool) *DockerService {
+	images, _ := store.NewCollection[model.Image]("", "images")
+	tags, _ := store.NewCollection[[]model.Tag]("", "tags")
+
+	s := &DockerService{
+		images:     images,
+		tags:       tags,
+		registries: registries,
+	}
+	s.seed()
+
+	return s
 }
 
-// ListImages lists all Docker images
-func (s *DockerService) ListImages(ctx context.Context) ([]model.Image, error) {
-	log.Info("Listing Docker images")
-	
-	// Mock implementation for now
-	images := []model.Image{
+// seed loads the built-in images and tags
+func (s *DockerService) seed() {
+	// Mock data for now
+	s.images.Put("1", model.Image{
+		ID:        "1",
+		Name:      "nginx",
+		Registry:  "docker.io",
+		Namespace: "library",
+		Team:      "Team A",
+		LatestTag: "1.25.1",
+	})
+	s.images.Put("2", model.Image{
+		ID:        "2",
+		Name:      "postgres",
+		Registry:  "docker.io",
+		Namespace: "library",
+		Team:      "Team A",
+		LatestTag: "16.0",
+	})
+
+	s.tags.Put("1", []model.Tag{
+		{
+			Name:      "1.25.1",
+			Digest:    "sha256:abcdef1234567890",
+			CreatedAt: time.Now().AddDate(0, 0, -5).Format(time.RFC3339),
+		},
 		{
-			ID:        "1",
-			Name:      "nginx",
-			Registry:  "docker.io",
-			Namespace: "library",
-			LatestTag: "1.25.1",
+			Name:      "1.25.0",
+			Digest:    "sha256:1234567890abcdef",
+			CreatedAt: time.Now().AddDate(0, 0, -20).Format(time.RFC3339),
 		},
 		{
-			ID:        "2",
-			Name:      "postgres",
-			Registry:  "docker.io",
-			Namespace: "library",
-			LatestTag: "16.0",
+			Name:      "1.24.0",
+			Digest:    "sha256:9876543210abcdef",
+			CreatedAt: time.Now().AddDate(0, -1, -5).Format(time.RFC3339),
 		},
+	})
+	s.tags.Put("2", []model.Tag{
+		{
+			Name:      "16.0",
+			Digest:    "sha256:abcdef1234567890",
+			CreatedAt: time.Now().AddDate(0, 0, -10).Format(time.RFC3339),
+		},
+		{
+			Name:      "15.4",
+			Digest:    "sha256:1234567890abcdef",
+			CreatedAt: time.Now().AddDate(0, -1, -15).Format(time.RFC3339),
+		},
+	})
+}
+
+// SyncImages replaces the tracked images with the declared ones. Images
+// that stay declared keep their tags and latest tag, so applying the same
+// declarations again changes nothing. Discovered images that were approved
+// stay tracked, unless an image is declared with their ID or repository.
+func (s *DockerService) SyncImages(ctx context.Context, images []model.Image) error {
+	images = append([]model.Image{}, images...)
+	declared := make(map[string]bool, len(images))
+	repositories := make(map[string]bool, len(images))
+	for _, image := range images {
+		declared[image.ID] = true
+		repositories[imageRepository(image)] = true
+	}
+
+	for _, image := range s.images.List() {
+		if image.Source == model.ImageSourceDiscovery && !declared[image.ID] && !repositories[imageRepository(image)] {
+			images = append(images, image)
+			declared[image.ID] = true
+		}
+	}
+
+	// Drop the tags of images that are no longer tracked
+	for _, image := range s.images.List() {
+		if !declared[image.ID] {
+			if err := s.tags.Delete(image.ID); err != nil && !errors.Is(err, store.ErrNotFound) {
+				return err
+			}
+		}
 	}
-	
-	return images, nil
+
+	return syncCollection(s.images, images, func(i model.Image) string { return i.ID }, func(existing model.Image, declared *model.Image) {
+		declared.LatestTag = existing.LatestTag
+	})
+}
+
+// ListImages lists all Docker images
+func (s *DockerService) ListImages(ctx context.Context) ([]model.Image, error) {
+	log.Info("Listing Docker images")
+
+	return s.images.List(), nil
 }
 
 // GetImage gets a Docker image by ID
 func (s *DockerService) GetImage(ctx context.Context, id string) (*model.Image, error) {
 	log.Infof("Getting Docker image with ID: %s", id)
-	
-	// Mock implementation for now
-	if id == "1" {
-		return &model.Image{
-			ID:        "1",
-			Name:      "nginx",
-			Registry:  "docker.io",
-			Namespace: "library",
-			LatestTag: "1.25.1",
-		}, nil
-	} else if id == "2" {
-		return &model.Image{
-			ID:        "2",
-			Name:      "postgres",
-			Registry:  "docker.io",
-			Namespace: "library",
-			LatestTag: "16.0",
-		}, nil
-	}
-	
-	return nil, errors.New("image not found")
+
+	image, ok := s.images.Get(id)
+	if !ok {
+		return nil, ErrImageNotFound
+	}
+
+	return &image, nil
 }
 
-// ListTags lists all tags for a Docker image
+// ListTags lists all tags for a Docker image, newest first
 func (s *DockerService) ListTags(ctx context.Context, id string) ([]model.Tag, error) {
 	log.Infof("Listing tags for Docker image with ID: %s", id)
-	
-	// Mock implementation for now
-	if id == "1" {
-		return []model.Tag{
-			{
-				Name:      "1.25.1",
-				Digest:    "sha256:abcdef1234567890",
-				CreatedAt: time.Now().AddDate(0, 0, -5).Format(time.RFC3339),
-			},
-			{
-				Name:      "1.25.0",
-				Digest:    "sha256:1234567890abcdef",
-				CreatedAt: time.Now().AddDate(0, 0, -20).Format(time.RFC3339),
-			},
-			{
-				Name:      "1.24.0",
-				Digest:    "sha256:9876543210abcdef",
-				CreatedAt: time.Now().AddDate(0, -1, -5).Format(time.RFC3339),
-			},
-		}, nil
-	} else if id == "2" {
-		return []model.Tag{
-			{
-				Name:      "16.0",
-				Digest:    "sha256:abcdef1234567890",
-				CreatedAt: time.Now().AddDate(0, 0, -10).Format(time.RFC3339),
-			},
-			{
-				Name:      "15.4",
-				Digest:    "sha256:1234567890abcdef",
-				CreatedAt: time.Now().AddDate(0, -1, -15).Format(time.RFC3339),
-			},
-		}, nil
-	}
-	
-	return nil, errors.New("image not found")
+
+	if _, ok := s.images.Get(id); !ok {
+		return nil, ErrImageNotFound
+	}
+
+	tags, _ := s.tags.Get(id)
+	result := make([]model.Tag, len(tags))
+	copy(result, tags)
+
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].CreatedAt > result[j].CreatedAt
+	})
+
+	return result, nil
 }
 
-// RefreshTags refreshes the tags for a Docker image
+// RefreshTags reads the tags of a Docker image from its registry. Tags
+// already known keep their digest and creation time; tags deleted from the
+// registry are dropped.
 func (s *DockerService) RefreshTags(ctx context.Context, id string) error {
 	log.Infof("Refreshing tags for Docker image with ID: %s", id)
-	
-	// Mock implementation for now
-	if id != "1" && id != "2" {
-		return errors.New("image not found")
-	}
-	
-	// In a real implementation, this would connect to the Docker registry
-	// and update the database with the latest tags
-	
-	return nil
+
+	image, ok := s.images.Get(id)
+	if !ok {
+		return ErrImageNotFound
+	}
+
+	client, err := s.registries.Client(image.Registry)
+	if err != nil {
+		return err
+	}
+	listed, err := client.ListTags(ctx, image.Namespace, image.Name)
+	if err != nil {
+		return err
+	}
+
+	// Merged in the store so tags recorded by concurrent webhooks survive
+	_, err = s.tags.Upsert(id, func(tags *[]model.Tag) error {
+		known := make(map[string]model.Tag, len(*tags))
+		for _, tag := range *tags {
+			known[tag.Name] = tag
+		}
+
+		refreshed := make([]model.Tag, 0, len(listed))
+		for _, tag := range listed {
+			if existing, ok := known[tag.Name]; ok {
+				tag = existing
+			}
+			refreshed = append(refreshed, tag)
+		}
+		*tags = refreshed
+		return nil
+	})
+	return err
+}
+
+// HandleWebhook records the tag announced by a registry push notification.
+// It returns the tracked image the event belongs to, or nil when the pushed
+// repository is not tracked.
+func (s *DockerService) HandleWebhook(ctx context.Context, event model.ImagePushedEvent) (*model.Image, error) {
+	log.Infof("Processing %s webhook for %s/%s:%s", event.Source, event.Namespace, event.Repository, event.Tag)
+
+	image := s.findImage(event.Registry, event.Namespace, event.Repository)
+	if image == nil {
+		log.Infof("Ignoring webhook for untracked image %s/%s", event.Namespace, event.Repository)
+		return nil, nil
+	}
+
+	createdAt := event.PushedAt
+	if createdAt == "" {
+		createdAt = time.Now().Format(time.RFC3339)
+	}
+
+	_, err := s.tags.Upsert(image.ID, func(tags *[]model.Tag) error {
+		updated := make([]model.Tag, 0, len(*tags)+1)
+		for _, tag := range *tags {
+			if tag.Name != event.Tag {
+				updated = append(updated, tag)
+			}
+		}
+		*tags = append(updated, model.Tag{
+			Name:      event.Tag,
+			Digest:    event.Digest,
+			CreatedAt: createdAt,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Only tags the image follows become its latest, not every pushed tag
+	// such as pr-123 or the signature tags of cosign
+	result, err := s.images.Update(image.ID, func(i *model.Image) error {
+		if advancesLatest(*i, event.Tag) {
+			i.LatestTag = event.Tag
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &result, nil
 }
 
-// HandleWebhook processes a Docker registry webhook
-func (s *DockerService) HandleWebhook(ctx context.Context, repository, tag, digest, namespace string) error {
-	log.Infof("Processing webhook for %s/%s:%s", namespace, repository, tag)
-	
-	// Mock implementation for now
-	// In a real implementation, this would update the database with the new tag
-	
+// setDigest records the digest a tag was found to point to
+func (s *DockerService) setDigest(imageID, tagName, digest string) error {
+	_, err := s.tags.Update(imageID, func(tags *[]model.Tag) error {
+		updated := make([]model.Tag, len(*tags))
+		copy(updated, *tags)
+		for i := range updated {
+			if updated[i].Name == tagName {
+				updated[i].Digest = digest
+			}
+		}
+		*tags = updated
+		return nil
+	})
+	if errors.Is(err, store.ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+// track starts tracking an image that is not declared
+func (s *DockerService) track(image model.Image) error {
+	if _, ok := s.images.Get(image.ID); ok {
+		return fmt.Errorf("%w: image %s is already tracked", ErrInvalidState, image.ID)
+	}
+	if existing := s.findImage(image.Registry, image.Namespace, image.Name); existing != nil {
+		return fmt.Errorf("%w: %s is already tracked as image %s", ErrInvalidState, imageRepository(image), existing.ID)
+	}
+
+	return s.images.Put(image.ID, image)
+}
+
+// findImage returns the tracked image stored at the given repository
+func (s *DockerService) findImage(registry, namespace, name string) *model.Image {
+	for _, image := range s.images.List() {
+		if image.Namespace != namespace || image.Name != name {
+			continue
+		}
+		if registry != "" && normalizeRegistry(registry) != normalizeRegistry(image.Registry) {
+			continue
+		}
+		return &image
+	}
+
 	return nil
 }
+
+// imageRepository names the repository of an image, e.g. ghcr.io/acme/api
+func imageRepository(image model.Image) string {
+	repository := normalizeRegistry(image.Registry) + "/"
+	if image.Namespace != "" {
+		repository += image.Namespace + "/"
+	}
+	return repository + image.Name
+}
+
+// normalizeRegistry maps the aliases of a registry host to a single name
+func normalizeRegistry(registry string) string {
+	registry = strings.ToLower(strings.TrimSuffix(registry, "/"))
+	registry = strings.TrimPrefix(registry, "https://")
+	registry = strings.TrimPrefix(registry, "http://")
+
+	switch registry {
+	case "index.docker.io", "registry-1.docker.io", "registry.hub.docker.com":
+		return "docker.io"
+	}
+
+	return registry
+}
@@ -3,132 +3,970 @@ package service
 import (
 	"context"
 	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/jpfaria/image-updater/internal/audit"
+	"github.com/jpfaria/image-updater/internal/clock"
 	"github.com/jpfaria/image-updater/internal/model"
+	"github.com/jpfaria/image-updater/internal/store"
 	"github.com/xgodev/boost/wrapper/log"
 )
 
+// EnvironmentOptions holds the settings of the environment service
+type EnvironmentOptions struct {
+	DataDir         string // empty keeps deployments in memory
+	CommitMessage   string
+	ApprovalTimeout time.Duration
+	Clock           clock.Clock // defaults to the system clock
+	Audit           *audit.Log  // nil records nothing
+	// Gates are asked before a tag is deployed, both when the deployment
+	// is requested and when it runs
+	Gates []DeploymentGate
+}
+
+// DeploymentGate decides whether an image tag may be deployed to an
+// environment
+type DeploymentGate interface {
+	// Check returns an error wrapping ErrPolicyViolation, with the reason,
+	// when the tag may not be deployed. Other errors, such as a registry
+	// being unavailable, leave the deployment to be checked again.
+	Check(ctx context.Context, env *model.Environment, imageTag string) (GateResult, error)
+}
+
+// GateResult is what a gate established about a tag it let through
+type GateResult struct {
+	// Digest is the digest the tag was checked at; empty when the gate did
+	// not look at the image
+	Digest string
+}
+
 // EnvironmentService handles environment operations
 type EnvironmentService struct {
-	// Add dependencies here (GitService, DockerService)
+	gitService   *GitService
+	environments *store.Collection[model.Environment]
+	deployments  *store.Collection[model.Deployment]
+	options      EnvironmentOptions
+
+	// mu serialises state transitions of deployments
+	mu sync.Mutex
+	// writing serialises the Git I/O of each environment, by environment
+	// ID, so it runs without holding mu
+	writing sync.Map
 }
 
 // NewEnvironmentService creates a new environment service
-func NewEnvironmentService() *EnvironmentService {
-	return &EnvironmentService{}
+func NewEnvironmentService(gitService *GitService, options EnvironmentOptions) (*EnvironmentService, error) {
+	if options.Clock == nil {
+		options.Clock = clock.Real()
+	}
+
+	environments, err := store.NewCollection[model.Environment]("", "environments")
+	if err != nil {
+		return nil, err
+	}
+
+	deployments, err := store.NewCollection[model.Deployment](options.DataDir, "deployments")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &EnvironmentService{
+		gitService:   gitService,
+		environments: environments,
+		deployments:  deployments,
+		options:      options,
+	}
+
+	if err := s.seed(); err != nil {
+		return nil, err
+	}
+	if err := s.recoverRunning(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
 }
 
-// ListEnvironments lists all environments
-func (s *EnvironmentService) ListEnvironments(ctx context.Context) ([]model.Environment, error) {
-	log.Info("Listing environments")
-	
-	// Mock implementation for now
+// recoverRunning fails the deployments that were writing to Git when the
+// service stopped; whether their commit was pushed is unknown, so they are
+// not retried
+func (s *EnvironmentService) recoverRunning() error {
+	for _, deployment := range s.deployments.List() {
+		if deployment.Status != model.DeploymentStatusRunning {
+			continue
+		}
+		log.Warnf("Deployment %s was interrupted while writing back to Git", deployment.ID)
+		deployment.Status = model.DeploymentStatusFailed
+		deployment.Message = "interrupted while writing back to Git, check the values file before deploying again"
+		if err := s.deployments.Put(deployment.ID, deployment); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// seed loads the built-in environments and deployment history
+func (s *EnvironmentService) seed() error {
+	// Mock data for now
 	environments := []model.Environment{
 		{
-			ID:           "1",
-			Name:         "production",
-			Application:  "my-app",
-			ValuesPath:   "my-app/production/values.yaml",
-			CurrentImage: "nginx:1.24.0",
+			ID:                "1",
+			Name:              "production",
+			Application:       "my-app",
+			RepositoryID:      "1",
+			ValuesPath:        "my-app/production/values.yaml",
+			CurrentImage:      "nginx:1.24.0",
+			RequiredApprovals: 2,
 		},
 		{
 			ID:           "2",
 			Name:         "staging",
 			Application:  "my-app",
+			RepositoryID: "1",
 			ValuesPath:   "my-app/staging/values.yaml",
 			CurrentImage: "nginx:1.25.0",
 		},
 	}
-	
-	return environments, nil
+	for _, env := range environments {
+		if err := s.environments.Put(env.ID, env); err != nil {
+			return err
+		}
+	}
+
+	if s.deployments.Len() > 0 {
+		return nil
+	}
+
+	deployments := []model.Deployment{
+		{
+			ID:            "1",
+			EnvironmentID: "1",
+			ImageTag:      "1.24.0",
+			Timestamp:     s.options.Clock.Now().AddDate(0, -1, 0).Format(time.RFC3339),
+			User:          "admin",
+			Status:        model.DeploymentStatusSuccess,
+		},
+		{
+			ID:            "2",
+			EnvironmentID: "1",
+			ImageTag:      "1.23.0",
+			Timestamp:     s.options.Clock.Now().AddDate(0, -2, 0).Format(time.RFC3339),
+			User:          "admin",
+			Status:        model.DeploymentStatusSuccess,
+		},
+		{
+			ID:            "3",
+			EnvironmentID: "2",
+			ImageTag:      "1.25.0",
+			Timestamp:     s.options.Clock.Now().AddDate(0, 0, -15).Format(time.RFC3339),
+			User:          "admin",
+			Status:        model.DeploymentStatusSuccess,
+		},
+	}
+	for _, deployment := range deployments {
+		if err := s.deployments.Put(deployment.ID, deployment); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ListEnvironments lists all environments
+func (s *EnvironmentService) ListEnvironments(ctx context.Context) ([]model.Environment, error) {
+	log.Info("Listing environments")
+
+	return s.environments.List(), nil
 }
 
 // GetEnvironment gets an environment by ID
 func (s *EnvironmentService) GetEnvironment(ctx context.Context, id string) (*model.Environment, error) {
 	log.Infof("Getting environment with ID: %s", id)
-	
-	// Mock implementation for now
-	if id == "1" {
-		return &model.Environment{
-			ID:           "1",
-			Name:         "production",
-			Application:  "my-app",
-			ValuesPath:   "my-app/production/values.yaml",
-			CurrentImage: "nginx:1.24.0",
-		}, nil
-	} else if id == "2" {
-		return &model.Environment{
-			ID:           "2",
-			Name:         "staging",
-			Application:  "my-app",
-			ValuesPath:   "my-app/staging/values.yaml",
-			CurrentImage: "nginx:1.25.0",
-		}, nil
+
+	env, ok := s.environments.Get(id)
+	if !ok {
+		return nil, ErrEnvironmentNotFound
 	}
-	
-	return nil, errors.New("environment not found")
+
+	return &env, nil
 }
 
-// GetDeployments gets deployments for an environment
+// Team returns the team owning an environment, which is the team of its
+// repository, or an empty string when the repository is unknown
+func (s *EnvironmentService) Team(ctx context.Context, env *model.Environment) string {
+	repository, err := s.gitService.GetRepository(ctx, env.RepositoryID)
+	if err != nil {
+		return ""
+	}
+
+	return repository.TeamName
+}
+
+// SyncEnvironments replaces the environments with the declared ones.
+// Environments that stay declared keep their current image and drift; the
+// current image of a new environment is read from its values file.
+func (s *EnvironmentService) SyncEnvironments(ctx context.Context, environments []model.Environment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	environments = append([]model.Environment{}, environments...)
+	for i, env := range environments {
+		if existing, ok := s.environments.Get(env.ID); ok && sameLocation(existing, env) {
+			continue
+		}
+
+		file, err := s.gitService.GetFile(ctx, env.RepositoryID, env.ValuesPath)
+		if err != nil {
+			log.Warnf("Failed to read the current image of environment %s: %v", env.ID, err)
+			continue
+		}
+		if image, err := imageFromValues(file.Content, env.KeyPath); err == nil {
+			environments[i].CurrentImage = image
+		}
+	}
+
+	return syncCollection(s.environments, environments, func(e model.Environment) string { return e.ID }, func(existing model.Environment, declared *model.Environment) {
+		if sameLocation(existing, *declared) {
+			declared.CurrentImage = existing.CurrentImage
+			declared.Drift = existing.Drift
+		}
+	})
+}
+
+// sameLocation reports whether two environments read their image from the
+// same place in Git
+func sameLocation(a, b model.Environment) bool {
+	return a.RepositoryID == b.RepositoryID && a.ValuesPath == b.ValuesPath && a.KeyPath == b.KeyPath
+}
+
+// GetDeployment gets a deployment of an environment
+func (s *EnvironmentService) GetDeployment(ctx context.Context, envID, id string) (*model.Deployment, error) {
+	deployment, ok := s.deployments.Get(id)
+	if !ok || deployment.EnvironmentID != envID {
+		return nil, ErrDeploymentNotFound
+	}
+
+	return &deployment, nil
+}
+
+// GetDeployments gets deployments for an environment, newest first
 func (s *EnvironmentService) GetDeployments(ctx context.Context, envID string) ([]model.Deployment, error) {
 	log.Infof("Getting deployments for environment with ID: %s", envID)
-	
-	// Mock implementation for now
-	if envID == "1" {
-		return []model.Deployment{
-			{
-				ID:        "1",
-				ImageTag:  "1.24.0",
-				Timestamp: time.Now().AddDate(0, -1, 0).Format(time.RFC3339),
-				User:      "admin",
-				Status:    "success",
-			},
-			{
-				ID:        "2",
-				ImageTag:  "1.23.0",
-				Timestamp: time.Now().AddDate(0, -2, 0).Format(time.RFC3339),
-				User:      "admin",
-				Status:    "success",
-			},
-		}, nil
-	} else if envID == "2" {
-		return []model.Deployment{
-			{
-				ID:        "3",
-				ImageTag:  "1.25.0",
-				Timestamp: time.Now().AddDate(0, 0, -15).Format(time.RFC3339),
-				User:      "admin",
-				Status:    "success",
-			},
-		}, nil
-	}
-	
-	return nil, errors.New("environment not found")
-}
-
-// DeployToEnvironment deploys an image to an environment
-func (s *EnvironmentService) DeployToEnvironment(ctx context.Context, envID, imageTag, user string) (*model.Deployment, error) {
+
+	if _, ok := s.environments.Get(envID); !ok {
+		return nil, ErrEnvironmentNotFound
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deployments := make([]model.Deployment, 0)
+	for _, deployment := range s.deployments.List() {
+		if deployment.EnvironmentID != envID {
+			continue
+		}
+		if s.expire(&deployment) {
+			if err := s.deployments.Put(deployment.ID, deployment); err != nil {
+				return nil, err
+			}
+		}
+		deployments = append(deployments, deployment)
+	}
+
+	sort.SliceStable(deployments, func(i, j int) bool {
+		return deployments[i].Timestamp > deployments[j].Timestamp
+	})
+
+	return deployments, nil
+}
+
+// DeployToEnvironment deploys an image to an environment.
+// Environments that require approvals get a deployment awaiting approval;
+// the Git write-back only runs once enough approvers have signed off.
+// A non-zero scheduledAt defers the write-back until that time.
+func (s *EnvironmentService) DeployToEnvironment(ctx context.Context, envID, imageTag, user string, scheduledAt time.Time) (*model.Deployment, error) {
 	log.Infof("Deploying image tag %s to environment with ID: %s", imageTag, envID)
-	
-	// Mock implementation for now
-	if envID != "1" && envID != "2" {
-		return nil, errors.New("environment not found")
-	}
-	
-	// In a real implementation, this would:
-	// 1. Get the environment details
-	// 2. Get the Git repository and file path
-	// 3. Update the file with the new image tag
-	// 4. Create a deployment record
-	
-	deployment := &model.Deployment{
-		ID:        "new-deployment-id",
-		ImageTag:  imageTag,
-		Timestamp: time.Now().Format(time.RFC3339),
-		User:      user,
-		Status:    "pending",
+
+	env, err := s.GetEnvironment(ctx, envID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := s.options.Clock.Now()
+	if !scheduledAt.IsZero() && !scheduledAt.After(now) {
+		return nil, fmt.Errorf("%w: scheduled_at must be in the future", ErrInvalidArgument)
+	}
+
+	result, err := s.checkGates(ctx, env, imageTag)
+	if err != nil {
+		return nil, err
 	}
-	
+
+	deployment := model.Deployment{
+		ID:            store.NewID(),
+		EnvironmentID: env.ID,
+		ImageTag:      imageTag,
+		Timestamp:     now.Format(time.RFC3339),
+		User:          user,
+		Status:        model.DeploymentStatusPending,
+	}
+	if !scheduledAt.IsZero() {
+		deployment.ScheduledAt = scheduledAt.UTC().Format(time.RFC3339)
+	}
+
+	s.mu.Lock()
+	err = s.proceed(ctx, env, &deployment)
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if deployment.Status != model.DeploymentStatusPending {
+		return &deployment, nil
+	}
+	return s.run(ctx, deployment.ID, &result)
+}
+
+// CancelDeployment cancels a deployment that has not run yet
+func (s *EnvironmentService) CancelDeployment(ctx context.Context, envID, deploymentID, user string) (*model.Deployment, error) {
+	log.Infof("User %s cancelling deployment %s in environment with ID: %s", user, deploymentID, envID)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deployment, err := s.waiting(envID, deploymentID)
+	if err != nil {
+		return nil, err
+	}
+
+	deployment.Status = model.DeploymentStatusCancelled
+	deployment.Message = fmt.Sprintf("cancelled by %s", user)
+
+	if err := s.deployments.Put(deployment.ID, *deployment); err != nil {
+		return nil, err
+	}
+
 	return deployment, nil
 }
+
+// RescheduleDeployment moves a deployment that has not run yet to a new time
+func (s *EnvironmentService) RescheduleDeployment(ctx context.Context, envID, deploymentID string, scheduledAt time.Time) (*model.Deployment, error) {
+	log.Infof("Rescheduling deployment %s in environment with ID: %s to %s", deploymentID, envID, scheduledAt.Format(time.RFC3339))
+
+	if !scheduledAt.After(s.options.Clock.Now()) {
+		return nil, fmt.Errorf("%w: scheduled_at must be in the future", ErrInvalidArgument)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deployment, err := s.waiting(envID, deploymentID)
+	if err != nil {
+		return nil, err
+	}
+
+	deployment.ScheduledAt = scheduledAt.UTC().Format(time.RFC3339)
+
+	if err := s.deployments.Put(deployment.ID, *deployment); err != nil {
+		return nil, err
+	}
+
+	return deployment, nil
+}
+
+// RunDueDeployments runs the scheduled deployments whose time has come, and
+// the deployments whose gates could not be checked before. Approval
+// requirements are checked again against the environment as it is now, so
+// a deployment scheduled before a gate was added still waits for it. A
+// deployment that cannot run does not hold up the others; the errors are
+// returned together.
+func (s *EnvironmentService) RunDueDeployments(ctx context.Context) error {
+	ready, errs := s.dueDeployments(ctx)
+
+	for _, id := range ready {
+		if _, err := s.run(ctx, id, nil); err != nil {
+			log.Errorf("Failed to run deployment %s: %v", id, err)
+			errs = append(errs, fmt.Errorf("deployment %s: %w", id, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// dueDeployments moves the scheduled deployments whose time has come to
+// their next state and returns the IDs of those ready to run, with the
+// errors of those that could not be moved
+func (s *EnvironmentService) dueDeployments(ctx context.Context) ([]string, []error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.options.Clock.Now()
+
+	ready := make([]string, 0)
+	var errs []error
+	for _, deployment := range s.deployments.List() {
+		if deployment.Status == model.DeploymentStatusPending {
+			ready = append(ready, deployment.ID)
+			continue
+		}
+		if deployment.Status != model.DeploymentStatusScheduled || !due(deployment.ScheduledAt, now) {
+			continue
+		}
+
+		log.Infof("Running scheduled deployment %s of %s", deployment.ID, deployment.ImageTag)
+
+		env, ok := s.environments.Get(deployment.EnvironmentID)
+		if !ok {
+			deployment.Status = model.DeploymentStatusFailed
+			deployment.Message = ErrEnvironmentNotFound.Error()
+			if err := s.deployments.Put(deployment.ID, deployment); err != nil {
+				errs = append(errs, fmt.Errorf("deployment %s: %w", deployment.ID, err))
+			}
+			continue
+		}
+
+		if err := s.proceed(ctx, &env, &deployment); err != nil {
+			log.Errorf("Failed to move scheduled deployment %s: %v", deployment.ID, err)
+			errs = append(errs, fmt.Errorf("deployment %s: %w", deployment.ID, err))
+			continue
+		}
+		if deployment.Status == model.DeploymentStatusPending {
+			ready = append(ready, deployment.ID)
+		}
+	}
+
+	return ready, errs
+}
+
+// ApproveDeployment records an approval for a deployment awaiting approval
+// and runs it once the environment's required approvals are reached
+func (s *EnvironmentService) ApproveDeployment(ctx context.Context, envID, deploymentID, user, comment string) (*model.Deployment, error) {
+	log.Infof("User %s approving deployment %s in environment with ID: %s", user, deploymentID, envID)
+
+	return s.decide(ctx, envID, deploymentID, user, model.ApprovalDecisionApproved, comment)
+}
+
+// RejectDeployment rejects a deployment awaiting approval
+func (s *EnvironmentService) RejectDeployment(ctx context.Context, envID, deploymentID, user, comment string) (*model.Deployment, error) {
+	log.Infof("User %s rejecting deployment %s in environment with ID: %s", user, deploymentID, envID)
+
+	return s.decide(ctx, envID, deploymentID, user, model.ApprovalDecisionRejected, comment)
+}
+
+// decide records an approval decision on a deployment and runs it once it is
+// ready
+func (s *EnvironmentService) decide(ctx context.Context, envID, deploymentID, user, decision, comment string) (*model.Deployment, error) {
+	env, err := s.GetEnvironment(ctx, envID)
+	if err != nil {
+		return nil, err
+	}
+
+	deployment, err := s.recordDecision(ctx, env, deploymentID, user, decision, comment)
+	if err != nil || deployment.Status != model.DeploymentStatusPending {
+		return deployment, err
+	}
+	return s.run(ctx, deployment.ID, nil)
+}
+
+// recordDecision adds an approval decision to a deployment and moves it to
+// its next state
+func (s *EnvironmentService) recordDecision(ctx context.Context, env *model.Environment, deploymentID, user, decision, comment string) (*model.Deployment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deployment, ok := s.deployments.Get(deploymentID)
+	if !ok || deployment.EnvironmentID != env.ID {
+		return nil, ErrDeploymentNotFound
+	}
+
+	if s.expire(&deployment) {
+		if err := s.deployments.Put(deployment.ID, deployment); err != nil {
+			return nil, err
+		}
+	}
+
+	if deployment.Status != model.DeploymentStatusAwaitingApproval {
+		return nil, fmt.Errorf("%w: deployment is %s", ErrInvalidState, deployment.Status)
+	}
+
+	if deployment.User == user {
+		return nil, fmt.Errorf("%w: requester cannot approve their own deployment", ErrForbidden)
+	}
+
+	for _, approval := range deployment.Approvals {
+		if approval.User == user {
+			return nil, fmt.Errorf("%w: %s already %s this deployment", ErrInvalidState, user, approval.Decision)
+		}
+	}
+
+	deployment.Approvals = append(deployment.Approvals, model.Approval{
+		User:      user,
+		Decision:  decision,
+		Comment:   comment,
+		Timestamp: s.options.Clock.Now().Format(time.RFC3339),
+	})
+
+	if decision == model.ApprovalDecisionRejected {
+		deployment.Status = model.DeploymentStatusRejected
+		deployment.Message = fmt.Sprintf("rejected by %s", user)
+
+		if err := s.deployments.Put(deployment.ID, deployment); err != nil {
+			return nil, err
+		}
+		return &deployment, nil
+	}
+
+	if err := s.proceed(ctx, env, &deployment); err != nil {
+		return nil, err
+	}
+
+	return &deployment, nil
+}
+
+// proceed moves a deployment to its next state: it waits for approvals the
+// environment still requires, waits for its scheduled time, or becomes
+// pending, to be run once its gates are checked.
+// Callers must hold s.mu.
+func (s *EnvironmentService) proceed(ctx context.Context, env *model.Environment, deployment *model.Deployment) error {
+	now := s.options.Clock.Now()
+
+	if countApprovals(deployment.Approvals) < env.RequiredApprovals {
+		if deployment.Status != model.DeploymentStatusAwaitingApproval {
+			deployment.Status = model.DeploymentStatusAwaitingApproval
+			deployment.ExpiresAt = now.Add(s.options.ApprovalTimeout).Format(time.RFC3339)
+		}
+		deployment.RequiredApprovals = env.RequiredApprovals
+
+		log.Infof("Deployment %s to %s is awaiting %d approvals", deployment.ID, env.Name, env.RequiredApprovals)
+		return s.deployments.Put(deployment.ID, *deployment)
+	}
+
+	if deployment.ScheduledAt != "" && !due(deployment.ScheduledAt, now) {
+		deployment.Status = model.DeploymentStatusScheduled
+
+		log.Infof("Deployment %s to %s is scheduled for %s", deployment.ID, env.Name, deployment.ScheduledAt)
+		return s.deployments.Put(deployment.ID, *deployment)
+	}
+
+	deployment.Status = model.DeploymentStatusPending
+	return s.deployments.Put(deployment.ID, *deployment)
+}
+
+// run checks the gates of a pending deployment and writes it back. Gates
+// ask registries and write-backs push to Git, so neither holds s.mu. A
+// policy violation fails the deployment; other errors leave it pending, to
+// be checked again by RunDueDeployments. checked is the result of gates
+// already checked for the deployment, if any.
+func (s *EnvironmentService) run(ctx context.Context, deploymentID string, checked *GateResult) (*model.Deployment, error) {
+	deployment, ok := s.deployments.Get(deploymentID)
+	if !ok {
+		return nil, ErrDeploymentNotFound
+	}
+	env, ok := s.environments.Get(deployment.EnvironmentID)
+	if !ok {
+		return nil, ErrEnvironmentNotFound
+	}
+
+	// The tag is checked again, as it may have been pushed again or the
+	// policy changed since the deployment was requested
+	var result GateResult
+	var err error
+	if checked != nil {
+		result = *checked
+	} else {
+		result, err = s.checkGates(ctx, &env, deployment.ImageTag)
+	}
+
+	started, ok, err := s.start(ctx, deploymentID, &env, result, err)
+	if err != nil || !ok {
+		return started, err
+	}
+
+	log.Infof("Deployment %s to %s is ready, writing back to Git", started.ID, env.Name)
+	if err := s.execute(ctx, &env, started); err != nil {
+		return nil, err
+	}
+	return started, nil
+}
+
+// start records the outcome of the gates of a pending deployment and, when
+// they let it through, marks it running and reports it started. gateErr is
+// the error of the gates.
+func (s *EnvironmentService) start(ctx context.Context, deploymentID string, env *model.Environment, result GateResult, gateErr error) (*model.Deployment, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Another run may have taken the deployment meanwhile
+	deployment, ok := s.deployments.Get(deploymentID)
+	if !ok {
+		return nil, false, ErrDeploymentNotFound
+	}
+	if deployment.Status != model.DeploymentStatusPending {
+		return &deployment, false, nil
+	}
+	current, ok := s.environments.Get(deployment.EnvironmentID)
+	if !ok {
+		return nil, false, ErrEnvironmentNotFound
+	}
+	*env = current
+
+	switch {
+	case errors.Is(gateErr, ErrPolicyViolation):
+		log.Warnf("Deployment %s to %s is blocked: %v", deployment.ID, env.Name, gateErr)
+		s.record(ctx, audit.Event{
+			Action:     "deployment.blocked",
+			TargetType: "deployments",
+			TargetID:   deployment.ID,
+			Outcome:    audit.OutcomeFailure,
+			Error:      gateErr.Error(),
+		})
+		deployment.Status = model.DeploymentStatusFailed
+		deployment.Message = gateErr.Error()
+		return &deployment, false, s.deployments.Put(deployment.ID, deployment)
+	case gateErr != nil:
+		log.Warnf("Deployment %s to %s could not be checked, retrying: %v", deployment.ID, env.Name, gateErr)
+		deployment.Message = fmt.Sprintf("waiting to check the deployment gates: %v", gateErr)
+		return &deployment, false, s.deployments.Put(deployment.ID, deployment)
+	}
+
+	// The checked digest is written rather than the tag, which could be
+	// pushed again after the gates checked it
+	if result.Digest != "" {
+		deployment.Digest = result.Digest
+	}
+
+	deployment.Status = model.DeploymentStatusRunning
+	deployment.Message = ""
+	if err := s.deployments.Put(deployment.ID, deployment); err != nil {
+		return nil, false, err
+	}
+	return &deployment, true, nil
+}
+
+// checkGates asks every deployment gate whether a tag may be deployed. The
+// gates must agree on the digest, or the tag was pushed while they checked.
+func (s *EnvironmentService) checkGates(ctx context.Context, env *model.Environment, imageTag string) (GateResult, error) {
+	var checked GateResult
+	for _, gate := range s.options.Gates {
+		result, err := gate.Check(ctx, env, imageTag)
+		if err != nil {
+			return GateResult{}, err
+		}
+		if result.Digest == "" {
+			continue
+		}
+		if checked.Digest != "" && checked.Digest != result.Digest {
+			return GateResult{}, fmt.Errorf("tag %s moved from %s to %s while it was checked", imageTag, checked.Digest, result.Digest)
+		}
+		checked.Digest = result.Digest
+	}
+	return checked, nil
+}
+
+// waiting returns a deployment of the environment that has not run yet;
+// callers must hold s.mu
+func (s *EnvironmentService) waiting(envID, deploymentID string) (*model.Deployment, error) {
+	deployment, ok := s.deployments.Get(deploymentID)
+	if !ok || deployment.EnvironmentID != envID {
+		return nil, ErrDeploymentNotFound
+	}
+
+	if s.expire(&deployment) {
+		if err := s.deployments.Put(deployment.ID, deployment); err != nil {
+			return nil, err
+		}
+	}
+
+	switch deployment.Status {
+	case model.DeploymentStatusScheduled, model.DeploymentStatusAwaitingApproval:
+		return &deployment, nil
+	default:
+		return nil, fmt.Errorf("%w: deployment is %s", ErrInvalidState, deployment.Status)
+	}
+}
+
+// execute performs the Git write-back of a running deployment and records
+// the outcome. Only recording takes s.mu, so a slow remote does not hold up
+// other environments or the scheduler.
+func (s *EnvironmentService) execute(ctx context.Context, env *model.Environment, deployment *model.Deployment) error {
+	unlock := s.lockEnvironment(env.ID)
+	defer unlock()
+
+	tag := deployedTag(deployment)
+	err := s.writeBack(ctx, env, tag)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if current, ok := s.environments.Get(env.ID); ok {
+		*env = current
+	}
+	s.record(ctx, audit.Event{
+		Action:     "deployment.execute",
+		TargetType: "deployments",
+		TargetID:   deployment.ID,
+		Before:     audit.Snapshot(map[string]string{"environment": env.ID, "image": env.CurrentImage}),
+		After:      audit.Snapshot(map[string]string{"environment": env.ID, "image": withTag(env.CurrentImage, tag)}),
+		Outcome:    audit.Outcome(err),
+		Error:      errorString(err),
+	})
+
+	if err != nil {
+		log.Errorf("Deployment %s to %s failed: %v", deployment.ID, env.Name, err)
+		deployment.Status = model.DeploymentStatusFailed
+		deployment.Message = err.Error()
+	} else if env.WriteBack == model.WriteBackBranch {
+		// The image rolls out once the branch is merged, which drift
+		// detection then picks up from the tracked branch
+		deployment.Status = model.DeploymentStatusSuccess
+		deployment.Message = fmt.Sprintf("committed to branch %s, merge it to roll out", writeBackBranch(env))
+	} else {
+		deployment.Status = model.DeploymentStatusSuccess
+		deployment.Message = ""
+
+		if _, err := s.environments.Update(env.ID, func(e *model.Environment) error {
+			e.CurrentImage = withTag(e.CurrentImage, tag)
+			e.Drift = nil
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+
+	return s.deployments.Put(deployment.ID, *deployment)
+}
+
+// lockEnvironment serialises the Git I/O of an environment and returns the
+// function releasing it. It must not be called while holding s.mu.
+func (s *EnvironmentService) lockEnvironment(envID string) func() {
+	value, _ := s.writing.LoadOrStore(envID, &sync.Mutex{})
+	mu := value.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
+
+// deployedTag returns the tag a deployment writes, pinned to its checked
+// digest as tag@sha256:... when it has one
+func deployedTag(deployment *model.Deployment) string {
+	if deployment.Digest == "" {
+		return deployment.ImageTag
+	}
+	return deployment.ImageTag + "@" + deployment.Digest
+}
+
+// writeBack updates the image tag in the environment's values file
+func (s *EnvironmentService) writeBack(ctx context.Context, env *model.Environment, imageTag string) error {
+	file, err := s.gitService.GetFile(ctx, env.RepositoryID, env.ValuesPath)
+	if err != nil {
+		return err
+	}
+
+	content, err := setImageTag(file.Content, env.KeyPath, imageTag)
+	if err != nil {
+		return err
+	}
+
+	branch := ""
+	if env.WriteBack == model.WriteBackBranch {
+		branch = writeBackBranch(env)
+	}
+
+	return s.gitService.UpdateFile(ctx, env.RepositoryID, branch, env.ValuesPath, content, fmt.Sprintf(s.options.CommitMessage, imageTag))
+}
+
+// writeBackBranch names the branch the tags of an environment are committed
+// to in branch write-back mode
+func writeBackBranch(env *model.Environment) string {
+	return "image-updater/" + env.Application + "-" + env.Name
+}
+
+// DetectDrift compares the image in the environment's values file with the
+// image recorded as deployed. Drift is recorded on the environment; when
+// adopt is set the Git value becomes the truth through an external deployment.
+func (s *EnvironmentService) DetectDrift(ctx context.Context, envID string, adopt bool) (*model.Environment, error) {
+	log.Infof("Checking drift for environment with ID: %s", envID)
+
+	// The values file is read without s.mu, but not while a deployment of
+	// the environment is writing it
+	unlock := s.lockEnvironment(envID)
+	defer unlock()
+
+	env, ok := s.environments.Get(envID)
+	if !ok {
+		return nil, ErrEnvironmentNotFound
+	}
+
+	file, err := s.gitService.GetFile(ctx, env.RepositoryID, env.ValuesPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", env.ValuesPath, err)
+	}
+
+	actual, err := imageFromValues(file.Content, env.KeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image from %s: %w", env.ValuesPath, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The environment may have been changed while the file was read
+	env, ok = s.environments.Get(envID)
+	if !ok {
+		return nil, ErrEnvironmentNotFound
+	}
+
+	now := s.options.Clock.Now()
+
+	before := env
+
+	switch {
+	case actual == env.CurrentImage:
+		env.Drift = nil
+	case adopt:
+		log.Warnf("Adopting %s from Git as the current image of %s (commit %s by %s)", actual, env.Name, file.LastCommit, file.LastAuthor)
+
+		deployment := model.Deployment{
+			ID:            store.NewID(),
+			EnvironmentID: env.ID,
+			ImageTag:      imageTag(actual),
+			Timestamp:     now.Format(time.RFC3339),
+			User:          file.LastAuthor,
+			Status:        model.DeploymentStatusSuccess,
+			Message:       fmt.Sprintf("adopted from Git, previously %s", env.CurrentImage),
+			Source:        model.DeploymentSourceExternal,
+			Commit:        file.LastCommit,
+		}
+		if err := s.deployments.Put(deployment.ID, deployment); err != nil {
+			return nil, err
+		}
+
+		env.CurrentImage = actual
+		env.Drift = nil
+	default:
+		if env.Drift == nil || env.Drift.ActualImage != actual || env.Drift.Commit != file.LastCommit {
+			log.Warnf("Drift detected in %s: expected %s, found %s (commit %s by %s)", env.Name, env.CurrentImage, actual, file.LastCommit, file.LastAuthor)
+
+			env.Drift = &model.Drift{
+				ExpectedImage: env.CurrentImage,
+				ActualImage:   actual,
+				Commit:        file.LastCommit,
+				Author:        file.LastAuthor,
+				DetectedAt:    now.Format(time.RFC3339),
+			}
+		}
+	}
+
+	if err := s.environments.Put(env.ID, env); err != nil {
+		return nil, err
+	}
+
+	if env.CurrentImage != before.CurrentImage || !sameDrift(env.Drift, before.Drift) {
+		action := "environment.drift"
+		if env.CurrentImage != before.CurrentImage {
+			action = "environment.drift_adopted"
+		}
+		s.record(ctx, audit.Event{
+			Action:     action,
+			TargetType: "environments",
+			TargetID:   env.ID,
+			Before:     audit.Snapshot(before),
+			After:      audit.Snapshot(env),
+		})
+	}
+
+	return &env, nil
+}
+
+// expire marks a deployment awaiting approval as expired once its deadline
+// has passed and reports whether it changed
+func (s *EnvironmentService) expire(deployment *model.Deployment) bool {
+	if deployment.Status != model.DeploymentStatusAwaitingApproval || deployment.ExpiresAt == "" {
+		return false
+	}
+
+	expiresAt, err := time.Parse(time.RFC3339, deployment.ExpiresAt)
+	if err != nil || s.options.Clock.Now().Before(expiresAt) {
+		return false
+	}
+
+	deployment.Status = model.DeploymentStatusExpired
+	deployment.Message = "approval window expired"
+	return true
+}
+
+// record adds an event to the audit log
+func (s *EnvironmentService) record(ctx context.Context, event audit.Event) {
+	if err := s.options.Audit.Record(ctx, event); err != nil {
+		log.Errorf("Failed to record audit event %s: %v", event.Action, err)
+	}
+}
+
+// sameDrift reports whether two drift records describe the same drift
+func sameDrift(a, b *model.Drift) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// errorString returns the message of err, or an empty string for nil
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// due reports whether a scheduled time has been reached
+func due(scheduledAt string, now time.Time) bool {
+	at, err := time.Parse(time.RFC3339, scheduledAt)
+	return err == nil && !now.Before(at)
+}
+
+// countApprovals counts the approvals granted on a deployment
+func countApprovals(approvals []model.Approval) int {
+	count := 0
+	for _, approval := range approvals {
+		if approval.Decision == model.ApprovalDecisionApproved {
+			count++
+		}
+	}
+	return count
+}
+
+// withTag replaces the tag, and any digest, of an image reference
+func withTag(image, tag string) string {
+	if image == "" {
+		return tag
+	}
+	image, _, _ = strings.Cut(image, "@")
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image = image[:i]
+	}
+	return image + ":" + tag
+}
+
+// imageTag returns the tag of an image reference, without the digest it
+// may be pinned to
+func imageTag(image string) string {
+	image, _, _ = strings.Cut(image, "@")
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		return image[i+1:]
+	}
+	return image
+}
+
+// containsString reports whether values contains value
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
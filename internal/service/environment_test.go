@@ -0,0 +1,394 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jpfaria/image-updater/internal/model"
+)
+
+// fakeGate answers deployment gates with a fixed result, for the
+// environments it applies to
+type fakeGate struct {
+	applies func(env *model.Environment) bool
+	result  GateResult
+	err     error
+}
+
+func (g *fakeGate) Check(ctx context.Context, env *model.Environment, imageTag string) (GateResult, error) {
+	if !g.applies(env) {
+		return GateResult{}, nil
+	}
+	return g.result, g.err
+}
+
+func TestDeploymentGates(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+
+	tests := []struct {
+		name             string
+		requireSignature bool
+		scanPolicy       bool
+		err              error // returned by the gates when the deployment runs
+		wantStatus       string
+		wantTag          string // in the values file afterwards
+	}{
+		{"pins the verified digest", true, false, nil, model.DeploymentStatusSuccess, "2.0.0@" + digest},
+		{"pins the scanned digest", false, true, nil, model.DeploymentStatusSuccess, "2.0.0@" + digest},
+		{"writes the tag without gates", false, false, nil, model.DeploymentStatusSuccess, "2.0.0"},
+		{"fails on policy violations", true, false, fmt.Errorf("%w: unsigned", ErrPolicyViolation), model.DeploymentStatusFailed, "1.25.0"},
+		{"retries registry errors", true, false, errors.New("registry unavailable"), model.DeploymentStatusPending, "1.25.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			signatures := &fakeGate{
+				applies: func(env *model.Environment) bool { return env.RequireSignature },
+				result:  GateResult{Digest: digest},
+			}
+			scans := &fakeGate{
+				applies: func(env *model.Environment) bool { return env.VulnerabilityPolicy != nil },
+				result:  GateResult{Digest: digest},
+			}
+			gitService := NewGitService(nil)
+			s, err := NewEnvironmentService(gitService, EnvironmentOptions{CommitMessage: "Deploy %s", Gates: []DeploymentGate{signatures, scans}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			env, _ := s.environments.Get("2")
+			env.RequireSignature = tt.requireSignature
+			if tt.scanPolicy {
+				env.VulnerabilityPolicy = &model.VulnerabilityPolicy{}
+			}
+			if err := s.environments.Put(env.ID, env); err != nil {
+				t.Fatal(err)
+			}
+
+			// The deployment is scheduled so the gates are asked again when
+			// it runs
+			deployment, err := s.DeployToEnvironment(ctx, env.ID, "2.0.0", "alice", s.options.Clock.Now().AddDate(0, 0, 1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			stored, _ := s.deployments.Get(deployment.ID)
+			stored.ScheduledAt = s.options.Clock.Now().AddDate(0, 0, -1).Format(time.RFC3339)
+			if err := s.deployments.Put(stored.ID, stored); err != nil {
+				t.Fatal(err)
+			}
+
+			signatures.err, scans.err = tt.err, tt.err
+			if err := s.RunDueDeployments(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			stored, _ = s.deployments.Get(deployment.ID)
+			if stored.Status != tt.wantStatus {
+				t.Fatalf("deployment is %s (%s), want %s", stored.Status, stored.Message, tt.wantStatus)
+			}
+			file, err := gitService.GetFile(ctx, env.RepositoryID, env.ValuesPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if image, _ := imageFromValues(file.Content, env.KeyPath); !strings.HasSuffix(image, ":"+tt.wantTag) {
+				t.Fatalf("values file has %s, want tag %s", image, tt.wantTag)
+			}
+
+			if tt.wantStatus == model.DeploymentStatusPending {
+				signatures.err, scans.err = nil, nil
+				if err := s.RunDueDeployments(ctx); err != nil {
+					t.Fatal(err)
+				}
+				if stored, _ = s.deployments.Get(deployment.ID); stored.Status != model.DeploymentStatusSuccess {
+					t.Fatalf("retried deployment is %s (%s)", stored.Status, stored.Message)
+				}
+			}
+		})
+	}
+}
+
+// fakeClock is a clock tests move by hand
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+// deployedImage returns the image in the values file of an environment
+func deployedImage(t *testing.T, s *EnvironmentService, gitService *GitService, envID string) string {
+	t.Helper()
+
+	env, _ := s.environments.Get(envID)
+	file, err := gitService.GetFile(context.Background(), env.RepositoryID, env.ValuesPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	image, _ := imageFromValues(file.Content, env.KeyPath)
+	return image
+}
+
+func TestScheduledDeployments(t *testing.T) {
+	start := time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		// steps run against the scheduled deployment, returning the
+		// service to continue with
+		steps      func(t *testing.T, s *EnvironmentService, clock *fakeClock, deployment *model.Deployment) *EnvironmentService
+		wantStatus string
+		wantImage  string
+	}{
+		{
+			name: "runs once due",
+			steps: func(t *testing.T, s *EnvironmentService, clock *fakeClock, deployment *model.Deployment) *EnvironmentService {
+				clock.now = start.Add(2 * time.Hour)
+				return s
+			},
+			wantStatus: model.DeploymentStatusSuccess,
+			wantImage:  "nginx:2.0.0",
+		},
+		{
+			name: "waits until due",
+			steps: func(t *testing.T, s *EnvironmentService, clock *fakeClock, deployment *model.Deployment) *EnvironmentService {
+				clock.now = start.Add(59 * time.Minute)
+				return s
+			},
+			wantStatus: model.DeploymentStatusScheduled,
+			wantImage:  "nginx:1.25.0",
+		},
+		{
+			name: "cancelled",
+			steps: func(t *testing.T, s *EnvironmentService, clock *fakeClock, deployment *model.Deployment) *EnvironmentService {
+				if _, err := s.CancelDeployment(context.Background(), "2", deployment.ID, "bob"); err != nil {
+					t.Fatal(err)
+				}
+				clock.now = start.Add(2 * time.Hour)
+				return s
+			},
+			wantStatus: model.DeploymentStatusCancelled,
+			wantImage:  "nginx:1.25.0",
+		},
+		{
+			name: "rescheduled later",
+			steps: func(t *testing.T, s *EnvironmentService, clock *fakeClock, deployment *model.Deployment) *EnvironmentService {
+				if _, err := s.RescheduleDeployment(context.Background(), "2", deployment.ID, start.Add(3*time.Hour)); err != nil {
+					t.Fatal(err)
+				}
+				clock.now = start.Add(2 * time.Hour)
+				return s
+			},
+			wantStatus: model.DeploymentStatusScheduled,
+			wantImage:  "nginx:1.25.0",
+		},
+		{
+			name: "rescheduled earlier",
+			steps: func(t *testing.T, s *EnvironmentService, clock *fakeClock, deployment *model.Deployment) *EnvironmentService {
+				if _, err := s.RescheduleDeployment(context.Background(), "2", deployment.ID, start.Add(10*time.Minute)); err != nil {
+					t.Fatal(err)
+				}
+				clock.now = start.Add(15 * time.Minute)
+				return s
+			},
+			wantStatus: model.DeploymentStatusSuccess,
+			wantImage:  "nginx:2.0.0",
+		},
+		{
+			name: "runs after a restart",
+			steps: func(t *testing.T, s *EnvironmentService, clock *fakeClock, deployment *model.Deployment) *EnvironmentService {
+				restarted, err := NewEnvironmentService(s.gitService, s.options)
+				if err != nil {
+					t.Fatal(err)
+				}
+				clock.now = start.Add(2 * time.Hour)
+				return restarted
+			},
+			wantStatus: model.DeploymentStatusSuccess,
+			wantImage:  "nginx:2.0.0",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			clock := &fakeClock{now: start}
+			gitService := NewGitService(nil)
+			s, err := NewEnvironmentService(gitService, EnvironmentOptions{DataDir: t.TempDir(), CommitMessage: "Deploy %s", Clock: clock})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			deployment, err := s.DeployToEnvironment(ctx, "2", "2.0.0", "alice", start.Add(time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s.RunDueDeployments(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if stored, _ := s.deployments.Get(deployment.ID); stored.Status != model.DeploymentStatusScheduled {
+				t.Fatalf("deployment ran early: %s", stored.Status)
+			}
+
+			s = tt.steps(t, s, clock, deployment)
+			if err := s.RunDueDeployments(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			stored, _ := s.deployments.Get(deployment.ID)
+			if stored.Status != tt.wantStatus {
+				t.Fatalf("deployment is %s (%s), want %s", stored.Status, stored.Message, tt.wantStatus)
+			}
+			if image := deployedImage(t, s, gitService, "2"); image != tt.wantImage {
+				t.Fatalf("values file has %s, want %s", image, tt.wantImage)
+			}
+		})
+	}
+}
+
+func TestRunDueDeploymentsKeepsGoing(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC)
+	clock := &fakeClock{now: start}
+	gitService := NewGitService(nil)
+	s, err := NewEnvironmentService(gitService, EnvironmentOptions{CommitMessage: "Deploy %s", Clock: clock})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An environment whose values file cannot be written
+	broken, _ := s.environments.Get("2")
+	broken.ID, broken.Name, broken.ValuesPath = "3", "broken", "my-app/broken/values.yaml"
+	if err := s.environments.Put(broken.ID, broken); err != nil {
+		t.Fatal(err)
+	}
+
+	scheduled := make(map[string]string) // deployment ID by environment ID
+	for _, envID := range []string{"3", "2"} {
+		deployment, err := s.DeployToEnvironment(ctx, envID, "2.0.0", "alice", start.Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		scheduled[envID] = deployment.ID
+	}
+
+	// A pending deployment whose environment went away cannot run at all
+	orphan := model.Deployment{ID: "orphan", EnvironmentID: "gone", ImageTag: "2.0.0", Status: model.DeploymentStatusPending}
+	if err := s.deployments.Put(orphan.ID, orphan); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.now = start.Add(2 * time.Hour)
+	if err := s.RunDueDeployments(ctx); !errors.Is(err, ErrEnvironmentNotFound) {
+		t.Fatalf("expected the orphan's error, got %v", err)
+	}
+
+	if stored, _ := s.deployments.Get(scheduled["3"]); stored.Status != model.DeploymentStatusFailed {
+		t.Fatalf("broken deployment is %s", stored.Status)
+	}
+	if stored, _ := s.deployments.Get(scheduled["2"]); stored.Status != model.DeploymentStatusSuccess {
+		t.Fatalf("healthy deployment is %s (%s)", stored.Status, stored.Message)
+	}
+	if image := deployedImage(t, s, gitService, "2"); image != "nginx:2.0.0" {
+		t.Fatalf("values file has %s", image)
+	}
+}
+
+// blockingGit holds write-backs until released, as a slow remote would
+type blockingGit struct {
+	GitBackend
+	writing chan struct{}
+	release chan struct{}
+}
+
+func (g *blockingGit) WriteFile(ctx context.Context, repository model.Repository, branch, path, content, message string) error {
+	g.writing <- struct{}{}
+	<-g.release
+	return g.GitBackend.WriteFile(ctx, repository, branch, path, content, message)
+}
+
+func TestWriteBackOutsideLock(t *testing.T) {
+	ctx := context.Background()
+	clock := &fakeClock{now: time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC)}
+	gitService := NewGitService(nil)
+	slow := &blockingGit{GitBackend: gitService.backend, writing: make(chan struct{}), release: make(chan struct{})}
+	gitService.backend = slow
+	s, err := NewEnvironmentService(gitService, EnvironmentOptions{CommitMessage: "Deploy %s", ApprovalTimeout: time.Hour, Clock: clock})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type outcome struct {
+		deployment *model.Deployment
+		err        error
+	}
+	done := make(chan outcome)
+	go func() {
+		deployment, err := s.DeployToEnvironment(ctx, "2", "2.0.0", "alice", time.Time{})
+		done <- outcome{deployment, err}
+	}()
+	<-slow.writing
+
+	// Other work goes on while the push is in flight
+	others := make(chan error)
+	go func() {
+		scheduled, err := s.DeployToEnvironment(ctx, "1", "1.26.0", "bob", clock.now.Add(time.Hour))
+		if err == nil {
+			_, err = s.CancelDeployment(ctx, "1", scheduled.ID, "bob")
+		}
+		if err == nil {
+			err = s.RunDueDeployments(ctx)
+		}
+		others <- err
+	}()
+	select {
+	case err := <-others:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("blocked behind the Git write-back")
+	}
+
+	running, err := s.GetDeployments(ctx, "2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if running[0].Status != model.DeploymentStatusRunning {
+		t.Fatalf("deployment is %s while writing, want running", running[0].Status)
+	}
+
+	close(slow.release)
+	result := <-done
+	if result.err != nil {
+		t.Fatal(result.err)
+	}
+	if result.deployment.Status != model.DeploymentStatusSuccess {
+		t.Fatalf("deployment is %s (%s)", result.deployment.Status, result.deployment.Message)
+	}
+	if env, _ := s.environments.Get("2"); env.CurrentImage != "nginx:2.0.0" {
+		t.Fatalf("current image is %s", env.CurrentImage)
+	}
+}
+
+func TestInterruptedWriteBackFails(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewEnvironmentService(NewGitService(nil), EnvironmentOptions{DataDir: dir, CommitMessage: "Deploy %s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	interrupted := model.Deployment{ID: "interrupted", EnvironmentID: "2", ImageTag: "2.0.0", Status: model.DeploymentStatusRunning}
+	if err := s.deployments.Put(interrupted.ID, interrupted); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted, err := NewEnvironmentService(s.gitService, s.options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ := restarted.deployments.Get(interrupted.ID); stored.Status != model.DeploymentStatusFailed {
+		t.Fatalf("interrupted deployment is %s, want failed", stored.Status)
+	}
+}
@@ -0,0 +1,19 @@
+package service
+
+import "errors"
+
+// Errors returned by the services so handlers can map them to HTTP statuses
+var (
+	ErrImageNotFound       = errors.New("image not found")
+	ErrEnvironmentNotFound = errors.New("environment not found")
+	ErrDeploymentNotFound  = errors.New("deployment not found")
+	ErrDeliveryNotFound    = errors.New("webhook delivery not found")
+	ErrCandidateNotFound   = errors.New("candidate image not found")
+	ErrReportNotFound      = errors.New("vulnerability report not found")
+	ErrRepositoryNotFound  = errors.New("repository not found")
+	ErrFileNotFound        = errors.New("file not found")
+	ErrForbidden           = errors.New("forbidden")
+	ErrInvalidState        = errors.New("invalid state")
+	ErrInvalidArgument     = errors.New("invalid argument")
+	ErrPolicyViolation     = errors.New("deployment blocked by policy")
+)
@@ -2,94 +2,222 @@ package service
 
 import (
 	"context"
+	"crypto/sha1"
+	"encoding/hex"
 	"errors"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/jpfaria/image-updater/internal/git"
 	"github.com/jpfaria/image-updater/internal/model"
+	"github.com/jpfaria/image-updater/internal/store"
 	"github.com/xgodev/boost/wrapper/log"
 )
 
+// GitBackend reads and writes the files of Git repositories
+type GitBackend interface {
+	ListFiles(ctx context.Context, repository model.Repository) ([]model.File, error)
+	ReadFile(ctx context.Context, repository model.Repository, path string) (*model.File, error)
+	// WriteFile commits a file to a branch, the tracked branch when empty
+	WriteFile(ctx context.Context, repository model.Repository, branch, path, content, message string) error
+}
+
 // GitService handles Git repository operations
 type GitService struct {
-	// Add dependencies here
+	repositories *store.Collection[model.Repository]
+	backend      GitBackend
 }
 
-// NewGitService creates a new Git service
-func NewGitService() *GitService {
-	return &GitService{}
+// NewGitService creates a new Git service reading and writing files through
+// backend. A nil backend keeps files in memory, seeded with the my-app
+// repositories.
+func NewGitService(backend GitBackend) *GitService {
+	repositories, _ := store.NewCollection[model.Repository]("", "repositories")
+
+	s := &GitService{
+		repositories: repositories,
+		backend:      backend,
+	}
+	if backend == nil {
+		memory := &memoryGit{files: make(map[string]model.File)}
+		s.backend = memory
+		s.seed(memory)
+	}
+
+	return s
 }
 
 // ListRepositories lists all Git repositories
 func (s *GitService) ListRepositories(ctx context.Context) ([]model.Repository, error) {
 	log.Info("Listing Git repositories")
-	
-	// Mock implementation for now
-	repositories := []model.Repository{
-		{
-			ID:       "1",
-			Name:     "team-a-manifests",
-			URL:      "https://github.com/org/team-a-manifests.git",
-			Branch:   "main",
-			TeamName: "Team A",
-		},
-		{
-			ID:       "2",
-			Name:     "team-b-manifests",
-			URL:      "https://github.com/org/team-b-manifests.git",
-			Branch:   "main",
-			TeamName: "Team B",
-		},
+
+	return s.repositories.List(), nil
+}
+
+// GetRepository gets a Git repository by ID
+func (s *GitService) GetRepository(ctx context.Context, id string) (*model.Repository, error) {
+	repository, ok := s.repositories.Get(id)
+	if !ok {
+		return nil, ErrRepositoryNotFound
 	}
-	
-	return repositories, nil
+
+	return &repository, nil
+}
+
+// SyncRepositories replaces the repositories with the declared ones.
+// Applying the same declarations again changes nothing.
+func (s *GitService) SyncRepositories(ctx context.Context, repositories []model.Repository) error {
+	return syncCollection(s.repositories, repositories, func(r model.Repository) string { return r.ID }, nil)
 }
 
 // ListFiles lists files in a Git repository
 func (s *GitService) ListFiles(ctx context.Context, id string) ([]model.File, error) {
 	log.Infof("Listing files in Git repository with ID: %s", id)
-	
-	// Mock implementation for now
-	if id == "1" || id == "2" {
-		return []model.File{
-			{
-				Path:       "my-app/production/values.yaml",
-				Type:       "file",
-				LastCommit: "abc123",
-				LastUpdate: time.Now().AddDate(0, 0, -2).Format(time.RFC3339),
-			},
-			{
-				Path:       "my-app/staging/values.yaml",
-				Type:       "file",
-				LastCommit: "def456",
-				LastUpdate: time.Now().AddDate(0, 0, -1).Format(time.RFC3339),
-			},
-			{
-				Path:       "another-app",
-				Type:       "directory",
-				LastCommit: "ghi789",
-				LastUpdate: time.Now().Format(time.RFC3339),
-			},
-		}, nil
+
+	repository, err := s.GetRepository(ctx, id)
+	if err != nil {
+		return nil, err
 	}
-	
-	return nil, errors.New("repository not found")
+
+	return s.backend.ListFiles(ctx, *repository)
 }
 
-// GetFile gets a file from a Git repository
+// GetFile gets a file from the tracked branch of a Git repository
 func (s *GitService) GetFile(ctx context.Context, id, path string) (*model.File, error) {
 	log.Infof("Getting file %s from Git repository with ID: %s", path, id)
-	
-	// Mock implementation for now
-	if (id == "1" || id == "2") && path == "my-app/production/values.yaml" {
-		return &model.File{
-			Path:       path,
+
+	repository, err := s.GetRepository(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := s.backend.ReadFile(ctx, *repository, path)
+	if errors.Is(err, git.ErrFileNotFound) {
+		return nil, ErrFileNotFound
+	}
+	return file, err
+}
+
+// UpdateFile updates a file in a Git repository, on the given branch or on
+// the tracked branch when branch is empty
+func (s *GitService) UpdateFile(ctx context.Context, id, branch, path, content, commitMessage string) error {
+	log.Infof("Updating file %s in Git repository with ID: %s", path, id)
+
+	repository, err := s.GetRepository(ctx, id)
+	if err != nil {
+		return err
+	}
+	if path == "" {
+		return errors.New("invalid path")
+	}
+
+	return s.backend.WriteFile(ctx, *repository, branch, path, content, commitMessage)
+}
+
+// memoryGit keeps files in memory, keyed by repository ID, branch and path
+type memoryGit struct {
+	mu    sync.RWMutex
+	files map[string]model.File
+}
+
+func (m *memoryGit) ListFiles(ctx context.Context, repository model.Repository) ([]model.File, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	files := make([]model.File, 0)
+	for key, file := range m.files {
+		if strings.HasPrefix(key, repository.ID+"/") {
+			files = append(files, file)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+
+	return files, nil
+}
+
+func (m *memoryGit) ReadFile(ctx context.Context, repository model.Repository, path string) (*model.File, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	file, ok := m.files[repository.ID+"/"+path]
+	if !ok {
+		return nil, ErrFileNotFound
+	}
+
+	return &file, nil
+}
+
+func (m *memoryGit) WriteFile(ctx context.Context, repository model.Repository, branch, path, content, message string) error {
+	// Files of other branches are kept apart from the tracked branch
+	key := repository.ID + "/" + path
+	if branch != "" && branch != repository.Branch {
+		key = repository.ID + "@" + branch + "/" + path
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	commit := sha1.Sum([]byte(message + now.String()))
+	m.files[key] = model.File{
+		Path:       path,
+		Type:       "file",
+		LastCommit: hex.EncodeToString(commit[:]),
+		LastAuthor: "Image Updater",
+		LastUpdate: now.Format(time.RFC3339),
+		Content:    content,
+	}
+
+	return nil
+}
+
+// seed loads the built-in repositories and fills them with the values
+// files of my-app
+func (s *GitService) seed(memory *memoryGit) {
+	// Mock data for now
+	s.repositories.Put("1", model.Repository{
+		ID:       "1",
+		Name:     "team-a-manifests",
+		URL:      "https://github.com/org/team-a-manifests.git",
+		Branch:   "main",
+		TeamName: "Team A",
+	})
+	s.repositories.Put("2", model.Repository{
+		ID:       "2",
+		Name:     "team-b-manifests",
+		URL:      "https://github.com/org/team-b-manifests.git",
+		Branch:   "main",
+		TeamName: "Team B",
+	})
+
+	for _, id := range []string{"1", "2"} {
+		memory.files[id+"/my-app/production/values.yaml"] = model.File{
+			Path:       "my-app/production/values.yaml",
 			Type:       "file",
 			LastCommit: "abc123",
+			LastAuthor: "admin",
 			LastUpdate: time.Now().AddDate(0, 0, -2).Format(time.RFC3339),
-			Content: `# Values for my-app
+			Content:    mockValues("1.24.0"),
+		}
+		memory.files[id+"/my-app/staging/values.yaml"] = model.File{
+			Path:       "my-app/staging/values.yaml",
+			Type:       "file",
+			LastCommit: "def456",
+			LastAuthor: "admin",
+			LastUpdate: time.Now().AddDate(0, 0, -1).Format(time.RFC3339),
+			Content:    mockValues("1.25.0"),
+		}
+	}
+}
+
+// mockValues renders the mock values file of my-app
+func mockValues(tag string) string {
+	return `# Values for my-app
 image:
   repository: nginx
-  tag: 1.24.0
+  tag: ` + tag + `
   pullPolicy: IfNotPresent
 
 replicaCount: 2
@@ -100,27 +228,5 @@ resources:
     memory: 128Mi
   requests:
     cpu: 50m
-    memory: 64Mi`,
-		}, nil
-	}
-	
-	return nil, errors.New("file not found")
-}
-
-// UpdateFile updates a file in a Git repository
-func (s *GitService) UpdateFile(ctx context.Context, id, path, content, commitMessage string) error {
-	log.Infof("Updating file %s in Git repository with ID: %s", path, id)
-	
-	// Mock implementation for now
-	if (id != "1" && id != "2") || path == "" {
-		return errors.New("invalid repository or path")
-	}
-	
-	// In a real implementation, this would:
-	// 1. Clone the repository
-	// 2. Update the file
-	// 3. Commit the changes
-	// 4. Push to the remote repository
-	
-	return nil
+    memory: 64Mi`
 }
@@ -0,0 +1,65 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/jpfaria/image-updater/internal/audit"
+	"github.com/xgodev/boost/wrapper/log"
+)
+
+// Reconciler periodically compares every environment's values file in Git
+// with the image the service believes is deployed
+type Reconciler struct {
+	environmentService *EnvironmentService
+	interval           time.Duration
+	adopt              bool
+}
+
+// NewReconciler creates a new drift reconciler.
+// When adopt is set, drifted environments take the Git value as the truth.
+func NewReconciler(environmentService *EnvironmentService, interval time.Duration, adopt bool) *Reconciler {
+	return &Reconciler{
+		environmentService: environmentService,
+		interval:           interval,
+		adopt:              adopt,
+	}
+}
+
+// Start runs the reconciler in the background until ctx is cancelled
+func (r *Reconciler) Start(ctx context.Context) {
+	log.Infof("Starting drift reconciler (interval: %s, adopt: %t)", r.interval, r.adopt)
+
+	// Changes made in the background are audited under the job's name
+	ctx = audit.WithActor(ctx, "system:reconciler", "", "")
+
+	go func() {
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+
+		for {
+			r.Reconcile(ctx)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Reconcile checks every environment for drift once
+func (r *Reconciler) Reconcile(ctx context.Context) {
+	environments, err := r.environmentService.ListEnvironments(ctx)
+	if err != nil {
+		log.Errorf("Failed to list environments for drift detection: %v", err)
+		return
+	}
+
+	for _, env := range environments {
+		if _, err := r.environmentService.DetectDrift(ctx, env.ID, r.adopt); err != nil {
+			log.Errorf("Failed to check drift for environment %s: %v", env.Name, err)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/jpfaria/image-updater/internal/audit"
+	"github.com/xgodev/boost/wrapper/log"
+)
+
+// Scheduler periodically runs scheduled deployments that are due.
+// Scheduled deployments live in the deployment store, so anything that
+// became due while the service was down runs on the first tick.
+type Scheduler struct {
+	environmentService *EnvironmentService
+	interval           time.Duration
+}
+
+// NewScheduler creates a new deployment scheduler
+func NewScheduler(environmentService *EnvironmentService, interval time.Duration) *Scheduler {
+	return &Scheduler{
+		environmentService: environmentService,
+		interval:           interval,
+	}
+}
+
+// Start runs the scheduler in the background until ctx is cancelled
+func (s *Scheduler) Start(ctx context.Context) {
+	log.Infof("Starting deployment scheduler (interval: %s)", s.interval)
+
+	// Changes made in the background are audited under the job's name
+	ctx = audit.WithActor(ctx, "system:scheduler", "", "")
+
+	go func() {
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+
+		for {
+			s.tick(ctx)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// tick runs the deployments that are due
+func (s *Scheduler) tick(ctx context.Context) {
+	if err := s.environmentService.RunDueDeployments(ctx); err != nil {
+		log.Errorf("Failed to run scheduled deployments: %v", err)
+	}
+}
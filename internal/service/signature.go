@@ -0,0 +1,188 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jpfaria/image-updater/internal/clock"
+	"github.com/jpfaria/image-updater/internal/docker"
+	"github.com/jpfaria/image-updater/internal/model"
+	"github.com/jpfaria/image-updater/internal/store"
+	"github.com/xgodev/boost/wrapper/log"
+)
+
+// unsignedRecheck is how long a digest found unsigned, or signed with
+// untrusted keys, is not checked again; its signature may be pushed after
+// the image. Verified signatures are kept as long as the keys do not change.
+const unsignedRecheck = 5 * time.Minute
+
+// SignatureOptions holds the settings of the signature service
+type SignatureOptions struct {
+	DataDir string             // empty keeps results in memory
+	Keys    []docker.PublicKey // keys trusted to sign images
+	Clock   clock.Clock        // defaults to the system clock
+}
+
+// SignatureService verifies the cosign signatures of image tags and gates
+// the deployments of environments requiring signed images
+type SignatureService struct {
+	dockerService *DockerService
+	registries    *docker.Pool
+	// results are keyed by repository and digest, as signatures are stored
+	// in the repository of the image
+	results *store.Collection[signatureRecord]
+	// keyring identifies the trusted keys; results obtained with other keys
+	// are not used
+	keyring string
+	options SignatureOptions
+}
+
+// signatureRecord is a verification result and the keys it was made with
+type signatureRecord struct {
+	Signature model.Signature `json:"signature"`
+	Keyring   string          `json:"keyring"`
+}
+
+// NewSignatureService creates a new signature service
+func NewSignatureService(dockerService *DockerService, registries *docker.Pool, options SignatureOptions) (*SignatureService, error) {
+	if options.Clock == nil {
+		options.Clock = clock.Real()
+	}
+
+	results, err := store.NewCollection[signatureRecord](options.DataDir, "signatures")
+	if err != nil {
+		return nil, err
+	}
+
+	fingerprints := make([]string, 0, len(options.Keys))
+	for _, key := range options.Keys {
+		fingerprints = append(fingerprints, key.Fingerprint)
+	}
+	sum := sha256.Sum256([]byte(strings.Join(fingerprints, ",")))
+
+	return &SignatureService{
+		dockerService: dockerService,
+		registries:    registries,
+		results:       results,
+		keyring:       hex.EncodeToString(sum[:8]),
+		options:       options,
+	}, nil
+}
+
+// VerifyTag verifies the signature of the digest a tag points to. A tag
+// given as a digest, sha256:..., is verified as is.
+func (s *SignatureService) VerifyTag(ctx context.Context, imageID, tag string) (*model.Signature, error) {
+	log.Infof("Verifying the signature of %s for Docker image with ID: %s", tag, imageID)
+
+	if len(s.options.Keys) == 0 {
+		return nil, fmt.Errorf("%w: no public keys are configured to verify signatures", ErrInvalidState)
+	}
+
+	image, err := s.dockerService.GetImage(ctx, imageID)
+	if err != nil {
+		return nil, err
+	}
+	client, err := s.registries.Client(image.Registry)
+	if err != nil {
+		return nil, err
+	}
+
+	digest := tag
+	if !strings.HasPrefix(tag, "sha256:") {
+		if digest, err = client.GetImageDigest(ctx, image.Namespace, image.Name, tag); err != nil {
+			return nil, err
+		}
+		if err := s.dockerService.setDigest(image.ID, tag, digest); err != nil {
+			return nil, err
+		}
+	}
+
+	key := imageRepository(*image) + "@" + digest
+	if record, ok := s.results.Get(key); ok && s.fresh(record) {
+		return &record.Signature, nil
+	}
+
+	result, err := client.VerifySignature(ctx, image.Namespace, image.Name, digest, s.options.Keys)
+	if err != nil {
+		return nil, err
+	}
+
+	signature := model.Signature{
+		Digest:    digest,
+		Status:    model.SignatureStatusVerified,
+		Key:       result.Key,
+		Message:   result.Reason,
+		CheckedAt: s.options.Clock.Now().Format(time.RFC3339),
+	}
+	switch {
+	case result.Verified:
+	case result.Signatures == 0:
+		signature.Status = model.SignatureStatusUnsigned
+	default:
+		signature.Status = model.SignatureStatusInvalid
+	}
+
+	if err := s.results.Put(key, signatureRecord{Signature: signature, Keyring: s.keyring}); err != nil {
+		return nil, err
+	}
+
+	return &signature, nil
+}
+
+// AnnotateTags sets the known signature status of the tags of an image,
+// without asking the registry
+func (s *SignatureService) AnnotateTags(image *model.Image, tags []model.Tag) {
+	for i, tag := range tags {
+		if tag.Digest == "" {
+			continue
+		}
+		if record, ok := s.results.Get(imageRepository(*image) + "@" + tag.Digest); ok && record.Keyring == s.keyring {
+			signature := record.Signature
+			tags[i].Signature = &signature
+		}
+	}
+}
+
+// Check blocks the deployment of tags without a verified signature to
+// environments requiring one, and returns the digest it verified
+func (s *SignatureService) Check(ctx context.Context, env *model.Environment, imageTag string) (GateResult, error) {
+	if !env.RequireSignature {
+		return GateResult{}, nil
+	}
+
+	if env.ImageID == "" {
+		return GateResult{}, fmt.Errorf("%w: environment %s requires signed images but tracks no image", ErrPolicyViolation, env.Name)
+	}
+	if len(s.options.Keys) == 0 {
+		return GateResult{}, fmt.Errorf("%w: environment %s requires signed images but no public keys are configured", ErrPolicyViolation, env.Name)
+	}
+
+	signature, err := s.VerifyTag(ctx, env.ImageID, imageTag)
+	if err != nil {
+		return GateResult{}, fmt.Errorf("failed to verify the signature of %s: %w", imageTag, err)
+	}
+	if signature.Status != model.SignatureStatusVerified {
+		return GateResult{}, fmt.Errorf("%w: environment %s requires signed images, but tag %s (%s) is %s: %s",
+			ErrPolicyViolation, env.Name, imageTag, signature.Digest, signature.Status, signature.Message)
+	}
+
+	log.Infof("Signature of %s (%s) verified with key %s", imageTag, signature.Digest, signature.Key)
+	return GateResult{Digest: signature.Digest}, nil
+}
+
+// fresh reports whether a stored result can be used
+func (s *SignatureService) fresh(record signatureRecord) bool {
+	if record.Keyring != s.keyring {
+		return false
+	}
+	if record.Signature.Status == model.SignatureStatusVerified {
+		return true
+	}
+
+	checkedAt, err := time.Parse(time.RFC3339, record.Signature.CheckedAt)
+	return err == nil && s.options.Clock.Now().Sub(checkedAt) < unsignedRecheck
+}
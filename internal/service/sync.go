@@ -0,0 +1,22 @@
+package service
+
+import "github.com/jpfaria/image-updater/internal/store"
+
+// syncCollection makes a collection hold exactly the declared items, in a
+// single change: items no longer declared are deleted and the others are
+// put. merge copies the state the service keeps on an item, such as the
+// latest tag of an image, from the stored item to the declared one; nil
+// keeps none.
+func syncCollection[T any](c *store.Collection[T], declared []T, id func(T) string, merge func(existing T, declared *T)) error {
+	return c.Replace(func(current map[string]T) map[string]T {
+		items := make(map[string]T, len(declared))
+		for _, item := range declared {
+			key := id(item)
+			if existing, ok := current[key]; ok && merge != nil {
+				merge(existing, &item)
+			}
+			items[key] = item
+		}
+		return items
+	})
+}
@@ -0,0 +1,130 @@
+package service
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/jpfaria/image-updater/internal/model"
+)
+
+// artifactTag matches the tags cosign stores signatures, attestations and
+// SBOMs under, sha256-<hex>.sig and the like, which are never images to
+// deploy
+var artifactTag = regexp.MustCompile(`^sha256-[a-f0-9]{64}(\.[a-z]+)?$`)
+
+// advancesLatest reports whether a pushed tag becomes the latest tag of an
+// image under its update strategy. Tags not matching the tag pattern never
+// do; the semver strategy only follows higher versions, the digest strategy
+// stays on its tag and the latest strategy follows every push.
+func advancesLatest(image model.Image, tag string) bool {
+	if tag == "" || tag == image.LatestTag || artifactTag.MatchString(tag) {
+		return false
+	}
+	if image.TagPattern != "" {
+		pattern, err := regexp.Compile(image.TagPattern)
+		if err != nil || !pattern.MatchString(tag) {
+			return false
+		}
+	}
+
+	switch image.UpdateStrategy {
+	case model.UpdateStrategyLatest:
+		return true
+	case model.UpdateStrategyDigest:
+		return image.LatestTag == ""
+	}
+
+	// Semver, the default strategy
+	pushed, ok := parseSemver(tag)
+	if !ok {
+		return false
+	}
+	current, ok := parseSemver(image.LatestTag)
+	return !ok || pushed.compare(current) > 0
+}
+
+// semver is a semantic version, MAJOR.MINOR.PATCH-PRERELEASE
+type semver struct {
+	numbers    [3]int
+	prerelease []string
+}
+
+// parseSemver parses a tag such as v1.2.3, 1.2 or 1.2.3-rc.1; build
+// metadata is ignored
+func parseSemver(tag string) (semver, bool) {
+	version, _, _ := strings.Cut(strings.TrimPrefix(tag, "v"), "+")
+	version, prerelease, hasPrerelease := strings.Cut(version, "-")
+
+	parts := strings.Split(version, ".")
+	if len(parts) > 3 {
+		return semver{}, false
+	}
+
+	var v semver
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 || (len(part) > 1 && part[0] == '0') {
+			return semver{}, false
+		}
+		v.numbers[i] = n
+	}
+	if hasPrerelease {
+		if prerelease == "" {
+			return semver{}, false
+		}
+		v.prerelease = strings.Split(prerelease, ".")
+	}
+
+	return v, true
+}
+
+// compare returns -1, 0 or 1 as v is lower than, equal to or higher than o
+func (v semver) compare(o semver) int {
+	for i := range v.numbers {
+		if v.numbers[i] != o.numbers[i] {
+			return sign(v.numbers[i] - o.numbers[i])
+		}
+	}
+
+	// A release is higher than its prereleases
+	switch {
+	case len(v.prerelease) == 0 && len(o.prerelease) == 0:
+		return 0
+	case len(v.prerelease) == 0:
+		return 1
+	case len(o.prerelease) == 0:
+		return -1
+	}
+
+	for i := 0; i < len(v.prerelease) && i < len(o.prerelease); i++ {
+		a, b := v.prerelease[i], o.prerelease[i]
+		if a == b {
+			continue
+		}
+		an, aErr := strconv.Atoi(a)
+		bn, bErr := strconv.Atoi(b)
+		switch {
+		case aErr == nil && bErr == nil:
+			return sign(an - bn)
+		case aErr == nil:
+			return -1 // numeric identifiers are lower than alphanumeric ones
+		case bErr == nil:
+			return 1
+		}
+		return strings.Compare(a, b)
+	}
+
+	return sign(len(v.prerelease) - len(o.prerelease))
+}
+
+// sign returns the sign of n
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,44 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/jpfaria/image-updater/internal/model"
+)
+
+func TestAdvancesLatest(t *testing.T) {
+	signature := "sha256-" + "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef" + ".sig"
+
+	tests := []struct {
+		name  string
+		image model.Image
+		tag   string
+		want  bool
+	}{
+		{"semver higher", model.Image{LatestTag: "1.2.3"}, "1.3.0", true},
+		{"semver lower", model.Image{LatestTag: "1.2.3"}, "1.2.2", false},
+		{"semver v prefix", model.Image{LatestTag: "v1.2.3"}, "v1.10.0", true},
+		{"semver release over prerelease", model.Image{LatestTag: "2.0.0-rc.1"}, "2.0.0", true},
+		{"semver prerelease under release", model.Image{LatestTag: "2.0.0"}, "2.0.0-rc.2", false},
+		{"semver numeric prerelease", model.Image{LatestTag: "2.0.0-rc.2"}, "2.0.0-rc.10", true},
+		{"semver from no latest", model.Image{}, "1.0.0", true},
+		{"semver over a non-version", model.Image{LatestTag: "main"}, "1.0.0", true},
+		{"semver ignores branches", model.Image{LatestTag: "1.2.3"}, "pr-123", false},
+		{"semver ignores commits", model.Image{LatestTag: "1.2.3"}, "sha-abc1234", false},
+		{"same tag", model.Image{LatestTag: "1.2.3"}, "1.2.3", false},
+		{"cosign signature", model.Image{UpdateStrategy: model.UpdateStrategyLatest}, signature, false},
+		{"latest follows pushes", model.Image{UpdateStrategy: model.UpdateStrategyLatest, LatestTag: "b"}, "a", true},
+		{"latest outside pattern", model.Image{UpdateStrategy: model.UpdateStrategyLatest, TagPattern: `^main-`}, "pr-1", false},
+		{"latest inside pattern", model.Image{UpdateStrategy: model.UpdateStrategyLatest, TagPattern: `^main-`}, "main-abc", true},
+		{"semver outside pattern", model.Image{LatestTag: "1.0.0", TagPattern: `^1\.`}, "2.0.0", false},
+		{"digest keeps its tag", model.Image{UpdateStrategy: model.UpdateStrategyDigest, LatestTag: "stable"}, "edge", false},
+		{"digest takes a first tag", model.Image{UpdateStrategy: model.UpdateStrategyDigest, TagPattern: `^stable$`}, "stable", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := advancesLatest(tt.image, tt.tag); got != tt.want {
+				t.Fatalf("advancesLatest(%+v, %q) = %v, want %v", tt.image, tt.tag, got, tt.want)
+			}
+		})
+	}
+}
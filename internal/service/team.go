@@ -0,0 +1,45 @@
+package service
+
+import (
+	"context"
+
+	"github.com/jpfaria/image-updater/internal/model"
+	"github.com/jpfaria/image-updater/internal/store"
+	"github.com/xgodev/boost/wrapper/log"
+)
+
+// TeamService handles the teams owning repositories and images
+type TeamService struct {
+	teams *store.Collection[model.Team]
+}
+
+// NewTeamService creates a new team service
+func NewTeamService() *TeamService {
+	teams, _ := store.NewCollection[model.Team]("", "teams")
+
+	s := &TeamService{
+		teams: teams,
+	}
+	s.seed()
+
+	return s
+}
+
+// seed loads the built-in teams
+func (s *TeamService) seed() {
+	// Mock data for now
+	s.teams.Put("Team A", model.Team{Name: "Team A"})
+	s.teams.Put("Team B", model.Team{Name: "Team B"})
+}
+
+// ListTeams lists all teams
+func (s *TeamService) ListTeams(ctx context.Context) ([]model.Team, error) {
+	log.Info("Listing teams")
+
+	return s.teams.List(), nil
+}
+
+// SyncTeams replaces the teams with the declared ones
+func (s *TeamService) SyncTeams(ctx context.Context, teams []model.Team) error {
+	return syncCollection(s.teams, teams, func(t model.Team) string { return t.Name }, nil)
+}
@@ -0,0 +1,110 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+)
+
+// defaultKeyPath is where Helm charts conventionally keep the image tag
+const defaultKeyPath = "image.tag"
+
+// setImageTag replaces the tag at a dotted key path of a Helm values file
+func setImageTag(content, keyPath, tag string) (string, error) {
+	path := splitKeyPath(keyPath)
+	lines := strings.Split(content, "\n")
+
+	i, ok := findKey(lines, path)
+	if !ok {
+		return "", fmt.Errorf("image tag %s not found in values file", strings.Join(path, "."))
+	}
+
+	line := lines[i]
+	indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+	lines[i] = indent + path[len(path)-1] + ": " + tag
+
+	return strings.Join(lines, "\n"), nil
+}
+
+// imageFromValues returns the image reference declared by a Helm values
+// file: the tag at the key path and the repository key next to it
+func imageFromValues(content, keyPath string) (string, error) {
+	path := splitKeyPath(keyPath)
+	lines := strings.Split(content, "\n")
+
+	i, ok := findKey(lines, path)
+	if !ok {
+		return "", fmt.Errorf("image tag %s not found in values file", strings.Join(path, "."))
+	}
+	tag := keyValue(lines[i])
+
+	repository := ""
+	repositoryPath := append(append([]string{}, path[:len(path)-1]...), "repository")
+	if j, ok := findKey(lines, repositoryPath); ok {
+		repository = keyValue(lines[j])
+	}
+
+	return withTag(repository, tag), nil
+}
+
+// splitKeyPath splits a dotted key path, defaulting to image.tag
+func splitKeyPath(keyPath string) []string {
+	if keyPath == "" {
+		keyPath = defaultKeyPath
+	}
+	return strings.Split(keyPath, ".")
+}
+
+// findKey returns the line of a nested mapping key of a YAML document. Only
+// block mappings are understood, which is how values files are written.
+func findKey(lines []string, path []string) (int, bool) {
+	parents := make([]int, 0, len(path)) // indentation of the keys matched so far
+	level := 0                           // indentation of the keys at the current depth, -1 until known
+
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		indent := len(line) - len(strings.TrimLeft(line, " \t"))
+
+		// A line no deeper than the matched parent ends its block, and keys
+		// are unique, so the path does not exist
+		if len(parents) > 0 && indent <= parents[len(parents)-1] {
+			return -1, false
+		}
+		if level < 0 {
+			level = indent
+		}
+		if indent != level {
+			continue
+		}
+
+		key, _, ok := strings.Cut(trimmed, ":")
+		if !ok || unquote(key) != path[len(parents)] {
+			continue
+		}
+		if len(parents) == len(path)-1 {
+			return i, true
+		}
+
+		parents = append(parents, indent)
+		level = -1
+	}
+
+	return -1, false
+}
+
+// keyValue returns the scalar value of a "key: value" line
+func keyValue(line string) string {
+	_, value, _ := strings.Cut(strings.TrimSpace(line), ":")
+	return unquote(value)
+}
+
+// unquote strips surrounding whitespace, quotes and trailing comments from a YAML scalar
+func unquote(value string) string {
+	value = strings.TrimSpace(value)
+	if i := strings.Index(value, " #"); i >= 0 {
+		value = strings.TrimSpace(value[:i])
+	}
+	return strings.Trim(value, `"'`)
+}
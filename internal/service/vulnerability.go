@@ -0,0 +1,371 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jpfaria/image-updater/internal/clock"
+	"github.com/jpfaria/image-updater/internal/docker"
+	"github.com/jpfaria/image-updater/internal/model"
+	"github.com/jpfaria/image-updater/internal/scan"
+	"github.com/jpfaria/image-updater/internal/store"
+	"github.com/xgodev/boost/wrapper/log"
+)
+
+// vulnerabilityPredicateTypes are the in-toto predicates carrying a scan
+// report in scanner.result, as written by cosign attest --type vuln
+var vulnerabilityPredicateTypes = []string{
+	"https://cosign.sigstore.dev/attestation/vuln/v1",
+	"https://in-toto.io/attestation/vulns/v0.1",
+}
+
+// digestPattern matches the image digests reports are keyed by
+var digestPattern = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+
+// policyViolationIDs is how many vulnerability IDs a blocked deployment names
+const policyViolationIDs = 5
+
+// VulnerabilityOptions holds the settings of the vulnerability service
+type VulnerabilityOptions struct {
+	DataDir string // empty keeps reports in memory
+	// Keys are trusted to sign vulnerability attestations; attestations
+	// are read from the registry only when ReadAttestations is set
+	Keys             []docker.PublicKey
+	ReadAttestations bool
+	Clock            clock.Clock // defaults to the system clock
+}
+
+// VulnerabilityService keeps the scan reports of image digests and gates
+// the deployments of environments with a vulnerability policy
+type VulnerabilityService struct {
+	dockerService *DockerService
+	registries    *docker.Pool
+	// reports are keyed by repository and digest, like signatures, and
+	// hold the latest report of each digest
+	reports *store.Collection[model.VulnerabilityReport]
+	options VulnerabilityOptions
+}
+
+// vulnerabilityPredicate is the part of a vulnerability attestation read
+type vulnerabilityPredicate struct {
+	Scanner struct {
+		URI     string          `json:"uri"`
+		Version string          `json:"version"`
+		Result  json.RawMessage `json:"result"`
+	} `json:"scanner"`
+}
+
+// NewVulnerabilityService creates a new vulnerability service
+func NewVulnerabilityService(dockerService *DockerService, registries *docker.Pool, options VulnerabilityOptions) (*VulnerabilityService, error) {
+	if options.Clock == nil {
+		options.Clock = clock.Real()
+	}
+
+	reports, err := store.NewCollection[model.VulnerabilityReport](options.DataDir, "vulnerability_reports")
+	if err != nil {
+		return nil, err
+	}
+
+	return &VulnerabilityService{
+		dockerService: dockerService,
+		registries:    registries,
+		reports:       reports,
+		options:       options,
+	}, nil
+}
+
+// UploadReport stores the scan report of an image digest, replacing the
+// previous upload. Reports read from signed attestations are never replaced
+// by unsigned uploads. The digest is taken from reference, a digest or a tag
+// to resolve, or else from the report; format is detected when empty.
+func (s *VulnerabilityService) UploadReport(ctx context.Context, imageID, reference, format string, body []byte, user string) (*model.VulnerabilityReport, error) {
+	log.Infof("Uploading vulnerability report for Docker image with ID: %s", imageID)
+
+	image, err := s.dockerService.GetImage(ctx, imageID)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, err := scan.Parse(format, body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidArgument, err)
+	}
+
+	digest := ""
+	switch {
+	case reference == "" && len(parsed.Digests) == 0:
+		return nil, fmt.Errorf("%w: the %s report names no image digest, a digest or tag is required", ErrInvalidArgument, parsed.Format)
+	case reference == "":
+		digest = parsed.Digests[0]
+	default:
+		if digest, err = s.resolve(ctx, image, reference); err != nil {
+			return nil, err
+		}
+		if len(parsed.Digests) > 0 && !slices.Contains(parsed.Digests, digest) {
+			return nil, fmt.Errorf("%w: the report is for %s, not %s", ErrInvalidArgument, strings.Join(parsed.Digests, ", "), digest)
+		}
+	}
+	if !digestPattern.MatchString(digest) {
+		return nil, fmt.Errorf("%w: invalid digest %q", ErrInvalidArgument, digest)
+	}
+
+	report := s.newReport(image, digest, parsed)
+	report.Source = model.ReportSourceUpload
+	report.UploadedBy = user
+	_, err = s.reports.Upsert(imageRepository(*image)+"@"+digest, func(stored *model.VulnerabilityReport) error {
+		if stored.Source == model.ReportSourceAttestation {
+			return fmt.Errorf("%w: the report of %s was read from an attestation signed with %s and cannot be replaced by an upload",
+				ErrInvalidState, digest, strings.TrimPrefix(stored.UploadedBy, "key:"))
+		}
+		*stored = report
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("Stored %s report of %s with %d vulnerabilities", report.Format, digest, len(report.Vulnerabilities))
+	return &report, nil
+}
+
+// GetReport returns the report of a digest, or of the digest a tag points
+// to
+func (s *VulnerabilityService) GetReport(ctx context.Context, imageID, reference string) (*model.VulnerabilityReport, error) {
+	image, err := s.dockerService.GetImage(ctx, imageID)
+	if err != nil {
+		return nil, err
+	}
+	digest, err := s.resolve(ctx, image, reference)
+	if err != nil {
+		return nil, err
+	}
+
+	report, ok := s.reports.Get(imageRepository(*image) + "@" + digest)
+	if !ok {
+		return nil, fmt.Errorf("%w: no vulnerability report for %s", ErrReportNotFound, digest)
+	}
+	return &report, nil
+}
+
+// ImportAttestation reads the vulnerability attestation of a tag from the
+// registry and stores its report
+func (s *VulnerabilityService) ImportAttestation(ctx context.Context, imageID, reference string) (*model.VulnerabilityReport, error) {
+	log.Infof("Importing the vulnerability attestation of %s for Docker image with ID: %s", reference, imageID)
+
+	if len(s.options.Keys) == 0 {
+		return nil, fmt.Errorf("%w: no public keys are configured to verify attestations", ErrInvalidState)
+	}
+
+	image, err := s.dockerService.GetImage(ctx, imageID)
+	if err != nil {
+		return nil, err
+	}
+	digest, err := s.resolve(ctx, image, reference)
+	if err != nil {
+		return nil, err
+	}
+
+	report, err := s.importAttestation(ctx, image, digest)
+	if err != nil {
+		return nil, err
+	}
+	if report == nil {
+		return nil, fmt.Errorf("%w: no signed vulnerability attestation for %s", ErrReportNotFound, digest)
+	}
+	return report, nil
+}
+
+// AnnotateTags sets the vulnerability counts of the tags of an image with a
+// report, without asking the registry
+func (s *VulnerabilityService) AnnotateTags(image *model.Image, tags []model.Tag) {
+	for i, tag := range tags {
+		if tag.Digest == "" {
+			continue
+		}
+		if report, ok := s.reports.Get(imageRepository(*image) + "@" + tag.Digest); ok {
+			counts := report.Counts
+			tags[i].Vulnerabilities = &counts
+		}
+	}
+}
+
+// Check blocks the deployment of tags whose report exceeds the
+// vulnerability policy of the environment, and returns the digest it checked
+func (s *VulnerabilityService) Check(ctx context.Context, env *model.Environment, imageTag string) (GateResult, error) {
+	policy := env.VulnerabilityPolicy
+	if policy == nil {
+		return GateResult{}, nil
+	}
+	if env.ImageID == "" {
+		return GateResult{}, fmt.Errorf("%w: environment %s has a vulnerability policy but tracks no image", ErrPolicyViolation, env.Name)
+	}
+
+	image, err := s.dockerService.GetImage(ctx, env.ImageID)
+	if err != nil {
+		return GateResult{}, err
+	}
+	digest, err := s.resolve(ctx, image, imageTag)
+	if err != nil {
+		return GateResult{}, fmt.Errorf("failed to resolve the digest of %s: %w", imageTag, err)
+	}
+
+	report, ok := s.reports.Get(imageRepository(*image) + "@" + digest)
+	if !ok && s.options.ReadAttestations && len(s.options.Keys) > 0 {
+		imported, err := s.importAttestation(ctx, image, digest)
+		if err != nil {
+			return GateResult{}, fmt.Errorf("failed to read the vulnerability attestation of %s: %w", imageTag, err)
+		}
+		if imported != nil {
+			report, ok = *imported, true
+		}
+	}
+	if !ok {
+		if policy.RequireReport {
+			return GateResult{}, fmt.Errorf("%w: environment %s requires a vulnerability report, but none was uploaded for tag %s (%s)",
+				ErrPolicyViolation, env.Name, imageTag, digest)
+		}
+		log.Warnf("No vulnerability report for %s (%s), deploying to %s unchecked", imageTag, digest, env.Name)
+		return GateResult{Digest: digest}, nil
+	}
+
+	if violations := evaluatePolicy(policy, report.Vulnerabilities); len(violations) > 0 {
+		return GateResult{}, fmt.Errorf("%w: environment %s blocks tag %s (%s), whose %s report has %s",
+			ErrPolicyViolation, env.Name, imageTag, digest, report.Format, strings.Join(violations, "; "))
+	}
+
+	log.Infof("Vulnerabilities of %s (%s) are within the policy of %s", imageTag, digest, env.Name)
+	return GateResult{Digest: digest}, nil
+}
+
+// resolve returns the digest of a reference, resolving tags through the
+// registry
+func (s *VulnerabilityService) resolve(ctx context.Context, image *model.Image, reference string) (string, error) {
+	if strings.HasPrefix(reference, "sha256:") {
+		return reference, nil
+	}
+
+	client, err := s.registries.Client(image.Registry)
+	if err != nil {
+		return "", err
+	}
+	digest, err := client.GetImageDigest(ctx, image.Namespace, image.Name, reference)
+	if err != nil {
+		return "", err
+	}
+	if err := s.dockerService.setDigest(image.ID, reference, digest); err != nil {
+		return "", err
+	}
+
+	return digest, nil
+}
+
+// importAttestation stores the report of the first signed vulnerability
+// attestation of a digest; it returns nil when there is none
+func (s *VulnerabilityService) importAttestation(ctx context.Context, image *model.Image, digest string) (*model.VulnerabilityReport, error) {
+	client, err := s.registries.Client(image.Registry)
+	if err != nil {
+		return nil, err
+	}
+	attestations, err := client.Attestations(ctx, image.Namespace, image.Name, digest, s.options.Keys)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, attestation := range attestations {
+		if !slices.Contains(vulnerabilityPredicateTypes, attestation.PredicateType) {
+			continue
+		}
+
+		var predicate vulnerabilityPredicate
+		if err := json.Unmarshal(attestation.Predicate, &predicate); err != nil || len(predicate.Scanner.Result) == 0 {
+			log.Warnf("Skipping vulnerability attestation of %s without a scanner result", digest)
+			continue
+		}
+		parsed, err := scan.Parse("", predicate.Scanner.Result)
+		if err != nil {
+			log.Warnf("Skipping vulnerability attestation of %s: %v", digest, err)
+			continue
+		}
+
+		report := s.newReport(image, digest, parsed)
+		report.Source = model.ReportSourceAttestation
+		report.UploadedBy = "key:" + attestation.Key
+		if predicate.Scanner.URI != "" {
+			report.Scanner = strings.TrimSpace(predicate.Scanner.URI + " " + predicate.Scanner.Version)
+		}
+		if err := s.reports.Put(imageRepository(*image)+"@"+digest, report); err != nil {
+			return nil, err
+		}
+
+		log.Infof("Imported %s report of %s from an attestation signed with %s", report.Format, digest, attestation.Key)
+		return &report, nil
+	}
+
+	return nil, nil
+}
+
+// newReport builds the stored form of a parsed report
+func (s *VulnerabilityService) newReport(image *model.Image, digest string, parsed *scan.Report) model.VulnerabilityReport {
+	return model.VulnerabilityReport{
+		ImageID:         image.ID,
+		Digest:          digest,
+		Format:          parsed.Format,
+		Scanner:         parsed.Scanner,
+		UploadedAt:      s.options.Clock.Now().Format(time.RFC3339),
+		Counts:          scan.Count(parsed.Vulnerabilities),
+		Vulnerabilities: parsed.Vulnerabilities,
+	}
+}
+
+// evaluatePolicy describes how vulnerabilities exceed a policy, e.g.
+// "critical vulnerabilities: 2, at most 0 allowed (CVE-1, CVE-2)"
+func evaluatePolicy(policy *model.VulnerabilityPolicy, vulnerabilities []model.Vulnerability) []string {
+	counted := make([]model.Vulnerability, 0, len(vulnerabilities))
+	for _, v := range vulnerabilities {
+		// Only findings known to have no fix are ignored; those whose fix
+		// state the scanner did not tell are counted
+		unfixed := v.FixState == model.FixStateNotFixed || v.FixState == model.FixStateWontFix
+		if slices.Contains(policy.Allow, v.ID) || (policy.IgnoreUnfixed && unfixed) {
+			continue
+		}
+		counted = append(counted, v)
+	}
+
+	violations := make([]string, 0)
+	for _, severity := range model.Severities {
+		max, ok := policy.Max[severity]
+		if !ok {
+			continue
+		}
+
+		// Unknown severities rank last, so they are only counted on their own
+		ids := make([]string, 0)
+		for _, v := range counted {
+			matches := v.Severity == severity || scan.Rank(v.Severity) < scan.Rank(severity) && severity != model.SeverityUnknown
+			if matches && !slices.Contains(ids, v.ID) {
+				ids = append(ids, v.ID)
+			}
+		}
+		if len(ids) <= max {
+			continue
+		}
+
+		label := severity
+		if severity != model.SeverityCritical && severity != model.SeverityUnknown {
+			label += " or higher"
+		}
+		named := ids
+		if len(named) > policyViolationIDs {
+			named = append(named[:policyViolationIDs:policyViolationIDs], fmt.Sprintf("and %d more", len(ids)-policyViolationIDs))
+		}
+		violations = append(violations, fmt.Sprintf("%s vulnerabilities: %d, at most %d allowed (%s)",
+			label, len(ids), max, strings.Join(named, ", ")))
+	}
+
+	return violations
+}
@@ -0,0 +1,31 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/jpfaria/image-updater/internal/model"
+)
+
+func TestEvaluatePolicyIgnoreUnfixed(t *testing.T) {
+	policy := &model.VulnerabilityPolicy{Max: map[string]int{model.SeverityHigh: 0}, IgnoreUnfixed: true}
+
+	tests := []struct {
+		name     string
+		fixState string
+		blocked  bool
+	}{
+		{"fixed", model.FixStateFixed, true},
+		{"not fixed", model.FixStateNotFixed, false},
+		{"won't fix", model.FixStateWontFix, false},
+		{"unknown", model.FixStateUnknown, true},
+		{"stored before fix states", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vulnerabilities := []model.Vulnerability{{ID: "CVE-1", Severity: model.SeverityHigh, FixState: tt.fixState}}
+			if blocked := len(evaluatePolicy(policy, vulnerabilities)) > 0; blocked != tt.blocked {
+				t.Fatalf("blocked = %v, want %v", blocked, tt.blocked)
+			}
+		})
+	}
+}
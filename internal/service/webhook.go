@@ -0,0 +1,428 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jpfaria/image-updater/internal/audit"
+	"github.com/jpfaria/image-updater/internal/clock"
+	"github.com/jpfaria/image-updater/internal/model"
+	"github.com/jpfaria/image-updater/internal/store"
+	"github.com/xgodev/boost/wrapper/log"
+)
+
+// Pushes already applied are remembered for processedRetention, and at most
+// maxProcessed of them, which is ample for registries retrying a delivery.
+// At most maxDeliveries finished deliveries are kept.
+const (
+	processedRetention = 24 * time.Hour
+	maxProcessed       = 10000
+	maxDeliveries      = 10000
+	pruneInterval      = time.Hour
+)
+
+// WebhookOptions holds the settings of the webhook service
+type WebhookOptions struct {
+	DataDir      string // empty keeps deliveries in memory
+	Workers      int
+	MaxAttempts  int
+	RetryBackoff time.Duration // delay before the first retry, doubled on each attempt
+	Clock        clock.Clock   // defaults to the system clock
+	Audit        *audit.Log    // nil records nothing
+	// DeliveryRetention is how long processed, duplicate and dead-lettered
+	// deliveries are kept, 7 days by default
+	DeliveryRetention time.Duration
+}
+
+// WebhookService persists webhook deliveries and processes them in the
+// background with a pool of workers, so registries get an answer right away
+type WebhookService struct {
+	dockerService *DockerService
+	deliveries    *store.Collection[model.WebhookDelivery]
+	// processed records the pushes already applied, keyed by pushKey
+	processed *store.Collection[processedPush]
+	options   WebhookOptions
+
+	queue chan string
+
+	mu       sync.Mutex
+	inflight map[string]bool
+}
+
+// processedPush records when a push was applied
+type processedPush struct {
+	Key         string `json:"key"`
+	DeliveryID  string `json:"delivery_id"`
+	ProcessedAt string `json:"processed_at"`
+}
+
+// NewWebhookService creates a new webhook service
+func NewWebhookService(dockerService *DockerService, options WebhookOptions) (*WebhookService, error) {
+	if options.Clock == nil {
+		options.Clock = clock.Real()
+	}
+	if options.Workers < 1 {
+		options.Workers = 1
+	}
+	if options.MaxAttempts < 1 {
+		options.MaxAttempts = 1
+	}
+	if options.DeliveryRetention <= 0 {
+		options.DeliveryRetention = 7 * 24 * time.Hour
+	}
+
+	deliveries, err := store.NewCollection[model.WebhookDelivery](options.DataDir, "webhook_deliveries")
+	if err != nil {
+		return nil, err
+	}
+
+	processed, err := store.NewCollection[processedPush](options.DataDir, "webhook_pushes")
+	if err != nil {
+		return nil, err
+	}
+
+	return &WebhookService{
+		dockerService: dockerService,
+		deliveries:    deliveries,
+		processed:     processed,
+		options:       options,
+		queue:         make(chan string, 100),
+		inflight:      make(map[string]bool),
+	}, nil
+}
+
+// Enqueue persists a delivery so it is processed in the background
+func (s *WebhookService) Enqueue(ctx context.Context, source string, events []model.ImagePushedEvent) (*model.WebhookDelivery, error) {
+	now := s.options.Clock.Now()
+	delivery := model.WebhookDelivery{
+		// Prefix with the time so deliveries list in arrival order
+		ID:         now.UTC().Format("20060102150405") + "-" + store.NewID(),
+		Source:     source,
+		ReceivedAt: now.Format(time.RFC3339),
+		Events:     events,
+		Status:     model.DeliveryStatusQueued,
+	}
+
+	if err := s.deliveries.Put(delivery.ID, delivery); err != nil {
+		return nil, err
+	}
+
+	log.Infof("Queued %s webhook delivery %s with %d events", source, delivery.ID, len(events))
+	s.dispatch(delivery.ID)
+
+	return &delivery, nil
+}
+
+// ListDeliveries lists deliveries, newest first, optionally filtered by status
+func (s *WebhookService) ListDeliveries(ctx context.Context, status string) ([]model.WebhookDelivery, error) {
+	log.Info("Listing webhook deliveries")
+
+	deliveries := make([]model.WebhookDelivery, 0)
+	for _, delivery := range s.deliveries.List() {
+		if status == "" || delivery.Status == status {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+
+	sort.SliceStable(deliveries, func(i, j int) bool {
+		return deliveries[i].ID > deliveries[j].ID
+	})
+
+	return deliveries, nil
+}
+
+// GetDelivery gets a delivery by ID
+func (s *WebhookService) GetDelivery(ctx context.Context, id string) (*model.WebhookDelivery, error) {
+	log.Infof("Getting webhook delivery with ID: %s", id)
+
+	delivery, ok := s.deliveries.Get(id)
+	if !ok {
+		return nil, ErrDeliveryNotFound
+	}
+
+	return &delivery, nil
+}
+
+// Redeliver queues a finished delivery again. Its pushes are applied even
+// if they were already processed.
+func (s *WebhookService) Redeliver(ctx context.Context, id string) (*model.WebhookDelivery, error) {
+	log.Infof("Redelivering webhook delivery with ID: %s", id)
+
+	delivery, err := s.deliveries.Update(id, func(d *model.WebhookDelivery) error {
+		if d.Status == model.DeliveryStatusQueued || d.Status == model.DeliveryStatusRetrying {
+			return fmt.Errorf("%w: delivery is %s", ErrInvalidState, d.Status)
+		}
+		d.Status = model.DeliveryStatusQueued
+		d.Attempts = 0
+		d.NextAttemptAt = ""
+		d.LastError = ""
+		d.Redelivered = true
+		return nil
+	})
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, ErrDeliveryNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s.dispatch(delivery.ID)
+
+	return &delivery, nil
+}
+
+// Start runs the workers until ctx is cancelled. Deliveries left queued by
+// a previous run are picked up again, which makes the queue durable.
+func (s *WebhookService) Start(ctx context.Context) {
+	log.Infof("Starting %d webhook workers", s.options.Workers)
+
+	for i := 0; i < s.options.Workers; i++ {
+		go s.work(ctx)
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		var pruned time.Time
+		for {
+			s.sweep()
+			if now := s.options.Clock.Now(); now.Sub(pruned) >= pruneInterval {
+				s.prune(now)
+				pruned = now
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// sweep dispatches the queued deliveries and the retries that are due
+func (s *WebhookService) sweep() {
+	now := s.options.Clock.Now()
+
+	for _, delivery := range s.deliveries.List() {
+		switch delivery.Status {
+		case model.DeliveryStatusQueued:
+			s.dispatch(delivery.ID)
+		case model.DeliveryStatusRetrying:
+			if due(delivery.NextAttemptAt, now) {
+				s.dispatch(delivery.ID)
+			}
+		}
+	}
+}
+
+// prune forgets the pushes processed before the retention window, and the
+// oldest ones beyond maxProcessed, then deletes the old finished deliveries
+func (s *WebhookService) prune(now time.Time) {
+	pushes := s.processed.List()
+	sort.SliceStable(pushes, func(i, j int) bool {
+		return pushes[i].ProcessedAt > pushes[j].ProcessedAt
+	})
+
+	for i, push := range pushes {
+		processedAt, err := time.Parse(time.RFC3339, push.ProcessedAt)
+		if i < maxProcessed && err == nil && now.Sub(processedAt) < processedRetention {
+			continue
+		}
+		if err := s.processed.Delete(push.Key); err != nil && !errors.Is(err, store.ErrNotFound) {
+			log.Errorf("Failed to forget processed push %s: %v", push.Key, err)
+		}
+	}
+
+	if err := s.pruneDeliveries(now); err != nil {
+		log.Errorf("Failed to delete old webhook deliveries: %v", err)
+	}
+}
+
+// pruneDeliveries deletes the finished deliveries older than the delivery
+// retention, and the oldest ones beyond maxDeliveries. Queued and retrying
+// deliveries are always kept.
+func (s *WebhookService) pruneDeliveries(now time.Time) error {
+	return s.deliveries.Replace(func(current map[string]model.WebhookDelivery) map[string]model.WebhookDelivery {
+		finished := make([]model.WebhookDelivery, 0, len(current))
+		for _, delivery := range current {
+			switch delivery.Status {
+			case model.DeliveryStatusProcessed, model.DeliveryStatusDuplicate, model.DeliveryStatusDead:
+				finished = append(finished, delivery)
+			}
+		}
+
+		// IDs start with the time the delivery was received
+		sort.Slice(finished, func(i, j int) bool {
+			return finished[i].ID > finished[j].ID
+		})
+
+		for i, delivery := range finished {
+			if i < maxDeliveries && now.Sub(finishedAt(delivery)) < s.options.DeliveryRetention {
+				continue
+			}
+			delete(current, delivery.ID)
+		}
+
+		return current
+	})
+}
+
+// finishedAt returns when a delivery was last processed, or received when
+// it never was
+func finishedAt(delivery model.WebhookDelivery) time.Time {
+	for _, value := range []string{delivery.ProcessedAt, delivery.ReceivedAt} {
+		if t, err := time.Parse(time.RFC3339, value); err == nil {
+			return t
+		}
+	}
+
+	return time.Time{}
+}
+
+// dispatch hands a delivery to the workers unless it is already being
+// handled; when the queue is full the next sweep picks it up
+func (s *WebhookService) dispatch(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.inflight[id] {
+		return
+	}
+
+	select {
+	case s.queue <- id:
+		s.inflight[id] = true
+	default:
+	}
+}
+
+// work processes deliveries from the queue
+func (s *WebhookService) work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case id := <-s.queue:
+			s.process(ctx, id)
+
+			s.mu.Lock()
+			delete(s.inflight, id)
+			s.mu.Unlock()
+		}
+	}
+}
+
+// process applies the events of a delivery and records the outcome
+func (s *WebhookService) process(ctx context.Context, id string) {
+	delivery, ok := s.deliveries.Get(id)
+	if !ok {
+		return
+	}
+
+	delivery.Attempts++
+	imageIDs, applied, err := s.apply(ctx, delivery)
+	now := s.options.Clock.Now()
+
+	switch {
+	case err == nil && applied == 0 && len(delivery.Events) > 0:
+		delivery.Status = model.DeliveryStatusDuplicate
+		delivery.ProcessedAt = now.Format(time.RFC3339)
+		delivery.NextAttemptAt = ""
+		delivery.LastError = ""
+	case err == nil:
+		delivery.Status = model.DeliveryStatusProcessed
+		delivery.ProcessedAt = now.Format(time.RFC3339)
+		delivery.NextAttemptAt = ""
+		delivery.LastError = ""
+		delivery.ImageIDs = imageIDs
+	case delivery.Attempts >= s.options.MaxAttempts:
+		log.Errorf("Webhook delivery %s failed after %d attempts, moving to dead letters: %v", id, delivery.Attempts, err)
+		delivery.Status = model.DeliveryStatusDead
+		delivery.NextAttemptAt = ""
+		delivery.LastError = err.Error()
+	default:
+		backoff := s.options.RetryBackoff << (delivery.Attempts - 1)
+		log.Warnf("Webhook delivery %s failed (attempt %d), retrying in %s: %v", id, delivery.Attempts, backoff, err)
+		delivery.Status = model.DeliveryStatusRetrying
+		delivery.NextAttemptAt = now.Add(backoff).Format(time.RFC3339)
+		delivery.LastError = err.Error()
+	}
+
+	if err := s.deliveries.Put(delivery.ID, delivery); err != nil {
+		log.Errorf("Failed to save webhook delivery %s: %v", id, err)
+	}
+}
+
+// apply feeds the events of a delivery to the Docker service, skipping pushes
+// already processed unless the delivery was explicitly redelivered. It
+// returns the IDs of the updated images and the number of events applied.
+func (s *WebhookService) apply(ctx context.Context, delivery model.WebhookDelivery) ([]string, int, error) {
+	imageIDs := make([]string, 0)
+	applied := 0
+
+	for _, event := range delivery.Events {
+		key := pushKey(delivery.Source, event)
+		if _, seen := s.processed.Get(key); key != "" && seen && !delivery.Redelivered {
+			log.Infof("Skipping already processed push %s", key)
+			continue
+		}
+
+		before := s.dockerService.findImage(event.Registry, event.Namespace, event.Repository)
+		image, err := s.dockerService.HandleWebhook(ctx, event)
+		if err != nil {
+			return nil, applied, err
+		}
+		if image != nil {
+			event := audit.Event{
+				Action:     "image.push",
+				TargetType: "images",
+				TargetID:   image.ID,
+				Before:     audit.Snapshot(before),
+				After:      audit.Snapshot(image),
+			}
+			if err := s.options.Audit.Record(audit.WithActor(ctx, "webhook:"+delivery.Source, "", ""), event); err != nil {
+				log.Errorf("Failed to record audit event %s: %v", event.Action, err)
+			}
+		}
+		if image != nil && !containsString(imageIDs, image.ID) {
+			imageIDs = append(imageIDs, image.ID)
+		}
+
+		if key != "" {
+			push := processedPush{Key: key, DeliveryID: delivery.ID, ProcessedAt: s.options.Clock.Now().Format(time.RFC3339)}
+			if err := s.processed.Put(key, push); err != nil {
+				return nil, applied, err
+			}
+		}
+		applied++
+	}
+
+	return imageIDs, applied, nil
+}
+
+// pushKey identifies a notification of a push by the delivery ID the
+// registry sent or, without one, the push time, along with the repository,
+// tag and digest. A registry retrying a delivery sends the same key, while
+// pushing a digest again, as a rollback does, comes with a new delivery ID
+// or push time and is applied. Without either the push is always applied
+// and the key is empty.
+func pushKey(source string, event model.ImagePushedEvent) string {
+	reference := fmt.Sprintf("%s/%s/%s:%s", normalizeRegistry(event.Registry), event.Namespace, event.Repository, event.Tag)
+	if event.Digest != "" {
+		reference += "@" + event.Digest
+	}
+
+	switch {
+	case event.DeliveryID != "":
+		return source + "#" + event.DeliveryID + " " + reference
+	case event.PushedAt != "":
+		return source + "@" + event.PushedAt + " " + reference
+	}
+	return ""
+}
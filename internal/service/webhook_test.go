@@ -0,0 +1,174 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jpfaria/image-updater/internal/model"
+)
+
+func TestPushKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		event  model.ImagePushedEvent
+		want   string
+	}{
+		{
+			name:   "digest and delivery ID",
+			source: "harbor",
+			event:  model.ImagePushedEvent{Registry: "docker.io", Namespace: "team", Repository: "app", Tag: "1.0.0", Digest: "sha256:abc", DeliveryID: "d1"},
+			want:   "harbor#d1 docker.io/team/app:1.0.0@sha256:abc",
+		},
+		{
+			name:   "delivery ID without digest",
+			source: "github",
+			event:  model.ImagePushedEvent{Registry: "ghcr.io", Namespace: "team", Repository: "app", Tag: "main", DeliveryID: "d1"},
+			want:   "github#d1 ghcr.io/team/app:main",
+		},
+		{
+			name:   "digest and push time",
+			source: "harbor",
+			event:  model.ImagePushedEvent{Registry: "docker.io", Namespace: "team", Repository: "app", Tag: "1.0.0", Digest: "sha256:abc", PushedAt: "2024-01-02T03:04:05Z"},
+			want:   "harbor@2024-01-02T03:04:05Z docker.io/team/app:1.0.0@sha256:abc",
+		},
+		{
+			name:   "digest alone",
+			source: "generic",
+			event:  model.ImagePushedEvent{Registry: "docker.io", Namespace: "team", Repository: "app", Tag: "1.0.0", Digest: "sha256:abc"},
+			want:   "",
+		},
+		{
+			name:   "neither",
+			source: "dockerhub",
+			event:  model.ImagePushedEvent{Registry: "docker.io", Namespace: "team", Repository: "app", Tag: "latest"},
+			want:   "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pushKey(tt.source, tt.event); got != tt.want {
+				t.Fatalf("pushKey() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// newTestWebhookService creates an in-memory webhook service without
+// workers; tests process deliveries themselves
+func newTestWebhookService(t *testing.T, clock *fakeClock) *WebhookService {
+	t.Helper()
+
+	s, err := NewWebhookService(NewDockerService(nil), WebhookOptions{MaxAttempts: 3, Clock: clock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestWebhookDuplicates(t *testing.T) {
+	ctx := context.Background()
+	clock := &fakeClock{now: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}
+	s := newTestWebhookService(t, clock)
+
+	push := func(digest, deliveryID, pushedAt string) model.ImagePushedEvent {
+		return model.ImagePushedEvent{
+			Registry: "docker.io", Namespace: "library", Repository: "nginx", Tag: "stable",
+			Digest: digest, DeliveryID: deliveryID, PushedAt: pushedAt,
+		}
+	}
+
+	steps := []struct {
+		name   string
+		source string
+		event  model.ImagePushedEvent
+		want   string // status of the delivery
+		digest string // digest of the tag afterwards
+	}{
+		{name: "first push", source: "harbor", event: push("sha256:aaa", "", "2024-01-02T03:00:00Z"), want: model.DeliveryStatusProcessed, digest: "sha256:aaa"},
+		{name: "retried push", source: "harbor", event: push("sha256:aaa", "", "2024-01-02T03:00:00Z"), want: model.DeliveryStatusDuplicate, digest: "sha256:aaa"},
+		{name: "new digest", source: "harbor", event: push("sha256:bbb", "", "2024-01-02T03:10:00Z"), want: model.DeliveryStatusProcessed, digest: "sha256:bbb"},
+		{name: "rollback to the first digest", source: "harbor", event: push("sha256:aaa", "", "2024-01-02T03:20:00Z"), want: model.DeliveryStatusProcessed, digest: "sha256:aaa"},
+		{name: "delivery", source: "github", event: push("sha256:bbb", "d1", "2024-01-02T03:30:00Z"), want: model.DeliveryStatusProcessed, digest: "sha256:bbb"},
+		{name: "redelivered by the registry", source: "github", event: push("sha256:bbb", "d1", "2024-01-02T03:30:00Z"), want: model.DeliveryStatusDuplicate, digest: "sha256:bbb"},
+		{name: "rollback in a new delivery", source: "github", event: push("sha256:aaa", "d2", "2024-01-02T03:30:00Z"), want: model.DeliveryStatusProcessed, digest: "sha256:aaa"},
+		{name: "unidentified push", source: "generic", event: push("sha256:aaa", "", ""), want: model.DeliveryStatusProcessed, digest: "sha256:aaa"},
+	}
+	for _, step := range steps {
+		delivery, err := s.Enqueue(ctx, step.source, []model.ImagePushedEvent{step.event})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.process(ctx, delivery.ID)
+		clock.now = clock.now.Add(time.Minute)
+
+		processed, err := s.GetDelivery(ctx, delivery.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if processed.Status != step.want {
+			t.Fatalf("%s: status %q, want %q", step.name, processed.Status, step.want)
+		}
+		tags, err := s.dockerService.ListTags(ctx, "1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		digest := ""
+		for _, tag := range tags {
+			if tag.Name == "stable" {
+				digest = tag.Digest
+			}
+		}
+		if digest != step.digest {
+			t.Fatalf("%s: tag at %q, want %q", step.name, digest, step.digest)
+		}
+	}
+}
+
+func TestPruneDeliveries(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC)
+	s := newTestWebhookService(t, &fakeClock{now: now})
+
+	deliveries := []struct {
+		status     string
+		receivedAt time.Time
+		processed  time.Duration // after receipt, unprocessed when zero
+		kept       bool
+	}{
+		{status: model.DeliveryStatusProcessed, receivedAt: now.Add(-time.Hour), processed: time.Minute, kept: true},
+		{status: model.DeliveryStatusProcessed, receivedAt: now.Add(-8 * 24 * time.Hour), processed: time.Minute},
+		{status: model.DeliveryStatusDuplicate, receivedAt: now.Add(-8 * 24 * time.Hour), processed: time.Minute},
+		{status: model.DeliveryStatusDead, receivedAt: now.Add(-8 * 24 * time.Hour)},
+		{status: model.DeliveryStatusDead, receivedAt: now.Add(-6 * 24 * time.Hour), kept: true},
+		// Redelivered after most of the retention went by
+		{status: model.DeliveryStatusProcessed, receivedAt: now.Add(-8 * 24 * time.Hour), processed: 2 * 24 * time.Hour, kept: true},
+		{status: model.DeliveryStatusQueued, receivedAt: now.Add(-30 * 24 * time.Hour), kept: true},
+		{status: model.DeliveryStatusRetrying, receivedAt: now.Add(-30 * 24 * time.Hour), kept: true},
+	}
+	for i, d := range deliveries {
+		delivery := model.WebhookDelivery{
+			ID:         fmt.Sprintf("%s-%d", d.receivedAt.Format("20060102150405"), i),
+			Source:     "harbor",
+			ReceivedAt: d.receivedAt.Format(time.RFC3339),
+			Status:     d.status,
+		}
+		if d.processed != 0 {
+			delivery.ProcessedAt = d.receivedAt.Add(d.processed).Format(time.RFC3339)
+		}
+		if err := s.deliveries.Put(delivery.ID, delivery); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s.prune(now)
+
+	for i, d := range deliveries {
+		id := fmt.Sprintf("%s-%d", d.receivedAt.Format("20060102150405"), i)
+		if _, err := s.GetDelivery(ctx, id); (err == nil) != d.kept {
+			t.Fatalf("delivery %d (%s): kept %v, want %v", i, d.status, err == nil, d.kept)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package store
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// ErrNotFound is returned when a record does not exist in a collection
+var ErrNotFound = errors.New("record not found")
+
+// Collection is a thread-safe set of records keyed by ID.
+// When created with a directory, every change is persisted to a JSON file
+// so the records survive restarts.
+type Collection[T any] struct {
+	mu    sync.RWMutex
+	path  string
+	items map[string]T
+}
+
+// NewCollection creates a collection named name stored under dir.
+// An empty dir keeps the collection in memory only.
+func NewCollection[T any](dir, name string) (*Collection[T], error) {
+	c := &Collection[T]{
+		items: make(map[string]T),
+	}
+
+	if dir == "" {
+		return c, nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create storage directory: %w", err)
+	}
+	c.path = filepath.Join(dir, name+".json")
+
+	data, err := os.ReadFile(c.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return c, nil
+		}
+		return nil, fmt.Errorf("failed to read %s: %w", c.path, err)
+	}
+
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &c.items); err != nil {
+			return nil, fmt.Errorf("failed to decode %s: %w", c.path, err)
+		}
+	}
+
+	return c, nil
+}
+
+// Get returns the record with the given ID
+func (c *Collection[T]) Get(id string) (T, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	item, ok := c.items[id]
+	return item, ok
+}
+
+// List returns all records ordered by ID
+func (c *Collection[T]) List() []T {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	ids := make([]string, 0, len(c.items))
+	for id := range c.items {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	items := make([]T, 0, len(ids))
+	for _, id := range ids {
+		items = append(items, c.items[id])
+	}
+
+	return items
+}
+
+// Len returns the number of records
+func (c *Collection[T]) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return len(c.items)
+}
+
+// Put creates or replaces the record with the given ID
+func (c *Collection[T]) Put(id string, item T) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.items[id] = item
+	return c.save()
+}
+
+// Update applies fn to the record with the given ID and stores the result.
+// The record is left untouched when fn returns an error.
+func (c *Collection[T]) Update(id string, fn func(item *T) error) (T, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	item, ok := c.items[id]
+	if !ok {
+		var zero T
+		return zero, ErrNotFound
+	}
+
+	if err := fn(&item); err != nil {
+		return item, err
+	}
+
+	c.items[id] = item
+	return item, c.save()
+}
+
+// Upsert applies fn to the record with the given ID, or to the zero value
+// when there is none, and stores the result. Nothing is stored when fn
+// returns an error.
+func (c *Collection[T]) Upsert(id string, fn func(item *T) error) (T, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	item := c.items[id]
+	if err := fn(&item); err != nil {
+		return item, err
+	}
+
+	c.items[id] = item
+	return item, c.save()
+}
+
+// Replace replaces every record with those fn returns, given a copy of the
+// current ones, and stores them at once. Readers see either the old records
+// or the new ones.
+func (c *Collection[T]) Replace(fn func(current map[string]T) map[string]T) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	previous := c.items
+	c.items = fn(maps.Clone(previous))
+	if err := c.save(); err != nil {
+		c.items = previous
+		return err
+	}
+
+	return nil
+}
+
+// Delete removes the record with the given ID
+func (c *Collection[T]) Delete(id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.items[id]; !ok {
+		return ErrNotFound
+	}
+
+	delete(c.items, id)
+	return c.save()
+}
+
+// save writes the collection to disk; callers must hold the lock
+func (c *Collection[T]) save() error {
+	if c.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(c.items, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %w", c.path, err)
+	}
+
+	// Write to a temporary file first so a crash never leaves a truncated file
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %w", tmp, err)
+	}
+	if err := os.Rename(tmp, c.path); err != nil {
+		return fmt.Errorf("failed to replace %s: %w", c.path, err)
+	}
+
+	return nil
+}
+
+// NewID generates a random identifier for a new record
+func NewID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("failed to generate id: %v", err))
+	}
+	return hex.EncodeToString(b)
+}
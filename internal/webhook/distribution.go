@@ -0,0 +1,107 @@
+package webhook
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jpfaria/image-updater/internal/model"
+)
+
+// distributionEventsMediaType is the content type of CNCF distribution notifications
+const distributionEventsMediaType = "application/vnd.docker.distribution.events.v1+json"
+
+// manifestMediaTypes are the media types of pushed images: single platform
+// manifests and the indexes of multi-platform images
+var manifestMediaTypes = map[string]bool{
+	"application/vnd.oci.image.manifest.v1+json":                true,
+	"application/vnd.oci.image.index.v1+json":                   true,
+	"application/vnd.docker.distribution.manifest.v2+json":      true,
+	"application/vnd.docker.distribution.manifest.list.v2+json": true,
+	"application/vnd.docker.distribution.manifest.v1+json":      true,
+	"application/vnd.docker.distribution.manifest.v1+prettyjws": true,
+}
+
+// distributionAdapter handles notification envelopes sent by CNCF
+// distribution registries. GitLab's container registry is a distribution
+// instance and sends the same envelopes, so it shares this adapter under
+// its own name.
+type distributionAdapter struct {
+	name string
+}
+
+type distributionEnvelope struct {
+	Events []struct {
+		ID        string    `json:"id"`
+		Timestamp time.Time `json:"timestamp"`
+		Action    string    `json:"action"`
+		Target    struct {
+			MediaType  string `json:"mediaType"`
+			Digest     string `json:"digest"`
+			Repository string `json:"repository"`
+			URL        string `json:"url"`
+			Tag        string `json:"tag"`
+		} `json:"target"`
+		Request struct {
+			Host string `json:"host"`
+		} `json:"request"`
+		Actor struct {
+			Name string `json:"name"`
+		} `json:"actor"`
+	} `json:"events"`
+}
+
+func (a *distributionAdapter) Name() string {
+	return a.name
+}
+
+func (a *distributionAdapter) Detect(header http.Header, body []byte) bool {
+	if strings.HasPrefix(header.Get("Content-Type"), distributionEventsMediaType) {
+		return true
+	}
+
+	var envelope distributionEnvelope
+	return json.Unmarshal(body, &envelope) == nil && len(envelope.Events) > 0 && envelope.Events[0].Action != ""
+}
+
+func (a *distributionAdapter) Parse(header http.Header, body []byte) ([]model.ImagePushedEvent, error) {
+	var envelope distributionEnvelope
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return nil, err
+	}
+
+	events := make([]model.ImagePushedEvent, 0, len(envelope.Events))
+	for _, e := range envelope.Events {
+		// Layer uploads and pushes by digest are reported too; only tagged
+		// manifest and index pushes are relevant
+		mediaType, _, _ := strings.Cut(e.Target.MediaType, ";")
+		if e.Action != "push" || e.Target.Tag == "" || !manifestMediaTypes[strings.TrimSpace(mediaType)] {
+			continue
+		}
+
+		registry := e.Request.Host
+		if u, err := url.Parse(e.Target.URL); err == nil && u.Host != "" {
+			registry = u.Host
+		}
+
+		namespace, name := splitRepository(e.Target.Repository)
+		event := model.ImagePushedEvent{
+			Registry:   registry,
+			Namespace:  namespace,
+			Repository: name,
+			Tag:        e.Target.Tag,
+			Digest:     e.Target.Digest,
+			Pusher:     e.Actor.Name,
+			DeliveryID: e.ID,
+		}
+		if !e.Timestamp.IsZero() {
+			event.PushedAt = e.Timestamp.UTC().Format(time.RFC3339)
+		}
+
+		events = append(events, event)
+	}
+
+	return events, nil
+}
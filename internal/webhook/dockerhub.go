@@ -0,0 +1,64 @@
+package webhook
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/jpfaria/image-updater/internal/model"
+)
+
+// dockerHubAdapter handles Docker Hub repository webhooks
+type dockerHubAdapter struct{}
+
+type dockerHubPayload struct {
+	PushData *struct {
+		PushedAt int64  `json:"pushed_at"`
+		Pusher   string `json:"pusher"`
+		Tag      string `json:"tag"`
+	} `json:"push_data"`
+	Repository struct {
+		RepoName  string `json:"repo_name"`
+		Namespace string `json:"namespace"`
+		Name      string `json:"name"`
+	} `json:"repository"`
+}
+
+func (a *dockerHubAdapter) Name() string {
+	return "dockerhub"
+}
+
+func (a *dockerHubAdapter) Detect(header http.Header, body []byte) bool {
+	var payload dockerHubPayload
+	return json.Unmarshal(body, &payload) == nil && payload.PushData != nil && payload.Repository.RepoName != ""
+}
+
+func (a *dockerHubAdapter) Parse(header http.Header, body []byte) ([]model.ImagePushedEvent, error) {
+	var payload dockerHubPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+
+	if payload.PushData == nil || payload.PushData.Tag == "" {
+		return nil, errors.New("push_data.tag is required")
+	}
+
+	namespace, name := payload.Repository.Namespace, payload.Repository.Name
+	if namespace == "" || name == "" {
+		namespace, name = splitRepository(payload.Repository.RepoName)
+	}
+
+	event := model.ImagePushedEvent{
+		Registry:   "docker.io",
+		Namespace:  namespace,
+		Repository: name,
+		Tag:        payload.PushData.Tag,
+		Pusher:     payload.PushData.Pusher,
+	}
+	if payload.PushData.PushedAt > 0 {
+		event.PushedAt = time.Unix(payload.PushData.PushedAt, 0).UTC().Format(time.RFC3339)
+	}
+
+	return []model.ImagePushedEvent{event}, nil
+}
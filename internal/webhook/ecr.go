@@ -0,0 +1,70 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jpfaria/image-updater/internal/model"
+)
+
+// ecrAdapter handles AWS ECR image actions delivered by EventBridge
+type ecrAdapter struct{}
+
+type ecrPayload struct {
+	ID         string    `json:"id"`
+	DetailType string    `json:"detail-type"`
+	Source     string    `json:"source"`
+	Account    string    `json:"account"`
+	Time       time.Time `json:"time"`
+	Region     string    `json:"region"`
+	Detail     struct {
+		Result         string `json:"result"`
+		RepositoryName string `json:"repository-name"`
+		ImageDigest    string `json:"image-digest"`
+		ActionType     string `json:"action-type"`
+		ImageTag       string `json:"image-tag"`
+	} `json:"detail"`
+}
+
+func (a *ecrAdapter) Name() string {
+	return "ecr"
+}
+
+func (a *ecrAdapter) Detect(header http.Header, body []byte) bool {
+	var payload ecrPayload
+	return json.Unmarshal(body, &payload) == nil && payload.Source == "aws.ecr"
+}
+
+func (a *ecrAdapter) Parse(header http.Header, body []byte) ([]model.ImagePushedEvent, error) {
+	var payload ecrPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+
+	detail := payload.Detail
+	if payload.DetailType != "ECR Image Action" || detail.ActionType != "PUSH" || detail.Result != "SUCCESS" || detail.ImageTag == "" {
+		return nil, nil
+	}
+
+	// ECR repository names may contain slashes but have no implicit namespace
+	namespace, name := "", detail.RepositoryName
+	if ns, n := splitRepository(detail.RepositoryName); ns != "library" {
+		namespace, name = ns, n
+	}
+
+	event := model.ImagePushedEvent{
+		Registry:   fmt.Sprintf("%s.dkr.ecr.%s.amazonaws.com", payload.Account, payload.Region),
+		Namespace:  namespace,
+		Repository: name,
+		Tag:        detail.ImageTag,
+		Digest:     detail.ImageDigest,
+		DeliveryID: payload.ID,
+	}
+	if !payload.Time.IsZero() {
+		event.PushedAt = payload.Time.UTC().Format(time.RFC3339)
+	}
+
+	return []model.ImagePushedEvent{event}, nil
+}
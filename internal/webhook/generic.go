@@ -0,0 +1,56 @@
+package webhook
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/jpfaria/image-updater/internal/model"
+)
+
+// genericAdapter accepts the service's own flat payload, for CI pipelines
+// that call the webhook directly
+type genericAdapter struct{}
+
+type genericPayload struct {
+	Registry   string `json:"registry"`
+	Namespace  string `json:"namespace"`
+	Repository string `json:"repository"`
+	Tag        string `json:"tag"`
+	Digest     string `json:"digest"`
+}
+
+func (a *genericAdapter) Name() string {
+	return "generic"
+}
+
+func (a *genericAdapter) Detect(header http.Header, body []byte) bool {
+	var payload genericPayload
+	return json.Unmarshal(body, &payload) == nil && payload.Repository != "" && payload.Tag != ""
+}
+
+func (a *genericAdapter) Parse(header http.Header, body []byte) ([]model.ImagePushedEvent, error) {
+	var payload genericPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+
+	if payload.Repository == "" || payload.Tag == "" {
+		return nil, errors.New("repository and tag are required")
+	}
+
+	namespace, name := payload.Namespace, payload.Repository
+	if namespace == "" {
+		namespace, name = splitRepository(payload.Repository)
+	}
+
+	return []model.ImagePushedEvent{
+		{
+			Registry:   payload.Registry,
+			Namespace:  namespace,
+			Repository: name,
+			Tag:        payload.Tag,
+			Digest:     payload.Digest,
+		},
+	}, nil
+}
@@ -0,0 +1,99 @@
+package webhook
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/jpfaria/image-updater/internal/model"
+)
+
+// githubAdapter handles GitHub package events for GHCR images
+type githubAdapter struct{}
+
+// githubPayload is a package event; registry_package events carry the
+// same package under another key
+type githubPayload struct {
+	Action          string        `json:"action"`
+	Package         githubPackage `json:"package"`
+	RegistryPackage githubPackage `json:"registry_package"`
+	Sender          struct {
+		Login string `json:"login"`
+	} `json:"sender"`
+}
+
+type githubPackage struct {
+	Name        string `json:"name"`
+	Namespace   string `json:"namespace"`
+	PackageType string `json:"package_type"`
+	Owner       struct {
+		Login string `json:"login"`
+	} `json:"owner"`
+	PackageVersion struct {
+		Version           string `json:"version"`
+		ContainerMetadata struct {
+			Tag struct {
+				Name   string `json:"name"`
+				Digest string `json:"digest"`
+			} `json:"tag"`
+		} `json:"container_metadata"`
+		CreatedAt string `json:"created_at"`
+	} `json:"package_version"`
+	Registry struct {
+		URL string `json:"url"`
+	} `json:"registry"`
+}
+
+func (a *githubAdapter) Name() string {
+	return "github"
+}
+
+func (a *githubAdapter) Detect(header http.Header, body []byte) bool {
+	event := header.Get("X-GitHub-Event")
+	return event == "package" || event == "registry_package"
+}
+
+func (a *githubAdapter) Parse(header http.Header, body []byte) ([]model.ImagePushedEvent, error) {
+	var payload githubPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+
+	pkg := payload.Package
+	if header.Get("X-GitHub-Event") == "registry_package" {
+		pkg = payload.RegistryPackage
+	}
+	tag := pkg.PackageVersion.ContainerMetadata.Tag
+	if payload.Action != "published" || !strings.EqualFold(pkg.PackageType, "container") || tag.Name == "" {
+		return nil, nil
+	}
+
+	registry := "ghcr.io"
+	if u, err := url.Parse(pkg.Registry.URL); err == nil && u.Host != "" {
+		registry = u.Host
+	}
+
+	namespace := pkg.Namespace
+	if namespace == "" {
+		namespace = pkg.Owner.Login
+	}
+
+	digest := tag.Digest
+	if digest == "" {
+		digest = pkg.PackageVersion.Version
+	}
+
+	return []model.ImagePushedEvent{
+		{
+			Registry:   registry,
+			Namespace:  strings.ToLower(namespace),
+			Repository: pkg.Name,
+			Tag:        tag.Name,
+			Digest:     digest,
+			Pusher:     payload.Sender.Login,
+			PushedAt:   pkg.PackageVersion.CreatedAt,
+			DeliveryID: header.Get("X-GitHub-Delivery"),
+		},
+	}, nil
+}
@@ -0,0 +1,87 @@
+package webhook
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jpfaria/image-updater/internal/model"
+)
+
+// harborAdapter handles Harbor project webhooks
+type harborAdapter struct{}
+
+type harborPayload struct {
+	Type      string `json:"type"`
+	OccurAt   int64  `json:"occur_at"`
+	Operator  string `json:"operator"`
+	EventData *struct {
+		Resources []struct {
+			Digest      string `json:"digest"`
+			Tag         string `json:"tag"`
+			ResourceURL string `json:"resource_url"`
+		} `json:"resources"`
+		Repository struct {
+			Name         string `json:"name"`
+			Namespace    string `json:"namespace"`
+			RepoFullName string `json:"repo_full_name"`
+		} `json:"repository"`
+	} `json:"event_data"`
+}
+
+func (a *harborAdapter) Name() string {
+	return "harbor"
+}
+
+func (a *harborAdapter) Detect(header http.Header, body []byte) bool {
+	var payload harborPayload
+	return json.Unmarshal(body, &payload) == nil && payload.Type != "" && payload.EventData != nil
+}
+
+func (a *harborAdapter) Parse(header http.Header, body []byte) ([]model.ImagePushedEvent, error) {
+	var payload harborPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+
+	// Harbor 2.x sends PUSH_ARTIFACT, 1.x sent pushImage
+	if payload.EventData == nil || (payload.Type != "PUSH_ARTIFACT" && payload.Type != "pushImage") {
+		return nil, nil
+	}
+
+	namespace, name := payload.EventData.Repository.Namespace, payload.EventData.Repository.Name
+	if namespace == "" || name == "" {
+		namespace, name = splitRepository(payload.EventData.Repository.RepoFullName)
+	}
+
+	pushedAt := ""
+	if payload.OccurAt > 0 {
+		pushedAt = time.Unix(payload.OccurAt, 0).UTC().Format(time.RFC3339)
+	}
+
+	events := make([]model.ImagePushedEvent, 0, len(payload.EventData.Resources))
+	for _, resource := range payload.EventData.Resources {
+		if resource.Tag == "" {
+			continue
+		}
+
+		// resource_url looks like harbor.example.com/library/nginx:v1
+		registry := ""
+		if i := strings.Index(resource.ResourceURL, "/"); i > 0 {
+			registry = resource.ResourceURL[:i]
+		}
+
+		events = append(events, model.ImagePushedEvent{
+			Registry:   registry,
+			Namespace:  namespace,
+			Repository: name,
+			Tag:        resource.Tag,
+			Digest:     resource.Digest,
+			Pusher:     payload.Operator,
+			PushedAt:   pushedAt,
+		})
+	}
+
+	return events, nil
+}
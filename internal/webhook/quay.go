@@ -0,0 +1,63 @@
+package webhook
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/jpfaria/image-updater/internal/model"
+)
+
+// quayAdapter handles Quay repository push notifications
+type quayAdapter struct{}
+
+type quayPayload struct {
+	Repository  string   `json:"repository"`
+	Namespace   string   `json:"namespace"`
+	Name        string   `json:"name"`
+	DockerURL   string   `json:"docker_url"`
+	UpdatedTags []string `json:"updated_tags"`
+}
+
+func (a *quayAdapter) Name() string {
+	return "quay"
+}
+
+func (a *quayAdapter) Detect(header http.Header, body []byte) bool {
+	var payload quayPayload
+	return json.Unmarshal(body, &payload) == nil && payload.DockerURL != "" && payload.UpdatedTags != nil
+}
+
+func (a *quayAdapter) Parse(header http.Header, body []byte) ([]model.ImagePushedEvent, error) {
+	var payload quayPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+
+	namespace, name := payload.Namespace, payload.Name
+	if namespace == "" || name == "" {
+		namespace, name = splitRepository(payload.Repository)
+	}
+	if name == "" {
+		return nil, errors.New("repository is required")
+	}
+
+	// docker_url looks like quay.io/namespace/repository
+	registry := "quay.io"
+	if i := strings.Index(payload.DockerURL, "/"); i > 0 {
+		registry = payload.DockerURL[:i]
+	}
+
+	events := make([]model.ImagePushedEvent, 0, len(payload.UpdatedTags))
+	for _, tag := range payload.UpdatedTags {
+		events = append(events, model.ImagePushedEvent{
+			Registry:   registry,
+			Namespace:  namespace,
+			Repository: name,
+			Tag:        tag,
+		})
+	}
+
+	return events, nil
+}
@@ -0,0 +1,329 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jpfaria/image-updater/internal/clock"
+	"github.com/xgodev/boost/wrapper/log"
+)
+
+// Verification errors
+var (
+	ErrUnauthenticated = errors.New("webhook authentication failed")
+	ErrReplayed        = errors.New("webhook delivery already received")
+)
+
+// Authentication modes
+const (
+	// ModeHMAC expects an HMAC-SHA256 signature of the body in a header
+	ModeHMAC = "hmac"
+	// ModeBearer expects the shared secret in the Authorization header,
+	// either bare (as Harbor sends its auth header) or as a bearer token
+	ModeBearer = "bearer"
+)
+
+// Rejection reasons
+const (
+	ReasonUnauthenticated  = "unauthenticated"
+	ReasonMissingSignature = "missing_signature"
+	ReasonInvalidSignature = "invalid_signature"
+	ReasonStaleTimestamp   = "stale_timestamp"
+	ReasonReplayed         = "replayed"
+)
+
+// SourceOptions configures how deliveries from a source are authenticated.
+//
+// Timestamps and delivery IDs only protect against replays when the sender
+// signs them, which SignedHeaders declares. Registries such as GitHub,
+// Harbor and Quay sign the body alone, so a captured delivery can be sent
+// again with a new ID or timestamp; for them both checks only catch
+// retries, and pushes with a digest are still applied once.
+type SourceOptions struct {
+	Secret          string
+	Mode            string // hmac or bearer, defaults to hmac
+	SignatureHeader string // defaults to X-Hub-Signature-256
+	SignaturePrefix string // defaults to "sha256="
+	TimestampHeader string // empty disables the timestamp check
+	DeliveryHeader  string // defaults to X-GitHub-Delivery for github, X-Delivery-ID otherwise
+	// SignedHeaders makes the HMAC cover "<timestamp>.<delivery ID>.<body>"
+	// rather than the body, each header empty when not sent
+	SignedHeaders bool
+}
+
+// VerifierOptions configures a Verifier
+type VerifierOptions struct {
+	// Sources holds the settings of each source by adapter name
+	Sources map[string]SourceOptions
+	// Default applies to sources without their own settings
+	Default SourceOptions
+	// AllowUnauthenticated accepts deliveries from sources without a secret
+	AllowUnauthenticated bool
+	// TimestampTolerance is the maximum clock skew of a delivery timestamp
+	TimestampTolerance time.Duration
+	// ReplayWindow is how long delivery IDs are remembered
+	ReplayWindow time.Duration
+	Clock        clock.Clock
+}
+
+// Verifier authenticates webhook deliveries and rejects replays
+type Verifier struct {
+	options VerifierOptions
+
+	mu sync.Mutex
+	// deliveries holds the IDs of the deliveries accepted within the replay
+	// window, and reserved those being verified and queued
+	deliveries map[string]time.Time
+	reserved   map[string]bool
+	rejections map[string]map[string]int64
+}
+
+// NewVerifier creates a new webhook verifier
+func NewVerifier(options VerifierOptions) *Verifier {
+	if options.Clock == nil {
+		options.Clock = clock.Real()
+	}
+	if options.AllowUnauthenticated {
+		log.Warn("Webhooks accept unauthenticated deliveries from sources without a secret")
+	}
+
+	return &Verifier{
+		options:    options,
+		deliveries: make(map[string]time.Time),
+		reserved:   make(map[string]bool),
+		rejections: make(map[string]map[string]int64),
+	}
+}
+
+// Verify checks that a delivery from source is authentic and new.
+// It returns ErrUnauthenticated or ErrReplayed for rejected deliveries.
+// The delivery ID is reserved and returned, empty when the source sent
+// none: Accept remembers it once the delivery is queued, and Release frees
+// it when the delivery could not be, so the sender can retry.
+func (v *Verifier) Verify(source string, header http.Header, body []byte) (string, error) {
+	opts := v.sourceOptions(source)
+
+	if opts.Secret == "" {
+		if !v.options.AllowUnauthenticated {
+			return "", v.reject(source, ReasonUnauthenticated, ErrUnauthenticated)
+		}
+	} else if reason := authenticate(opts, header, body); reason != "" {
+		return "", v.reject(source, reason, ErrUnauthenticated)
+	}
+
+	if opts.TimestampHeader != "" && !v.fresh(header.Get(opts.TimestampHeader)) {
+		return "", v.reject(source, ReasonStaleTimestamp, ErrUnauthenticated)
+	}
+
+	id := header.Get(opts.DeliveryHeader)
+	if id == "" {
+		return "", nil
+	}
+	key := source + ":" + id
+	if !v.reserve(key) {
+		return "", v.reject(source, ReasonReplayed, ErrReplayed)
+	}
+
+	return key, nil
+}
+
+// Accept remembers a delivery ID returned by Verify for the replay window
+func (v *Verifier) Accept(key string) {
+	if key == "" {
+		return
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	delete(v.reserved, key)
+	v.deliveries[key] = v.options.Clock.Now()
+}
+
+// Release frees a delivery ID returned by Verify without remembering it
+func (v *Verifier) Release(key string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	delete(v.reserved, key)
+}
+
+// Rejections returns the number of rejected deliveries by source and reason
+func (v *Verifier) Rejections() map[string]map[string]int64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	result := make(map[string]map[string]int64, len(v.rejections))
+	for source, reasons := range v.rejections {
+		result[source] = make(map[string]int64, len(reasons))
+		for reason, count := range reasons {
+			result[source][reason] = count
+		}
+	}
+
+	return result
+}
+
+// sourceOptions returns the settings of a source with defaults applied
+func (v *Verifier) sourceOptions(source string) SourceOptions {
+	opts, ok := v.options.Sources[source]
+	if !ok {
+		opts = v.options.Default
+	}
+
+	if opts.Mode == "" {
+		opts.Mode = ModeHMAC
+	}
+	if opts.SignatureHeader == "" {
+		opts.SignatureHeader = "X-Hub-Signature-256"
+	}
+	if opts.SignaturePrefix == "" {
+		opts.SignaturePrefix = "sha256="
+	}
+	if opts.DeliveryHeader == "" {
+		opts.DeliveryHeader = "X-Delivery-ID"
+		if source == "github" {
+			opts.DeliveryHeader = "X-GitHub-Delivery"
+		}
+	}
+
+	return opts
+}
+
+// authenticate checks the credentials of a delivery and returns the
+// rejection reason, or an empty string when they are valid
+func authenticate(opts SourceOptions, header http.Header, body []byte) string {
+	switch opts.Mode {
+	case ModeBearer:
+		token := header.Get("Authorization")
+		if token == "" {
+			return ReasonMissingSignature
+		}
+		token = strings.TrimPrefix(token, "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(opts.Secret)) != 1 {
+			return ReasonInvalidSignature
+		}
+	default:
+		signature := header.Get(opts.SignatureHeader)
+		if signature == "" {
+			return ReasonMissingSignature
+		}
+		got, err := hex.DecodeString(strings.TrimPrefix(signature, opts.SignaturePrefix))
+		if err != nil {
+			return ReasonInvalidSignature
+		}
+		mac := hmac.New(sha256.New, []byte(opts.Secret))
+		if opts.SignedHeaders {
+			fmt.Fprintf(mac, "%s.%s.", header.Get(opts.TimestampHeader), header.Get(opts.DeliveryHeader))
+		}
+		mac.Write(body)
+		if !hmac.Equal(got, mac.Sum(nil)) {
+			return ReasonInvalidSignature
+		}
+	}
+
+	return ""
+}
+
+// fresh reports whether a delivery timestamp, in Unix seconds or RFC 3339,
+// is within the configured tolerance
+func (v *Verifier) fresh(value string) bool {
+	var ts time.Time
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		ts = time.Unix(seconds, 0)
+	} else if t, err := time.Parse(time.RFC3339, value); err == nil {
+		ts = t
+	} else {
+		return false
+	}
+
+	skew := v.options.Clock.Now().Sub(ts)
+	if skew < 0 {
+		skew = -skew
+	}
+
+	return skew <= v.options.TimestampTolerance
+}
+
+// reserve reserves a delivery ID and reports whether it was new
+func (v *Verifier) reserve(key string) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	now := v.options.Clock.Now()
+	for id, seen := range v.deliveries {
+		if now.Sub(seen) > v.options.ReplayWindow {
+			delete(v.deliveries, id)
+		}
+	}
+
+	if _, ok := v.deliveries[key]; ok || v.reserved[key] {
+		return false
+	}
+
+	v.reserved[key] = true
+	return true
+}
+
+// reject logs and counts a rejected delivery
+func (v *Verifier) reject(source, reason string, err error) error {
+	log.Warnf("Rejected %s webhook delivery: %s", source, reason)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.rejections[source] == nil {
+		v.rejections[source] = make(map[string]int64)
+	}
+	v.rejections[source][reason]++
+
+	return fmt.Errorf("%w: %s", err, reason)
+}
+
+// Validate checks the verifier settings for mistakes
+func (o VerifierOptions) Validate() error {
+	var problems []string
+
+	sources := make([]string, 0, len(o.Sources))
+	for name := range o.Sources {
+		sources = append(sources, name)
+	}
+	sort.Strings(sources)
+
+	for _, name := range sources {
+		if _, ok := adapter(name); !ok {
+			problems = append(problems, fmt.Sprintf("unknown webhook source %q", name))
+		}
+		if mode := o.Sources[name].Mode; !validMode(mode) {
+			problems = append(problems, fmt.Sprintf("webhook source %q: unknown mode %q", name, mode))
+		}
+	}
+
+	if !validMode(o.Default.Mode) {
+		problems = append(problems, fmt.Sprintf("unknown webhook mode %q", o.Default.Mode))
+	}
+	if o.TimestampTolerance <= 0 {
+		problems = append(problems, "webhook timestamp tolerance must be positive")
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// validMode reports whether mode is a known mode, or empty for the default
+func validMode(mode string) bool {
+	return mode == "" || mode == ModeHMAC || mode == ModeBearer
+}
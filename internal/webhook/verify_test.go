@@ -0,0 +1,117 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func sign(secret, material string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(material))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifySignedHeaders(t *testing.T) {
+	body := `{"tag":"1.0.0"}`
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+
+	tests := []struct {
+		name          string
+		signedHeaders bool
+		signature     string
+		timestamp     string // sent, when it differs from the signed one
+		want          error
+	}{
+		{"body", false, sign("s3cret", body), "", nil},
+		{"headers and body", true, sign("s3cret", now+".d1."+body), "", nil},
+		{"body when headers are signed", true, sign("s3cret", body), "", ErrUnauthenticated},
+		{"replayed with a new timestamp", true, sign("s3cret", "1.d1."+body), "", ErrUnauthenticated},
+		{"stale timestamp", true, sign("s3cret", "1.d1."+body), "1", ErrUnauthenticated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := NewVerifier(VerifierOptions{
+				Default: SourceOptions{
+					Secret:          "s3cret",
+					TimestampHeader: "X-Timestamp",
+					SignedHeaders:   tt.signedHeaders,
+				},
+				TimestampTolerance: time.Minute,
+				ReplayWindow:       time.Hour,
+			})
+			timestamp := now
+			if tt.timestamp != "" {
+				timestamp = tt.timestamp
+			}
+			header := http.Header{}
+			header.Set("X-Hub-Signature-256", tt.signature)
+			header.Set("X-Timestamp", timestamp)
+			header.Set("X-Delivery-ID", "d1")
+
+			if _, err := v.Verify("harbor", header, []byte(body)); !errors.Is(err, tt.want) {
+				t.Fatalf("Verify() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyRemembersQueuedDeliveries(t *testing.T) {
+	v := NewVerifier(VerifierOptions{AllowUnauthenticated: true, ReplayWindow: time.Hour})
+	header := http.Header{}
+	header.Set("X-Delivery-ID", "d1")
+
+	key, err := v.Verify("harbor", header, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.Verify("harbor", header, nil); !errors.Is(err, ErrReplayed) {
+		t.Fatalf("a delivery being queued was not reserved: %v", err)
+	}
+
+	// A delivery that failed to queue can be sent again
+	v.Release(key)
+	if key, err = v.Verify("harbor", header, nil); err != nil {
+		t.Fatalf("a released delivery was rejected: %v", err)
+	}
+
+	v.Accept(key)
+	if _, err := v.Verify("harbor", header, nil); !errors.Is(err, ErrReplayed) {
+		t.Fatalf("a queued delivery was accepted again: %v", err)
+	}
+}
+
+func TestVerifierOptionsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		options VerifierOptions
+		wantErr bool
+	}{
+		{name: "defaults", options: VerifierOptions{TimestampTolerance: time.Minute}},
+		{
+			name: "known modes",
+			options: VerifierOptions{
+				Default:            SourceOptions{Mode: ModeBearer},
+				Sources:            map[string]SourceOptions{"harbor": {Mode: ModeHMAC}},
+				TimestampTolerance: time.Minute,
+			},
+		},
+		{name: "unknown default mode", options: VerifierOptions{Default: SourceOptions{Mode: "basic"}, TimestampTolerance: time.Minute}, wantErr: true},
+		{name: "unknown source mode", options: VerifierOptions{Sources: map[string]SourceOptions{"harbor": {Mode: "basic"}}, TimestampTolerance: time.Minute}, wantErr: true},
+		{name: "unknown source", options: VerifierOptions{Sources: map[string]SourceOptions{"svn": {}}, TimestampTolerance: time.Minute}, wantErr: true},
+		{name: "no timestamp tolerance", options: VerifierOptions{}, wantErr: true},
+		{name: "negative timestamp tolerance", options: VerifierOptions{TimestampTolerance: -time.Minute}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.options.Validate(); (err != nil) != tt.wantErr {
+				t.Fatalf("Validate() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
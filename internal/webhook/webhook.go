@@ -0,0 +1,104 @@
+package webhook
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/jpfaria/image-updater/internal/model"
+)
+
+// ErrUnknownSource is returned when no adapter exists for a webhook source
+var ErrUnknownSource = errors.New("unknown webhook source")
+
+// Adapter translates the webhook payload of a registry into image pushed events
+type Adapter interface {
+	// Name returns the source name used in the webhook route
+	Name() string
+	// Detect reports whether the payload looks like one sent by this registry
+	Detect(header http.Header, body []byte) bool
+	// Parse extracts the image pushed events from the payload; payloads that
+	// describe something other than a push yield no events
+	Parse(header http.Header, body []byte) ([]model.ImagePushedEvent, error)
+}
+
+// adapters lists the supported registries in detection order. GitLab
+// payloads are indistinguishable from distribution ones, so they are only
+// labelled as such on the GitLab route; the generic adapter accepts almost
+// any JSON object so it must stay last.
+var adapters = []Adapter{
+	&githubAdapter{},
+	&ecrAdapter{},
+	&harborAdapter{},
+	&dockerHubAdapter{},
+	&quayAdapter{},
+	&distributionAdapter{name: "distribution"},
+	&distributionAdapter{name: "gitlab"},
+	&genericAdapter{},
+}
+
+// Sources returns the names of the supported webhook sources
+func Sources() []string {
+	names := make([]string, 0, len(adapters))
+	for _, adapter := range adapters {
+		names = append(names, adapter.Name())
+	}
+	return names
+}
+
+// Parse normalises a payload sent by the named source
+func Parse(source string, header http.Header, body []byte) ([]model.ImagePushedEvent, error) {
+	a, ok := adapter(source)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownSource, source)
+	}
+
+	return parse(a, header, body)
+}
+
+// DetectSource returns the name of the source whose payload format matches
+func DetectSource(header http.Header, body []byte) (string, error) {
+	for _, a := range adapters {
+		if a.Detect(header, body) {
+			return a.Name(), nil
+		}
+	}
+
+	return "", errors.New("unrecognised webhook payload")
+}
+
+// adapter returns the adapter with the given name
+func adapter(name string) (Adapter, bool) {
+	for _, a := range adapters {
+		if a.Name() == name {
+			return a, true
+		}
+	}
+
+	return nil, false
+}
+
+// parse runs an adapter and tags the events with its source
+func parse(adapter Adapter, header http.Header, body []byte) ([]model.ImagePushedEvent, error) {
+	events, err := adapter.Parse(header, body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s payload: %w", adapter.Name(), err)
+	}
+
+	for i := range events {
+		events[i].Source = adapter.Name()
+	}
+
+	return events, nil
+}
+
+// splitRepository splits a repository path into its namespace and name;
+// single-segment paths belong to the official "library" namespace
+func splitRepository(path string) (string, string) {
+	path = strings.Trim(path, "/")
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		return path[:i], path[i+1:]
+	}
+	return "library", path
+}
@@ -0,0 +1,144 @@
+package webhook
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/jpfaria/image-updater/internal/model"
+)
+
+func TestParseSamplePayloads(t *testing.T) {
+	tests := []struct {
+		source   string
+		file     string
+		header   http.Header
+		detected string // source DetectSource finds, source when empty
+		want     []model.ImagePushedEvent
+	}{
+		{
+			source: "dockerhub",
+			file:   "dockerhub.json",
+			want: []model.ImagePushedEvent{
+				{Registry: "docker.io", Namespace: "svendowideit", Repository: "testhook", Tag: "latest", Pusher: "trustedbuilder", PushedAt: "2014-12-03T00:22:41Z"},
+			},
+		},
+		{
+			source: "distribution",
+			file:   "distribution.json",
+			header: http.Header{"Content-Type": {"application/vnd.docker.distribution.events.v1+json"}},
+			want: []model.ImagePushedEvent{
+				{
+					DeliveryID: "320678d8-ca14-430f-8bb6-4ca139cd83f7", Registry: "192.168.100.227:5000", Namespace: "library", Repository: "hello-world",
+					Tag: "latest", Digest: "sha256:fea8895f450959fa676bcc1df0611ea93823a735a01205fd8622846041d0c7cf", Pusher: "ci", PushedAt: "2016-03-09T22:44:26Z",
+				},
+				{
+					DeliveryID: "c1a6a5f2-5a1b-4a3c-8f0e-2f6f3b1a9d11", Registry: "192.168.100.227:5000", Namespace: "platform", Repository: "api",
+					Tag: "1.2.0", Digest: "sha256:6f6b2a4a8e2b1c0c6f8f0f1e1b0d5e6f4a3b2c1d0e9f8a7b6c5d4e3f2a1b0c9d", Pusher: "buildx", PushedAt: "2016-03-09T14:45:02Z",
+				},
+			},
+		},
+		{
+			source:   "gitlab",
+			file:     "gitlab.json",
+			detected: "distribution",
+			want: []model.ImagePushedEvent{
+				{
+					DeliveryID: "5b4a2e5c-1d3f-4e6a-9b8c-7d6e5f4a3b2c", Registry: "registry.gitlab.com", Namespace: "acme/payments", Repository: "api",
+					Tag: "v3.4.1", Digest: "sha256:2b8a9c7d6e5f4a3b2c1d0e9f8a7b6c5d4e3f2a1b0c9d8e7f6a5b4c3d2e1f0a9b", Pusher: "project_42_bot", PushedAt: "2024-05-14T09:12:45Z",
+				},
+			},
+		},
+		{
+			source: "harbor",
+			file:   "harbor.json",
+			want: []model.ImagePushedEvent{
+				{
+					Registry: "hub.harbor.com", Namespace: "test-webhook", Repository: "debian", Tag: "latest",
+					Digest: "sha256:8a9e9863dbb6e10edb5adfe917c00da84e1700fa76e7ed02476aa6e6fb8ee0d8", Pusher: "admin", PushedAt: "2020-04-15T03:45:08Z",
+				},
+			},
+		},
+		{
+			source: "quay",
+			file:   "quay.json",
+			want: []model.ImagePushedEvent{
+				{Registry: "quay.io", Namespace: "mynamespace", Repository: "repository", Tag: "1.0.0"},
+				{Registry: "quay.io", Namespace: "mynamespace", Repository: "repository", Tag: "latest"},
+			},
+		},
+		{
+			source: "github",
+			file:   "github.json",
+			header: http.Header{"X-Github-Event": {"package"}, "X-Github-Delivery": {"72d3162e-cc78-11e3-81ab-4c9367dc0958"}},
+			want: []model.ImagePushedEvent{
+				{
+					DeliveryID: "72d3162e-cc78-11e3-81ab-4c9367dc0958", Registry: "ghcr.io", Namespace: "octo-org", Repository: "hello-world", Tag: "2.1.0",
+					Digest: "sha256:3c1a5d2e8f7b6a9c0d4e3f2a1b0c9d8e7f6a5b4c3d2e1f0a9b8c7d6e5f4a3b2c", Pusher: "octocat", PushedAt: "2024-03-01T10:20:30Z",
+				},
+			},
+		},
+		{
+			source: "github",
+			file:   "github_registry_package.json",
+			header: http.Header{"X-Github-Event": {"registry_package"}, "X-Github-Delivery": {"9a3f1c2e-cc78-11e3-81ab-4c9367dc0958"}},
+			want: []model.ImagePushedEvent{
+				{
+					DeliveryID: "9a3f1c2e-cc78-11e3-81ab-4c9367dc0958", Registry: "ghcr.io", Namespace: "octo-org", Repository: "hello-world", Tag: "2.1.0",
+					Digest: "sha256:3c1a5d2e8f7b6a9c0d4e3f2a1b0c9d8e7f6a5b4c3d2e1f0a9b8c7d6e5f4a3b2c", Pusher: "octocat", PushedAt: "2024-03-01T10:20:30Z",
+				},
+			},
+		},
+		{
+			source: "ecr",
+			file:   "ecr.json",
+			want: []model.ImagePushedEvent{
+				{
+					DeliveryID: "13cde686-328b-6117-af20-0e5566167482", Registry: "123456789012.dkr.ecr.us-west-2.amazonaws.com", Namespace: "team", Repository: "my-repository-name",
+					Tag: "latest", Digest: "sha256:7f5b2640fe6fb4f46592dfd3410c4a79dac4f89e4782432e0378abcd12345678", PushedAt: "2019-11-16T01:54:34Z",
+				},
+			},
+		},
+		{
+			source: "generic",
+			file:   "generic.json",
+			want: []model.ImagePushedEvent{
+				{Registry: "registry.example.com", Namespace: "team", Repository: "app", Tag: "1.4.0", Digest: "sha256:5d41402abc4b2a76b9719d911017c592ae2b5f2f7b1a4c9e0d3f6a8b7c2e1d0f"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			body, err := os.ReadFile(filepath.Join("testdata", tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			header := tt.header
+			if header == nil {
+				header = http.Header{}
+			}
+
+			detected, err := DetectSource(header, body)
+			want := tt.detected
+			if want == "" {
+				want = tt.source
+			}
+			if err != nil || detected != want {
+				t.Fatalf("DetectSource() = %q, %v, want %q", detected, err, want)
+			}
+
+			events, err := Parse(tt.source, header, body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range tt.want {
+				tt.want[i].Source = tt.source
+			}
+			if !reflect.DeepEqual(events, tt.want) {
+				t.Fatalf("Parse() =\n%+v\nwant\n%+v", events, tt.want)
+			}
+		})
+	}
+}